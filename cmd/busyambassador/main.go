@@ -19,6 +19,7 @@ import (
 
 	"github.com/emissary-ingress/emissary/v3/cmd/entrypoint"
 	"github.com/emissary-ingress/emissary/v3/cmd/kubestatus"
+	"github.com/emissary-ingress/emissary/v3/cmd/snapdiff"
 )
 
 func noop(_ context.Context) {}
@@ -36,6 +37,7 @@ func main() {
 	busy.Main("busyambassador", "Ambassador", version, map[string]busy.Command{
 		"kubestatus": {Setup: environment.EnvironmentSetupEntrypoint, Run: kubestatus.Main},
 		"entrypoint": {Setup: noop, Run: entrypoint.Main},
+		"snapdiff":   {Setup: noop, Run: snapdiff.Main},
 		"version":    {Setup: noop, Run: showVersion},
 	})
 }
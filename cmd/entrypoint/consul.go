@@ -2,16 +2,36 @@ package entrypoint
 
 import (
 	"context"
+	"fmt"
 	"reflect"
+	"strings"
 	"sync"
 
 	consulapi "github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/datawire/dlib/dlog"
 	amb "github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io/v3alpha1"
 	"github.com/emissary-ingress/emissary/v3/pkg/consulwatch"
+	"github.com/emissary-ingress/emissary/v3/pkg/metrics"
 	snapshotTypes "github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
 )
 
+var (
+	consulWatches = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Name: "emissary_consul_watches",
+		Help: "Number of Consul services being watched.",
+	})
+	consulWatchUpdates = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "emissary_consul_watch_updates_total",
+		Help: "Number of updates received from Consul service watches, by ConsulResolver.",
+	}, []string{"resolver"})
+	consulWatchErrors = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "emissary_consul_watch_errors_total",
+		Help: "Number of errors from Consul service watches, by ConsulResolver.",
+	}, []string{"resolver"})
+)
+
 // consulMapping contains the necessary subset of Ambassador Mapping and TCPMapping
 // definitions needed for consul reconcilation and watching to happen.
 type consulMapping struct {
@@ -57,7 +77,114 @@ func ReconcileConsul(ctx context.Context, consulWatcher *consulWatcher, s *snaps
 		}
 	}
 
-	return consulWatcher.reconcile(ctx, s.ConsulResolvers, mappings)
+	// A resolver whose Secrets we can't find isn't going to get anywhere with Consul, so leave it
+	// out (and its Mappings with it) until the Secrets show up.
+	var usable []*amb.ConsulResolver
+	credentials := make(map[string]consulCredentials)
+	for _, cr := range s.ConsulResolvers {
+		creds, err := findConsulCredentials(cr, s)
+		if err != nil {
+			dlog.Errorf(ctx, "ConsulResolver %s.%s: %v", cr.GetName(), cr.GetNamespace(), err)
+			continue
+		}
+		usable = append(usable, cr)
+		credentials[cr.GetName()] = creds
+	}
+
+	return consulWatcher.reconcile(ctx, usable, credentials, mappings)
+}
+
+// consulCredentials is the part of a ConsulResolver's Consul client configuration that comes
+// from Secrets rather than from the ConsulResolver itself.
+type consulCredentials struct {
+	Token   string
+	CAPEM   []byte
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// findConsulCredentials digs the Secrets that a ConsulResolver refers to out of the snapshot.
+// Secrets always live in the ConsulResolver's namespace, and, as with ReconcileSecrets, FSSecrets
+// win over K8sSecrets.
+func findConsulCredentials(cr *amb.ConsulResolver, s *snapshotTypes.KubernetesSnapshot) (consulCredentials, error) {
+	var creds consulCredentials
+
+	secretKey := func(what, name, key string) ([]byte, error) {
+		ref := snapshotTypes.SecretRef{Namespace: cr.GetNamespace(), Name: name}
+		secret, ok := s.FSSecrets[ref]
+		if !ok {
+			for _, k8sSecret := range s.K8sSecrets {
+				if k8sSecret.GetNamespace() == ref.Namespace && k8sSecret.GetName() == ref.Name {
+					secret = k8sSecret
+					break
+				}
+			}
+		}
+		if secret == nil {
+			return nil, fmt.Errorf("%s %s.%s not found", what, ref.Name, ref.Namespace)
+		}
+		value, ok := secret.Data[key]
+		if !ok || len(value) == 0 {
+			return nil, fmt.Errorf("%s %s.%s has no %q key", what, ref.Name, ref.Namespace, key)
+		}
+		return value, nil
+	}
+
+	if cr.Spec.TokenSecret != "" {
+		token, err := secretKey("token_secret", cr.Spec.TokenSecret, "token")
+		if err != nil {
+			return creds, err
+		}
+		creds.Token = strings.TrimSpace(string(token))
+	}
+	if cr.Spec.TLSSecret != "" {
+		var err error
+		if creds.CertPEM, err = secretKey("tls_secret", cr.Spec.TLSSecret, "tls.crt"); err != nil {
+			return creds, err
+		}
+		if creds.KeyPEM, err = secretKey("tls_secret", cr.Spec.TLSSecret, "tls.key"); err != nil {
+			return creds, err
+		}
+	}
+	if cr.Spec.CASecret != "" {
+		var err error
+		if creds.CAPEM, err = secretKey("ca_secret", cr.Spec.CASecret, "tls.crt"); err != nil {
+			return creds, err
+		}
+	}
+	return creds, nil
+}
+
+// consulClientConfig builds the configuration for a Consul client that talks to the Consul that
+// a ConsulResolver points at. Anything the ConsulResolver doesn't say falls back to the usual
+// CONSUL_* environment variables.
+func consulClientConfig(resolver *amb.ConsulResolver, creds consulCredentials) *consulapi.Config {
+	consulConfig := consulapi.DefaultConfig()
+	consulConfig.Address = resolver.Spec.Address
+	// The watch plan ignores its own datacenter and token, and uses the client's instead.
+	if resolver.Spec.Datacenter != "" {
+		consulConfig.Datacenter = resolver.Spec.Datacenter
+	}
+	if resolver.Spec.ConsulNamespace != "" {
+		consulConfig.Namespace = resolver.Spec.ConsulNamespace
+	}
+	if resolver.Spec.ConsulPartition != "" {
+		consulConfig.Partition = resolver.Spec.ConsulPartition
+	}
+	if creds.Token != "" {
+		consulConfig.Token = creds.Token
+	}
+	if len(creds.CAPEM) > 0 || len(creds.CertPEM) > 0 {
+		consulConfig.TLSConfig.CAPem = creds.CAPEM
+		consulConfig.TLSConfig.CertPEM = creds.CertPEM
+		consulConfig.TLSConfig.KeyPEM = creds.KeyPEM
+		// There's no point in having TLS material if we're not going to use TLS. An explicit
+		// "http://" in the address still wins, though.
+		if !strings.Contains(consulConfig.Address, "://") {
+			consulConfig.Scheme = "https"
+		}
+	}
+	return consulConfig
 }
 
 type consulWatcher struct {
@@ -117,7 +244,7 @@ func (c *consulWatcher) run(ctx context.Context) error {
 func (c *consulWatcher) updateEndpoints(endpoints consulwatch.Endpoints) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	c.endpoints[endpoints.Service] = endpoints
+	c.endpoints[consulEndpointsKey(endpoints.Service, endpoints.Subset)] = endpoints
 }
 
 func (c *consulWatcher) changed() chan struct{} {
@@ -164,12 +291,12 @@ func (c *consulWatcher) cleanup(ctx context.Context) error {
 		w.Stop()
 	}()*/
 
-	return c.reconcile(ctx, nil, nil)
+	return c.reconcile(ctx, nil, nil, nil)
 }
 
 // Start and stop consul service watches as needed in order to match the supplied set of resolvers
-// and mappings.
-func (c *consulWatcher) reconcile(ctx context.Context, resolvers []*amb.ConsulResolver, mappings []consulMapping) error {
+// (with their credentials, by resolver name) and mappings.
+func (c *consulWatcher) reconcile(ctx context.Context, resolvers []*amb.ConsulResolver, credentials map[string]consulCredentials, mappings []consulMapping) error {
 	// ==First we compute resolvers and their related mappings without actualy changing anything.==
 	resolversByName := make(map[string]*amb.ConsulResolver)
 	for _, cr := range resolvers {
@@ -212,15 +339,16 @@ func (c *consulWatcher) reconcile(ctx context.Context, resolvers []*amb.ConsulRe
 	for name, cr := range resolversByName {
 		oldr, ok := c.resolvers[name]
 		// The resolver hasn't change so continue. Make sure we only compare the spec, since we
-		// don't want to delete/recreate resolvers on things like label changes.
-		if ok && reflect.DeepEqual(oldr.resolver.Spec, cr.Spec) {
+		// don't want to delete/recreate resolvers on things like label changes. Rotating one of
+		// its Secrets does count as a change, though.
+		if ok && reflect.DeepEqual(oldr.resolver.Spec, cr.Spec) && reflect.DeepEqual(oldr.credentials, credentials[name]) {
 			continue
 		}
 		// It exists, but is different, so we delete/recreate i.
 		if ok {
 			oldr.deleted()
 		}
-		c.resolvers[name] = newResolver(cr)
+		c.resolvers[name] = newResolver(cr, credentials[name])
 	}
 
 	// Now we delete unneeded resolvers.
@@ -240,14 +368,21 @@ func (c *consulWatcher) reconcile(ctx context.Context, resolvers []*amb.ConsulRe
 		}
 	}
 
+	watches := 0
+	for _, res := range c.resolvers {
+		watches += len(res.watches)
+	}
+	consulWatches.Set(float64(watches))
+
 	// If this is the first time we are reconciling, we need to compute conditions for being
 	// bootstrapped.
 	if !c.firstReconcileHasHappened {
 		c.firstReconcileHasHappened = true
 		var keysForBootstrap []string
-		for _, mappings := range mappingsByResolver {
+		for rname, mappings := range mappingsByResolver {
+			subset := consulSubset(resolversByName[rname])
 			for _, m := range mappings {
-				keysForBootstrap = append(keysForBootstrap, m.Service)
+				keysForBootstrap = append(keysForBootstrap, consulEndpointsKey(m.Service, subset))
 			}
 		}
 		c.mutex.Lock()
@@ -257,13 +392,43 @@ func (c *consulWatcher) reconcile(ctx context.Context, resolvers []*amb.ConsulRe
 	return nil
 }
 
+// consulSubset returns the name of the subset of service instances that a ConsulResolver selects,
+// or "" if it doesn't filter them at all. Each filtering ConsulResolver gets its own subset, named
+// after the resolver, so that (say) a "canary" and a "stable" resolver for the same service end up
+// as different clusters.
+func consulSubset(resolver *amb.ConsulResolver) string {
+	if len(resolver.Spec.Tags) == 0 && len(resolver.Spec.Meta) == 0 {
+		return ""
+	}
+	return resolver.GetName()
+}
+
+// selectConsulEndpoints applies a ConsulResolver's tag and metadata filters to the endpoints that
+// Consul handed us.
+func selectConsulEndpoints(resolver *amb.ConsulResolver, endpoints consulwatch.Endpoints) consulwatch.Endpoints {
+	subset := consulSubset(resolver)
+	if subset == "" {
+		return endpoints
+	}
+	return endpoints.Select(subset, resolver.Spec.Tags, resolver.Spec.Meta)
+}
+
+// consulEndpointsKey is the key for a service's endpoints in the ConsulSnapshot.
+func consulEndpointsKey(svc, subset string) string {
+	if subset == "" {
+		return svc
+	}
+	return svc + "/" + subset
+}
+
 type resolver struct {
-	resolver *amb.ConsulResolver
-	watches  map[string]Stopper
+	resolver    *amb.ConsulResolver
+	credentials consulCredentials
+	watches     map[string]Stopper
 }
 
-func newResolver(spec *amb.ConsulResolver) *resolver {
-	return &resolver{resolver: spec, watches: make(map[string]Stopper)}
+func newResolver(spec *amb.ConsulResolver, credentials consulCredentials) *resolver {
+	return &resolver{resolver: spec, credentials: credentials, watches: make(map[string]Stopper)}
 }
 
 func (r *resolver) deleted() {
@@ -281,7 +446,7 @@ func (r *resolver) reconcile(ctx context.Context, watchFunc watchConsulFunc, map
 		w, ok := r.watches[svc]
 		if !ok {
 			var err error
-			w, err = watchFunc(ctx, r.resolver, svc, endpoints)
+			w, err = watchFunc(ctx, r.resolver, r.credentials, svc, endpoints)
 			if err != nil {
 				return err
 			}
@@ -299,7 +464,7 @@ func (r *resolver) reconcile(ctx context.Context, watchFunc watchConsulFunc, map
 	return nil
 }
 
-type watchConsulFunc func(ctx context.Context, resolver *amb.ConsulResolver, svc string, endpoints chan consulwatch.Endpoints) (Stopper, error)
+type watchConsulFunc func(ctx context.Context, resolver *amb.ConsulResolver, credentials consulCredentials, svc string, endpoints chan consulwatch.Endpoints) (Stopper, error)
 
 type Stopper interface {
 	Stop()
@@ -308,38 +473,114 @@ type Stopper interface {
 func watchConsul(
 	ctx context.Context,
 	resolver *amb.ConsulResolver,
+	credentials consulCredentials,
 	svc string,
 	endpointsCh chan consulwatch.Endpoints,
 ) (Stopper, error) {
-	// XXX: should this part be shared?
-	consulConfig := consulapi.DefaultConfig()
-	consulConfig.Address = resolver.Spec.Address
-	consul, err := consulapi.NewClient(consulConfig)
-	if err != nil {
-		return nil, err
+	datacenters := consulDatacenters(resolver)
+	failover := newConsulFailover(resolver, svc)
+
+	var stoppers consulStoppers
+	for priority, datacenter := range datacenters {
+		priority, datacenter := priority, datacenter
+
+		// XXX: should this part be shared?
+		consulConfig := consulClientConfig(resolver, credentials)
+		consulConfig.Datacenter = datacenter
+		consul, err := consulapi.NewClient(consulConfig)
+		if err != nil {
+			stoppers.Stop()
+			return nil, err
+		}
+
+		// this part is per service
+		// We want to hear about instances that aren't passing all their health checks too, so
+		// that warning instances can be degraded and ones in maintenance can drain. Critical
+		// instances get left out by consulEndpointsToAmbex.
+		w, err := consulwatch.New(consul, datacenter, svc, false)
+		if err != nil {
+			stoppers.Stop()
+			return nil, err
+		}
+
+		w.Watch(func(endpoints consulwatch.Endpoints, e error) {
+			if e != nil {
+				consulWatchErrors.WithLabelValues(resolver.GetName()).Inc()
+				dlog.Errorf(ctx, "error watching Consul service %s in datacenter %s with ConsulResolver %s: %v", svc, datacenter, resolver.GetName(), e)
+			} else {
+				consulWatchUpdates.WithLabelValues(resolver.GetName()).Inc()
+			}
+			failover.update(priority, endpoints, endpointsCh)
+		})
+
+		go func() {
+			if err := w.Start(ctx); err != nil {
+				panic(err) // TODO: Find a better way of reporting errors from goroutines.
+			}
+		}()
+
+		stoppers = append(stoppers, w)
 	}
 
-	// this part is per service
-	w, err := consulwatch.New(consul, resolver.Spec.Datacenter, svc, true)
-	if err != nil {
-		return nil, err
+	return stoppers, nil
+}
+
+// consulDatacenters returns the datacenters that a ConsulResolver looks for services in, in
+// failover order.
+func consulDatacenters(resolver *amb.ConsulResolver) []string {
+	return append([]string{resolver.Spec.Datacenter}, resolver.Spec.FailoverDatacenters...)
+}
+
+// consulFailover merges the endpoints of a service from each of a ConsulResolver's datacenters
+// into one set of endpoints for the primary datacenter, with each endpoint's priority saying
+// which datacenter it came from. Envoy then fails over from one datacenter to the next as they
+// run out of healthy endpoints, and fails back once they recover.
+type consulFailover struct {
+	resolver *amb.ConsulResolver
+	service  string
+
+	mu          sync.Mutex
+	datacenters []consulwatch.Endpoints
+}
+
+func newConsulFailover(resolver *amb.ConsulResolver, service string) *consulFailover {
+	return &consulFailover{
+		resolver:    resolver,
+		service:     service,
+		datacenters: make([]consulwatch.Endpoints, len(consulDatacenters(resolver))),
 	}
+}
 
-	w.Watch(func(endpoints consulwatch.Endpoints, e error) {
-		if endpoints.Id == "" {
-			// For Ambassador, overwrite the ID with the resolver's datacenter -- the
-			// Consul watcher doesn't actually hand back the DC, and we need it.
-			endpoints.Id = resolver.Spec.Datacenter
+// update records the endpoints from the datacenter with the given priority, and sends the merged
+// endpoints to endpointsCh. The merged endpoints are sent with f.mu held, so that they can't
+// arrive out of order.
+func (f *consulFailover) update(priority int, endpoints consulwatch.Endpoints, endpointsCh chan<- consulwatch.Endpoints) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.datacenters[priority] = endpoints
+
+	// For Ambassador, the ID is the resolver's datacenter -- the Consul watcher doesn't actually
+	// hand back the DC, and we need it.
+	merged := consulwatch.Endpoints{
+		Id:        f.resolver.Spec.Datacenter,
+		Service:   f.service,
+		Endpoints: []consulwatch.Endpoint{},
+	}
+	for p, dcEndpoints := range f.datacenters {
+		for _, ep := range dcEndpoints.Endpoints {
+			ep.Priority = p
+			merged.Endpoints = append(merged.Endpoints, ep)
 		}
+	}
 
-		endpointsCh <- endpoints
-	})
+	endpointsCh <- selectConsulEndpoints(f.resolver, merged)
+}
 
-	go func() {
-		if err := w.Start(ctx); err != nil {
-			panic(err) // TODO: Find a better way of reporting errors from goroutines.
-		}
-	}()
+// consulStoppers stops all the watches for a service, one per datacenter.
+type consulStoppers []Stopper
 
-	return w, nil
+func (s consulStoppers) Stop() {
+	for _, w := range s {
+		w.Stop()
+	}
 }
@@ -73,7 +73,7 @@ secret: consultest-client-cert-secret
 
 func TestReconcile(t *testing.T) {
 	ctx, resolvers, mappings, c, tw := setup(t)
-	require.NoError(t, c.reconcile(ctx, resolvers, mappings))
+	require.NoError(t, c.reconcile(ctx, resolvers, nil, mappings))
 	tw.Assert(
 		"consultest-resolver.default:consultest-consul-service:watch",
 		"consultest-resolver.default:consultest-consul-service-tcp:watch",
@@ -82,11 +82,11 @@ func TestReconcile(t *testing.T) {
 		Service:  "foo",
 		Resolver: "consultest-resolver",
 	}
-	require.NoError(t, c.reconcile(ctx, resolvers, append(mappings, extra)))
+	require.NoError(t, c.reconcile(ctx, resolvers, nil, append(mappings, extra)))
 	tw.Assert(
 		"consultest-resolver.default:foo:watch",
 	)
-	require.NoError(t, c.reconcile(ctx, resolvers, nil))
+	require.NoError(t, c.reconcile(ctx, resolvers, nil, nil))
 	tw.Assert(
 		"consultest-resolver.default:consultest-consul-service-tcp:stop",
 		"consultest-resolver.default:consultest-consul-service:stop",
@@ -94,9 +94,244 @@ func TestReconcile(t *testing.T) {
 	)
 }
 
+func TestReconcileCredentials(t *testing.T) {
+	ctx, resolvers, mappings, c, tw := setup(t)
+	creds := map[string]consulCredentials{"consultest-resolver": {Token: "one"}}
+	require.NoError(t, c.reconcile(ctx, resolvers, creds, mappings))
+	tw.Assert(
+		"consultest-resolver.default:consultest-consul-service:watch",
+		"consultest-resolver.default:consultest-consul-service-tcp:watch",
+	)
+	require.NoError(t, c.reconcile(ctx, resolvers, map[string]consulCredentials{"consultest-resolver": {Token: "one"}}, mappings))
+	tw.Assert()
+	// Rotating the token restarts the watches.
+	require.NoError(t, c.reconcile(ctx, resolvers, map[string]consulCredentials{"consultest-resolver": {Token: "two"}}, mappings))
+	tw.Assert(
+		"consultest-resolver.default:consultest-consul-service:stop",
+		"consultest-resolver.default:consultest-consul-service-tcp:stop",
+		"consultest-resolver.default:consultest-consul-service:watch",
+		"consultest-resolver.default:consultest-consul-service-tcp:watch",
+	)
+}
+
+func TestConsulCredentials(t *testing.T) {
+	secret := func(namespace, name string, data map[string]string) *kates.Secret {
+		s := &kates.Secret{ObjectMeta: kates.ObjectMeta{Namespace: namespace, Name: name}, Data: map[string][]byte{}}
+		for k, v := range data {
+			s.Data[k] = []byte(v)
+		}
+		return s
+	}
+	snapshot := &snapshotTypes.KubernetesSnapshot{
+		K8sSecrets: []*kates.Secret{
+			secret("consul", "acl", map[string]string{"token": "k8s-token\n"}),
+			secret("consul", "client", map[string]string{"tls.crt": "client-cert", "tls.key": "client-key"}),
+			secret("consul", "ca", map[string]string{"tls.crt": "ca-cert"}),
+			secret("other", "ca", map[string]string{"tls.crt": "wrong-ca-cert"}),
+		},
+		FSSecrets: map[snapshotTypes.SecretRef]*kates.Secret{
+			{Namespace: "consul", Name: "acl"}: secret("consul", "acl", map[string]string{"token": "fs-token"}),
+		},
+	}
+	resolver := &amb.ConsulResolver{
+		ObjectMeta: kates.ObjectMeta{Namespace: "consul", Name: "resolver"},
+		Spec: amb.ConsulResolverSpec{
+			Address:         "consul-server:8501",
+			Datacenter:      "dc2",
+			TokenSecret:     "acl",
+			TLSSecret:       "client",
+			CASecret:        "ca",
+			ConsulNamespace: "team-a",
+			ConsulPartition: "part-1",
+		},
+	}
+
+	creds, err := findConsulCredentials(resolver, snapshot)
+	require.NoError(t, err)
+	assert.Equal(t, consulCredentials{
+		Token:   "fs-token",
+		CAPEM:   []byte("ca-cert"),
+		CertPEM: []byte("client-cert"),
+		KeyPEM:  []byte("client-key"),
+	}, creds)
+
+	config := consulClientConfig(resolver, creds)
+	assert.Equal(t, "consul-server:8501", config.Address)
+	assert.Equal(t, "https", config.Scheme)
+	assert.Equal(t, "dc2", config.Datacenter)
+	assert.Equal(t, "fs-token", config.Token)
+	assert.Equal(t, "team-a", config.Namespace)
+	assert.Equal(t, "part-1", config.Partition)
+	assert.Equal(t, []byte("ca-cert"), config.TLSConfig.CAPem)
+	assert.Equal(t, []byte("client-cert"), config.TLSConfig.CertPEM)
+	assert.Equal(t, []byte("client-key"), config.TLSConfig.KeyPEM)
+
+	// Secrets have to exist, and have the right keys.
+	resolver.Spec.CASecret = "missing"
+	_, err = findConsulCredentials(resolver, snapshot)
+	assert.EqualError(t, err, "ca_secret missing.consul not found")
+	resolver.Spec.CASecret = "acl"
+	_, err = findConsulCredentials(resolver, snapshot)
+	assert.EqualError(t, err, `ca_secret acl.consul has no "tls.crt" key`)
+
+	// Without any Secrets, it's just the address and datacenter.
+	resolver.Spec = amb.ConsulResolverSpec{Address: "consul-server:8500", Datacenter: "dc1"}
+	creds, err = findConsulCredentials(resolver, snapshot)
+	require.NoError(t, err)
+	assert.Equal(t, consulCredentials{}, creds)
+	config = consulClientConfig(resolver, creds)
+	assert.Equal(t, "dc1", config.Datacenter)
+	assert.Nil(t, config.TLSConfig.CAPem)
+}
+
+func TestConsulSubsets(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	endpoints := consulwatch.Endpoints{
+		Id:      "dc1",
+		Service: "myservice",
+		Endpoints: []consulwatch.Endpoint{
+			{ID: "a", Address: "10.0.0.1", Port: 80, Tags: []string{"stable"}, Meta: map[string]string{"version": "v1"}},
+			{ID: "b", Address: "10.0.0.2", Port: 80, Tags: []string{"canary", "blue"}, Meta: map[string]string{"version": "v2"}},
+			{ID: "c", Address: "10.0.0.3", Port: 80, Tags: []string{"canary"}, Meta: map[string]string{"version": "v2", "zone": "a"}},
+		},
+	}
+	ids := func(endpoints consulwatch.Endpoints) (result []string) {
+		for _, ep := range endpoints.Endpoints {
+			result = append(result, ep.ID)
+		}
+		return
+	}
+	resolver := func(tags []string, meta map[string]string) *amb.ConsulResolver {
+		return &amb.ConsulResolver{
+			ObjectMeta: kates.ObjectMeta{Name: "consul-subset"},
+			Spec:       amb.ConsulResolverSpec{Datacenter: "dc1", Tags: tags, Meta: meta},
+		}
+	}
+
+	// Without any filters, everything goes through untouched.
+	all := selectConsulEndpoints(resolver(nil, nil), endpoints)
+	assert.Equal(t, endpoints, all)
+	assert.Equal(t, "myservice", consulEndpointsKey(all.Service, all.Subset))
+
+	canary := selectConsulEndpoints(resolver([]string{"canary"}, nil), endpoints)
+	assert.Equal(t, []string{"b", "c"}, ids(canary))
+	assert.Equal(t, "consul-subset", canary.Subset)
+	assert.Equal(t, "myservice/consul-subset", consulEndpointsKey(canary.Service, canary.Subset))
+
+	// All the tags and all the metadata have to match.
+	assert.Equal(t, []string{"b"}, ids(selectConsulEndpoints(resolver([]string{"canary", "blue"}, nil), endpoints)))
+	assert.Equal(t, []string{"c"}, ids(selectConsulEndpoints(resolver(nil, map[string]string{"version": "v2", "zone": "a"}), endpoints)))
+	assert.Equal(t, []string{"a"}, ids(selectConsulEndpoints(resolver([]string{"stable"}, map[string]string{"version": "v1"}), endpoints)))
+	assert.Empty(t, ids(selectConsulEndpoints(resolver([]string{"stable"}, map[string]string{"version": "v2"}), endpoints)))
+
+	// Each subset is its own cluster.
+	for _, ep := range consulEndpointsToAmbex(ctx, canary) {
+		assert.Equal(t, "consul/dc1/myservice/consul-subset", ep.ClusterName)
+	}
+	for _, ep := range consulEndpointsToAmbex(ctx, all) {
+		assert.Equal(t, "consul/dc1/myservice", ep.ClusterName)
+	}
+}
+
+func TestConsulFailover(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	resolver := &amb.ConsulResolver{
+		ObjectMeta: kates.ObjectMeta{Name: "consul-failover"},
+		Spec: amb.ConsulResolverSpec{
+			Datacenter:          "dc1",
+			FailoverDatacenters: []string{"dc2", "dc3"},
+		},
+	}
+	assert.Equal(t, []string{"dc1", "dc2", "dc3"}, consulDatacenters(resolver))
+
+	endpointsIn := func(datacenter string, addresses ...string) consulwatch.Endpoints {
+		result := consulwatch.Endpoints{Service: "myservice"}
+		for _, address := range addresses {
+			result.Endpoints = append(result.Endpoints, consulwatch.Endpoint{ID: datacenter, Address: address, Port: 80})
+		}
+		return result
+	}
+	type endpoint struct {
+		ip       string
+		priority uint32
+	}
+	endpointsCh := make(chan consulwatch.Endpoints, 1)
+	failover := newConsulFailover(resolver, "myservice")
+	update := func(priority int, endpoints consulwatch.Endpoints) (result []endpoint) {
+		failover.update(priority, endpoints, endpointsCh)
+		merged := <-endpointsCh
+		assert.Equal(t, "dc1", merged.Id)
+		for _, ep := range consulEndpointsToAmbex(ctx, merged) {
+			assert.Equal(t, "consul/dc1/myservice", ep.ClusterName)
+			result = append(result, endpoint{ep.Ip, ep.Priority})
+		}
+		return
+	}
+
+	assert.Equal(t, []endpoint{{"10.0.1.1", 0}}, update(0, endpointsIn("dc1", "10.0.1.1")))
+	assert.Equal(t, []endpoint{{"10.0.1.1", 0}, {"10.0.3.1", 2}}, update(2, endpointsIn("dc3", "10.0.3.1")))
+	assert.Equal(t, []endpoint{{"10.0.1.1", 0}, {"10.0.2.1", 1}, {"10.0.2.2", 1}, {"10.0.3.1", 2}},
+		update(1, endpointsIn("dc2", "10.0.2.1", "10.0.2.2")))
+
+	// When the primary datacenter has nothing healthy left, what's left is the failover
+	// datacenters, and the primary comes back when it recovers.
+	assert.Equal(t, []endpoint{{"10.0.2.1", 1}, {"10.0.2.2", 1}, {"10.0.3.1", 2}}, update(0, endpointsIn("dc1")))
+	assert.Equal(t, []endpoint{{"10.0.1.2", 0}, {"10.0.2.1", 1}, {"10.0.2.2", 1}, {"10.0.3.1", 2}},
+		update(0, endpointsIn("dc1", "10.0.1.2")))
+}
+
+func TestConsulEndpointHealth(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	endpoints := consulwatch.Endpoints{
+		Id:      "dc1",
+		Service: "myservice",
+		Endpoints: []consulwatch.Endpoint{
+			{Address: "10.0.0.1", Port: 80, Status: "passing", Weight: 10},
+			{Address: "10.0.0.2", Port: 80, Status: "warning", Weight: 1},
+			{Address: "10.0.0.3", Port: 80, Status: "warning", Weight: 0},
+			{Address: "10.0.0.4", Port: 80, Status: "critical", Weight: 10},
+			{Address: "10.0.0.5", Port: 80, Status: "maintenance", Weight: 10},
+			// We don't know anything about this one.
+			{Address: "10.0.0.6", Port: 80},
+		},
+	}
+
+	type endpoint struct {
+		ip     string
+		health string
+		weight uint32
+	}
+	var result []endpoint
+	for _, ep := range consulEndpointsToAmbex(ctx, endpoints) {
+		result = append(result, endpoint{ep.Ip, ep.HealthStatus, ep.Weight})
+	}
+	// Critical instances, and warning ones with no weight, are left out.
+	assert.Equal(t, []endpoint{
+		{"10.0.0.1", "HEALTHY", 10},
+		{"10.0.0.2", "DEGRADED", 1},
+		{"10.0.0.5", "DRAINING", 10},
+		{"10.0.0.6", "", 0},
+	}, result)
+
+	// However much of a service is critical, Envoy never hears about the critical instances, so
+	// it can't end up sending them traffic.
+	endpoints.Endpoints = []consulwatch.Endpoint{
+		{Address: "10.0.0.1", Port: 80, Status: "critical", Weight: 1},
+		{Address: "10.0.0.2", Port: 80, Status: "critical", Weight: 1},
+		{Address: "10.0.0.3", Port: 80, Status: "passing", Weight: 1},
+		{Address: "10.0.0.4", Port: 80, Status: "critical", Weight: 1},
+		{Address: "10.0.0.5", Port: 80, Status: "critical", Weight: 1},
+	}
+	result = nil
+	for _, ep := range consulEndpointsToAmbex(ctx, endpoints) {
+		result = append(result, endpoint{ep.Ip, ep.HealthStatus, ep.Weight})
+	}
+	assert.Equal(t, []endpoint{{"10.0.0.3", "HEALTHY", 1}}, result)
+}
+
 func TestCleanup(t *testing.T) {
 	ctx, resolvers, mappings, c, tw := setup(t)
-	require.NoError(t, c.reconcile(ctx, resolvers, mappings))
+	require.NoError(t, c.reconcile(ctx, resolvers, nil, mappings))
 	tw.Assert(
 		"consultest-resolver.default:consultest-consul-service:watch",
 		"consultest-resolver.default:consultest-consul-service-tcp:watch",
@@ -111,7 +346,7 @@ func TestCleanup(t *testing.T) {
 func TestBootstrap(t *testing.T) {
 	ctx, resolvers, mappings, c, _ := setup(t)
 	assert.False(t, c.isBootstrapped())
-	require.NoError(t, c.reconcile(ctx, resolvers, mappings))
+	require.NoError(t, c.reconcile(ctx, resolvers, nil, mappings))
 	assert.False(t, c.isBootstrapped())
 	// XXX: break this (maybe use a chan to replace uncoalesced dirties and passing con around?)
 	//
@@ -193,7 +428,7 @@ func (tw *testWatcher) Assert(events ...string) {
 	tw.events = make(map[string]bool)
 }
 
-func (tw *testWatcher) Watch(ctx context.Context, resolver *amb.ConsulResolver, svc string, _ chan consulwatch.Endpoints) (Stopper, error) {
+func (tw *testWatcher) Watch(ctx context.Context, resolver *amb.ConsulResolver, _ consulCredentials, svc string, _ chan consulwatch.Endpoints) (Stopper, error) {
 	rname := fmt.Sprintf("%s.%s", resolver.GetName(), resolver.GetNamespace())
 	tw.Logf("%s:%s:watch", rname, svc)
 	return &testStopper{watcher: tw, resolver: rname, service: svc}, nil
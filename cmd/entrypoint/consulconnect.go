@@ -0,0 +1,188 @@
+package entrypoint
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/consulwatch"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+)
+
+// ConsulConnectCert manages the Consul Connect leaf certificate for Emissary's own service
+// identity, along with the Connect CA roots that upstream certificates are signed by. Like
+// IstioCert, it hands them to the rest of Emissary as Kubernetes-style Secrets, so that a
+// TLSContext can use them to originate mTLS to services in the Consul mesh:
+//
+//   - the secret named "name" is a kubernetes.io/tls Secret holding the leaf certificate and key;
+//   - the secret named "name-ca" holds all the CA roots in tls.crt, for use as a ca_secret.
+//
+// Consul rotates the leaf certificate well before it expires, and we watch for that (and for CA
+// rotation), so the Secrets are kept up to date without anyone having to do anything.
+type ConsulConnectCert struct {
+	name      string // Name we'll use when generating our secrets
+	namespace string // Namespace in which our secrets will appear to be
+
+	// Where shall we send updates when things happen?
+	updates chan IstioCertUpdate
+
+	mu    sync.Mutex
+	leaf  *consulwatch.Certificate
+	roots *consulwatch.CARoots
+}
+
+// NewConsulConnectCert instantiates a ConsulConnectCert that will post updates to the secrets
+// "name" and "name-ca" in "namespace" to "updateChannel" whenever the certificate or the CA roots
+// change.
+func NewConsulConnectCert(name, namespace string, updateChannel chan IstioCertUpdate) *ConsulConnectCert {
+	return &ConsulConnectCert{
+		name:      name,
+		namespace: namespace,
+		updates:   updateChannel,
+	}
+}
+
+// String returns a string representation of this ConsulConnectCert.
+func (cc *ConsulConnectCert) String() string {
+	return fmt.Sprintf("ConsulConnectCert %s.%s", cc.name, cc.namespace)
+}
+
+// Watch starts watching Consul for the leaf certificate of the given service and for the CA
+// roots. The watches stop when ctx is done.
+func (cc *ConsulConnectCert) Watch(ctx context.Context, consul *consulapi.Client, service string) error {
+	leafWatcher, err := consulwatch.NewConnectLeafWatcher(consul, service)
+	if err != nil {
+		return err
+	}
+	rootsWatcher, err := consulwatch.NewConnectCARootsWatcher(consul)
+	if err != nil {
+		return err
+	}
+
+	leafWatcher.Watch(func(cert *consulwatch.Certificate, err error) {
+		if err != nil {
+			dlog.Errorf(ctx, "%s: error watching the leaf certificate for %s: %v", cc, service, err)
+			return
+		}
+		cc.HandleLeaf(ctx, cert)
+	})
+	rootsWatcher.Watch(func(roots *consulwatch.CARoots, err error) {
+		if err != nil {
+			dlog.Errorf(ctx, "%s: error watching the CA roots: %v", cc, err)
+			return
+		}
+		cc.HandleRoots(ctx, roots)
+	})
+
+	for _, w := range []interface {
+		Start(context.Context) error
+	}{leafWatcher, rootsWatcher} {
+		w := w
+		go func() {
+			if err := w.Start(ctx); err != nil {
+				dlog.Errorf(ctx, "%s: %v", cc, err)
+			}
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		leafWatcher.Stop()
+		rootsWatcher.Stop()
+	}()
+
+	dlog.Infof(ctx, "%s: watching Consul Connect certificates for service %s", cc, service)
+	return nil
+}
+
+// HandleLeaf tells the ConsulConnectCert about a new leaf certificate.
+func (cc *ConsulConnectCert) HandleLeaf(ctx context.Context, cert *consulwatch.Certificate) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	dlog.Infof(ctx, "%s: leaf certificate %s for %s, valid until %v", cc, cert.SerialNumber, cert.ServiceURI, cert.ValidBefore)
+	cc.leaf = cert
+	cc.notify(ctx)
+}
+
+// HandleRoots tells the ConsulConnectCert about a new set of CA roots.
+func (cc *ConsulConnectCert) HandleRoots(ctx context.Context, roots *consulwatch.CARoots) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	dlog.Infof(ctx, "%s: %d CA roots for trust domain %s, active root %s", cc, len(roots.Roots), roots.TrustDomain, roots.ActiveRootID)
+	cc.roots = roots
+	cc.notify(ctx)
+}
+
+// notify posts the secrets, once we have both the leaf certificate and the CA roots. The caller
+// must hold cc.mu, which also keeps the updates in order.
+func (cc *ConsulConnectCert) notify(ctx context.Context) {
+	if cc.leaf == nil || cc.roots == nil {
+		dlog.Debugf(ctx, "%s: still waiting for the leaf certificate or the CA roots", cc)
+		return
+	}
+
+	for _, secret := range cc.Secrets() {
+		select {
+		case cc.updates <- IstioCertUpdate{
+			Op:        "update",
+			Name:      secret.ObjectMeta.Name,
+			Namespace: secret.ObjectMeta.Namespace,
+			Secret:    secret,
+		}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Secrets generates the leaf certificate and CA secrets. The caller must hold cc.mu.
+func (cc *ConsulConnectCert) Secrets() []*kates.Secret {
+	// The active root goes first, then the rest in a stable order, so that upstreams with
+	// certificates signed by a root that's being rotated out still validate.
+	var ids []string
+	for id := range cc.roots.Roots {
+		if id != cc.roots.ActiveRootID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	if _, ok := cc.roots.Roots[cc.roots.ActiveRootID]; ok {
+		ids = append([]string{cc.roots.ActiveRootID}, ids...)
+	}
+	var bundle strings.Builder
+	for _, id := range ids {
+		bundle.WriteString(strings.TrimSpace(cc.roots.Roots[id].PEM))
+		bundle.WriteString("\n")
+	}
+
+	return []*kates.Secret{
+		cc.secret(cc.name, kates.SecretTypeTLS, map[string][]byte{
+			"tls.crt": []byte(cc.leaf.PEM),
+			"tls.key": []byte(cc.leaf.PrivateKeyPEM),
+		}),
+		cc.secret(cc.name+"-ca", kates.SecretTypeOpaque, map[string][]byte{
+			"tls.crt": []byte(bundle.String()),
+		}),
+	}
+}
+
+func (cc *ConsulConnectCert) secret(name string, secretType kates.SecretType, data map[string][]byte) *kates.Secret {
+	return &kates.Secret{
+		TypeMeta: kates.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: kates.ObjectMeta{
+			Name:      name,
+			Namespace: cc.namespace,
+		},
+		Type: secretType,
+		Data: data,
+	}
+}
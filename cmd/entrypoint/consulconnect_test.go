@@ -0,0 +1,63 @@
+package entrypoint_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/cmd/entrypoint"
+	"github.com/emissary-ingress/emissary/v3/pkg/consulwatch"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+)
+
+func TestConsulConnectCert(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	updates := make(chan entrypoint.IstioCertUpdate, 10)
+	ccert := entrypoint.NewConsulConnectCert("ambassador-consul-connect", "ambassador", updates)
+
+	// Nothing happens until we have both the leaf certificate and the CA roots.
+	ccert.HandleLeaf(ctx, &consulwatch.Certificate{
+		SerialNumber:  "1",
+		PEM:           "leaf-1",
+		PrivateKeyPEM: "key-1",
+		ServiceURI:    "spiffe://example.consul/ns/default/dc/dc1/svc/ambassador",
+		ValidBefore:   time.Now().Add(time.Hour),
+	})
+	assert.Len(t, updates, 0)
+
+	ccert.HandleRoots(ctx, &consulwatch.CARoots{
+		ActiveRootID: "b",
+		TrustDomain:  "example.consul",
+		Roots: map[string]consulwatch.CARoot{
+			"a": {ID: "a", PEM: "root-a\n"},
+			"b": {ID: "b", PEM: "root-b\n", Active: true},
+			"c": {ID: "c", PEM: "root-c"},
+		},
+	})
+	require.Len(t, updates, 2)
+
+	leaf := <-updates
+	assert.Equal(t, "update", leaf.Op)
+	assert.Equal(t, "ambassador-consul-connect", leaf.Name)
+	assert.Equal(t, "ambassador", leaf.Namespace)
+	assert.Equal(t, kates.SecretTypeTLS, leaf.Secret.Type)
+	assert.Equal(t, "leaf-1", string(leaf.Secret.Data["tls.crt"]))
+	assert.Equal(t, "key-1", string(leaf.Secret.Data["tls.key"]))
+
+	// The active root comes first.
+	ca := <-updates
+	assert.Equal(t, "ambassador-consul-connect-ca", ca.Name)
+	assert.Equal(t, "root-b\nroot-a\nroot-c\n", string(ca.Secret.Data["tls.crt"]))
+	_, hasKey := ca.Secret.Data["tls.key"]
+	assert.False(t, hasKey)
+
+	// Rotating the leaf certificate updates the secrets.
+	ccert.HandleLeaf(ctx, &consulwatch.Certificate{SerialNumber: "2", PEM: "leaf-2", PrivateKeyPEM: "key-2"})
+	require.Len(t, updates, 2)
+	leaf = <-updates
+	assert.Equal(t, "leaf-2", string(leaf.Secret.Data["tls.crt"]))
+	<-updates
+}
@@ -4,6 +4,9 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sort"
+
+	consulapi "github.com/hashicorp/consul/api"
 
 	"github.com/datawire/dlib/dlog"
 	"github.com/emissary-ingress/emissary/v3/pkg/ambex"
@@ -18,13 +21,39 @@ func makeEndpoints(ctx context.Context, ksnap *snapshot.KubernetesSnapshot, cons
 		k8sServices[key(svc)] = svc
 	}
 
+	// EndpointSlices belong to the Service named by their kubernetes.io/service-name label.
+	k8sSlices := map[string][]*kates.EndpointSlice{}
+	for _, slice := range ksnap.EndpointSlices {
+		svcName := slice.GetLabels()[kates.LabelServiceName]
+		if svcName == "" {
+			continue
+		}
+		svcKey := fmt.Sprintf("%s:%s", slice.GetNamespace(), svcName)
+		k8sSlices[svcKey] = append(k8sSlices[svcKey], slice)
+	}
+
 	result := map[string][]*ambex.Endpoint{}
 
+	for _, svcKey := range sortedSliceKeys(k8sSlices) {
+		svc, ok := k8sServices[svcKey]
+		if !ok {
+			continue
+		}
+		for _, ep := range k8sEndpointSlicesToAmbex(k8sSlices[svcKey], svc) {
+			result[ep.ClusterName] = append(result[ep.ClusterName], ep)
+		}
+	}
+
+	// Legacy Endpoints only get used for Services that don't have any EndpointSlices, since they
+	// don't know anything about zones.
 	for _, k8sEp := range ksnap.Endpoints {
 		svc, ok := k8sServices[key(k8sEp)]
 		if !ok {
 			continue
 		}
+		if _, ok := k8sSlices[key(k8sEp)]; ok {
+			continue
+		}
 		for _, ep := range k8sEndpointsToAmbex(k8sEp, svc) {
 			result[ep.ClusterName] = append(result[ep.ClusterName], ep)
 		}
@@ -36,14 +65,26 @@ func makeEndpoints(ctx context.Context, ksnap *snapshot.KubernetesSnapshot, cons
 		}
 	}
 
-	return &ambex.Endpoints{Entries: result}
+	return &ambex.Endpoints{Entries: result, LocalZone: GetAmbassadorZone()}
 }
 
 func key(resource kates.Object) string {
 	return fmt.Sprintf("%s:%s", resource.GetNamespace(), resource.GetName())
 }
 
-func k8sEndpointsToAmbex(ep *kates.Endpoints, svc *kates.Service) (result []*ambex.Endpoint) {
+func sortedSliceKeys(slices map[string][]*kates.EndpointSlice) []string {
+	keys := make([]string, 0, len(slices))
+	for k := range slices {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// servicePortMap maps each of the ways an endpoint port can be identified (target port number,
+// target port name, or "" for a Service with a single port) to the names that clusters use for
+// the Service port: its number, its name, and "" if it's the only port.
+func servicePortMap(svc *kates.Service) map[string][]string {
 	portmap := map[string][]string{}
 	for _, p := range svc.Spec.Ports {
 		port := fmt.Sprintf("%d", p.Port)
@@ -63,30 +104,124 @@ func k8sEndpointsToAmbex(ep *kates.Endpoints, svc *kates.Service) (result []*amb
 			portmap[""] = append(portmap[""], "")
 		}
 	}
+	return portmap
+}
+
+// clusterPortNames returns the cluster port names for an endpoint port.
+func clusterPortNames(portmap map[string][]string, port int32, name string) []string {
+	portNames := map[string]bool{}
+	candidates := []string{fmt.Sprintf("%d", port), name, ""}
+	for _, c := range candidates {
+		if pns, ok := portmap[c]; ok {
+			for _, pn := range pns {
+				portNames[pn] = true
+			}
+		}
+	}
+	result := make([]string, 0, len(portNames))
+	for pn := range portNames {
+		result = append(result, pn)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func k8sClusterName(namespace, name, portName string) string {
+	if portName == "" {
+		return fmt.Sprintf("k8s/%s/%s", namespace, name)
+	}
+	return fmt.Sprintf("k8s/%s/%s/%s", namespace, name, portName)
+}
+
+func k8sEndpointsToAmbex(ep *kates.Endpoints, svc *kates.Service) (result []*ambex.Endpoint) {
+	portmap := servicePortMap(svc)
 
 	for _, subset := range ep.Subsets {
 		for _, port := range subset.Ports {
 			if port.Protocol == kates.ProtocolTCP || port.Protocol == kates.ProtocolUDP {
-				portNames := map[string]bool{}
-				candidates := []string{fmt.Sprintf("%d", port.Port), port.Name, ""}
-				for _, c := range candidates {
-					if pns, ok := portmap[c]; ok {
-						for _, pn := range pns {
-							portNames[pn] = true
-						}
+				portNames := clusterPortNames(portmap, port.Port, port.Name)
+				// Endpoints can't tell us whether a not-ready address is terminating, so those
+				// are left out, just like any other address that isn't ready.
+				for _, addr := range subset.Addresses {
+					for _, pn := range portNames {
+						result = append(result, &ambex.Endpoint{
+							ClusterName:  k8sClusterName(ep.Namespace, ep.Name, pn),
+							Ip:           addr.IP,
+							Port:         uint32(port.Port),
+							Protocol:     string(port.Protocol),
+							HealthStatus: ambex.HealthStatusHealthy,
+						})
 					}
 				}
-				for _, addr := range subset.Addresses {
-					for pn := range portNames {
-						sep := "/"
-						if pn == "" {
-							sep = ""
-						}
+			}
+		}
+	}
+
+	return
+}
+
+// k8sEndpointSlicesToAmbex does the same thing as k8sEndpointsToAmbex, for all the EndpointSlices
+// of a Service, but also keeps track of where each endpoint is running.
+func k8sEndpointSlicesToAmbex(slices []*kates.EndpointSlice, svc *kates.Service) (result []*ambex.Endpoint) {
+	portmap := servicePortMap(svc)
+
+	// The legacy Endpoints only ever have addresses of the Service's primary IP family, so stick
+	// to that here too.
+	var family string
+	if len(svc.Spec.IPFamilies) > 0 {
+		family = string(svc.Spec.IPFamilies[0])
+	}
+
+	sort.Slice(slices, func(i, j int) bool { return slices[i].GetName() < slices[j].GetName() })
+	for _, slice := range slices {
+		if slice.AddressType != kates.AddressTypeIPv4 && slice.AddressType != kates.AddressTypeIPv6 {
+			continue
+		}
+		if family != "" && string(slice.AddressType) != family {
+			continue
+		}
+		for _, port := range slice.Ports {
+			protocol := kates.ProtocolTCP
+			if port.Protocol != nil {
+				protocol = *port.Protocol
+			}
+			if port.Port == nil || (protocol != kates.ProtocolTCP && protocol != kates.ProtocolUDP) {
+				continue
+			}
+			name := ""
+			if port.Name != nil {
+				name = *port.Name
+			}
+			portNames := clusterPortNames(portmap, *port.Port, name)
+			for _, endpoint := range slice.Endpoints {
+				health, ok := sliceEndpointHealth(endpoint.Conditions)
+				if !ok {
+					continue
+				}
+				var zone, nodeName string
+				if endpoint.Zone != nil {
+					zone = *endpoint.Zone
+				}
+				if endpoint.NodeName != nil {
+					nodeName = *endpoint.NodeName
+				}
+				var hints []string
+				if endpoint.Hints != nil {
+					for _, forZone := range endpoint.Hints.ForZones {
+						hints = append(hints, forZone.Name)
+					}
+				}
+				for _, addr := range endpoint.Addresses {
+					for _, pn := range portNames {
 						result = append(result, &ambex.Endpoint{
-							ClusterName: fmt.Sprintf("k8s/%s/%s%s%s", ep.Namespace, ep.Name, sep, pn),
-							Ip:          addr.IP,
-							Port:        uint32(port.Port),
-							Protocol:    string(port.Protocol),
+							ClusterName:  k8sClusterName(svc.Namespace, svc.Name, pn),
+							Ip:           addr,
+							Port:         uint32(*port.Port),
+							Protocol:     string(protocol),
+							Zone:         zone,
+							NodeName:     nodeName,
+							ZoneHints:    hints,
+							HealthStatus: health,
 						})
 					}
 				}
@@ -97,22 +232,80 @@ func k8sEndpointsToAmbex(ep *kates.Endpoints, svc *kates.Service) (result []*amb
 	return
 }
 
+// sliceEndpointHealth maps an EndpointSlice endpoint's conditions to a health status, and returns
+// false if the endpoint should be left out altogether. A terminating endpoint that's still serving
+// is draining, so that the requests it already has can finish; otherwise an endpoint is healthy if
+// it's ready. Endpoints that can't take requests are left out rather than sent as unhealthy: if
+// enough of a cluster were unhealthy, Envoy's panic threshold would have it send traffic to them
+// anyway. A nil ready or serving condition means that the endpoint is ready or serving.
+func sliceEndpointHealth(conditions kates.EndpointConditions) (string, bool) {
+	if conditions.Terminating != nil && *conditions.Terminating {
+		if conditions.Serving == nil || *conditions.Serving {
+			return ambex.HealthStatusDraining, true
+		}
+		return "", false
+	}
+	if conditions.Ready == nil || *conditions.Ready {
+		return ambex.HealthStatusHealthy, true
+	}
+	return "", false
+}
+
 func consulEndpointsToAmbex(ctx context.Context, endpoints consulwatch.Endpoints) (result []*ambex.Endpoint) {
+	clusterName := fmt.Sprintf("consul/%s/%s", endpoints.Id, endpoints.Service)
+	if endpoints.Subset != "" {
+		clusterName += "/" + endpoints.Subset
+	}
 	for _, ep := range endpoints.Endpoints {
 		addrs, err := net.LookupHost(ep.Address)
 		if err != nil {
 			dlog.Errorf(ctx, "error resolving consul address %s: %+v", ep.Address, err)
 			continue
 		}
+		health, weight, ok := consulEndpointHealth(ep)
+		if !ok {
+			continue
+		}
 		for _, addr := range addrs {
 			result = append(result, &ambex.Endpoint{
-				ClusterName: fmt.Sprintf("consul/%s/%s", endpoints.Id, endpoints.Service),
-				Ip:          addr,
-				Port:        uint32(ep.Port),
-				Protocol:    "TCP",
+				ClusterName:  clusterName,
+				Ip:           addr,
+				Port:         uint32(ep.Port),
+				Protocol:     "TCP",
+				HealthStatus: health,
+				Priority:     uint32(ep.Priority),
+				Weight:       weight,
 			})
 		}
 	}
 
 	return
 }
+
+// consulEndpointHealth maps the status of a Consul instance's health checks to an EDS health
+// status, and its Consul weight to a load-balancing weight, and returns false if the instance
+// should be left out altogether. An instance that's only warning is degraded, and gets its
+// (usually lower) warning weight; if that weight is 0, Consul says it shouldn't get any traffic
+// at all. An instance in maintenance mode is draining. Critical instances are left out, for the
+// same reason that sliceEndpointHealth leaves out endpoints that aren't ready.
+func consulEndpointHealth(ep consulwatch.Endpoint) (string, uint32, bool) {
+	var health string
+	switch ep.Status {
+	case consulapi.HealthPassing:
+		health = ambex.HealthStatusHealthy
+	case consulapi.HealthWarning:
+		if ep.Weight <= 0 {
+			return "", 0, false
+		}
+		health = ambex.HealthStatusDegraded
+	case consulapi.HealthCritical:
+		return "", 0, false
+	case consulapi.HealthMaint:
+		health = ambex.HealthStatusDraining
+	}
+
+	if ep.Weight <= 0 {
+		return health, 0, true
+	}
+	return health, uint32(ep.Weight), true
+}
@@ -180,6 +180,93 @@ spec:
 	assert.Equal(t, "1.2.3.4", endpoints.Entries["k8s/default/foo/80"][0].Ip)
 }
 
+func TestEndpointRoutingSlices(t *testing.T) {
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+	assert.NoError(t, f.Upsert(makeMapping("default", "foo", "/foo", "foo", "endpoint")))
+	assert.NoError(t, f.Upsert(makeService("default", "foo")))
+	// The legacy Endpoints get ignored once there are EndpointSlices for the Service.
+	subset, err := makeSubset(8080, "1.2.3.4")
+	require.NoError(t, err)
+	assert.NoError(t, f.Upsert(makeEndpoints("default", "foo", subset)))
+	assert.NoError(t, f.Upsert(makeEndpointSlice("default", "foo", "foo-abcde", 8080,
+		makeSliceEndpoint("10.0.0.1", "us-east-1a", "node-1", true),
+		makeSliceEndpoint("10.0.0.2", "us-east-1b", "node-2", true),
+		makeSliceEndpoint("10.0.0.3", "us-east-1b", "node-3", false),
+	)))
+	f.Flush()
+
+	endpoints, err := f.GetEndpoints(HasEndpoints("k8s/default/foo/80"))
+	require.NoError(t, err)
+	eps := endpoints.Entries["k8s/default/foo/80"]
+	// The endpoint that isn't ready is left out.
+	require.Len(t, eps, 2)
+	assert.Equal(t, "10.0.0.1", eps[0].Ip)
+	assert.Equal(t, uint32(8080), eps[0].Port)
+	assert.Equal(t, "us-east-1a", eps[0].Zone)
+	assert.Equal(t, "node-1", eps[0].NodeName)
+	assert.Equal(t, ambex.HealthStatusHealthy, eps[0].HealthStatus)
+	assert.Equal(t, "10.0.0.2", eps[1].Ip)
+	assert.Equal(t, "us-east-1b", eps[1].Zone)
+
+	// Changing a slice sends new endpoints.
+	assert.NoError(t, f.Upsert(makeEndpointSlice("default", "foo", "foo-abcde", 8080,
+		makeSliceEndpoint("10.0.0.4", "us-east-1c", "node-4", true),
+	)))
+	f.Flush()
+	endpoints, err = f.GetEndpoints(func(endpoints *ambex.Endpoints) bool {
+		eps := endpoints.Entries["k8s/default/foo/80"]
+		return len(eps) == 1 && eps[0].Ip == "10.0.0.4"
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "us-east-1c", endpoints.Entries["k8s/default/foo/80"][0].Zone)
+}
+
+func TestEndpointRoutingHealth(t *testing.T) {
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+	assert.NoError(t, f.Upsert(makeMapping("default", "foo", "/foo", "foo", "endpoint")))
+	assert.NoError(t, f.Upsert(makeService("default", "foo")))
+	assert.NoError(t, f.Upsert(makeMapping("default", "bar", "/bar", "bar", "endpoint")))
+	assert.NoError(t, f.Upsert(makeService("default", "bar")))
+
+	// Legacy Endpoints only know whether an address is ready, and the ones that aren't are left
+	// out.
+	subset, err := makeSubset(8080, "1.2.3.4")
+	require.NoError(t, err)
+	subset.NotReadyAddresses = []kates.EndpointAddress{{IP: "1.2.3.5"}}
+	assert.NoError(t, f.Upsert(makeEndpoints("default", "foo", subset)))
+
+	// EndpointSlices also know whether it's terminating, and if so, whether it's still serving.
+	terminating := func(ip string, serving bool) kates.EndpointSliceEndpoint {
+		ep := makeSliceEndpoint(ip, "us-east-1a", "node-2", false)
+		isTerminating := true
+		ep.Conditions.Serving = &serving
+		ep.Conditions.Terminating = &isTerminating
+		return ep
+	}
+	assert.NoError(t, f.Upsert(makeEndpointSlice("default", "bar", "bar-abcde", 8080,
+		makeSliceEndpoint("10.0.0.1", "us-east-1a", "node-1", true),
+		terminating("10.0.0.2", true),
+		terminating("10.0.0.3", false),
+	)))
+	f.Flush()
+
+	endpoints, err := f.GetEndpoints(func(endpoints *ambex.Endpoints) bool {
+		return len(endpoints.Entries["k8s/default/foo/80"]) == 1 && len(endpoints.Entries["k8s/default/bar/80"]) == 2
+	})
+	require.NoError(t, err)
+	health := map[string]string{}
+	for _, cluster := range []string{"k8s/default/foo/80", "k8s/default/bar/80"} {
+		for _, ep := range endpoints.Entries[cluster] {
+			health[ep.Ip] = ep.HealthStatus
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"1.2.3.4":  ambex.HealthStatusHealthy,
+		"10.0.0.1": ambex.HealthStatusHealthy,
+		"10.0.0.2": ambex.HealthStatusDraining,
+	}, health)
+}
+
 func ClusterNameContains(substring string) func(*v3cluster.Cluster) bool {
 	return func(c *v3cluster.Cluster) bool {
 		return strings.Contains(c.Name, substring)
@@ -250,6 +337,30 @@ func makeEndpoints(namespace, name string, subsets ...kates.EndpointSubset) *kat
 	}
 }
 
+func makeEndpointSlice(namespace, svcName, name string, port int32, endpoints ...kates.EndpointSliceEndpoint) *kates.EndpointSlice {
+	protocol := kates.ProtocolTCP
+	return &kates.EndpointSlice{
+		TypeMeta: kates.TypeMeta{Kind: "EndpointSlice", APIVersion: "discovery.k8s.io/v1"},
+		ObjectMeta: kates.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{kates.LabelServiceName: svcName},
+		},
+		AddressType: kates.AddressTypeIPv4,
+		Endpoints:   endpoints,
+		Ports:       []kates.EndpointSlicePort{{Port: &port, Protocol: &protocol}},
+	}
+}
+
+func makeSliceEndpoint(ip, zone, nodeName string, ready bool) kates.EndpointSliceEndpoint {
+	return kates.EndpointSliceEndpoint{
+		Addresses:  []string{ip},
+		Conditions: kates.EndpointConditions{Ready: &ready},
+		Zone:       &zone,
+		NodeName:   &nodeName,
+	}
+}
+
 // makeSubset provides a convenient way to kubernetes EndpointSubset resources. Any int args are
 // ports, any ip address strings are addresses, and no ip address strings are used as the port name
 // for any ports that follow them in the arg list.
@@ -19,9 +19,11 @@ import (
 	"github.com/emissary-ingress/emissary/v3/pkg/acp"
 	"github.com/emissary-ingress/emissary/v3/pkg/ambex"
 	"github.com/emissary-ingress/emissary/v3/pkg/busy"
+	"github.com/emissary-ingress/emissary/v3/pkg/debug"
 	"github.com/emissary-ingress/emissary/v3/pkg/kates"
 	"github.com/emissary-ingress/emissary/v3/pkg/logutil"
 	"github.com/emissary-ingress/emissary/v3/pkg/memory"
+	"github.com/emissary-ingress/emissary/v3/pkg/metrics"
 )
 
 // This is the main ambassador entrypoint. It launches and manages two other
@@ -91,6 +93,9 @@ func Main(ctx context.Context, Version string, args ...string) error {
 
 	dlog.Infof(ctx, "Started Ambassador (Version %s)", Version)
 
+	// Export the timings of all our debug timers as metrics.
+	metrics.ObserveTimers(debug.FromContext(ctx))
+
 	// Do whatever waiting for apiext that we need to do. This ensures
 	// that the CRD conversion webhook is available before we start
 	// processing resources, if we're using it.
@@ -163,8 +168,9 @@ func Main(ctx context.Context, Version string, args ...string) error {
 
 	fastpathCh := make(chan *ambex.FastpathSnapshot)
 	group.Go("ambex", func(ctx context.Context) error {
-		return ambex.Main(ctx, Version, usage.PercentUsed, fastpathCh, "--ads-listen-address",
-			"127.0.0.1:8003", GetEnvoyDir())
+		adsNetwork, adsAddress := GetAmbexADSAddress()
+		return ambex.Main(ctx, Version, usage.PercentUsed, ambwatch.NoteEnvoyNack, fastpathCh, "--ads-listen-network", adsNetwork,
+			"--ads-listen-address", adsAddress, "--runtime-listen-address", GetAmbexRuntimeAddress(), GetEnvoyDir())
 	})
 
 	group.Go("envoy", func(ctx context.Context) error {
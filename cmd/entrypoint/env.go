@@ -135,6 +135,23 @@ func GetEnvoyFlags() []string {
 	return result
 }
 
+// GetAmbexRuntimeAddress is where ambex's runtime API listens. The API is off unless
+// AMBASSADOR_AMBEX_RUNTIME_ADDRESS is set.
+func GetAmbexRuntimeAddress() string {
+	return env("AMBASSADOR_AMBEX_RUNTIME_ADDRESS", "")
+}
+
+// GetAmbexADSAddress is the network and address that ambex's ADS server listens on, and that
+// Envoy's bootstrap points at. AMBASSADOR_AMBEX_ADS_ADDRESS can be a host:port, or unix:/path
+// for a unix socket.
+func GetAmbexADSAddress() (network, address string) {
+	addr := env("AMBASSADOR_AMBEX_ADS_ADDRESS", "127.0.0.1:8003")
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
 func GetDiagdBindAddress() string {
 	return env("AMBASSADOR_DIAGD_BIND_ADDREASS", "")
 }
@@ -149,6 +166,25 @@ func ForceEndpoints() bool {
 	return envbool("AMBASSADOR_FORCE_ENDPOINTS")
 }
 
+// GetAmbassadorZone returns the zone that this Emissary is running in, from AMBASSADOR_ZONE. When
+// it's set, endpoint routing prefers endpoints in the same zone.
+func GetAmbassadorZone() string {
+	return env("AMBASSADOR_ZONE", "")
+}
+
+// GetConsulConnectService returns the Consul service name that Emissary should get a Consul
+// Connect leaf certificate for, from AMBASSADOR_CONSUL_CONNECT_SERVICE. If it's empty, Emissary
+// doesn't do Consul Connect at all.
+func GetConsulConnectService() string {
+	return env("AMBASSADOR_CONSUL_CONNECT_SERVICE", "")
+}
+
+// GetConsulConnectSecretName returns the name of the Secret that holds the Consul Connect leaf
+// certificate. The CA roots are in the same name with "-ca" appended.
+func GetConsulConnectSecretName() string {
+	return env("AMBASSADOR_CONSUL_CONNECT_SECRET", "ambassador-consul-connect")
+}
+
 func GetDiagdBindPort() string {
 	return env("AMBASSADOR_DIAGD_BIND_PORT", "8004")
 }
@@ -77,3 +77,19 @@ func TestGetHealthCheckIPNetworkFamily(t *testing.T) {
 		})
 	}
 }
+
+func TestGetAmbexADSAddress(t *testing.T) {
+	network, address := GetAmbexADSAddress()
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "127.0.0.1:8003", address)
+
+	t.Setenv("AMBASSADOR_AMBEX_ADS_ADDRESS", "0.0.0.0:18000")
+	network, address = GetAmbexADSAddress()
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "0.0.0.0:18000", address)
+
+	t.Setenv("AMBASSADOR_AMBEX_ADS_ADDRESS", "unix:/run/ambex/ads.sock")
+	network, address = GetAmbexADSAddress()
+	assert.Equal(t, "unix", network)
+	assert.Equal(t, "/run/ambex/ads.sock", address)
+}
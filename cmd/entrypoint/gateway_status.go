@@ -0,0 +1,193 @@
+package entrypoint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+)
+
+// StatusProcessor is handed the Gateway API resources whose status needs to be written back to
+// the cluster, along with the statusKeys of any Gateway API resources that have been deleted.
+type StatusProcessor func(ctx context.Context, updates []kates.Object, deleted []string)
+
+// gatewayStatusWriter writes Gateway API status back to the cluster without blocking the watcher.
+// Updates are coalesced by resource, so if a resource's status changes several times before we get
+// around to writing it, only the latest status is written. Writes are rate limited so that a storm
+// of changes can't hammer the API server, and writes that fail are retried with backoff.
+type gatewayStatusWriter struct {
+	update     func(context.Context, kates.Object) error
+	limiter    *rate.Limiter
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	mu      sync.Mutex
+	pending map[string]kates.Object
+	notify  chan struct{}
+
+	// The number of times in a row that writing each resource's status has failed.
+	failures map[string]int
+
+	// The status we most recently wrote for each resource, so that we don't repeat a write while
+	// waiting for the watch to catch up with it.
+	written map[string]writtenStatus
+}
+
+type writtenStatus struct {
+	resourceVersion string // The version of the resource that the status was written to.
+	status          string
+}
+
+func newGatewayStatusWriter(ctx context.Context, client *kates.Client) (*gatewayStatusWriter, error) {
+	qps, err := strconv.ParseFloat(env("AMBASSADOR_GATEWAY_STATUS_QPS", "5"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("AMBASSADOR_GATEWAY_STATUS_QPS: %w", err)
+	}
+	dlog.Infof(ctx, "AMBASSADOR_GATEWAY_STATUS_QPS set to %g", qps)
+
+	return &gatewayStatusWriter{
+		update: func(ctx context.Context, obj kates.Object) error {
+			return client.UpdateStatus(ctx, obj, nil)
+		},
+		limiter:    rate.NewLimiter(rate.Limit(qps), 1),
+		backoff:    time.Second,
+		maxBackoff: time.Minute,
+		pending:    map[string]kates.Object{},
+		notify:     make(chan struct{}, 1),
+		failures:   map[string]int{},
+		written:    map[string]writtenStatus{},
+	}, nil
+}
+
+func statusKey(obj kates.Object) string {
+	return statusKeyFromParts(obj.GetObjectKind().GroupVersionKind().Kind, obj.GetNamespace(), obj.GetName())
+}
+
+func statusKeyFromParts(kind, namespace, name string) string {
+	return fmt.Sprintf("%s:%s:%s", kind, namespace, name)
+}
+
+// Update queues the supplied resources to have their status written, and forgets everything about
+// the deleted ones. It never blocks.
+func (w *gatewayStatusWriter) Update(ctx context.Context, objs []kates.Object, deleted []string) {
+	w.mu.Lock()
+	for _, obj := range objs {
+		w.pending[statusKey(obj)] = obj
+	}
+	for _, key := range deleted {
+		delete(w.pending, key)
+		delete(w.failures, key)
+		delete(w.written, key)
+	}
+	w.mu.Unlock()
+	w.wake()
+}
+
+func (w *gatewayStatusWriter) wake() {
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// retry queues the resource to have its status written again after a delay that doubles with
+// each failure. The retry is dropped if a newer version of the resource is queued or written in
+// the meantime, or if the resource is deleted.
+func (w *gatewayStatusWriter) retry(ctx context.Context, key string, obj kates.Object) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	failures := w.failures[key]
+	w.failures[key] = failures + 1
+	delay := w.maxBackoff
+	if failures < 32 && w.backoff<<failures < delay {
+		delay = w.backoff << failures
+	}
+	dlog.Infof(ctx, "[STATUS]: retrying status of %s in %v", key, delay)
+	time.AfterFunc(delay, func() {
+		w.mu.Lock()
+		_, newer := w.pending[key]
+		_, failing := w.failures[key]
+		if failing && !newer {
+			w.pending[key] = obj
+		}
+		w.mu.Unlock()
+		w.wake()
+	})
+}
+
+// Run writes queued statuses until the context is canceled.
+func (w *gatewayStatusWriter) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-w.notify:
+		}
+
+		w.mu.Lock()
+		pending := w.pending
+		w.pending = map[string]kates.Object{}
+		w.mu.Unlock()
+
+		for key, obj := range pending {
+			status, err := json.Marshal(statusOf(obj))
+			if err != nil {
+				dlog.Errorf(ctx, "[STATUS]: unable to marshal status of %s: %v", key, err)
+				continue
+			}
+			w.mu.Lock()
+			prev, ok := w.written[key]
+			w.mu.Unlock()
+			if ok && prev.resourceVersion == obj.GetResourceVersion() && prev.status == string(status) {
+				continue
+			}
+			if err := w.limiter.Wait(ctx); err != nil {
+				// The context was canceled.
+				return nil
+			}
+			err = w.update(ctx, obj)
+			switch {
+			case err == nil:
+				w.mu.Lock()
+				delete(w.failures, key)
+				w.written[key] = writtenStatus{resourceVersion: obj.GetResourceVersion(), status: string(status)}
+				w.mu.Unlock()
+			case kates.IsConflict(err) || kates.IsNotFound(err):
+				// There's no point in retrying: the watch will hand us the newer resource and
+				// we'll recompute its status, or tell us that it's gone.
+				dlog.Infof(ctx, "[STATUS]: unable to update status of %s: %v", key, err)
+				w.mu.Lock()
+				delete(w.failures, key)
+				delete(w.written, key)
+				w.mu.Unlock()
+			default:
+				dlog.Errorf(ctx, "[STATUS]: unable to update status of %s: %v", key, err)
+				w.mu.Lock()
+				delete(w.written, key)
+				w.mu.Unlock()
+				w.retry(ctx, key, obj)
+			}
+		}
+	}
+}
+
+// statusOf extracts just the status of a resource, so that the written-status cache isn't fooled
+// by changes to metadata.
+func statusOf(obj kates.Object) interface{} {
+	var un map[string]interface{}
+	bytes, err := json.Marshal(obj)
+	if err != nil {
+		return nil
+	}
+	if err := json.Unmarshal(bytes, &un); err != nil {
+		return nil
+	}
+	return un["status"]
+}
@@ -0,0 +1,101 @@
+package entrypoint
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+	gw "sigs.k8s.io/gateway-api/apis/v1"
+)
+
+func TestGatewayStatusWriterRetries(t *testing.T) {
+	ctx, cancel := context.WithCancel(dlog.NewTestContext(t, false))
+	defer cancel()
+
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	failures := map[string]error{
+		"retried":    errors.New("connection refused"),
+		"conflicted": k8serrors.NewConflict(schema.GroupResource{Group: gw.GroupName, Resource: "httproutes"}, "conflicted", errors.New("stale")),
+	}
+	done := make(chan struct{}, 10)
+	w := &gatewayStatusWriter{
+		update: func(_ context.Context, obj kates.Object) error {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts[obj.GetName()]++
+			defer func() { done <- struct{}{} }()
+			// Writing "retried" fails twice, writing "conflicted" always fails.
+			if err := failures[obj.GetName()]; err != nil && (obj.GetName() != "retried" || attempts["retried"] < 3) {
+				return err
+			}
+			return nil
+		},
+		limiter:    rate.NewLimiter(rate.Inf, 1),
+		backoff:    time.Millisecond,
+		maxBackoff: 10 * time.Millisecond,
+		pending:    map[string]kates.Object{},
+		notify:     make(chan struct{}, 1),
+		failures:   map[string]int{},
+		written:    map[string]writtenStatus{},
+	}
+	go func() {
+		_ = w.Run(ctx)
+	}()
+
+	route := func(name string) kates.Object {
+		return &gw.HTTPRoute{
+			TypeMeta:   kates.TypeMeta{Kind: "HTTPRoute"},
+			ObjectMeta: kates.ObjectMeta{Namespace: "default", Name: name, ResourceVersion: "1"},
+		}
+	}
+	w.Update(ctx, []kates.Object{route("retried"), route("conflicted")}, nil)
+
+	// Three attempts for "retried" and a single one for "conflicted", since retrying a conflict is
+	// pointless.
+	for i := 0; i < 4; i++ {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for status writes")
+		}
+	}
+	require.Eventually(t, func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		_, ok := w.written["HTTPRoute:default:retried"]
+		return ok
+	}, 10*time.Second, time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, map[string]int{"retried": 3, "conflicted": 1}, attempts)
+	mu.Unlock()
+
+	w.mu.Lock()
+	assert.Empty(t, w.failures)
+	assert.NotContains(t, w.written, "HTTPRoute:default:conflicted")
+	w.mu.Unlock()
+
+	// The same status for the same version of the resource isn't written twice.
+	w.Update(ctx, []kates.Object{route("retried")}, nil)
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, 3, attempts["retried"])
+	mu.Unlock()
+
+	// Deleting a resource forgets about it.
+	w.Update(ctx, nil, []string{"HTTPRoute:default:retried"})
+	w.mu.Lock()
+	assert.Empty(t, w.written)
+	w.mu.Unlock()
+}
@@ -1,7 +1,10 @@
 package entrypoint
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -12,8 +15,10 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 
 	"github.com/datawire/dlib/dhttp"
+	"github.com/datawire/dlib/dlog"
 	"github.com/emissary-ingress/emissary/v3/pkg/acp"
 	"github.com/emissary-ingress/emissary/v3/pkg/debug"
+	"github.com/emissary-ingress/emissary/v3/pkg/metrics"
 )
 
 func handleCheckAlive(w http.ResponseWriter, r *http.Request, ambwatch *acp.AmbassadorWatcher) {
@@ -42,11 +47,54 @@ func handleCheckReady(w http.ResponseWriter, r *http.Request, ambwatch *acp.Amba
 
 	if ok {
 		_, _ = w.Write([]byte("Ambassador is ready and waiting\n"))
+	} else if err := ambwatch.EnvoyRejection(); err != nil {
+		http.Error(w, fmt.Sprintf("Ambassador is not ready: %v\n", err), http.StatusServiceUnavailable)
 	} else {
 		http.Error(w, "Ambassador is not ready\n", http.StatusServiceUnavailable)
 	}
 }
 
+// handleMetrics serves diagd's metrics (which include Envoy's), followed by the metrics of the Go
+// side of Ambassador, so that everything can be scraped from the one endpoint. If diagd can't be
+// reached, the Go metrics are still served.
+func handleMetrics(w http.ResponseWriter, r *http.Request, diagdOrigin *url.URL) {
+	diagdMetrics, err := fetchDiagdMetrics(r.Context(), diagdOrigin)
+	if err != nil {
+		dlog.Debugf(r.Context(), "unable to fetch diagd metrics: %v", err)
+	}
+
+	var goMetrics bytes.Buffer
+	if err := metrics.WriteText(&goMetrics); err != nil {
+		http.Error(w, fmt.Sprintf("error gathering metrics: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if len(diagdMetrics) > 0 {
+		_, _ = w.Write(diagdMetrics)
+		if !bytes.HasSuffix(diagdMetrics, []byte("\n")) {
+			_, _ = w.Write([]byte("\n"))
+		}
+	}
+	_, _ = w.Write(goMetrics.Bytes())
+}
+
+func fetchDiagdMetrics(ctx context.Context, diagdOrigin *url.URL) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, diagdOrigin.ResolveReference(&url.URL{Path: "/metrics"}).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("diagd returned %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
 func healthCheckHandler(ctx context.Context, ambwatch *acp.AmbassadorWatcher) error {
 	dbg := debug.FromContext(ctx)
 
@@ -72,6 +120,14 @@ func healthCheckHandler(ctx context.Context, ambwatch *acp.AmbassadorWatcher) er
 	// Serve any debug info from the golang codebase.
 	sm.Handle("/debug", dbg)
 
+	// diagdOrigin is where diagd is listening.
+	diagdOrigin, _ := url.Parse("http://127.0.0.1:8004/")
+
+	// Serve metrics from diagd, Envoy, and the golang codebase.
+	sm.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		handleMetrics(w, r, diagdOrigin)
+	})
+
 	// Serve pprof endpoints to aid in live debugging.
 	sm.HandleFunc("/debug/pprof/", pprof.Index)
 	sm.HandleFunc("/debug/pprof/profile", pprof.Profile)
@@ -80,10 +136,6 @@ func healthCheckHandler(ctx context.Context, ambwatch *acp.AmbassadorWatcher) er
 	sm.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 
 	// For everything else, use a ReverseProxy to forward it to diagd.
-	//
-	// diagdOrigin is where diagd is listening.
-	diagdOrigin, _ := url.Parse("http://127.0.0.1:8004/")
-
 	// This reverseProxy is dirt simple: use a director function to
 	// swap the scheme and host of our request for the ones from the
 	// diagdOrigin. Leave everything else (notably including the path)
@@ -0,0 +1,41 @@
+package entrypoint
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleMetrics(t *testing.T) {
+	diagd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/metrics", r.URL.Path)
+		_, _ = io.WriteString(w, "# TYPE envoy_cluster_upstream_rq_total counter\nenvoy_cluster_upstream_rq_total 42")
+	}))
+	defer diagd.Close()
+
+	get := func(origin string) string {
+		diagdOrigin, err := url.Parse(origin)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil), diagdOrigin)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	// diagd's metrics come first, followed by ours.
+	body := get(diagd.URL + "/")
+	assert.True(t, strings.HasPrefix(body, "# TYPE envoy_cluster_upstream_rq_total counter\nenvoy_cluster_upstream_rq_total 42\n"), body)
+	assert.Contains(t, body, "\ngo_goroutines ")
+
+	// Without diagd we still serve our own.
+	diagd.Close()
+	body = get(diagd.URL + "/")
+	assert.NotContains(t, body, "envoy_cluster_upstream_rq_total")
+	assert.Contains(t, body, "go_goroutines ")
+}
@@ -84,6 +84,9 @@ func GetInterestingTypes(ctx context.Context, serverTypeList []kates.APIResource
 		"Endpoints":  {{typename: "endpoints.v1.", fieldselector: endpointFs}}, // New in Kubernetes 0.16.0 (2015-04-28) (v1beta{1..3} before that)
 		"K8sSecrets": {{typename: "secrets.v1."}},                              // New in Kubernetes 0.16.0 (2015-04-28) (v1beta{1..3} before that)
 		"ConfigMaps": {{typename: "configmaps.v1.", fieldselector: configMapFs}},
+		"EndpointSlices": {
+			{typename: "endpointslices.v1.discovery.k8s.io", fieldselector: endpointFs}, // New in Kubernetes 1.21.0 (2021-04-08)
+		},
 		"Ingresses": {
 			{typename: "ingresses.v1beta1.extensions"},        // New in Kubernetes 1.2.0 (2016-03-16), gone in Kubernetes 1.22.0 (2021-08-04)
 			{typename: "ingresses.v1beta1.networking.k8s.io"}, // New in Kubernetes 1.14.0 (2019-03-25), gone in Kubernetes 1.22.0 (2021-08-04)
@@ -96,16 +99,25 @@ func GetInterestingTypes(ctx context.Context, serverTypeList []kates.APIResource
 
 		// Gateway API (of which Emissary is one of the implementations)
 		"GatewayClasses": {
-			{typename: "gatewayclasses.v1alpha1.networking.x-k8s.io"}, // New in gateway-api 0.1.0 (2020-11-18)
-			//{typename: "gatewayclasses.v1alpha2.gateway.networking.k8s.io"}, // Not yet released
+			{typename: "gatewayclasses.v1.gateway.networking.k8s.io"}, // New in gateway-api 1.0.0 (2023-10-31)
 		},
 		"Gateways": {
-			{typename: "gateways.v1alpha1.networking.x-k8s.io"}, // New in gateway-api 0.1.0 (2020-11-18)
-			//{typename: "gateways.v1alpha2.gateway.networking.k8s.io"}, // Not yet released
+			{typename: "gateways.v1.gateway.networking.k8s.io"}, // New in gateway-api 1.0.0 (2023-10-31)
 		},
 		"HTTPRoutes": {
-			{typename: "httproutes.v1alpha1.networking.x-k8s.io"}, // New in gateway-api 0.1.0 (2020-11-18)
-			//{typename: "httproutes.v1alpha2.gateway.networking.k8s.io"}, // Not yet released
+			{typename: "httproutes.v1.gateway.networking.k8s.io"}, // New in gateway-api 1.0.0 (2023-10-31)
+		},
+		"GRPCRoutes": {
+			{typename: "grpcroutes.v1alpha2.gateway.networking.k8s.io"}, // New in gateway-api 0.6.0 (2022-12-20)
+		},
+		"TCPRoutes": {
+			{typename: "tcproutes.v1alpha2.gateway.networking.k8s.io"}, // New in gateway-api 0.3.0 (2021-04-29)
+		},
+		"TLSRoutes": {
+			{typename: "tlsroutes.v1alpha2.gateway.networking.k8s.io"}, // New in gateway-api 0.3.0 (2021-04-29)
+		},
+		"ReferenceGrants": {
+			{typename: "referencegrants.v1beta1.gateway.networking.k8s.io"}, // New in gateway-api 0.6.0 (2022-12-20)
 		},
 
 		// Knative types
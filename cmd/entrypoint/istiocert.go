@@ -8,6 +8,8 @@ import (
 	"path"
 	"time"
 
+	consulapi "github.com/hashicorp/consul/api"
+
 	"github.com/datawire/dlib/dlog"
 	"github.com/emissary-ingress/emissary/v3/pkg/kates"
 	"github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
@@ -83,6 +85,21 @@ func (src *istioCertSource) Watch(ctx context.Context) (IstioCertWatcher, error)
 		}
 	}
 
+	// Consul Connect certificates come from Consul rather than the filesystem, but they end up
+	// as Secrets in exactly the same way, so they use the same update channel.
+	if service := GetConsulConnectService(); service != "" {
+		// The Consul client picks up its address, token, and TLS settings from the usual
+		// CONSUL_HTTP_* environment variables.
+		consul, err := consulapi.NewClient(consulapi.DefaultConfig())
+		if err != nil {
+			return nil, err
+		}
+		ccert := NewConsulConnectCert(GetConsulConnectSecretName(), GetAmbassadorNamespace(), istioCertUpdateChannel)
+		if err := ccert.Watch(ctx, consul, service); err != nil {
+			return nil, err
+		}
+	}
+
 	return &istioCertWatcher{
 		updateChannel: istioCertUpdateChannel,
 	}, nil
@@ -2,9 +2,7 @@ package entrypoint
 
 import (
 	"context"
-	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
 	"os"
 	"strconv"
@@ -12,9 +10,9 @@ import (
 
 	v1 "k8s.io/api/core/v1"
 
-	"github.com/datawire/dlib/derror"
 	"github.com/datawire/dlib/dlog"
 	amb "github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io/v3alpha1"
+	"github.com/emissary-ingress/emissary/v3/pkg/emissaryutil"
 	"github.com/emissary-ingress/emissary/v3/pkg/kates"
 	"github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
 	snapshotTypes "github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
@@ -39,72 +37,9 @@ func checkSecret(
 		return
 	}
 
-	// Assume that the secret is valid...
-	isValid := true
-
-	// ...and that we have no errors.
-	var errs derror.MultiError
-
-	// OK, do we have a TLS private key?
-	privKeyPEMBytes, ok := secret.Data[v1.TLSPrivateKeyKey]
-
-	if ok && len(privKeyPEMBytes) > 0 {
-		// Yes. We need to be able to decode it.
-		caKeyBlock, _ := pem.Decode(privKeyPEMBytes)
-
-		if caKeyBlock != nil {
-			dlog.Debugf(ctx, "%s has private key, block type %s", secretName, caKeyBlock.Type)
-
-			// First try PKCS1.
-			_, err := x509.ParsePKCS1PrivateKey(caKeyBlock.Bytes)
-
-			if err != nil {
-				// Try PKCS8? (No, = instead of := is not a typo here: we're overwriting the
-				// earlier error.)
-				_, err = x509.ParsePKCS8PrivateKey(caKeyBlock.Bytes)
-			}
-
-			if err != nil {
-				// Try EC? (No, = instead of := is not a typo here: we're overwriting the
-				// earlier error.)
-				_, err = x509.ParseECPrivateKey(caKeyBlock.Bytes)
-			}
-
-			// Any issues here?
-			if err != nil {
-				errs = append(errs,
-					fmt.Errorf("%s %s cannot be parsed as PKCS1, PKCS8, or EC: %s", secretName, v1.TLSPrivateKeyKey, err.Error()))
-				isValid = false
-			}
-		} else {
-			errs = append(errs,
-				fmt.Errorf("%s %s is not a PEM-encoded key", secretName, v1.TLSPrivateKeyKey))
-			isValid = false
-		}
-	}
-
-	// How about a TLS cert bundle?
-	caCertPEMBytes, ok := secret.Data[v1.TLSCertKey]
-
-	if ok && len(caCertPEMBytes) > 0 {
-		caCertBlock, _ := pem.Decode(caCertPEMBytes)
-
-		if caCertBlock != nil {
-			dlog.Debugf(ctx, "%s has public key, block type %s", secretName, caCertBlock.Type)
-
-			_, err := x509.ParseCertificate(caCertBlock.Bytes)
-
-			if err != nil {
-				errs = append(errs,
-					fmt.Errorf("%s %s cannot be parsed as x.509: %s", secretName, v1.TLSCertKey, err.Error()))
-				isValid = false
-			}
-		} else {
-			errs = append(errs,
-				fmt.Errorf("%s %s is not a PEM-encoded certificate", secretName, v1.TLSCertKey))
-			isValid = false
-		}
-	}
+	// Check that whatever key and certificate the secret has can actually be parsed.
+	errs := emissaryutil.ValidateTLSSecret(ctx, secretName, secret)
+	isValid := len(errs) == 0
 
 	if isValid || !forceSecretValidation {
 		dlog.Debugf(ctx, "taking %s", secretName)
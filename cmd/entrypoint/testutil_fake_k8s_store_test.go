@@ -211,6 +211,8 @@ func canonGVK(rawString string) (canonKind string, canonGroupVersion string, err
 		return "Service", "v1", nil
 	case "endpoints":
 		return "Endpoints", "v1", nil
+	case "endpointslice", "endpointslices":
+		return "EndpointSlice", "discovery.k8s.io/v1", nil
 	case "secret", "secrets":
 		return "Secret", "v1", nil
 	case "configmap", "configmaps":
@@ -224,11 +226,19 @@ func canonGVK(rawString string) (canonKind string, canonGroupVersion string, err
 		return "IngressClass", "networking.k8s.io/v1", nil
 	// Gateway API
 	case "gatewayclass", "gatewayclasses":
-		return "GatewayClass", "networking.x-k8s.io/v1alpha1", nil
+		return "GatewayClass", "gateway.networking.k8s.io/v1", nil
 	case "gateway", "gateways":
-		return "Gateway", "networking.x-k8s.io/v1alpha1", nil
+		return "Gateway", "gateway.networking.k8s.io/v1", nil
 	case "httproute", "httproutes":
-		return "HTTPRoute", "networking.x-k8s.io/v1alpha1", nil
+		return "HTTPRoute", "gateway.networking.k8s.io/v1", nil
+	case "grpcroute", "grpcroutes":
+		return "GRPCRoute", "gateway.networking.k8s.io/v1alpha2", nil
+	case "tcproute", "tcproutes":
+		return "TCPRoute", "gateway.networking.k8s.io/v1alpha2", nil
+	case "tlsroute", "tlsroutes":
+		return "TLSRoute", "gateway.networking.k8s.io/v1alpha2", nil
+	case "referencegrant", "referencegrants":
+		return "ReferenceGrant", "gateway.networking.k8s.io/v1beta1", nil
 	// Knative types
 	case "clusteringress", "clusteringresses":
 		return "ClusterIngress", "networking.internal.knative.dev/v1alpha1", nil
@@ -288,10 +288,14 @@ func (f *Fake) runWatcher(ctx context.Context) error {
 		f.istioCertSource,
 		f.notifySnapshot,
 		f.notifyFastpath,
+		f.notifyStatus,
 		f.ambassadorMeta,
 	)
 }
 
+// notifyStatus discards Gateway API status updates; the fake has no cluster to write them to.
+func (f *Fake) notifyStatus(ctx context.Context, objs []kates.Object, deleted []string) {}
+
 func (f *Fake) notifyFastpath(ctx context.Context, fastpath *ambex.FastpathSnapshot) {
 	f.fastpath.Add(f.T, fastpath)
 }
@@ -603,13 +607,16 @@ type fakeWatcher struct {
 	store *ConsulStore
 }
 
-func (f *fakeWatcher) Watch(ctx context.Context, resolver *amb.ConsulResolver, svc string, endpoints chan consulwatch.Endpoints) (Stopper, error) {
-	var sent consulwatch.Endpoints
+func (f *fakeWatcher) Watch(ctx context.Context, resolver *amb.ConsulResolver, _ consulCredentials, svc string, endpoints chan consulwatch.Endpoints) (Stopper, error) {
+	failover := newConsulFailover(resolver, svc)
+	sent := make([]consulwatch.Endpoints, len(consulDatacenters(resolver)))
 	stop := f.fake.consulNotifier.Listen(func() {
-		ep, ok := f.store.Get(resolver.Spec.Datacenter, svc)
-		if ok && !reflect.DeepEqual(ep, sent) {
-			endpoints <- ep
-			sent = ep
+		for priority, datacenter := range consulDatacenters(resolver) {
+			ep, ok := f.store.Get(datacenter, svc)
+			if ok && !reflect.DeepEqual(ep, sent[priority]) {
+				failover.update(priority, ep, endpoints)
+				sent[priority] = ep
+			}
 		}
 	})
 	return &fakeStopper{stop}, nil
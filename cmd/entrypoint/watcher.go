@@ -10,7 +10,8 @@ import (
 	"sync/atomic"
 	"time"
 
-	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
+	gw "sigs.k8s.io/gateway-api/apis/v1"
+	gwv1a2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
 
 	"github.com/datawire/dlib/dgroup"
 	"github.com/datawire/dlib/dlog"
@@ -71,21 +72,34 @@ func WatchAllTheThings(
 		fastpathCh <- fastpathSnapshot
 	}
 
+	statusWriter, err := newGatewayStatusWriter(ctx, client)
+	if err != nil {
+		return err
+	}
+
 	k8sSrc := newK8sSource(client)
 	consulSrc := watchConsul
 	istioCertSrc := newIstioCertSource()
 
-	return watchAllTheThingsInternal(
-		ctx,
-		encoded,
-		k8sSrc,
-		queries,
-		consulSrc, // watchConsulFunc
-		istioCertSrc,
-		notify,         // snapshotProcessor
-		fastpathUpdate, // fastpathProcessor
-		ambassadorMeta,
-	)
+	grp := dgroup.NewGroup(ctx, dgroup.GroupConfig{
+		ShutdownOnNonError: true,
+	})
+	grp.Go("gateway-status", statusWriter.Run)
+	grp.Go("watcher", func(ctx context.Context) error {
+		return watchAllTheThingsInternal(
+			ctx,
+			encoded,
+			k8sSrc,
+			queries,
+			consulSrc, // watchConsulFunc
+			istioCertSrc,
+			notify,              // snapshotProcessor
+			fastpathUpdate,      // fastpathProcessor
+			statusWriter.Update, // statusProcessor
+			ambassadorMeta,
+		)
+	})
+	return grp.Wait()
 }
 
 func getAmbassadorMeta(ambassadorID string, clusterID string, version string, client *kates.Client) *snapshot.AmbassadorMetaInfo {
@@ -189,6 +203,7 @@ func watchAllTheThingsInternal(
 	istioCertSrc IstioCertSource,
 	snapshotProcessor SnapshotProcessor,
 	fastpathProcessor FastpathProcessor,
+	statusProcessor StatusProcessor,
 	ambassadorMeta *snapshot.AmbassadorMetaInfo,
 ) error {
 	// Ambassador has three sources of inputs: kubernetes, consul, and the filesystem. The job
@@ -275,7 +290,7 @@ func watchAllTheThingsInternal(
 			select {
 			case <-k8sWatcher.Changed():
 				// Kubernetes has some changes, so we need to handle them.
-				changed, err := snapshots.K8sUpdate(ctx, k8sWatcher, consulWatcher, fastpathProcessor)
+				changed, err := snapshots.K8sUpdate(ctx, k8sWatcher, consulWatcher, fastpathProcessor, statusProcessor)
 				if err != nil {
 					return err
 				}
@@ -345,18 +360,49 @@ type SnapshotHolder struct {
 
 func NewSnapshotHolder(ambassadorMeta *snapshot.AmbassadorMetaInfo) (*SnapshotHolder, error) {
 	disp := gateway.NewDispatcher()
-	err := disp.Register("Gateway", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
-		return gateway.Compile_Gateway(untyped.(*gw.Gateway))
+	err := disp.Register("GatewayClass", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_GatewayClass(untyped.(*gw.GatewayClass))
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = disp.RegisterWithQuery("Gateway", func(untyped kates.Object, q *gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_Gateway(untyped.(*gw.Gateway), q)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = disp.RegisterWithQuery("HTTPRoute", func(untyped kates.Object, q *gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_HTTPRoute(untyped.(*gw.HTTPRoute), q)
 	})
 	if err != nil {
 		return nil, err
 	}
-	err = disp.Register("HTTPRoute", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
-		return gateway.Compile_HTTPRoute(untyped.(*gw.HTTPRoute))
+	err = disp.RegisterWithQuery("GRPCRoute", func(untyped kates.Object, q *gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_GRPCRoute(untyped.(*gwv1a2.GRPCRoute), q)
 	})
 	if err != nil {
 		return nil, err
 	}
+	err = disp.RegisterWithQuery("TCPRoute", func(untyped kates.Object, q *gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_TCPRoute(untyped.(*gwv1a2.TCPRoute), q)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = disp.RegisterWithQuery("TLSRoute", func(untyped kates.Object, q *gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_TLSRoute(untyped.(*gwv1a2.TLSRoute), q)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// These kinds don't produce any configuration themselves, but the transforms above look them
+	// up.
+	for _, kind := range []string{"Service", "Secret", "ReferenceGrant"} {
+		if err := disp.RegisterDependency(kind); err != nil {
+			return nil, err
+		}
+	}
 	validator, err := newResourceValidator()
 	if err != nil {
 		return nil, err
@@ -378,6 +424,7 @@ func (sh *SnapshotHolder) K8sUpdate(
 	watcher K8sWatcher,
 	consulWatcher *consulWatcher,
 	fastpathProcessor FastpathProcessor,
+	statusProcessor StatusProcessor,
 ) (bool, error) {
 	dbg := debug.FromContext(ctx)
 
@@ -390,6 +437,8 @@ func (sh *SnapshotHolder) K8sUpdate(
 	dispatcherChanged := false
 	var endpoints *ambex.Endpoints
 	var dispSnapshot *ecp_v3_cache.Snapshot
+	var statuses []kates.Object
+	var deleted []string
 	changed, err := func() (bool, error) {
 		dlog.Debugf(ctx, "[WATCHER]: processing cluster changes detected by the kubernetes watcher")
 		sh.mutex.Lock()
@@ -472,6 +521,7 @@ func (sh *SnapshotHolder) K8sUpdate(
 		}
 
 		endpointsOnly := true
+		var sliceServices map[string]string
 		for _, delta := range deltas {
 			sh.unsentDeltas = append(sh.unsentDeltas, delta)
 
@@ -480,14 +530,29 @@ func (sh *SnapshotHolder) K8sUpdate(
 				if sh.endpointRoutingInfo.endpointWatches[key] || sh.dispatcher.IsWatched(delta.Namespace, delta.Name) {
 					endpointsChanged = true
 				}
+			} else if delta.Kind == "EndpointSlice" {
+				// EndpointSlices are named after their Service plus a random suffix, so we have
+				// to find the slice to know which Service it belongs to. If it's gone, we can't
+				// tell, so assume it mattered.
+				if sliceServices == nil {
+					sliceServices = sh.endpointSliceServices()
+				}
+				svcName, found := sliceServices[fmt.Sprintf("%s:%s", delta.Namespace, delta.Name)]
+				key := fmt.Sprintf("%s:%s", delta.Namespace, svcName)
+				if !found || sh.endpointRoutingInfo.endpointWatches[key] || sh.dispatcher.IsWatched(delta.Namespace, svcName) {
+					endpointsChanged = true
+				}
 			} else {
 				endpointsOnly = false
 			}
 
 			if sh.dispatcher.IsRegistered(delta.Kind) {
-				dispatcherChanged = true
+				if sh.dispatcher.IsRelevant(delta.Kind, delta.Namespace, delta.Name) {
+					dispatcherChanged = true
+				}
 				if delta.DeltaType == kates.ObjectDelete {
-					sh.dispatcher.DeleteKey(delta.Kind, delta.Namespace, delta.Name)
+					sh.dispatcher.DeleteKey(ctx, delta.Kind, delta.Namespace, delta.Name)
+					deleted = append(deleted, statusKeyFromParts(delta.Kind, delta.Namespace, delta.Name))
 				}
 			}
 		}
@@ -497,21 +562,77 @@ func (sh *SnapshotHolder) K8sUpdate(
 
 		if endpointsChanged || dispatcherChanged {
 			endpoints = makeEndpoints(ctx, sh.k8sSnapshot, sh.consulSnapshot.Endpoints)
+			// Upserting a resource that hasn't changed is a no-op, so only the resources that
+			// changed, and the resources that depend on them, actually get recompiled.
+			// ReferenceGrants go first, since they decide which other resources the Gateway API
+			// resources may refer to.
+			for _, grant := range sh.k8sSnapshot.ReferenceGrants {
+				if err := sh.dispatcher.Upsert(ctx, grant); err != nil {
+					// TODO: Should this be more severe?
+					dlog.Error(ctx, err)
+				}
+			}
+			// Only Gateways whose GatewayClass names our controller belong to us.
+			ourClasses := map[string]bool{}
 			for _, gwc := range sh.k8sSnapshot.GatewayClasses {
-				if err := sh.dispatcher.Upsert(gwc); err != nil {
+				if err := sh.dispatcher.Upsert(ctx, gwc); err != nil {
 					// TODO: Should this be more severe?
 					dlog.Error(ctx, err)
 				}
+				if gwc.Spec.ControllerName == gateway.ControllerName {
+					ourClasses[gwc.Name] = true
+				}
 			}
-			for _, gw := range sh.k8sSnapshot.Gateways {
-				if err := sh.dispatcher.Upsert(gw); err != nil {
+			for _, gtw := range sh.k8sSnapshot.Gateways {
+				if !ourClasses[string(gtw.Spec.GatewayClassName)] {
+					sh.dispatcher.DeleteKey(ctx, "Gateway", gtw.Namespace, gtw.Name)
+					continue
+				}
+				if err := sh.dispatcher.Upsert(ctx, gtw); err != nil {
 					// TODO: Should this be more severe?
 					dlog.Error(ctx, err)
 				}
-
 			}
 			for _, hr := range sh.k8sSnapshot.HTTPRoutes {
-				if err := sh.dispatcher.Upsert(hr); err != nil {
+				if err := sh.dispatcher.Upsert(ctx, hr); err != nil {
+					// TODO: Should this be more severe?
+					dlog.Error(ctx, err)
+				}
+			}
+			for _, gr := range sh.k8sSnapshot.GRPCRoutes {
+				if err := sh.dispatcher.Upsert(ctx, gr); err != nil {
+					// TODO: Should this be more severe?
+					dlog.Error(ctx, err)
+				}
+			}
+			for _, tr := range sh.k8sSnapshot.TCPRoutes {
+				if err := sh.dispatcher.Upsert(ctx, tr); err != nil {
+					// TODO: Should this be more severe?
+					dlog.Error(ctx, err)
+				}
+			}
+			for _, tr := range sh.k8sSnapshot.TLSRoutes {
+				if err := sh.dispatcher.Upsert(ctx, tr); err != nil {
+					// TODO: Should this be more severe?
+					dlog.Error(ctx, err)
+				}
+			}
+			// Services and Secrets go last, and only the ones that the Gateway API resources
+			// refer to, so that the dispatcher doesn't hold a copy of every one in the cluster.
+			var dependencies []kates.Object
+			for _, svc := range sh.k8sSnapshot.Services {
+				dependencies = append(dependencies, svc)
+			}
+			for _, secret := range sh.k8sSnapshot.K8sSecrets {
+				dependencies = append(dependencies, secret)
+			}
+			for _, obj := range dependencies {
+				kind := obj.GetObjectKind().GroupVersionKind().Kind
+				if !sh.dispatcher.IsRelevant(kind, obj.GetNamespace(), obj.GetName()) {
+					sh.dispatcher.DeleteKey(ctx, kind, obj.GetNamespace(), obj.GetName())
+					continue
+				}
+				if err := sh.dispatcher.Upsert(ctx, obj); err != nil {
 					// TODO: Should this be more severe?
 					dlog.Error(ctx, err)
 				}
@@ -523,6 +644,7 @@ func (sh *SnapshotHolder) K8sUpdate(
 				dlog.Error(ctx, err)
 				return false, err
 			}
+			statuses = sh.dispatcher.GetStatuses(ctx)
 		}
 		return true, nil
 	}()
@@ -538,9 +660,22 @@ func (sh *SnapshotHolder) K8sUpdate(
 		}
 		fastpathProcessor(ctx, fastpath)
 	}
+	if len(statuses) > 0 || len(deleted) > 0 {
+		statusProcessor(ctx, statuses, deleted)
+	}
 	return changed, nil
 }
 
+// endpointSliceServices maps "namespace:name" of each EndpointSlice in the snapshot to the name of
+// the Service that it belongs to. The caller must hold sh.mutex.
+func (sh *SnapshotHolder) endpointSliceServices() map[string]string {
+	result := make(map[string]string, len(sh.k8sSnapshot.EndpointSlices))
+	for _, slice := range sh.k8sSnapshot.EndpointSlices {
+		result[key(slice)] = slice.GetLabels()[kates.LabelServiceName]
+	}
+	return result
+}
+
 func (sh *SnapshotHolder) ConsulUpdate(ctx context.Context, consulWatcher *consulWatcher, fastpathProcessor FastpathProcessor) bool {
 	var endpoints *ambex.Endpoints
 	var dispSnapshot *ecp_v3_cache.Snapshot
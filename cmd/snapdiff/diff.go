@@ -0,0 +1,455 @@
+package snapdiff
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// unset is how we show a field that is only present on one side of a change.
+const unset = "(unset)"
+
+// A fieldDiff is a single field that differs between two versions of a resource.
+type fieldDiff struct {
+	path     string
+	old, new string
+}
+
+// writeDiff writes out every resource that was added, removed or changed between two snapshots,
+// along with the fields that changed.
+func writeDiff(w io.Writer, oldSnap, newSnap *snapshot) {
+	header := func(prefix string, snap *snapshot) {
+		if snap.version != "" {
+			fmt.Fprintf(w, "%s %s (%s)\n", prefix, snap.path, snap.version)
+		} else {
+			fmt.Fprintf(w, "%s %s\n", prefix, snap.path)
+		}
+	}
+	header("---", oldSnap)
+	header("+++", newSnap)
+
+	sections := map[string]interface{}{}
+	for section := range oldSnap.sections {
+		sections[section] = nil
+	}
+	for section := range newSnap.sections {
+		sections[section] = nil
+	}
+
+	changed := false
+	for _, section := range sortedKeys(sections) {
+		oldItems := oldSnap.sections[section]
+		newItems := newSnap.sections[section]
+
+		names := map[string]interface{}{}
+		for name := range oldItems {
+			names[name] = nil
+		}
+		for name := range newItems {
+			names[name] = nil
+		}
+
+		var lines []string
+		for _, name := range sortedKeys(names) {
+			oldItem, inOld := oldItems[name]
+			newItem, inNew := newItems[name]
+			switch {
+			case !inOld:
+				lines = append(lines, "  + "+name)
+			case !inNew:
+				lines = append(lines, "  - "+name)
+			default:
+				diffs := diffResources(oldItem, newItem)
+				if len(diffs) == 0 {
+					continue
+				}
+				lines = append(lines, "  ~ "+name)
+				for _, d := range diffs {
+					lines = append(lines, fmt.Sprintf("      %s: %s -> %s", d.path, d.old, d.new))
+				}
+			}
+		}
+
+		if len(lines) > 0 {
+			changed = true
+			fmt.Fprintf(w, "%s:\n%s\n", section, strings.Join(lines, "\n"))
+		}
+	}
+
+	if !changed {
+		fmt.Fprintln(w, "no changes")
+	}
+}
+
+// diffResources compares two versions of a resource. If they are both protobuf messages, the
+// comparison follows the message structure, otherwise it's a comparison of the plain JSON.
+func diffResources(oldItem, newItem interface{}) []fieldDiff {
+	var diffs []fieldDiff
+	oldMsg, oldIsProto := oldItem.(proto.Message)
+	newMsg, newIsProto := newItem.(proto.Message)
+	switch {
+	case oldIsProto && newIsProto:
+		diffMessages("", oldMsg.ProtoReflect(), newMsg.ProtoReflect(), &diffs)
+	case oldIsProto || newIsProto:
+		diffJSON("", toJSON(oldItem), toJSON(newItem), &diffs)
+	default:
+		diffJSON("", oldItem, newItem, &diffs)
+	}
+	return diffs
+}
+
+// toJSON turns a resource into plain JSON, for comparing a protobuf message with a resource
+// that we couldn't decode as one.
+func toJSON(item interface{}) interface{} {
+	msg, ok := item.(proto.Message)
+	if !ok {
+		return item
+	}
+	bs, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(msg)
+	if err != nil {
+		return item
+	}
+	var result interface{}
+	if err := json.Unmarshal(bs, &result); err != nil {
+		return item
+	}
+	return result
+}
+
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+func diffMessages(path string, oldMsg, newMsg protoreflect.Message, diffs *[]fieldDiff) {
+	if oldMsg.Descriptor().FullName() != newMsg.Descriptor().FullName() {
+		*diffs = append(*diffs, fieldDiff{path, formatMessage(oldMsg), formatMessage(newMsg)})
+		return
+	}
+
+	// For an Any, compare whatever it holds, if we know the type.
+	if oldAny, ok := oldMsg.Interface().(*anypb.Any); ok {
+		newAny := newMsg.Interface().(*anypb.Any)
+		oldInner, oldErr := oldAny.UnmarshalNew()
+		newInner, newErr := newAny.UnmarshalNew()
+		if oldErr == nil && newErr == nil {
+			diffMessages(path, oldInner.ProtoReflect(), newInner.ProtoReflect(), diffs)
+			return
+		}
+	}
+
+	fields := oldMsg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		oldHas, newHas := oldMsg.Has(fd), newMsg.Has(fd)
+		if !oldHas && !newHas {
+			continue
+		}
+		fieldPath := joinPath(path, fd.TextName())
+		oldVal, newVal := oldMsg.Get(fd), newMsg.Get(fd)
+
+		switch {
+		case fd.IsList():
+			diffLists(fieldPath, fd, oldVal.List(), newVal.List(), diffs)
+		case fd.IsMap():
+			diffMaps(fieldPath, fd, oldVal.Map(), newVal.Map(), diffs)
+		case fd.Message() != nil:
+			switch {
+			case !oldHas:
+				*diffs = append(*diffs, fieldDiff{fieldPath, unset, formatMessage(newVal.Message())})
+			case !newHas:
+				*diffs = append(*diffs, fieldDiff{fieldPath, formatMessage(oldVal.Message()), unset})
+			default:
+				diffMessages(fieldPath, oldVal.Message(), newVal.Message(), diffs)
+			}
+		default:
+			if !oldVal.Equal(newVal) {
+				*diffs = append(*diffs, fieldDiff{fieldPath, formatScalar(fd, oldVal), formatScalar(fd, newVal)})
+			}
+		}
+	}
+}
+
+// diffLists compares repeated fields. Lists of messages that all have distinct names (e.g.
+// filter_chains, virtual_hosts) are matched up by name, so that inserting an element doesn't
+// show up as a change to every element after it. Other lists of messages are compared element
+// by element, and lists of scalars are compared as a whole.
+func diffLists(path string, fd protoreflect.FieldDescriptor, oldList, newList protoreflect.List, diffs *[]fieldDiff) {
+	if fd.Message() == nil {
+		if !listsEqual(oldList, newList) {
+			*diffs = append(*diffs, fieldDiff{path, formatList(fd, oldList), formatList(fd, newList)})
+		}
+		return
+	}
+
+	oldNames, oldNamed := listNames(oldList)
+	newNames, newNamed := listNames(newList)
+	if oldNamed && newNamed {
+		names := map[string]interface{}{}
+		for name := range oldNames {
+			names[name] = nil
+		}
+		for name := range newNames {
+			names[name] = nil
+		}
+		for _, name := range sortedKeys(names) {
+			elemPath := fmt.Sprintf("%s[name=%s]", path, name)
+			oldElem, inOld := oldNames[name]
+			newElem, inNew := newNames[name]
+			switch {
+			case !inOld:
+				*diffs = append(*diffs, fieldDiff{elemPath, unset, formatMessage(newElem)})
+			case !inNew:
+				*diffs = append(*diffs, fieldDiff{elemPath, formatMessage(oldElem), unset})
+			default:
+				diffMessages(elemPath, oldElem, newElem, diffs)
+			}
+		}
+		return
+	}
+
+	for i := 0; i < oldList.Len() || i < newList.Len(); i++ {
+		elemPath := fmt.Sprintf("%s[%d]", path, i)
+		switch {
+		case i >= oldList.Len():
+			*diffs = append(*diffs, fieldDiff{elemPath, unset, formatMessage(newList.Get(i).Message())})
+		case i >= newList.Len():
+			*diffs = append(*diffs, fieldDiff{elemPath, formatMessage(oldList.Get(i).Message()), unset})
+		default:
+			diffMessages(elemPath, oldList.Get(i).Message(), newList.Get(i).Message(), diffs)
+		}
+	}
+}
+
+// listNames indexes a list of messages by their "name" field. It returns false if the messages
+// don't have a name field, or if the names are empty or not unique.
+func listNames(list protoreflect.List) (map[string]protoreflect.Message, bool) {
+	result := map[string]protoreflect.Message{}
+	for i := 0; i < list.Len(); i++ {
+		msg := list.Get(i).Message()
+		fd := msg.Descriptor().Fields().ByName("name")
+		if fd == nil || fd.Kind() != protoreflect.StringKind || fd.IsList() {
+			return nil, false
+		}
+		name := msg.Get(fd).String()
+		if _, dup := result[name]; dup || name == "" {
+			return nil, false
+		}
+		result[name] = msg
+	}
+	return result, true
+}
+
+func listsEqual(a, b protoreflect.List) bool {
+	if a.Len() != b.Len() {
+		return false
+	}
+	for i := 0; i < a.Len(); i++ {
+		if !a.Get(i).Equal(b.Get(i)) {
+			return false
+		}
+	}
+	return true
+}
+
+func diffMaps(path string, fd protoreflect.FieldDescriptor, oldMap, newMap protoreflect.Map, diffs *[]fieldDiff) {
+	keys := map[string]protoreflect.MapKey{}
+	collect := func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+		keys[k.String()] = k
+		return true
+	}
+	oldMap.Range(collect)
+	newMap.Range(collect)
+
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	valueFd := fd.MapValue()
+	format := func(v protoreflect.Value) string {
+		if valueFd.Message() != nil {
+			return formatMessage(v.Message())
+		}
+		return formatScalar(valueFd, v)
+	}
+
+	for _, k := range sorted {
+		key := keys[k]
+		elemPath := fmt.Sprintf("%s[%s]", path, k)
+		oldHas, newHas := oldMap.Has(key), newMap.Has(key)
+		switch {
+		case !oldHas:
+			*diffs = append(*diffs, fieldDiff{elemPath, unset, format(newMap.Get(key))})
+		case !newHas:
+			*diffs = append(*diffs, fieldDiff{elemPath, format(oldMap.Get(key)), unset})
+		case valueFd.Message() != nil:
+			diffMessages(elemPath, oldMap.Get(key).Message(), newMap.Get(key).Message(), diffs)
+		case !oldMap.Get(key).Equal(newMap.Get(key)):
+			*diffs = append(*diffs, fieldDiff{elemPath, format(oldMap.Get(key)), format(newMap.Get(key))})
+		}
+	}
+}
+
+func formatMessage(msg protoreflect.Message) string {
+	bs, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(msg.Interface())
+	if err != nil {
+		return fmt.Sprintf("%v", msg.Interface())
+	}
+	// protojson deliberately randomizes its whitespace, so compact it to make it stable.
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, bs); err != nil {
+		return string(bs)
+	}
+	return compact.String()
+}
+
+func formatScalar(fd protoreflect.FieldDescriptor, v protoreflect.Value) string {
+	switch fd.Kind() {
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return fmt.Sprintf("%d", v.Enum())
+	case protoreflect.StringKind:
+		return fmt.Sprintf("%q", v.String())
+	case protoreflect.BytesKind:
+		return fmt.Sprintf("%q", v.Bytes())
+	default:
+		return fmt.Sprintf("%v", v.Interface())
+	}
+}
+
+func formatList(fd protoreflect.FieldDescriptor, list protoreflect.List) string {
+	items := make([]string, list.Len())
+	for i := range items {
+		items[i] = formatScalar(fd, list.Get(i))
+	}
+	return "[" + strings.Join(items, ", ") + "]"
+}
+
+// diffJSON compares two plain JSON values, with the same rules for lists as diffLists, except that
+// Kubernetes resources are matched up by their metadata.name.
+func diffJSON(path string, oldVal, newVal interface{}, diffs *[]fieldDiff) {
+	oldObj, oldIsObj := oldVal.(map[string]interface{})
+	newObj, newIsObj := newVal.(map[string]interface{})
+	if oldIsObj && newIsObj {
+		keys := map[string]interface{}{}
+		for k := range oldObj {
+			keys[k] = nil
+		}
+		for k := range newObj {
+			keys[k] = nil
+		}
+		for _, k := range sortedKeys(keys) {
+			fieldPath := joinPath(path, k)
+			o, inOld := oldObj[k]
+			n, inNew := newObj[k]
+			switch {
+			case !inOld:
+				*diffs = append(*diffs, fieldDiff{fieldPath, unset, formatJSON(n)})
+			case !inNew:
+				*diffs = append(*diffs, fieldDiff{fieldPath, formatJSON(o), unset})
+			default:
+				diffJSON(fieldPath, o, n, diffs)
+			}
+		}
+		return
+	}
+
+	oldArr, oldIsArr := oldVal.([]interface{})
+	newArr, newIsArr := newVal.([]interface{})
+	if oldIsArr && newIsArr && (containsObjects(oldArr) || containsObjects(newArr)) {
+		oldNames, oldNamed := jsonNames(oldArr)
+		newNames, newNamed := jsonNames(newArr)
+		if oldNamed && newNamed {
+			names := map[string]interface{}{}
+			for name := range oldNames {
+				names[name] = nil
+			}
+			for name := range newNames {
+				names[name] = nil
+			}
+			for _, name := range sortedKeys(names) {
+				elemPath := fmt.Sprintf("%s[name=%s]", path, name)
+				o, inOld := oldNames[name]
+				n, inNew := newNames[name]
+				switch {
+				case !inOld:
+					*diffs = append(*diffs, fieldDiff{elemPath, unset, formatJSON(n)})
+				case !inNew:
+					*diffs = append(*diffs, fieldDiff{elemPath, formatJSON(o), unset})
+				default:
+					diffJSON(elemPath, o, n, diffs)
+				}
+			}
+			return
+		}
+		for i := 0; i < len(oldArr) || i < len(newArr); i++ {
+			elemPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(oldArr):
+				*diffs = append(*diffs, fieldDiff{elemPath, unset, formatJSON(newArr[i])})
+			case i >= len(newArr):
+				*diffs = append(*diffs, fieldDiff{elemPath, formatJSON(oldArr[i]), unset})
+			default:
+				diffJSON(elemPath, oldArr[i], newArr[i], diffs)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(oldVal, newVal) {
+		*diffs = append(*diffs, fieldDiff{path, formatJSON(oldVal), formatJSON(newVal)})
+	}
+}
+
+func containsObjects(arr []interface{}) bool {
+	for _, item := range arr {
+		if _, ok := item.(map[string]interface{}); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonNames is the plain JSON version of listNames. Objects are named by their "name" field, or
+// by their metadata.name for Kubernetes resources.
+func jsonNames(arr []interface{}) (map[string]interface{}, bool) {
+	result := map[string]interface{}{}
+	for _, item := range arr {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		name, _ := obj["name"].(string)
+		if metadata, ok := obj["metadata"].(map[string]interface{}); ok && name == "" {
+			name, _ = metadata["name"].(string)
+		}
+		if _, dup := result[name]; dup || name == "" {
+			return nil, false
+		}
+		result[name] = obj
+	}
+	return result, true
+}
+
+func formatJSON(v interface{}) string {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(bs)
+}
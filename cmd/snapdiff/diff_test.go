@@ -0,0 +1,144 @@
+package snapdiff
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	v3cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	v3listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	v3httpman "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+)
+
+// writeAmbexSnapshot writes out resources in the same format as ambex's csDump.
+func writeAmbexSnapshot(t *testing.T, version string, sections map[string][]proto.Message) string {
+	t.Helper()
+	type item struct {
+		Resource json.RawMessage
+	}
+	v3 := map[string]interface{}{}
+	for section, msgs := range sections {
+		items := map[string]item{}
+		for _, msg := range msgs {
+			bs, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(msg)
+			require.NoError(t, err)
+			name := msg.ProtoReflect().Get(msg.ProtoReflect().Descriptor().Fields().ByName("name")).String()
+			items[name] = item{Resource: bs}
+		}
+		v3[section] = map[string]interface{}{"Version": version, "Items": items}
+	}
+	bs, err := json.Marshal(map[string]interface{}{"version": version, "v3": v3})
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "ambex-"+version+".json")
+	require.NoError(t, os.WriteFile(path, bs, 0644))
+	return path
+}
+
+func testListener(t *testing.T, statPrefix string) *v3listener.Listener {
+	hcm, err := anypb.New(&v3httpman.HttpConnectionManager{StatPrefix: statPrefix})
+	require.NoError(t, err)
+	return &v3listener.Listener{
+		Name: "ambassador-listener-8080",
+		FilterChains: []*v3listener.FilterChain{{
+			Filters: []*v3listener.Filter{{
+				Name:       "envoy.filters.network.http_connection_manager",
+				ConfigType: &v3listener.Filter_TypedConfig{TypedConfig: hcm},
+			}},
+		}},
+	}
+}
+
+func runSnapdiff(t *testing.T, oldPath, newPath string) string {
+	t.Helper()
+	oldSnap, err := loadSnapshot(oldPath)
+	require.NoError(t, err)
+	newSnap, err := loadSnapshot(newPath)
+	require.NoError(t, err)
+	out := &strings.Builder{}
+	writeDiff(out, oldSnap, newSnap)
+	return out.String()
+}
+
+func TestAmbexDiff(t *testing.T) {
+	oldPath := writeAmbexSnapshot(t, "v1", map[string][]proto.Message{
+		"clusters": {
+			&v3cluster.Cluster{Name: "cluster_a", ConnectTimeout: durationpb.New(3e9)},
+			&v3cluster.Cluster{Name: "cluster_b"},
+		},
+		"listeners": {testListener(t, "ingress_http")},
+	})
+	newPath := writeAmbexSnapshot(t, "v2", map[string][]proto.Message{
+		"clusters": {
+			&v3cluster.Cluster{Name: "cluster_a", ConnectTimeout: durationpb.New(5e9), LbPolicy: v3cluster.Cluster_RING_HASH},
+			&v3cluster.Cluster{Name: "cluster_c"},
+		},
+		"listeners": {testListener(t, "ingress_https")},
+	})
+
+	assert.Equal(t, strings.Join([]string{
+		"--- " + oldPath + " (v1)",
+		"+++ " + newPath + " (v2)",
+		"clusters:",
+		"  ~ cluster_a",
+		"      connect_timeout.seconds: 3 -> 5",
+		"      lb_policy: ROUND_ROBIN -> RING_HASH",
+		"  - cluster_b",
+		"  + cluster_c",
+		"listeners:",
+		"  ~ ambassador-listener-8080",
+		`      filter_chains[0].filters[name=envoy.filters.network.http_connection_manager].typed_config.stat_prefix: "ingress_http" -> "ingress_https"`,
+		"",
+	}, "\n"), runSnapdiff(t, oldPath, newPath))
+
+	assert.Contains(t, runSnapdiff(t, oldPath, oldPath), "no changes")
+}
+
+func TestWatcherDiff(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0644))
+		return path
+	}
+	oldPath := write("snapshot-2.yaml", `{
+		"Kubernetes": {
+			"Mappings": [
+				{"kind": "Mapping", "metadata": {"name": "foo", "namespace": "default", "resourceVersion": "1"}, "spec": {"prefix": "/foo/", "service": "foo"}}
+			],
+			"service": [
+				{"kind": "Service", "metadata": {"name": "foo", "namespace": "default"}, "spec": {"ports": [{"name": "http", "port": 80}]}}
+			]
+		}
+	}`)
+	newPath := write("snapshot-1.yaml", `{
+		"Kubernetes": {
+			"Mappings": [
+				{"kind": "Mapping", "metadata": {"name": "foo", "namespace": "default", "resourceVersion": "2"}, "spec": {"prefix": "/foo/", "service": "foo:8080"}}
+			],
+			"service": [
+				{"kind": "Service", "metadata": {"name": "foo", "namespace": "default"}, "spec": {"ports": [{"name": "http", "port": 8080}]}}
+			]
+		}
+	}`)
+
+	assert.Equal(t, strings.Join([]string{
+		"--- " + oldPath,
+		"+++ " + newPath,
+		"Mappings:",
+		"  ~ Mapping default/foo",
+		`      spec.service: "foo" -> "foo:8080"`,
+		"service:",
+		"  ~ Service default/foo",
+		"      spec.ports[name=http].port: 80 -> 8080",
+		"",
+	}, "\n"), runSnapdiff(t, oldPath, newPath))
+}
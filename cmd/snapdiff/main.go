@@ -0,0 +1,211 @@
+package snapdiff
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"sigs.k8s.io/yaml"
+
+	v3cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	v3endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	v3listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	v3route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	v3runtime "github.com/envoyproxy/go-control-plane/envoy/service/runtime/v3"
+
+	// Importing ambex registers all the envoy extension types that ambex knows about, so that
+	// we can expand any typed_config in the snapshots.
+	_ "github.com/emissary-ingress/emissary/v3/pkg/ambex"
+	"github.com/emissary-ingress/emissary/v3/pkg/snapshotdir"
+)
+
+func Main(ctx context.Context, version string, args ...string) error {
+	var cmd = &cobra.Command{
+		Use:   "snapdiff <old-snapshot> <new-snapshot>",
+		Short: "show what changed between two ambex or watcher snapshots",
+		Long: "Show what changed between two ambex snapshots (ambex-#.json) or two watcher " +
+			"snapshots (snapshot-#.yaml), resource by resource.",
+		Args:          cobra.ExactArgs(2),
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		oldSnap, err := loadSnapshot(args[0])
+		if err != nil {
+			return err
+		}
+		newSnap, err := loadSnapshot(args[1])
+		if err != nil {
+			return err
+		}
+		if oldSnap.kind != newSnap.kind {
+			return fmt.Errorf("can't compare %s snapshot %s with %s snapshot %s",
+				oldSnap.kind, args[0], newSnap.kind, args[1])
+		}
+		writeDiff(cmd.OutOrStdout(), oldSnap, newSnap)
+		return nil
+	}
+
+	cmd.SetArgs(args)
+	return cmd.ExecuteContext(ctx)
+}
+
+// A snapshot is the contents of a snapshot file, broken down into sections (e.g. "clusters"),
+// each of which holds resources by name. A resource is either a proto.Message, or, where we don't
+// know the type, whatever encoding/json decoded it into.
+type snapshot struct {
+	path     string
+	kind     string // "ambex" or "watcher"
+	version  string
+	sections map[string]map[string]interface{}
+}
+
+// ambexSections are the sections of an ambex snapshot, along with the type of their resources.
+var ambexSections = map[string]func() proto.Message{
+	"endpoints": func() proto.Message { return &v3endpoint.ClusterLoadAssignment{} },
+	"clusters":  func() proto.Message { return &v3cluster.Cluster{} },
+	"routes":    func() proto.Message { return &v3route.RouteConfiguration{} },
+	"listeners": func() proto.Message { return &v3listener.Listener{} },
+	"runtimes":  func() proto.Message { return &v3runtime.Runtime{} },
+}
+
+func loadSnapshot(path string) (*snapshot, error) {
+	// This takes care of compressed snapshots, and snapshots stored as deltas.
+	contents, err := snapshotdir.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(contents, &top); err != nil {
+		// Watcher snapshots are JSON, but they get a .yaml name, so maybe someone converted it.
+		if contents, err = yaml.YAMLToJSON(contents); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := json.Unmarshal(contents, &top); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	snap := &snapshot{path: path, sections: map[string]map[string]interface{}{}}
+	switch {
+	case top["v3"] != nil:
+		snap.kind = "ambex"
+		err = loadAmbexSnapshot(snap, top)
+	case top["Kubernetes"] != nil:
+		snap.kind = "watcher"
+		err = loadWatcherSnapshot(snap, top)
+	default:
+		err = fmt.Errorf("not an ambex or watcher snapshot")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return snap, nil
+}
+
+func loadAmbexSnapshot(snap *snapshot, top map[string]json.RawMessage) error {
+	_ = json.Unmarshal(top["version"], &snap.version)
+
+	var v3 map[string]struct {
+		Items map[string]struct {
+			Resource json.RawMessage
+		}
+	}
+	if err := json.Unmarshal(top["v3"], &v3); err != nil {
+		return err
+	}
+
+	for section, resources := range v3 {
+		items := map[string]interface{}{}
+		for name, item := range resources.Items {
+			if newMessage, ok := ambexSections[section]; ok {
+				msg := newMessage()
+				err := protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(item.Resource, msg)
+				if err == nil {
+					items[name] = msg
+					continue
+				}
+				// Snapshots written by older versions of ambex aren't protojson, so fall
+				// back to comparing them as plain JSON.
+			}
+			var value interface{}
+			if err := json.Unmarshal(item.Resource, &value); err != nil {
+				return fmt.Errorf("%s %s: %w", section, name, err)
+			}
+			items[name] = value
+		}
+		snap.sections[section] = items
+	}
+	return nil
+}
+
+func loadWatcherSnapshot(snap *snapshot, top map[string]json.RawMessage) error {
+	var kubernetes map[string]json.RawMessage
+	if err := json.Unmarshal(top["Kubernetes"], &kubernetes); err != nil {
+		return err
+	}
+	for field, raw := range kubernetes {
+		var objs []map[string]interface{}
+		if err := json.Unmarshal(raw, &objs); err != nil {
+			// Not a list of resources.
+			continue
+		}
+		snap.sections[field] = watcherObjects(objs)
+	}
+
+	var invalid []map[string]interface{}
+	if err := json.Unmarshal(top["Invalid"], &invalid); err == nil && len(invalid) > 0 {
+		snap.sections["Invalid"] = watcherObjects(invalid)
+	}
+
+	var consul struct {
+		Endpoints map[string]interface{}
+	}
+	if err := json.Unmarshal(top["Consul"], &consul); err == nil && len(consul.Endpoints) > 0 {
+		snap.sections["Consul Endpoints"] = consul.Endpoints
+	}
+	return nil
+}
+
+// watcherObjects indexes a list of Kubernetes resources by namespace and name. The parts of the
+// metadata that change on every write are left out, since they'd show up as changes that aren't.
+func watcherObjects(objs []map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	for idx, obj := range objs {
+		var name, namespace, kind string
+		kind, _ = obj["kind"].(string)
+		if metadata, ok := obj["metadata"].(map[string]interface{}); ok {
+			name, _ = metadata["name"].(string)
+			namespace, _ = metadata["namespace"].(string)
+			delete(metadata, "resourceVersion")
+			delete(metadata, "managedFields")
+		}
+		key := name
+		if namespace != "" {
+			key = namespace + "/" + name
+		}
+		if kind != "" {
+			key = kind + " " + key
+		}
+		if name == "" {
+			key = fmt.Sprintf("#%d", idx)
+		}
+		result[key] = obj
+	}
+	return result
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
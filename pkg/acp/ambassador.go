@@ -78,6 +78,10 @@ type AmbassadorWatcher struct {
 	// snapshot, we have to hand the snapshot to Envoy and allow Envoy to start
 	// up. This takes finite time, so we have to allow for that.
 	GraceEnd time.Time
+
+	// If Envoy is rejecting (NACKing) the configuration we're sending it, this
+	// describes why.
+	envoyRejection error
 }
 
 // NewAmbassadorWatcher creates a new AmbassadorWatcher, given a fetcher.
@@ -132,6 +136,24 @@ func (w *AmbassadorWatcher) NoteSnapshotProcessed() {
 	}
 }
 
+// NoteEnvoyNack will note that Envoy is rejecting the configuration we've sent it,
+// or, if err is nil, that it is no longer rejecting anything.
+func (w *AmbassadorWatcher) NoteEnvoyNack(err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.envoyRejection = err
+}
+
+// EnvoyRejection returns why Envoy is rejecting the configuration we've sent it,
+// or nil if it isn't.
+func (w *AmbassadorWatcher) EnvoyRejection() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.envoyRejection
+}
+
 // IsAlive returns true IFF the Ambassador as a whole can be considered alive.
 func (w *AmbassadorWatcher) IsAlive() bool {
 	w.mutex.Lock()
@@ -185,7 +207,8 @@ func (w *AmbassadorWatcher) IsReady() bool {
 	defer w.mutex.Unlock()
 
 	// This is much simpler that IsAlive. Ambassador is ready IFF both diagd and
-	// Envoy are ready; that's all there is to it.
+	// Envoy are ready, and Envoy is running the configuration we gave it rather
+	// than silently hanging on to an older one; that's all there is to it.
 
-	return w.dw.IsReady() && w.ew.IsReady()
+	return w.dw.IsReady() && w.ew.IsReady() && w.envoyRejection == nil
 }
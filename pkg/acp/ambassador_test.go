@@ -1,6 +1,7 @@
 package acp_test
 
 import (
+	"errors"
 	"testing"
 	"time"
 
@@ -107,6 +108,28 @@ func TestAmbassadorUnrealisticallyHappy(t *testing.T) {
 	m.check(3, 30, true, true)
 }
 
+func TestAmbassadorEnvoyNack(t *testing.T) {
+	m := newAWMetadata(t)
+	m.check(0, 0, true, false)
+
+	// Get to happy.
+	m.stepSec(10)
+	m.aw.NoteSnapshotSent()
+	m.aw.NoteSnapshotProcessed()
+	m.aw.FetchEnvoyReady(dlog.NewTestContext(t, false))
+	m.check(1, 10, true, true)
+
+	// Envoy rejects a snapshot: still alive, but not ready.
+	m.stepSec(10)
+	m.aw.NoteEnvoyNack(errors.New("envoy rejected configuration"))
+	m.check(2, 20, true, false)
+
+	// Envoy accepts a later one, and we're ready again.
+	m.stepSec(10)
+	m.aw.NoteEnvoyNack(nil)
+	m.check(3, 30, true, true)
+}
+
 func TestAmbassadorNoSnapshots(t *testing.T) {
 	m := newAWMetadata(t)
 	m.check(0, 0, true, false)
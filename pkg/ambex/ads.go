@@ -0,0 +1,298 @@
+package ambex
+
+import (
+	// standard library
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	// third-party libraries
+	"github.com/fsnotify/fsnotify"
+
+	// first-party libraries
+	"github.com/datawire/dlib/dlog"
+)
+
+// adsCredentials are the certificate (and, for mTLS, the client CA) that the ADS server uses.
+// They're reloaded whenever the files change, so that rotating the certificate doesn't need an
+// ambex restart; connections that are already open keep the certificate they started with.
+type adsCredentials struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+}
+
+// newADSCredentials loads the ADS server's credentials. It's an error for them not to load the
+// first time; after that, we keep the old ones if the new ones are bad.
+func newADSCredentials(certFile, keyFile, clientCAFile string) (*adsCredentials, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("ADS TLS needs both a certificate and a key")
+	}
+	creds := &adsCredentials{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+	}
+	if err := creds.load(); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+func (c *adsCredentials) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("ADS TLS certificate: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if c.clientCAFile != "" {
+		pem, err := os.ReadFile(c.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("ADS TLS client CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("ADS TLS client CA: no certificates in %s", c.clientCAFile)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.clientCA = pool
+	return nil
+}
+
+// tlsConfig returns the TLS configuration for the ADS server, which always uses the current
+// credentials.
+func (c *adsCredentials) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			return c.cert, nil
+		},
+	}
+	if c.clientCAFile != "" {
+		// We can't just set ClientCAs, since that can't be reloaded, so we check the client
+		// certificate ourselves.
+		config.ClientAuth = tls.RequireAnyClientCert
+		config.VerifyPeerCertificate = c.verifyClient
+	}
+	return config
+}
+
+func (c *adsCredentials) verifyClient(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return errors.New("no client certificate")
+	}
+
+	c.mu.RLock()
+	roots := c.clientCA
+	c.mu.RUnlock()
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// watch reloads the credentials whenever any of their files change. We watch the directories
+// rather than the files, since Kubernetes updates mounted Secrets by swapping a symlink.
+func (c *adsCredentials) watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	dirs := map[string]bool{}
+	for _, file := range []string{c.certFile, c.keyFile, c.clientCAFile} {
+		if file != "" {
+			dirs[filepath.Dir(file)] = true
+		}
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-watcher.Events:
+			if err := c.load(); err != nil {
+				// The cert and key usually don't get updated at exactly the same moment, so
+				// this can happen in passing; we'll try again on the next event.
+				dlog.Warnf(ctx, "Not reloading ADS TLS credentials: %v", err)
+				continue
+			}
+			dlog.Infof(ctx, "Reloaded ADS TLS credentials from %s", c.certFile)
+		case err := <-watcher.Errors:
+			dlog.Warnf(ctx, "ADS TLS watcher error: %v", err)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// socketPermissions are what a unix-socket ADS listener's file mode and ownership should be set
+// to. A zero mode, or a negative uid or gid, leaves that alone.
+type socketPermissions struct {
+	mode os.FileMode
+	uid  int
+	gid  int
+}
+
+// parseSocketPermissions parses an octal file mode (e.g. "0660") and an owner, which is
+// "user", "user:group" or ":group", where the user and group are names or numeric IDs.
+func parseSocketPermissions(mode, owner string) (socketPermissions, error) {
+	perms := socketPermissions{uid: -1, gid: -1}
+
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0777 {
+			return perms, fmt.Errorf("invalid ADS socket mode %q", mode)
+		}
+		perms.mode = os.FileMode(m)
+	}
+
+	if owner != "" {
+		userName, groupName, _ := strings.Cut(owner, ":")
+		if userName != "" {
+			uid, err := strconv.Atoi(userName)
+			if err != nil {
+				u, err := user.Lookup(userName)
+				if err != nil {
+					return perms, fmt.Errorf("invalid ADS socket owner %q: %w", owner, err)
+				}
+				uid, _ = strconv.Atoi(u.Uid)
+			}
+			perms.uid = uid
+		}
+		if groupName != "" {
+			gid, err := strconv.Atoi(groupName)
+			if err != nil {
+				g, err := user.LookupGroup(groupName)
+				if err != nil {
+					return perms, fmt.Errorf("invalid ADS socket owner %q: %w", owner, err)
+				}
+				gid, _ = strconv.Atoi(g.Gid)
+			}
+			perms.gid = gid
+		}
+	}
+
+	return perms, nil
+}
+
+// listenADS opens the ADS listener. For a unix socket, a stale socket file left over from a
+// previous run is removed first, and the socket gets the requested permissions.
+func listenADS(ctx context.Context, network, address string, perms socketPermissions) (net.Listener, error) {
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	if info, err := os.Lstat(address); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("ADS socket %s: file exists and is not a socket", address)
+		}
+		dlog.Infof(ctx, "Removing stale ADS socket %s", address)
+		if err := os.Remove(address); err != nil {
+			return nil, err
+		}
+	}
+
+	// Anyone could connect to the socket between net.Listen creating it and us fixing its mode and
+	// owner, so create it in a directory that only we can get into, and only move it into place
+	// once it has the right permissions.
+	dir, err := os.MkdirTemp(filepath.Dir(address), ".ads-")
+	if err != nil {
+		return nil, fmt.Errorf("ADS socket directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, filepath.Base(address))
+	lis, err := net.ListenUnix(network, &net.UnixAddr{Name: tmp, Net: network})
+	if err != nil {
+		return nil, err
+	}
+	// The listener would only remove the socket by its temporary name.
+	lis.SetUnlinkOnClose(false)
+
+	if perms.mode != 0 {
+		if err := os.Chmod(tmp, perms.mode); err != nil {
+			lis.Close()
+			return nil, fmt.Errorf("ADS socket mode: %w", err)
+		}
+	}
+	if perms.uid >= 0 || perms.gid >= 0 {
+		if err := os.Chown(tmp, perms.uid, perms.gid); err != nil {
+			lis.Close()
+			return nil, fmt.Errorf("ADS socket owner: %w", err)
+		}
+	}
+	if err := os.Rename(tmp, address); err != nil {
+		lis.Close()
+		return nil, fmt.Errorf("ADS socket: %w", err)
+	}
+
+	return &unixSocketListener{UnixListener: lis, path: address}, nil
+}
+
+// unixSocketListener is a unix socket listener that removes its socket, by its final name, when
+// it's closed.
+type unixSocketListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixSocketListener) Close() error {
+	err := l.UnixListener.Close()
+	if rmErr := os.Remove(l.path); err == nil && !errors.Is(rmErr, os.ErrNotExist) {
+		err = rmErr
+	}
+	return err
+}
+
+// isLoopback returns whether a TCP listen address only accepts connections from this host.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
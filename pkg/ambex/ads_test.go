@@ -0,0 +1,249 @@
+package ambex
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/dlib/dlog"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// makeTestCert makes a certificate for name, signed by issuer, or self-signed (as a CA) if issuer
+// is nil.
+func makeTestCert(t *testing.T, name string, issuer *testCert, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	parent, parentKey := tmpl, key
+	if issuer == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, parentKey = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	require.NoError(t, err)
+	return cert
+}
+
+// handshake connects a TLS client to a TLS server using the ADS credentials, and returns the
+// server certificate the client saw.
+func handshake(t *testing.T, creds *adsCredentials, roots *x509.CertPool, clientCert *tls.Certificate) (*x509.Certificate, error) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverConn, err := lis.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		conn := tls.Server(serverConn, creds.tlsConfig())
+		serverErr <- conn.Handshake()
+		conn.Close()
+	}()
+
+	clientConn, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	defer clientConn.Close()
+
+	config := &tls.Config{RootCAs: roots, ServerName: "ambex"}
+	if clientCert != nil {
+		config.Certificates = []tls.Certificate{*clientCert}
+	}
+	conn := tls.Client(clientConn, config)
+	err = conn.Handshake()
+	if err == nil {
+		// With TLS 1.3, the client finishes its handshake before the server has checked the
+		// client certificate.
+		err = <-serverErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestADSCredentials(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	dir := t.TempDir()
+
+	ca := makeTestCert(t, "ca", nil, x509.ExtKeyUsageAny)
+	otherCA := makeTestCert(t, "other-ca", nil, x509.ExtKeyUsageAny)
+	server := makeTestCert(t, "ambex", ca, x509.ExtKeyUsageServerAuth)
+	client := makeTestCert(t, "envoy", ca, x509.ExtKeyUsageClientAuth).tlsCertificate(t)
+	badClient := makeTestCert(t, "envoy", otherCA, x509.ExtKeyUsageClientAuth).tlsCertificate(t)
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(certFile, server.certPEM, 0600))
+	require.NoError(t, os.WriteFile(keyFile, server.keyPEM, 0600))
+	require.NoError(t, os.WriteFile(caFile, ca.certPEM, 0600))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	_, err := newADSCredentials(certFile, "", "")
+	assert.Error(t, err)
+	_, err = newADSCredentials(certFile, filepath.Join(dir, "missing.key"), "")
+	assert.Error(t, err)
+
+	// Plain TLS doesn't care about client certificates.
+	creds, err := newADSCredentials(certFile, keyFile, "")
+	require.NoError(t, err)
+	_, err = handshake(t, creds, roots, nil)
+	assert.NoError(t, err)
+
+	// mTLS needs a client certificate signed by the client CA.
+	creds, err = newADSCredentials(certFile, keyFile, caFile)
+	require.NoError(t, err)
+	_, err = handshake(t, creds, roots, nil)
+	assert.Error(t, err)
+	_, err = handshake(t, creds, roots, &badClient)
+	assert.Error(t, err)
+	serverCert, err := handshake(t, creds, roots, &client)
+	require.NoError(t, err)
+	assert.Equal(t, server.cert.SerialNumber, serverCert.SerialNumber)
+
+	// Rotating the certificate and the client CA takes effect without a restart.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchDone := make(chan error, 1)
+	go func() { watchDone <- creds.watch(ctx) }()
+	// Give the watcher a moment to start watching.
+	time.Sleep(100 * time.Millisecond)
+
+	newServer := makeTestCert(t, "ambex", otherCA, x509.ExtKeyUsageServerAuth)
+	require.NoError(t, os.WriteFile(keyFile, newServer.keyPEM, 0600))
+	require.NoError(t, os.WriteFile(certFile, newServer.certPEM, 0600))
+	require.NoError(t, os.WriteFile(caFile, otherCA.certPEM, 0600))
+
+	newRoots := x509.NewCertPool()
+	newRoots.AddCert(otherCA.cert)
+	require.Eventually(t, func() bool {
+		serverCert, err := handshake(t, creds, newRoots, &badClient)
+		return err == nil && serverCert.SerialNumber.Cmp(newServer.cert.SerialNumber) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+	_, err = handshake(t, creds, newRoots, &client)
+	assert.Error(t, err)
+
+	cancel()
+	assert.NoError(t, <-watchDone)
+}
+
+func TestListenADSUnixSocket(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	socket := filepath.Join(t.TempDir(), "ads.sock")
+
+	perms, err := parseSocketPermissions("0600", "")
+	require.NoError(t, err)
+	_, err = parseSocketPermissions("999", "")
+	assert.Error(t, err)
+	_, err = parseSocketPermissions("", "no-such-user-hopefully")
+	assert.Error(t, err)
+	owner, err := parseSocketPermissions("", "1234:5678")
+	require.NoError(t, err)
+	assert.Equal(t, socketPermissions{uid: 1234, gid: 5678}, owner)
+
+	// A socket left over from a previous run doesn't get in the way.
+	stale, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	lis, err := listenADS(ctx, "unix", socket, perms)
+	require.NoError(t, err)
+
+	info, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The socket is created somewhere private and moved into place, so nothing else is left
+	// behind, and it's usable where it ends up.
+	entries, err := os.ReadDir(filepath.Dir(socket))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+	go func() {
+		if conn, err := lis.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", socket)
+	require.NoError(t, err)
+	conn.Close()
+
+	// Closing the listener removes the socket.
+	require.NoError(t, lis.Close())
+	_, err = os.Lstat(socket)
+	assert.True(t, os.IsNotExist(err))
+
+	// Other files are left alone, though.
+	regular := filepath.Join(t.TempDir(), "ads.sock")
+	require.NoError(t, os.WriteFile(regular, nil, 0644))
+	_, err = listenADS(ctx, "unix", regular, perms)
+	assert.Error(t, err)
+}
+
+func TestIsLoopback(t *testing.T) {
+	assert.True(t, isLoopback("127.0.0.1:8003"))
+	assert.True(t, isLoopback("[::1]:8003"))
+	assert.True(t, isLoopback("localhost:8003"))
+	assert.False(t, isLoopback(":8003"))
+	assert.False(t, isLoopback("0.0.0.0:8003"))
+	assert.False(t, isLoopback("10.1.2.3:8003"))
+}
@@ -5,6 +5,8 @@ import (
 	"sort"
 	"strings"
 
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
 	v3core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	v3endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 )
@@ -15,6 +17,11 @@ import (
 // endpoint data fairly easily with this layer of indirection.
 type Endpoints struct {
 	Entries map[string][]*Endpoint
+
+	// LocalZone is the zone that this Envoy is running in, if we know it. When it's set, and
+	// Kubernetes topology-aware routing has hinted every endpoint of a cluster, the endpoints
+	// hinted for the local zone are preferred over everything else at the same Endpoint priority.
+	LocalZone string
 }
 
 func (e *Endpoints) RoutesString() string {
@@ -31,34 +38,160 @@ func (e *Endpoints) RoutesString() string {
 	return strings.Join(routes, "\n")
 }
 
-// ToMap_v3 produces a map with the envoy v3 friendly forms of all the endpoint data.
+// ToMap_v3 produces a map with the envoy v3 friendly forms of all the endpoint data. Each cluster's
+// endpoints are grouped into one LocalityLbEndpoints per zone (and priority), in a stable order.
 func (e *Endpoints) ToMap_v3() map[string]*v3endpoint.ClusterLoadAssignment {
 	result := map[string]*v3endpoint.ClusterLoadAssignment{}
 	for name, eps := range e.Entries {
-		var endpoints []*v3endpoint.LbEndpoint
+		result[name] = &v3endpoint.ClusterLoadAssignment{
+			ClusterName: name,
+			Endpoints:   e.localities_v3(eps),
+		}
+	}
+	return result
+}
+
+type localityKey struct {
+	priority uint32
+	zone     string
+}
+
+func (e *Endpoints) localities_v3(eps []*Endpoint) []*v3endpoint.LocalityLbEndpoints {
+	// Putting the local zone at a priority of its own makes every other zone a failover target,
+	// which is only safe if the local zone has enough endpoints for its share of the traffic. The
+	// EndpointSlice controller only hints endpoints when that's the case, so, like kube-proxy, we
+	// only prefer the local zone if every endpoint is hinted and some are hinted for it. Otherwise
+	// all the zones share a priority, and are just grouped into localities.
+	preferLocal := false
+	if e.LocalZone != "" {
 		for _, ep := range eps {
-			endpoints = append(endpoints, ep.ToLbEndpoint_v3())
+			if len(ep.ZoneHints) == 0 {
+				preferLocal = false
+				break
+			}
+			if ep.servesZone(e.LocalZone) {
+				preferLocal = true
+			}
 		}
-		loadAssignment := &v3endpoint.ClusterLoadAssignment{
-			ClusterName: name,
-			Endpoints:   []*v3endpoint.LocalityLbEndpoints{{LbEndpoints: endpoints}},
+	}
+
+	// Each Endpoint priority is split in two, local endpoints first, and then the levels that
+	// are actually used are numbered from 0, since that's what Envoy expects.
+	level := func(ep *Endpoint) uint32 {
+		l := 2 * ep.Priority
+		if preferLocal && !ep.servesZone(e.LocalZone) {
+			l++
+		}
+		return l
+	}
+	var levels []uint32
+	seen := map[uint32]bool{}
+	for _, ep := range eps {
+		if l := level(ep); !seen[l] {
+			seen[l] = true
+			levels = append(levels, l)
+		}
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i] < levels[j] })
+	priorities := make(map[uint32]uint32, len(levels))
+	for i, l := range levels {
+		priorities[l] = uint32(i)
+	}
+
+	groups := map[localityKey][]*v3endpoint.LbEndpoint{}
+	var keys []localityKey
+	for _, ep := range eps {
+		key := localityKey{priority: priorities[level(ep)], zone: ep.Zone}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
 		}
-		result[name] = loadAssignment
+		groups[key] = append(groups[key], ep.ToLbEndpoint_v3())
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].priority != keys[j].priority {
+			return keys[i].priority < keys[j].priority
+		}
+		return keys[i].zone < keys[j].zone
+	})
+
+	var result []*v3endpoint.LocalityLbEndpoints
+	for _, key := range keys {
+		locality := &v3endpoint.LocalityLbEndpoints{
+			LbEndpoints: groups[key],
+			Priority:    key.priority,
+		}
+		if key.zone != "" {
+			locality.Locality = &v3core.Locality{Zone: key.zone}
+		}
+		result = append(result, locality)
+	}
+	if len(result) == 0 {
+		// Keep the single, empty locality that we've always sent for a cluster with no endpoints.
+		result = []*v3endpoint.LocalityLbEndpoints{{}}
 	}
 	return result
 }
 
+// The health statuses that an Endpoint can have. They have the same names as Envoy's
+// HealthStatus values; an empty status is Envoy's UNKNOWN, which Envoy treats as healthy. There's
+// deliberately no UNHEALTHY: an endpoint that can't take traffic should be left out, since Envoy
+// sends traffic to unhealthy endpoints anyway once enough of a cluster is unhealthy.
+const (
+	HealthStatusHealthy  = "HEALTHY"
+	HealthStatusDegraded = "DEGRADED"
+	HealthStatusDraining = "DRAINING"
+)
+
 // Endpoint contains the subset of fields we bother to expose.
 type Endpoint struct {
 	ClusterName string
 	Ip          string
 	Port        uint32
 	Protocol    string
+
+	// Zone and NodeName say where the endpoint is running, if we know. Endpoints are grouped
+	// into Envoy localities by Zone.
+	Zone     string
+	NodeName string
+	// ZoneHints are the zones that Kubernetes topology-aware routing wants this endpoint to
+	// serve. They, not Zone, decide whether the endpoint is local.
+	ZoneHints []string
+
+	// HealthStatus is one of the HealthStatus constants, or empty if we don't know anything
+	// about the endpoint's health. Envoy only sends requests to DEGRADED endpoints when there
+	// aren't enough healthy ones. It stops sending new requests to DRAINING endpoints, but lets
+	// the requests that are already in flight finish.
+	HealthStatus string
+
+	// Weight is the endpoint's load-balancing weight, relative to the other endpoints in its
+	// locality. 0 means that we don't have a weight for it, which Envoy treats as 1.
+	Weight uint32
+
+	// Priority is the endpoint's failover priority. Envoy only sends traffic to endpoints at a
+	// higher Priority when the ones at lower priorities can't handle it, and sends it back once
+	// they can.
+	Priority uint32
+}
+
+// servesZone returns whether the endpoint is hinted to serve the given zone.
+func (e *Endpoint) servesZone(zone string) bool {
+	for _, hint := range e.ZoneHints {
+		if hint == zone {
+			return true
+		}
+	}
+	return false
 }
 
 // ToLBEndpoint_v3 translates to envoy v3 frinedly form of the Endpoint data.
 func (e *Endpoint) ToLbEndpoint_v3() *v3endpoint.LbEndpoint {
+	var weight *wrapperspb.UInt32Value
+	if e.Weight > 0 {
+		weight = wrapperspb.UInt32(e.Weight)
+	}
 	return &v3endpoint.LbEndpoint{
+		LoadBalancingWeight: weight,
+		HealthStatus:        v3core.HealthStatus(v3core.HealthStatus_value[e.HealthStatus]),
 		HostIdentifier: &v3endpoint.LbEndpoint_Endpoint{
 			Endpoint: &v3endpoint.Endpoint{
 				Address: &v3core.Address{
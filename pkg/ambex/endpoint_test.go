@@ -0,0 +1,104 @@
+package ambex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v3core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+func TestEndpointLocalities(t *testing.T) {
+	eps := []*Endpoint{
+		{ClusterName: "c", Ip: "10.0.0.1", Port: 80, Protocol: "TCP", Zone: "b"},
+		{ClusterName: "c", Ip: "10.0.0.2", Port: 80, Protocol: "TCP", Zone: "a"},
+		{ClusterName: "c", Ip: "10.0.0.3", Port: 80, Protocol: "TCP", Zone: "b"},
+		{ClusterName: "c", Ip: "10.0.0.4", Port: 80, Protocol: "TCP"},
+		// Hinted to serve zone a, even though it's in zone c.
+		{ClusterName: "c", Ip: "10.0.0.5", Port: 80, Protocol: "TCP", Zone: "c", ZoneHints: []string{"a"}},
+	}
+
+	type locality struct {
+		zone     string
+		priority uint32
+		ips      []string
+	}
+	localities := func(e *Endpoints) []locality {
+		cla := e.ToMap_v3()["c"]
+		require.NotNil(t, cla)
+		var result []locality
+		for _, lle := range cla.Endpoints {
+			l := locality{zone: lle.GetLocality().GetZone(), priority: lle.Priority}
+			for _, lb := range lle.LbEndpoints {
+				l.ips = append(l.ips, lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+			}
+			result = append(result, l)
+		}
+		return result
+	}
+
+	// Without a local zone, everything's at priority 0, grouped by zone.
+	assert.Equal(t, []locality{
+		{"", 0, []string{"10.0.0.4"}},
+		{"a", 0, []string{"10.0.0.2"}},
+		{"b", 0, []string{"10.0.0.1", "10.0.0.3"}},
+		{"c", 0, []string{"10.0.0.5"}},
+	}, localities(&Endpoints{Entries: map[string][]*Endpoint{"c": eps}}))
+
+	// Knowing the local zone doesn't change that unless every endpoint has topology hints, since
+	// otherwise there's no telling whether the local zone can take all of its traffic.
+	assert.Equal(t, localities(&Endpoints{Entries: map[string][]*Endpoint{"c": eps}}),
+		localities(&Endpoints{Entries: map[string][]*Endpoint{"c": eps}, LocalZone: "a"}))
+
+	// If every endpoint has hints, the ones hinted for the local zone stay at priority 0, wherever
+	// they are.
+	hinted := []*Endpoint{
+		{ClusterName: "c", Ip: "10.0.0.1", Port: 80, Protocol: "TCP", Zone: "b", ZoneHints: []string{"b"}},
+		{ClusterName: "c", Ip: "10.0.0.2", Port: 80, Protocol: "TCP", Zone: "a", ZoneHints: []string{"a"}},
+		{ClusterName: "c", Ip: "10.0.0.5", Port: 80, Protocol: "TCP", Zone: "c", ZoneHints: []string{"a"}},
+	}
+	assert.Equal(t, []locality{
+		{"a", 0, []string{"10.0.0.2"}},
+		{"c", 0, []string{"10.0.0.5"}},
+		{"b", 1, []string{"10.0.0.1"}},
+	}, localities(&Endpoints{Entries: map[string][]*Endpoint{"c": hinted}, LocalZone: "a"}))
+
+	// If nothing is hinted for the local zone, there's no point in demoting everything.
+	assert.Equal(t, localities(&Endpoints{Entries: map[string][]*Endpoint{"c": hinted}}),
+		localities(&Endpoints{Entries: map[string][]*Endpoint{"c": hinted}, LocalZone: "z"}))
+
+	// Failover priorities come first, then the local zone, and the priorities that are used are
+	// numbered from 0.
+	failover := []*Endpoint{
+		{ClusterName: "c", Ip: "10.0.1.1", Port: 80, Protocol: "TCP", Zone: "a", ZoneHints: []string{"a"}, Priority: 2},
+		{ClusterName: "c", Ip: "10.0.1.2", Port: 80, Protocol: "TCP", Zone: "b", ZoneHints: []string{"b"}, Priority: 2},
+		{ClusterName: "c", Ip: "10.0.0.1", Port: 80, Protocol: "TCP", Zone: "b", ZoneHints: []string{"b"}},
+	}
+	assert.Equal(t, []locality{
+		{"b", 0, []string{"10.0.0.1"}},
+		{"a", 1, []string{"10.0.1.1"}},
+		{"b", 1, []string{"10.0.1.2"}},
+	}, localities(&Endpoints{Entries: map[string][]*Endpoint{"c": failover}}))
+	assert.Equal(t, []locality{
+		{"b", 0, []string{"10.0.0.1"}},
+		{"a", 1, []string{"10.0.1.1"}},
+		{"b", 2, []string{"10.0.1.2"}},
+	}, localities(&Endpoints{Entries: map[string][]*Endpoint{"c": failover}, LocalZone: "a"}))
+
+	// Health statuses map straight to Envoy's.
+	draining := (&Endpoint{Ip: "10.0.0.1", Port: 80, Protocol: "TCP", HealthStatus: HealthStatusDraining}).ToLbEndpoint_v3()
+	assert.Equal(t, v3core.HealthStatus_DRAINING, draining.HealthStatus)
+	unknown := (&Endpoint{Ip: "10.0.0.1", Port: 80, Protocol: "TCP"}).ToLbEndpoint_v3()
+	assert.Equal(t, v3core.HealthStatus_UNKNOWN, unknown.HealthStatus)
+
+	// So do weights, but only if we have one.
+	weighted := (&Endpoint{Ip: "10.0.0.1", Port: 80, Protocol: "TCP", Weight: 5}).ToLbEndpoint_v3()
+	assert.Equal(t, uint32(5), weighted.GetLoadBalancingWeight().GetValue())
+	assert.Nil(t, unknown.LoadBalancingWeight)
+
+	// A cluster with no endpoints still gets a (single, empty) locality.
+	cla := (&Endpoints{Entries: map[string][]*Endpoint{"empty": nil}}).ToMap_v3()["empty"]
+	require.Len(t, cla.Endpoints, 1)
+	assert.Empty(t, cla.Endpoints[0].LbEndpoints)
+}
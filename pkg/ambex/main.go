@@ -16,6 +16,11 @@ package ambex
  *   - A given SnapshotCache can hold configurations for multiple Envoys,
  *     identified by the Envoy 'node ID', which must be configured for the
  *     Envoy.
+ *   - We don't know which Envoys there are until they connect, so the
+ *     nodeRegistry hands each one the latest Snapshot when it connects, and
+ *     every new Snapshot to all of the connected Envoys. Envoys can be keyed
+ *     by their node ID (the default) or by their node cluster, so that a whole
+ *     fleet of identically-configured Envoys shares one Snapshot.
  * - The SnapshotCache can only hold go-control-plane configuration objects,
  *   so you have to build these up to hand to the SnapshotCache.
  * - The gRPC stuff is handled by a Server.
@@ -31,6 +36,10 @@ package ambex
  *     the Server's SnapshotCache knows about.
  *   - Whenever a newer Snapshot is added to the SnapshotCache, that Snapshot
  *     will get sent to the Envoy.
+ *   - Envoy can use either the state-of-the-world or the incremental ("delta")
+ *     flavor of the xDS protocol; the Server speaks both. With delta xDS, each
+ *     resource has its own version (a hash of its contents), and only the
+ *     resources whose versions changed are sent.
  * - We manage the SnapshotCache by loading envoy configuration from
  *   json and/or protobuf files on disk.
  *   - By default when we get a SIGHUP, we reload configuration.
@@ -41,18 +50,21 @@ package ambex
 import (
 	// standard library
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	// third-party libraries
 	"github.com/fsnotify/fsnotify"
@@ -109,6 +121,8 @@ import (
 	"github.com/datawire/dlib/dgroup"
 	"github.com/datawire/dlib/dhttp"
 	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/debug"
+	"github.com/emissary-ingress/emissary/v3/pkg/snapshotdir"
 )
 
 type Args struct {
@@ -117,14 +131,46 @@ type Args struct {
 	adsNetwork string
 	adsAddress string
 
+	// adsTLSCert and adsTLSKey turn on TLS for the ADS server, and adsTLSClientCA turns on mTLS.
+	adsTLSCert     string
+	adsTLSKey      string
+	adsTLSClientCA string
+
+	// adsSocket is the file mode and ownership for a unix-socket ADS listener.
+	adsSocket socketPermissions
+
 	dirs []string
 
 	snapdirPath string
-	numsnaps    int
+	snapshots   snapshotdir.Options
 
 	// edsBypass will bypass using EDS and will insert the endpoints into the cluster data manually
 	// This is a stop gap solution to resolve 503s on certification rotation
 	edsBypass bool
+
+	// deltaXDS means that Envoy is using the incremental xDS protocol, so we need per-resource
+	// versions for every snapshot.
+	deltaXDS bool
+
+	// nodeKeyCluster means that Envoys are told apart by their node cluster rather than their
+	// node ID.
+	nodeKeyCluster bool
+
+	// nackRollback means that when an Envoy rejects a snapshot, we hand it the last snapshot it
+	// accepted again.
+	nackRollback bool
+
+	// skipValidation means that we hand snapshots to Envoy without checking them for problems
+	// that would make Envoy reject them first.
+	skipValidation bool
+
+	// runtimeAddress is where the runtime API listens; if it's empty, there's no runtime API.
+	// runtimePath is where the overrides set through it are kept, runtimeAuditPath is where every
+	// change to them is logged, and runtimeTokenPath is where the token for it is kept.
+	runtimeAddress   string
+	runtimePath      string
+	runtimeAuditPath string
+	runtimeTokenPath string
 }
 
 func parseArgs(ctx context.Context, rawArgs ...string) (*Args, error) {
@@ -140,6 +186,16 @@ func parseArgs(ctx context.Context, rawArgs ...string) (*Args, error) {
 	var legacyAdsPort uint
 	flagset.UintVar(&legacyAdsPort, "ads", 0, "port number for ADS to listen on--deprecated, use --ads-listen-address=:1234 instead")
 
+	flagset.StringVar(&args.adsTLSCert, "ads-tls-cert", os.Getenv("AMBASSADOR_AMBEX_ADS_TLS_CERT"), "certificate file for ADS to serve TLS with")
+	flagset.StringVar(&args.adsTLSKey, "ads-tls-key", os.Getenv("AMBASSADOR_AMBEX_ADS_TLS_KEY"), "private key file for ADS to serve TLS with")
+	flagset.StringVar(&args.adsTLSClientCA, "ads-tls-client-ca", os.Getenv("AMBASSADOR_AMBEX_ADS_TLS_CLIENT_CA"), "CA file that ADS clients' certificates must be signed by (turns on mTLS)")
+
+	var adsSocketMode, adsSocketOwner string
+	flagset.StringVar(&adsSocketMode, "ads-socket-mode", os.Getenv("AMBASSADOR_AMBEX_ADS_SOCKET_MODE"), "octal file mode for ADS to set on its unix socket")
+	flagset.StringVar(&adsSocketOwner, "ads-socket-owner", os.Getenv("AMBASSADOR_AMBEX_ADS_SOCKET_OWNER"), "user[:group] for ADS to set on its unix socket")
+
+	flagset.StringVar(&args.runtimeAddress, "runtime-listen-address", "", "address for the runtime API to listen on (disabled if empty)")
+
 	if err := flagset.Parse(rawArgs); err != nil {
 		return nil, err
 	}
@@ -148,6 +204,19 @@ func parseArgs(ctx context.Context, rawArgs ...string) (*Args, error) {
 		args.adsAddress = fmt.Sprintf(":%v", legacyAdsPort)
 	}
 
+	if (args.adsTLSCert == "") != (args.adsTLSKey == "") {
+		return nil, fmt.Errorf("--ads-tls-cert and --ads-tls-key must be given together")
+	}
+	if args.adsTLSClientCA != "" && args.adsTLSCert == "" {
+		return nil, fmt.Errorf("--ads-tls-client-ca needs --ads-tls-cert and --ads-tls-key")
+	}
+
+	adsSocket, err := parseSocketPermissions(adsSocketMode, adsSocketOwner)
+	if err != nil {
+		return nil, err
+	}
+	args.adsSocket = adsSocket
+
 	args.dirs = flagset.Args()
 	if len(args.dirs) == 0 {
 		args.dirs = []string{"."}
@@ -166,19 +235,17 @@ func parseArgs(ctx context.Context, rawArgs ...string) (*Args, error) {
 	}
 	args.snapdirPath = path.Join(snapdirPath, "snapshots")
 
+	// Runtime overrides live next to the snapshots, so that they survive ambex restarts.
+	args.runtimePath = path.Join(snapdirPath, "ambex-runtime.json")
+	args.runtimeAuditPath = path.Join(snapdirPath, "ambex-runtime-audit.log")
+	args.runtimeTokenPath = path.Join(snapdirPath, "ambex-runtime-token")
+
 	// We'll keep $AMBASSADOR_AMBEX_SNAPSHOT_COUNT snapshots. If unset, or set to
 	// something we can't treat as an int, use 30 (which Flynn just made up, so don't
-	// be afraid to change it if need be).
-	numsnapStr := os.Getenv("AMBASSADOR_AMBEX_SNAPSHOT_COUNT")
-	if numsnapStr == "" {
-		numsnapStr = "30"
-	}
-	var err error
-	args.numsnaps, err = strconv.Atoi(numsnapStr)
-	if (err != nil) || (args.numsnaps < 0) {
-		args.numsnaps = 30
-		dlog.Errorf(ctx, "Invalid AMBASSADOR_AMBEX_SNAPSHOT_COUNT: %s, using %d", numsnapStr, args.numsnaps)
-	}
+	// be afraid to change it if need be). $AMBASSADOR_AMBEX_SNAPSHOT_COMPRESSION,
+	// $AMBASSADOR_AMBEX_SNAPSHOT_MAX_BYTES and $AMBASSADOR_AMBEX_SNAPSHOT_DELTAS control
+	// how much space they take up.
+	args.snapshots = snapshotdir.OptionsFromEnv(ctx, "AMBASSADOR_AMBEX_SNAPSHOT", 30)
 
 	// edsBypass will bypass using EDS and will insert the endpoints into the cluster data manually
 	// This is a stop gap solution to resolve 503s on certification rotation
@@ -188,11 +255,40 @@ func parseArgs(ctx context.Context, rawArgs ...string) (*Args, error) {
 		args.edsBypass = v
 	}
 
+	// AMBASSADOR_XDS_DELTA is also read when generating the Envoy bootstrap config, which is what
+	// actually tells Envoy to use delta xDS.
+	if v, err := strconv.ParseBool(os.Getenv("AMBASSADOR_XDS_DELTA")); err == nil && v {
+		dlog.Info(ctx, "AMBASSADOR_XDS_DELTA has been set to true. Envoy will use incremental xDS.")
+		args.deltaXDS = v
+	}
+
+	// Every Envoy connecting to us gets the same configuration, but the SnapshotCache keeps track
+	// of what it has sent to each node key separately. Keying by cluster rather than ID is
+	// cheaper for a large fleet of Envoys that share a node cluster.
+	switch nodeKey := os.Getenv("AMBASSADOR_AMBEX_NODE_KEY"); nodeKey {
+	case "", "id":
+	case "cluster":
+		args.nodeKeyCluster = true
+	default:
+		dlog.Errorf(ctx, "Invalid AMBASSADOR_AMBEX_NODE_KEY: %s, using id", nodeKey)
+	}
+
+	if v, err := strconv.ParseBool(os.Getenv("AMBASSADOR_AMBEX_NACK_ROLLBACK")); err == nil && v {
+		dlog.Info(ctx, "AMBASSADOR_AMBEX_NACK_ROLLBACK has been set to true. Envoys that reject a snapshot will be rolled back to the last one they accepted.")
+		args.nackRollback = v
+	}
+
+	if v, err := strconv.ParseBool(os.Getenv("AMBASSADOR_AMBEX_SKIP_VALIDATION")); err == nil && v {
+		dlog.Info(ctx, "AMBASSADOR_AMBEX_SKIP_VALIDATION has been set to true. Snapshots will not be validated before they're sent to Envoy.")
+		args.skipValidation = v
+	}
+
 	return &args, nil
 }
 
-// Hasher returns node ID as an ID
+// Hasher returns node ID (or, with ByCluster, the node cluster) as an ID
 type HasherV3 struct {
+	ByCluster bool
 }
 
 // ID function
@@ -200,6 +296,9 @@ func (h HasherV3) ID(node *v3core.Node) string {
 	if node == nil {
 		return "unknown"
 	}
+	if h.ByCluster && node.Cluster != "" {
+		return node.Cluster
+	}
 	return node.Id
 }
 
@@ -207,10 +306,11 @@ func (h HasherV3) ID(node *v3core.Node) string {
 
 // run stuff
 // RunManagementServer starts an xDS server at the given port.
-func runManagementServer(ctx context.Context, serverv3 ecp_v3_server.Server, adsNetwork, adsAddress string) error {
+// If creds is nil, it serves plaintext.
+func runManagementServer(ctx context.Context, serverv3 ecp_v3_server.Server, args *Args, creds *adsCredentials) error {
 	grpcServer := grpc.NewServer()
 
-	lis, err := net.Listen(adsNetwork, adsAddress)
+	lis, err := listenADS(ctx, args.adsNetwork, args.adsAddress, args.adsSocket)
 	if err != nil {
 		return fmt.Errorf("failed to listen: %w", err)
 	}
@@ -222,11 +322,23 @@ func runManagementServer(ctx context.Context, serverv3 ecp_v3_server.Server, ads
 	v3route.RegisterRouteDiscoveryServiceServer(grpcServer, serverv3)
 	v3listener.RegisterListenerDiscoveryServiceServer(grpcServer, serverv3)
 
-	dlog.Infof(ctx, "Listening on %s:%s", adsNetwork, adsAddress)
-
 	sc := &dhttp.ServerConfig{
 		Handler: grpcServer,
 	}
+
+	if creds != nil {
+		sc.TLSConfig = creds.tlsConfig()
+
+		dlog.Infof(ctx, "Listening on %s:%s with TLS (client certificates required: %v)",
+			args.adsNetwork, args.adsAddress, args.adsTLSClientCA != "")
+		return sc.ServeTLS(ctx, lis, "", "")
+	}
+
+	if args.adsNetwork == "tcp" && !isLoopback(args.adsAddress) {
+		dlog.Warnf(ctx, "ADS is listening on %s without TLS; anything that can reach it can read the Envoy configuration", args.adsAddress)
+	}
+
+	dlog.Infof(ctx, "Listening on %s:%s", args.adsNetwork, args.adsAddress)
 	return sc.Serve(ctx, lis)
 }
 
@@ -286,23 +398,53 @@ func Decode(ctx context.Context, name string) (proto.Message, error) {
 // These "expanded" snapshots make the snapshots we log easier to read: basically,
 // instead of just indexing by Golang types, make the JSON marshal with real names.
 type v3ExpandedSnapshot struct {
-	Endpoints ecp_v3_cache.Resources `json:"endpoints"`
-	Clusters  ecp_v3_cache.Resources `json:"clusters"`
-	Routes    ecp_v3_cache.Resources `json:"routes"`
-	Listeners ecp_v3_cache.Resources `json:"listeners"`
-	Runtimes  ecp_v3_cache.Resources `json:"runtimes"`
+	Endpoints expandedResources `json:"endpoints"`
+	Clusters  expandedResources `json:"clusters"`
+	Routes    expandedResources `json:"routes"`
+	Listeners expandedResources `json:"listeners"`
+	Runtimes  expandedResources `json:"runtimes"`
 }
 
 func NewV3ExpandedSnapshot(v3snap *ecp_v3_cache.Snapshot) v3ExpandedSnapshot {
 	return v3ExpandedSnapshot{
-		Endpoints: v3snap.Resources[ecp_cache_types.Endpoint],
-		Clusters:  v3snap.Resources[ecp_cache_types.Cluster],
-		Routes:    v3snap.Resources[ecp_cache_types.Route],
-		Listeners: v3snap.Resources[ecp_cache_types.Listener],
-		Runtimes:  v3snap.Resources[ecp_cache_types.Runtime],
+		Endpoints: expandedResources(v3snap.Resources[ecp_cache_types.Endpoint]),
+		Clusters:  expandedResources(v3snap.Resources[ecp_cache_types.Cluster]),
+		Routes:    expandedResources(v3snap.Resources[ecp_cache_types.Route]),
+		Listeners: expandedResources(v3snap.Resources[ecp_cache_types.Listener]),
+		Runtimes:  expandedResources(v3snap.Resources[ecp_cache_types.Runtime]),
 	}
 }
 
+// expandedResources marshals the same way as the ecp_v3_cache.Resources it wraps, except that the
+// resources themselves are marshalled as protojson, with the same field names as the envoy config.
+// That expands any typed_config, and means the resources can be read back in (e.g. by the
+// busyambassador snapdiff command).
+type expandedResources ecp_v3_cache.Resources
+
+func (r expandedResources) MarshalJSON() ([]byte, error) {
+	type item struct {
+		Resource json.RawMessage
+		TTL      *time.Duration
+	}
+	items := make(map[string]item, len(r.Items))
+	for name, res := range r.Items {
+		bs, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(res.Resource)
+		if err != nil {
+			// Most likely a typed_config of a type we don't know about, so fall back to
+			// marshalling the Go struct.
+			bs, err = json.Marshal(res.Resource)
+			if err != nil {
+				return nil, err
+			}
+		}
+		items[name] = item{Resource: bs, TTL: res.TTL}
+	}
+	return json.Marshal(struct {
+		Version string
+		Items   map[string]item
+	}{r.Version, items})
+}
+
 // A combinedSnapshot has both a V2 and V3 snapshot, for logging.
 type combinedSnapshot struct {
 	Version string             `json:"version"`
@@ -310,12 +452,11 @@ type combinedSnapshot struct {
 }
 
 // csDump creates a combinedSnapshot from a V2 snapshot and a V3 snapshot, then
-// dumps the combinedSnapshot to disk. Only numsnaps snapshots are kept: ambex-1.json
-// is the newest, then ambex-2.json, etc., so ambex-$numsnaps.json is the oldest.
-// Every time we write a new one, we rename all the older ones, ditching the oldest
-// after we've written numsnaps snapshots.
-func csDump(ctx context.Context, snapdirPath string, numsnaps int, generation int, v3snap *ecp_v3_cache.Snapshot) {
-	if numsnaps <= 0 {
+// dumps the combinedSnapshot to disk. Only snapshots.Count snapshots are kept: ambex-1.json
+// is the newest, then ambex-2.json, etc. Depending on the options, the older ones may be
+// compressed or stored as deltas against the next newer one; see the snapshotdir package.
+func csDump(ctx context.Context, snapdirPath string, snapshots snapshotdir.Options, generation int, v3snap *ecp_v3_cache.Snapshot) {
+	if snapshots.Count <= 0 {
 		// Don't do snapshotting at all.
 		return
 	}
@@ -329,9 +470,8 @@ func csDump(ctx context.Context, snapdirPath string, numsnaps int, generation in
 		V3:      NewV3ExpandedSnapshot(v3snap),
 	}
 
-	// Next up, marshal as JSON and write to ambex-0.json. Note that we
-	// didn't say anything about a -0 file; that's because it's about to
-	// be renamed.
+	// Next up, marshal as JSON and write it out as ambex-1.json, moving all the older
+	// ones down.
 
 	bs, err := json.MarshalIndent(cs, "", "  ")
 
@@ -340,54 +480,98 @@ func csDump(ctx context.Context, snapdirPath string, numsnaps int, generation in
 		return
 	}
 
-	csPath := path.Join(snapdirPath, "ambex-0.json")
-
-	err = ioutil.WriteFile(csPath, bs, 0644)
+	err = snapshotdir.Write(ctx, snapdirPath, "ambex", ".json", bs, snapshots)
 
 	if err != nil {
 		dlog.Errorf(ctx, "CSNAP: write failure: %s", err)
 	} else {
 		dlog.Infof(ctx, "Saved snapshot %s", version)
 	}
+}
 
-	// Rotate everything one file down. This includes renaming the just-written
-	// ambex-0 to ambex-1.
-	for i := numsnaps; i > 0; i-- {
-		previous := i - 1
-
-		fromPath := path.Join(snapdirPath, fmt.Sprintf("ambex-%d.json", previous))
-		toPath := path.Join(snapdirPath, fmt.Sprintf("ambex-%d.json", i))
-
-		err := os.Rename(fromPath, toPath)
+// snapshotState is what update remembers from one snapshot to the next. It's also what we show
+// in the debug endpoint.
+type snapshotState struct {
+	// Generation is the number of snapshots we've created so far, and is used to version them.
+	Generation int `json:"generation"`
+	// Hash is the content hash of the most recent snapshot.
+	Hash string `json:"hash"`
+	// Skipped is the number of updates that didn't change anything, and so didn't produce a
+	// snapshot.
+	Skipped int `json:"skipped"`
+	// Invalid is why the most recent update didn't produce a snapshot, if it failed validation.
+	Invalid string `json:"invalid,omitempty"`
+}
 
-		if (err != nil) && !os.IsNotExist(err) {
-			dlog.Infof(ctx, "CSNAP: could not rename %s -> %s: %#v", fromPath, toPath, err)
+// hashResources computes a hash of everything in a snapshot. Resources are hashed in a fixed order
+// using their deterministic protobuf encoding, so identical configuration always gives the same
+// hash no matter what order it was loaded in.
+func hashResources(resources map[ecp_v3_resource.Type][]ecp_cache_types.Resource) (string, error) {
+	typeURLs := make([]string, 0, len(resources))
+	for typeURL := range resources {
+		typeURLs = append(typeURLs, typeURL)
+	}
+	sort.Strings(typeURLs)
+
+	hasher := sha256.New()
+	for _, typeURL := range typeURLs {
+		items := make([]ecp_cache_types.Resource, len(resources[typeURL]))
+		copy(items, resources[typeURL])
+		sort.SliceStable(items, func(i, j int) bool {
+			return ecp_v3_cache.GetResourceName(items[i]) < ecp_v3_cache.GetResourceName(items[j])
+		})
+		for _, item := range items {
+			bs, err := ecp_v3_cache.MarshalResource(item)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(hasher, "%s %s %d\n", typeURL, ecp_v3_cache.GetResourceName(item), len(bs))
+			hasher.Write(bs)
 		}
 	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// An updater is everything update needs: the options it was started with, which don't change,
+// and the state that's carried over from one update to the next. Main builds one, and tests build
+// one with just the fields they care about.
+type updater struct {
+	snapdirPath string
+	snapshots   snapshotdir.Options
+	edsBypass   bool
+	deltaXDS    bool
+	validate    bool
+	dirs        []string
+	nodes       *nodeRegistry
+	runtime     *runtimeOverrides
+	updates     chan<- Update
+
+	// The latest endpoints and snapshot from the fastpath.
+	edsEndpointsV3   map[string]*v3endpointconfig.ClusterLoadAssignment
+	fastpathSnapshot *FastpathSnapshot
+
+	state snapshotState
 }
 
 // Get an updated snapshot going.
-func update(
-	ctx context.Context,
-	snapdirPath string,
-	numsnaps int,
-	edsBypass bool,
-	configv3 ecp_v3_cache.SnapshotCache,
-	generation *int,
-	dirs []string,
-	edsEndpointsV3 map[string]*v3endpointconfig.ClusterLoadAssignment,
-	fastpathSnapshot *FastpathSnapshot,
-	updates chan<- Update,
-) error {
+func (u *updater) update(ctx context.Context) error {
+	start := time.Now()
 
 	clustersv3 := []ecp_cache_types.Resource{}  // v3.Cluster
 	routesv3 := []ecp_cache_types.Resource{}    // v3.RouteConfiguration
 	listenersv3 := []ecp_cache_types.Resource{} // v3.Listener
 	runtimesv3 := []ecp_cache_types.Resource{}  // v3.Runtime
+	secretsv3 := []ecp_cache_types.Resource{}   // v3.Secret
+
+	// The runtime layers from the bootstrap, which is where the Module's runtime_overrides are.
+	var runtimeLayers []*v3bootstrap.RuntimeLayer
+
+	// Where everything came from, for the validation errors.
+	sources := resourceSources{}
 
 	var filenames []string
 
-	for _, dir := range dirs {
+	for _, dir := range u.dirs {
 		files, err := ioutil.ReadDir(dir)
 		if err != nil {
 			dlog.Warnf(ctx, "Error listing %q: %v", dir, err)
@@ -408,17 +592,19 @@ func update(
 			continue
 		}
 		var dst *[]ecp_cache_types.Resource
+		var typeURL string
 		switch m.(type) {
 		case *v3clusterconfig.Cluster:
-			dst = &clustersv3
+			dst, typeURL = &clustersv3, ecp_v3_resource.ClusterType
 		case *v3routeconfig.RouteConfiguration:
-			dst = &routesv3
+			dst, typeURL = &routesv3, ecp_v3_resource.RouteType
 		case *v3listenerconfig.Listener:
-			dst = &listenersv3
+			dst, typeURL = &listenersv3, ecp_v3_resource.ListenerType
 		case *v3runtime.Runtime:
-			dst = &runtimesv3
+			dst, typeURL = &runtimesv3, ecp_v3_resource.RuntimeType
 		case *v3bootstrap.Bootstrap:
 			bs := m.(*v3bootstrap.Bootstrap)
+			runtimeLayers = append(runtimeLayers, bs.GetLayeredRuntime().GetLayers()...)
 			sr := bs.StaticResources
 			for _, lst := range sr.Listeners {
 				// When the RouteConfiguration is embedded in the listener, it will cause envoy to
@@ -432,16 +618,44 @@ func update(
 				if err != nil {
 					dlog.Errorf(ctx, "Error converting listener to RDS: %+v", err)
 					listenersv3 = append(listenersv3, proto.Clone(lst).(ecp_cache_types.Resource))
+					sources.add(ecp_v3_resource.ListenerType, lst, name)
 					continue
 				}
-				listenersv3 = append(listenersv3, rdsListener)
 				for _, rc := range routeConfigs {
 					// These routes will get included in the configuration snapshot created below.
 					routesv3 = append(routesv3, rc)
+					sources.add(ecp_v3_resource.RouteType, rc, name)
+				}
+				// The same goes for TLS certificates: with the certificates inlined, every
+				// rotation changes the listener, so we hand them to envoy via SDS instead.
+				sdsListener, secrets, err := V3ListenerToSdsListener(rdsListener)
+				if err != nil {
+					dlog.Errorf(ctx, "Error converting listener to SDS: %+v", err)
+					listenersv3 = append(listenersv3, rdsListener)
+					sources.add(ecp_v3_resource.ListenerType, rdsListener, name)
+					continue
+				}
+				listenersv3 = append(listenersv3, sdsListener)
+				sources.add(ecp_v3_resource.ListenerType, sdsListener, name)
+				for _, secret := range secrets {
+					secretsv3 = append(secretsv3, secret)
+					sources.add(ecp_v3_resource.SecretType, secret, name)
 				}
 			}
 			for _, cls := range sr.Clusters {
-				clustersv3 = append(clustersv3, proto.Clone(cls).(ecp_cache_types.Resource))
+				sdsCluster, secrets, err := V3ClusterToSdsCluster(cls)
+				if err != nil {
+					dlog.Errorf(ctx, "Error converting cluster to SDS: %+v", err)
+					clustersv3 = append(clustersv3, proto.Clone(cls).(ecp_cache_types.Resource))
+					sources.add(ecp_v3_resource.ClusterType, cls, name)
+					continue
+				}
+				clustersv3 = append(clustersv3, sdsCluster)
+				sources.add(ecp_v3_resource.ClusterType, sdsCluster, name)
+				for _, secret := range secrets {
+					secretsv3 = append(secretsv3, secret)
+					sources.add(ecp_v3_resource.SecretType, secret, name)
+				}
 			}
 			continue
 		default:
@@ -449,21 +663,39 @@ func update(
 			continue
 		}
 		*dst = append(*dst, m.(ecp_cache_types.Resource))
+		sources.add(typeURL, m.(ecp_cache_types.Resource), name)
 	}
 
-	if fastpathSnapshot != nil && fastpathSnapshot.Snapshot != nil {
-		for _, lst := range fastpathSnapshot.Snapshot.Resources[ecp_cache_types.Listener].Items {
+	if u.fastpathSnapshot != nil && u.fastpathSnapshot.Snapshot != nil {
+		for _, lst := range u.fastpathSnapshot.Snapshot.Resources[ecp_cache_types.Listener].Items {
 			listenersv3 = append(listenersv3, lst.Resource)
+			sources.add(ecp_v3_resource.ListenerType, lst.Resource, "the fastpath snapshot")
 		}
-		for _, route := range fastpathSnapshot.Snapshot.Resources[ecp_cache_types.Route].Items {
+		for _, route := range u.fastpathSnapshot.Snapshot.Resources[ecp_cache_types.Route].Items {
 			routesv3 = append(routesv3, route.Resource)
+			sources.add(ecp_v3_resource.RouteType, route.Resource, "the fastpath snapshot")
 		}
-		for _, clu := range fastpathSnapshot.Snapshot.Resources[ecp_cache_types.Cluster].Items {
+		for _, clu := range u.fastpathSnapshot.Snapshot.Resources[ecp_cache_types.Cluster].Items {
 			clustersv3 = append(clustersv3, clu.Resource)
+			sources.add(ecp_v3_resource.ClusterType, clu.Resource, "the fastpath snapshot")
+		}
+		for _, secret := range u.fastpathSnapshot.Snapshot.Resources[ecp_cache_types.Secret].Items {
+			secretsv3 = append(secretsv3, secret.Resource)
+			sources.add(ecp_v3_resource.SecretType, secret.Resource, "the fastpath snapshot")
 		}
 		// We intentionally omit endpoints since those are carried separately.
 	}
 
+	// We always serve the RTDS layer, even if it's empty, because Envoy waits for it before it
+	// finishes starting up.
+	rt, err := runtimeLayer(runtimeLayers, u.runtime.get())
+	if err != nil {
+		dlog.Errorf(ctx, "Error building runtime layer: %v", err)
+	} else {
+		runtimesv3 = append(runtimesv3, rt)
+		sources.add(ecp_v3_resource.RuntimeType, rt, "the Module's runtime_overrides and the runtime API")
+	}
+
 	// The configuration data that reaches us here arrives via two parallel paths that race each
 	// other. The endpoint data comes in realtime directly from the golang watcher in the entrypoint
 	// package. The cluster configuration comes from the python code. Either one can win which means
@@ -487,13 +719,7 @@ func update(
 	// warmup sequence in scenarios where the endpoint data for a cluster is really flapping into
 	// and out of existence. In that circumstance we want to faithfully relay to envoy that the
 	// cluster exists but currently has no endpoints.
-	endpointsv3 := JoinEdsClustersV3(ctx, clustersv3, edsEndpointsV3, edsBypass)
-
-	// Create a new configuration snapshot from everything we have just loaded from disk.
-	curgen := *generation
-	*generation++
-
-	version := fmt.Sprintf("v%d", curgen)
+	endpointsv3 := JoinEdsClustersV3(ctx, clustersv3, u.edsEndpointsV3, u.edsBypass)
 
 	snapshotResources := map[ecp_v3_resource.Type][]ecp_cache_types.Resource{
 		ecp_v3_resource.EndpointType: endpointsv3,
@@ -501,8 +727,50 @@ func update(
 		ecp_v3_resource.RouteType:    routesv3,
 		ecp_v3_resource.ListenerType: listenersv3,
 		ecp_v3_resource.RuntimeType:  runtimesv3,
+		ecp_v3_resource.SecretType:   secretsv3,
 	}
 
+	// We get woken up for lots of reasons that don't actually change anything: the Python side
+	// rewriting identical files, endpoint updates for services nobody routes to, etc. Pushing a
+	// snapshot for those would just make Envoy do work for nothing, and would count against the
+	// stale-config rate limit in the Updater, so if the content is the same as last time we skip
+	// it entirely.
+	//
+	// Note that the snapshot version is still just the generation, not this hash: Envoy only warms
+	// a changed cluster once it gets an EDS response, and the cache only sends one when the EDS
+	// version changes.
+	hash, err := hashResources(snapshotResources)
+	if err != nil {
+		dlog.Errorf(ctx, "V3 Snapshot hash error: %v", err)
+		return nil
+	}
+	if hash == u.state.Hash {
+		u.state.Skipped++
+		snapshotsSkipped.Inc()
+		debug.FromContext(ctx).Value("ambexSnapshots").Store(u.state)
+		dlog.Debugf(ctx, "Skipping snapshot: no changes since v%d", u.state.Generation-1)
+		return nil
+	}
+
+	// Envoy rejects a whole snapshot if anything in it is wrong, and keeps running the old
+	// configuration, so if we can tell that Envoy is going to reject it, there's no point sending
+	// it. Better still, we can say which file the problem came from, which Envoy can't.
+	if u.validate {
+		if err := validateSnapshot(snapshotResources, sources); err != nil {
+			u.state.Invalid = err.Error()
+			snapshotsInvalid.Inc()
+			debug.FromContext(ctx).Value("ambexSnapshots").Store(u.state)
+			dlog.Errorf(ctx, "V3 Snapshot rejected: %v", err)
+			return nil
+		}
+	}
+	u.state.Invalid = ""
+
+	// Create a new configuration snapshot from everything we have just loaded from disk.
+	curgen := u.state.Generation
+
+	version := fmt.Sprintf("v%d", curgen)
+
 	snapshot, err := ecp_v3_cache.NewSnapshot(version, snapshotResources)
 	if err != nil {
 		dlog.Errorf(ctx, "V3 Snapshot error: %v", err)
@@ -515,17 +783,42 @@ func update(
 		return nil // TODO: should we return the error, rather than just logging it?
 	}
 
+	u.state.Generation++
+	u.state.Hash = hash
+	debug.FromContext(ctx).Value("ambexSnapshots").Store(u.state)
+	snapshotGeneration.Set(float64(curgen))
+	for typeURL, resources := range snapshotResources {
+		size := 0
+		for _, resource := range resources {
+			size += proto.Size(resource)
+		}
+		snapshotResourceCount.WithLabelValues(typeURL).Set(float64(len(resources)))
+		snapshotBytes.WithLabelValues(typeURL).Set(float64(size))
+	}
+
+	// Delta xDS needs a version for every resource, which is the SHA256 hash of the resource's
+	// deterministic protobuf encoding. Unchanged resources therefore keep their versions from one
+	// snapshot to the next, and aren't resent. The cache would build the version map itself when it
+	// needs it, but hashing thousands of resources is expensive enough that we'd rather do it here
+	// than while the cache holds its lock.
+	if u.deltaXDS {
+		if err := snapshot.ConstructVersionMap(); err != nil {
+			dlog.Errorf(ctx, "V3 Snapshot version map error: %v", err)
+			return nil
+		}
+	}
+
 	// This used to just directly update envoy. Since we want ratelimiting, we now send an
 	// Update object down the channel with a function that knows how to do the update if/when
 	// the ratelimiting logic decides.
 
 	dlog.Debugf(ctx, "Created snapshot %s", version)
-	csDump(ctx, snapdirPath, numsnaps, curgen, snapshot)
+	csDump(ctx, u.snapdirPath, u.snapshots, curgen, snapshot)
 
 	update := Update{version, func() error {
 		dlog.Debugf(ctx, "Accepting snapshot %s", version)
 
-		err = configv3.SetSnapshot(ctx, "test-id", snapshot)
+		err = u.nodes.SetSnapshot(ctx, snapshot)
 		if err != nil {
 			return fmt.Errorf("v3 Snapshot error %q for %+v", err, snapshot)
 		}
@@ -533,11 +826,13 @@ func update(
 		return nil
 	}}
 
+	updateSeconds.Observe(time.Since(start).Seconds())
+
 	// We also need to pay attention to contexts here so we can shutdown properly. If we didn't
 	// have the context portion, the ratelimit goroutine could shutdown first and we could end
 	// up blocking here and never shutting down.
 	select {
-	case updates <- update:
+	case u.updates <- update:
 	case <-ctx.Done():
 	}
 	return nil
@@ -548,6 +843,7 @@ type logAdapterBase struct {
 }
 type logAdapterV3 struct {
 	logAdapterBase
+	nodes *nodeRegistry
 }
 
 var _ ecp_v3_server.Callbacks = logAdapterV3{}
@@ -580,14 +876,20 @@ func (l logAdapterBase) OnStreamOpen(ctx context.Context, sid int64, stype strin
 }
 
 // OnStreamClosed implements ecp_v3_server.Callbacks.
-func (l logAdapterBase) OnStreamClosed(sid int64, node *v3core.Node) {
+func (l logAdapterV3) OnStreamClosed(sid int64, node *v3core.Node) {
 	dlog.Debugf(context.TODO(), "%v Stream closed[%v]", l.prefix, sid)
+	if l.nodes != nil {
+		l.nodes.streamClosed(context.TODO(), streamKey{false, sid})
+	}
 }
 
 // OnStreamRequest implements ecp_v3_server.Callbacks.
 func (l logAdapterV3) OnStreamRequest(sid int64, req *v3discovery.DiscoveryRequest) error {
 	dlog.Debugf(context.TODO(), "V3 Stream request[%v] for type %s: requesting %d resources", sid, req.TypeUrl, len(req.ResourceNames))
 	dlog.Debugf(context.TODO(), "V3 Stream request[%v] dump: %v", sid, req)
+	if l.nodes != nil {
+		l.nodes.streamRequest(context.TODO(), streamKey{false, sid}, req.Node, req.TypeUrl, req.ResponseNonce, req.ErrorDetail)
+	}
 	return nil
 }
 
@@ -595,6 +897,9 @@ func (l logAdapterV3) OnStreamRequest(sid int64, req *v3discovery.DiscoveryReque
 func (l logAdapterV3) OnStreamResponse(ctx context.Context, sid int64, req *v3discovery.DiscoveryRequest, res *v3discovery.DiscoveryResponse) {
 	dlog.Debugf(ctx, "V3 Stream response[%v] for type %s: returning %d resources", sid, res.TypeUrl, len(res.Resources))
 	dlog.Debugf(ctx, "V3 Stream dump response[%v]: %v -> %v", sid, req, res)
+	if l.nodes != nil {
+		l.nodes.streamResponse(streamKey{false, sid}, res.TypeUrl, res.Nonce, res.VersionInfo)
+	}
 }
 
 // OnDeltaStreamOpen implements ecp_v3_server.Callbacks.
@@ -606,12 +911,18 @@ func (l logAdapterV3) OnDeltaStreamOpen(ctx context.Context, sid int64, stype st
 // OnDeltaStreamClosed implements ecp_v3_server.Callbacks.
 func (l logAdapterV3) OnDeltaStreamClosed(sid int64, node *v3core.Node) {
 	dlog.Debugf(context.TODO(), "%v DeltaStream closed[%v]", l.prefix, sid)
+	if l.nodes != nil {
+		l.nodes.streamClosed(context.TODO(), streamKey{true, sid})
+	}
 }
 
 // OnStreamDeltaRequest implements ecp_v3_server.Callbacks.
 func (l logAdapterV3) OnStreamDeltaRequest(sid int64, req *v3discovery.DeltaDiscoveryRequest) error {
 	dlog.Debugf(context.TODO(), "V3 Stream DeltaRequest[%v] for type %s: subscribing for %d resources", sid, req.TypeUrl, len(req.ResourceNamesSubscribe))
 	dlog.Debugf(context.TODO(), "V3 Stream DeltaRequest[%v] dump: %v", sid, req)
+	if l.nodes != nil {
+		l.nodes.streamRequest(context.TODO(), streamKey{true, sid}, req.Node, req.TypeUrl, req.ResponseNonce, req.ErrorDetail)
+	}
 	return nil
 }
 
@@ -619,6 +930,9 @@ func (l logAdapterV3) OnStreamDeltaRequest(sid int64, req *v3discovery.DeltaDisc
 func (l logAdapterV3) OnStreamDeltaResponse(sid int64, req *v3discovery.DeltaDiscoveryRequest, res *v3discovery.DeltaDiscoveryResponse) {
 	dlog.Debugf(context.TODO(), "V3 Stream dump DeltaResponse[%v] for type %s: returning %d resources", sid, res.TypeUrl, len(res.Resources))
 	dlog.Debugf(context.TODO(), "V3 Stream dump DeltaResponse[%v]: %v -> %v", sid, req, res)
+	if l.nodes != nil {
+		l.nodes.streamResponse(streamKey{true, sid}, res.TypeUrl, res.Nonce, res.SystemVersionInfo)
+	}
 }
 
 // OnFetchRequest implements ecp_v3_server.Callbacks.
@@ -636,6 +950,7 @@ func Main(
 	ctx context.Context,
 	Version string,
 	getUsage MemoryGetter,
+	reportNacks NackReporter,
 	fastpathCh <-chan *FastpathSnapshot,
 	rawArgs ...string,
 ) error {
@@ -672,15 +987,50 @@ func Main(
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	configv3 := ecp_v3_cache.NewSnapshotCache(true, HasherV3{}, logAdapterV3{logAdapterBase{"V3"}})
-	serverv3 := ecp_v3_server.NewServer(ctx, configv3, logAdapterV3{logAdapterBase{"V3"}})
+	hasher := HasherV3{ByCluster: args.nodeKeyCluster}
+	configv3 := ecp_v3_cache.NewSnapshotCache(true, hasher, logAdapterV3{logAdapterBase{"V3"}, nil})
+	nodes := newNodeRegistry(ctx, configv3, hasher, args.nackRollback, reportNacks)
+	serverv3 := ecp_v3_server.NewServer(ctx, configv3, logAdapterV3{logAdapterBase{"V3"}, nodes})
 
 	grp := dgroup.NewGroup(ctx, dgroup.GroupConfig{})
 
+	var adsCreds *adsCredentials
+	if args.adsTLSCert != "" {
+		adsCreds, err = newADSCredentials(args.adsTLSCert, args.adsTLSKey, args.adsTLSClientCA)
+		if err != nil {
+			return err
+		}
+		grp.Go("ads-tls-watcher", func(ctx context.Context) error {
+			// Not being able to watch the files isn't worth shutting down for: we just won't
+			// notice when they're rotated.
+			if err := adsCreds.watch(ctx); err != nil {
+				dlog.Errorf(ctx, "ADS TLS credentials won't be reloaded: %v", err)
+			}
+			return nil
+		})
+	}
+
 	grp.Go("management-server", func(ctx context.Context) error {
-		return runManagementServer(ctx, serverv3, args.adsNetwork, args.adsAddress)
+		return runManagementServer(ctx, serverv3, args, adsCreds)
 	})
 
+	var runtime *runtimeOverrides
+	var runtimeChanged <-chan struct{}
+	if args.runtimeAddress != "" {
+		token, err := runtimeToken(args.runtimeTokenPath)
+		if err != nil {
+			return err
+		}
+		runtime, err = loadRuntimeOverrides(ctx, args.runtimePath, args.runtimeAuditPath, token)
+		if err != nil {
+			return err
+		}
+		runtimeChanged = runtime.changed
+		grp.Go("runtime-server", func(ctx context.Context) error {
+			return runRuntimeServer(ctx, runtime, args.runtimeAddress)
+		})
+	}
+
 	pid := os.Getpid()
 	file := "ambex.pid"
 	if err := ioutil.WriteFile(file, []byte(fmt.Sprintf("%v", pid)), 0644); err != nil {
@@ -696,26 +1046,24 @@ func Main(
 		return Updater(ctx, updates, getUsage)
 	})
 	grp.Go("main-loop", func(ctx context.Context) error {
-		generation := 0
-		var fastpathSnapshot *FastpathSnapshot
-		edsEndpointsV3 := map[string]*v3endpointconfig.ClusterLoadAssignment{}
+		u := &updater{
+			snapdirPath:    args.snapdirPath,
+			snapshots:      args.snapshots,
+			edsBypass:      args.edsBypass,
+			deltaXDS:       args.deltaXDS,
+			validate:       !args.skipValidation,
+			dirs:           args.dirs,
+			nodes:          nodes,
+			runtime:        runtime,
+			updates:        updates,
+			edsEndpointsV3: map[string]*v3endpointconfig.ClusterLoadAssignment{},
+		}
 
 		// We always start by updating with a totally empty snapshot.
 		//
 		// XXX This seems questionable: why do we do this? Envoy isn't currently started until
 		// we have a real configuration...
-		err = update(
-			ctx,
-			args.snapdirPath,
-			args.numsnaps,
-			args.edsBypass,
-			configv3,
-			&generation,
-			args.dirs,
-			edsEndpointsV3,
-			fastpathSnapshot,
-			updates,
-		)
+		err = u.update(ctx)
 		if err != nil {
 			return err
 		}
@@ -725,56 +1073,29 @@ func Main(
 
 			select {
 			case <-sigCh:
-				err := update(
-					ctx,
-					args.snapdirPath,
-					args.numsnaps,
-					args.edsBypass,
-					configv3,
-					&generation,
-					args.dirs,
-					edsEndpointsV3,
-					fastpathSnapshot,
-					updates,
-				)
+				err := u.update(ctx)
 				if err != nil {
 					return err
 				}
 			case fpSnap := <-fastpathCh:
 				// Fastpath update. Grab new endpoints and update.
 				if fpSnap.Endpoints != nil {
-					edsEndpointsV3 = fpSnap.Endpoints.ToMap_v3()
+					u.edsEndpointsV3 = fpSnap.Endpoints.ToMap_v3()
+				}
+				u.fastpathSnapshot = fpSnap
+				err := u.update(ctx)
+				if err != nil {
+					return err
 				}
-				fastpathSnapshot = fpSnap
-				err := update(
-					ctx,
-					args.snapdirPath,
-					args.numsnaps,
-					args.edsBypass,
-					configv3,
-					&generation,
-					args.dirs,
-					edsEndpointsV3,
-					fastpathSnapshot,
-					updates,
-				)
+			case <-runtimeChanged:
+				// Someone changed the runtime overrides.
+				err := u.update(ctx)
 				if err != nil {
 					return err
 				}
 			case <-watcher.Events:
 				// Non-fastpath update. Just update.
-				err := update(
-					ctx,
-					args.snapdirPath,
-					args.numsnaps,
-					args.edsBypass,
-					configv3,
-					&generation,
-					args.dirs,
-					edsEndpointsV3,
-					fastpathSnapshot,
-					updates,
-				)
+				err := u.update(ctx)
 				if err != nil {
 					return err
 				}
@@ -0,0 +1,137 @@
+package ambex
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v3core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	v3endpointconfig "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	ecp_v3_cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	ecp_v3_resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+
+	"github.com/datawire/dlib/dlog"
+)
+
+func writeCluster(t *testing.T, dir, name, timeout string) {
+	t.Helper()
+	cluster := `{
+  "@type": "/envoy.config.cluster.v3.Cluster",
+  "name": "` + name + `",
+  "connect_timeout": "` + timeout + `",
+  "type": "EDS",
+  "eds_cluster_config": {"eds_config": {"ads": {}}}
+}`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".json"), []byte(cluster), 0644))
+}
+
+func TestUpdateDeltaVersions(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	dir := t.TempDir()
+	writeCluster(t, dir, "foo", "1s")
+	writeCluster(t, dir, "bar", "1s")
+
+	cache := ecp_v3_cache.NewSnapshotCache(true, HasherV3{}, logAdapterV3{logAdapterBase{"V3"}, nil})
+	nodes := newNodeRegistry(ctx, cache, HasherV3{}, false, nil)
+	nodes.streamRequest(ctx, streamKey{true, 1}, &v3core.Node{Id: "test-id"}, ecp_v3_resource.ClusterType, "", nil)
+	updates := make(chan Update, 1)
+	u := &updater{deltaXDS: true, validate: true, dirs: []string{dir}, nodes: nodes, updates: updates}
+
+	versions := func() map[string]string {
+		require.NoError(t, u.update(ctx))
+		require.NoError(t, (<-updates).Update())
+		snapshot, err := cache.GetSnapshot("test-id")
+		require.NoError(t, err)
+		return snapshot.GetVersionMap(ecp_v3_resource.ClusterType)
+	}
+
+	first := versions()
+	require.Len(t, first, 2)
+
+	// Only the cluster that changed gets a new version, even though the snapshot's version
+	// changes every time.
+	writeCluster(t, dir, "bar", "2s")
+	second := versions()
+	require.Len(t, second, 2)
+	assert.Equal(t, first["foo"], second["foo"])
+	assert.NotEqual(t, first["bar"], second["bar"])
+}
+
+func TestUpdateSkipsNoopSnapshots(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	dir := t.TempDir()
+	writeCluster(t, dir, "foo", "1s")
+	writeCluster(t, dir, "bar", "1s")
+
+	cache := ecp_v3_cache.NewSnapshotCache(true, HasherV3{}, logAdapterV3{logAdapterBase{"V3"}, nil})
+	nodes := newNodeRegistry(ctx, cache, HasherV3{}, false, nil)
+	updates := make(chan Update, 1)
+	u := &updater{validate: true, dirs: []string{dir}, nodes: nodes, updates: updates}
+
+	require.NoError(t, u.update(ctx))
+	require.Len(t, updates, 1)
+	assert.Equal(t, "v0", (<-updates).Version)
+
+	// Rewriting a file with the same contents doesn't produce a snapshot...
+	writeCluster(t, dir, "bar", "1s")
+	require.NoError(t, u.update(ctx))
+	assert.Len(t, updates, 0)
+	assert.Equal(t, 1, u.state.Generation)
+	assert.Equal(t, 1, u.state.Skipped)
+
+	// ...and neither does endpoint data that doesn't change the assembled endpoints.
+	u.edsEndpointsV3 = map[string]*v3endpointconfig.ClusterLoadAssignment{}
+	require.NoError(t, u.update(ctx))
+	assert.Len(t, updates, 0)
+	assert.Equal(t, 2, u.state.Skipped)
+
+	// Real changes still get through.
+	u.edsEndpointsV3 = map[string]*v3endpointconfig.ClusterLoadAssignment{
+		"foo": {ClusterName: "foo", Endpoints: []*v3endpointconfig.LocalityLbEndpoints{{}}},
+	}
+	require.NoError(t, u.update(ctx))
+	require.Len(t, updates, 1)
+	assert.Equal(t, "v1", (<-updates).Version)
+	assert.Equal(t, 2, u.state.Skipped)
+}
+
+func TestUpdateRejectsInvalidSnapshots(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	dir := t.TempDir()
+	listener := `{
+  "@type": "/envoy.config.listener.v3.Listener",
+  "name": "tcp",
+  "address": {"socket_address": {"address": "0.0.0.0", "port_value": 8080}},
+  "filter_chains": [{"filters": [{
+    "name": "envoy.filters.network.tcp_proxy",
+    "typed_config": {
+      "@type": "type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy",
+      "stat_prefix": "tcp",
+      "cluster": "backend"
+    }
+  }]}]
+}`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "listener.json"), []byte(listener), 0644))
+
+	cache := ecp_v3_cache.NewSnapshotCache(true, HasherV3{}, logAdapterV3{logAdapterBase{"V3"}, nil})
+	nodes := newNodeRegistry(ctx, cache, HasherV3{}, false, nil)
+	updates := make(chan Update, 1)
+	u := &updater{validate: true, dirs: []string{dir}, nodes: nodes, updates: updates}
+
+	// The listener refers to a cluster that doesn't exist, so Envoy would reject it.
+	require.NoError(t, u.update(ctx))
+	assert.Len(t, updates, 0)
+	assert.Equal(t, 0, u.state.Generation)
+	assert.Contains(t, u.state.Invalid, `refers to cluster "backend"`)
+	assert.Contains(t, u.state.Invalid, filepath.Join(dir, "listener.json"))
+
+	// Once the cluster shows up, the snapshot goes through.
+	writeCluster(t, dir, "backend", "1s")
+	require.NoError(t, u.update(ctx))
+	require.Len(t, updates, 1)
+	assert.Equal(t, "v0", (<-updates).Version)
+	assert.Empty(t, u.state.Invalid)
+}
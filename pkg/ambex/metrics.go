@@ -0,0 +1,70 @@
+package ambex
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/emissary-ingress/emissary/v3/pkg/metrics"
+)
+
+var (
+	updateSeconds = metrics.Factory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "emissary_ambex_update_duration_seconds",
+		Help:    "Time taken by ambex to load the Envoy configuration and build a snapshot from it.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+	snapshotGeneration = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Name: "emissary_ambex_snapshot_generation",
+		Help: "Generation of the most recent ambex snapshot.",
+	})
+	snapshotsSkipped = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Name: "emissary_ambex_snapshots_skipped_total",
+		Help: "Number of ambex updates skipped because nothing changed since the last snapshot.",
+	})
+	snapshotsInvalid = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Name: "emissary_ambex_snapshots_invalid_total",
+		Help: "Number of ambex updates rejected because Envoy would have rejected the snapshot.",
+	})
+	runtimeOverridesGauge = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Name: "emissary_ambex_runtime_overrides",
+		Help: "Number of Envoy runtime keys overridden through the ambex runtime API.",
+	})
+	snapshotResourceCount = metrics.Factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "emissary_ambex_snapshot_resources",
+		Help: "Number of resources in the most recent ambex snapshot, by type URL.",
+	}, []string{"type"})
+	snapshotBytes = metrics.Factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "emissary_ambex_snapshot_bytes",
+		Help: "Encoded size of the resources in the most recent ambex snapshot, by type URL.",
+	}, []string{"type"})
+
+	envoyReconfigs = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Name: "emissary_ambex_envoy_reconfigs_total",
+		Help: "Number of snapshots pushed to Envoy.",
+	})
+	envoyReconfigsThrottled = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Name: "emissary_ambex_envoy_reconfigs_throttled_total",
+		Help: "Number of times a snapshot was held back because of memory pressure.",
+	})
+	staleReconfigsGauge = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Name: "emissary_ambex_stale_reconfigs",
+		Help: "Number of reconfigs within the drain time, whose configuration Envoy may still hold.",
+	})
+	staleReconfigsMax = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Name: "emissary_ambex_stale_reconfigs_max",
+		Help: "Maximum number of stale reconfigs allowed at the current memory usage; 0 means no limit.",
+	})
+
+	xdsNodes = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Name: "emissary_ambex_xds_nodes",
+		Help: "Number of Envoy nodes connected to ambex.",
+	})
+	xdsAckSeconds = metrics.Factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "emissary_ambex_xds_ack_duration_seconds",
+		Help:    "Time from a snapshot being handed to the snapshot cache until an Envoy node ACKs it, by type URL.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"type"})
+	xdsNacks = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "emissary_ambex_xds_nacks_total",
+		Help: "Number of responses NACKed by Envoy nodes, by type URL.",
+	}, []string{"type"})
+)
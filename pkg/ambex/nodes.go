@@ -0,0 +1,428 @@
+package ambex
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+
+	v3core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	ecp_v3_cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	ecp_v3_resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/debug"
+)
+
+// historySize is how many of the most recent snapshots we keep around to roll back to.
+const historySize = 10
+
+// A NackReporter is called whenever the configuration that Envoy is rejecting changes. The error
+// describes every rejection, and is nil once Envoy has accepted a configuration for everything it
+// rejected.
+type NackReporter func(err error)
+
+// nodeInfo is the connection state of a single Envoy node, as shown in the debug endpoint.
+type nodeInfo struct {
+	ID          string    `json:"id"`
+	Cluster     string    `json:"cluster"`
+	Key         string    `json:"key"`
+	Streams     int       `json:"streams"`
+	Connected   time.Time `json:"connected"`
+	LastRequest time.Time `json:"lastRequest"`
+
+	// Acked is the most recent version the node accepted, by type URL.
+	Acked map[string]string `json:"acked,omitempty"`
+	// Rejected is the configuration the node is currently rejecting, by type URL.
+	Rejected map[string]rejection `json:"rejected,omitempty"`
+}
+
+// A rejection is a version of a resource type that an Envoy NACKed.
+type rejection struct {
+	Version string    `json:"version"`
+	Error   string    `json:"error"`
+	Time    time.Time `json:"time"`
+
+	// serial is the serial number of the rejected snapshot, so that we can tell whether a later
+	// ACK is for something at least as new.
+	serial uint64
+}
+
+// streamKey identifies an xDS stream. The state-of-the-world and delta servers number their
+// streams independently, so the stream ID alone isn't enough.
+type streamKey struct {
+	delta bool
+	id    int64
+}
+
+// nodeID identifies an Envoy node. Envoys in different clusters can share a node ID (e.g. if
+// they're all started from the same bootstrap), so the ID alone isn't enough.
+type nodeID struct {
+	id      string
+	cluster string
+}
+
+// streamInfo is the node that a stream belongs to, and the node key that the stream counts
+// towards.
+type streamInfo struct {
+	node nodeID
+	key  string
+}
+
+// typeState is what we know about a single resource type on a single stream: the last response we
+// sent, and the last version that was ACKed.
+type typeState struct {
+	nonce   string
+	version string
+	acked   string
+}
+
+// The nodeRegistry keeps track of which Envoy nodes are connected, and makes sure that every one
+// of them has the latest snapshot in the SnapshotCache. The SnapshotCache holds a snapshot per node
+// key (as computed by the HasherV3), but we don't know what nodes there are until they connect, so
+// we hand a node the latest snapshot on the first request of its first stream. Once the last
+// stream for a node key closes, its snapshot is removed from the cache again.
+//
+// The registry also keeps track of which responses each node ACKs and NACKs. If rollback is
+// enabled, a node that NACKs a snapshot is handed the last snapshot it accepted for that type
+// again, so that it doesn't end up running a mix of the old and new configuration. While any
+// rejection is outstanding, nodes that connect are handed the last snapshot that was accepted
+// rather than the one that's being rejected.
+//
+// Snapshots are per node key, not per node, so rolling back a key rolls back every node with that
+// key. We only do that automatically when the rejecting node is the only one connected with its
+// key: otherwise one misbehaving node would take the others back with it, so the rejection is
+// just reported.
+type nodeRegistry struct {
+	cache    ecp_v3_cache.SnapshotCache
+	hasher   HasherV3
+	rollback bool
+	report   NackReporter
+	info     *atomic.Value
+
+	mu       sync.Mutex
+	latest   *ecp_v3_cache.Snapshot
+	good     *ecp_v3_cache.Snapshot // the newest snapshot accepted by a node, with nothing older rejected
+	history  []*ecp_v3_cache.Snapshot
+	setAt    map[string]time.Time // snapshot version -> when it was set, for the history
+	serials  map[string]uint64    // snapshot version -> serial number, for the history
+	serial   uint64               // the serial number of the latest snapshot
+	streams  map[streamKey]streamInfo
+	types    map[streamKey]map[string]*typeState
+	nodes    map[nodeID]*nodeInfo
+	keys     map[string]int // node key -> number of streams
+	reported string         // the rejections most recently handed to report
+}
+
+func newNodeRegistry(ctx context.Context, cache ecp_v3_cache.SnapshotCache, hasher HasherV3, rollback bool, report NackReporter) *nodeRegistry {
+	return &nodeRegistry{
+		cache:    cache,
+		hasher:   hasher,
+		rollback: rollback,
+		report:   report,
+		info:     debug.FromContext(ctx).Value("xdsNodes"),
+		setAt:    map[string]time.Time{},
+		serials:  map[string]uint64{},
+		streams:  map[streamKey]streamInfo{},
+		types:    map[streamKey]map[string]*typeState{},
+		nodes:    map[nodeID]*nodeInfo{},
+		keys:     map[string]int{},
+	}
+}
+
+// snapshotVersion returns the version of a snapshot. We always use the same version for every
+// resource type.
+func snapshotVersion(snapshot *ecp_v3_cache.Snapshot) string {
+	return snapshot.GetVersion(ecp_v3_resource.ClusterType)
+}
+
+// SetSnapshot makes snapshot the latest snapshot, and hands it to every connected node.
+func (r *nodeRegistry) SetSnapshot(ctx context.Context, snapshot *ecp_v3_cache.Snapshot) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.latest = snapshot
+	r.history = append(r.history, snapshot)
+	r.setAt[snapshotVersion(snapshot)] = time.Now()
+	r.serial++
+	r.serials[snapshotVersion(snapshot)] = r.serial
+	if len(r.history) > historySize {
+		for _, old := range r.history[:len(r.history)-historySize] {
+			delete(r.setAt, snapshotVersion(old))
+			delete(r.serials, snapshotVersion(old))
+		}
+		r.history = r.history[len(r.history)-historySize:]
+	}
+
+	keys := make([]string, 0, len(r.keys))
+	for key := range r.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := r.cache.SetSnapshot(ctx, key, snapshot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamRequest records a request on a stream. The first request on a stream registers the stream
+// with its node, and if this is the first stream for the node's key, hands the node the latest
+// snapshot. This has to happen before the server asks the cache for a watch, which is why it's
+// called from the request callbacks.
+//
+// A request that carries the nonce of the last response we sent for its type is either an ACK or,
+// if errorDetail is set, a NACK of that response.
+func (r *nodeRegistry) streamRequest(ctx context.Context, stream streamKey, node *v3core.Node, typeURL, nonce string, errorDetail *rpcstatus.Status) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	si, ok := r.streams[stream]
+	if !ok {
+		if node == nil {
+			return
+		}
+		si = r.register(ctx, stream, node, now)
+	}
+	info := r.nodes[si.node]
+	info.LastRequest = now
+
+	ts := r.types[stream][typeURL]
+	if nonce == "" || ts == nil || ts.nonce != nonce {
+		// Either the first request for the type, or a stale one.
+		return
+	}
+
+	if errorDetail == nil {
+		if setAt, ok := r.setAt[ts.version]; ok && ts.acked != ts.version {
+			xdsAckSeconds.WithLabelValues(typeURL).Observe(now.Sub(setAt).Seconds())
+		}
+		ts.acked = ts.version
+		info.Acked[typeURL] = ts.version
+		// ACKing the snapshot we rolled back to doesn't make the rejection go away: only accepting
+		// something at least as new as what was rejected does. Versions that have dropped out of
+		// the history have serial 0, and count as older than anything.
+		if rej, ok := info.Rejected[typeURL]; ok && r.serials[ts.version] >= rej.serial {
+			delete(info.Rejected, typeURL)
+		}
+		r.markGood(ts.version)
+	} else {
+		dlog.Errorf(ctx, "xDS node %q rejected %s version %s: %s", info.ID, typeURL, ts.version, errorDetail.GetMessage())
+		xdsNacks.WithLabelValues(typeURL).Inc()
+		info.Rejected[typeURL] = rejection{Version: ts.version, Error: errorDetail.GetMessage(), Time: now, serial: r.serials[ts.version]}
+		if r.rollback && ts.acked != "" && ts.acked != ts.version {
+			if n := r.nodesWithKey(si.key); n > 1 {
+				dlog.Warnf(ctx, "not rolling xDS node key %q back to snapshot %s: %d nodes share it", si.key, ts.acked, n)
+			} else {
+				r.rollbackTo(ctx, si.key, ts.acked)
+			}
+		}
+	}
+	r.storeInfo()
+	r.reportRejections()
+}
+
+// register adds a new stream for a node. It must be called with the mutex held.
+func (r *nodeRegistry) register(ctx context.Context, stream streamKey, node *v3core.Node, now time.Time) streamInfo {
+	si := streamInfo{node: nodeID{node.Id, node.Cluster}, key: r.hasher.ID(node)}
+	key := si.key
+	r.streams[stream] = si
+	r.types[stream] = map[string]*typeState{}
+	info, ok := r.nodes[si.node]
+	if !ok {
+		info = &nodeInfo{
+			ID:        node.Id,
+			Cluster:   node.Cluster,
+			Key:       key,
+			Connected: now,
+			Acked:     map[string]string{},
+			Rejected:  map[string]rejection{},
+		}
+		r.nodes[si.node] = info
+		dlog.Infof(ctx, "xDS node %q (cluster %q) connected", node.Id, node.Cluster)
+	}
+	info.Streams++
+
+	r.keys[key]++
+	if r.keys[key] == 1 && r.latest != nil {
+		snapshot := r.latest
+		if r.rollback && r.good != nil && r.rejected(r.serial) {
+			snapshot = r.good
+			dlog.Warnf(ctx, "handing xDS node key %q snapshot %s rather than rejected snapshot %s", key, snapshotVersion(snapshot), snapshotVersion(r.latest))
+		}
+		if err := r.cache.SetSnapshot(ctx, key, snapshot); err != nil {
+			dlog.Errorf(ctx, "unable to set snapshot for xDS node key %q: %v", key, err)
+		}
+	}
+	r.storeInfo()
+	return si
+}
+
+// rejected returns whether any node is rejecting a snapshot with the given serial number or an
+// older one. It must be called with the mutex held.
+func (r *nodeRegistry) rejected(serial uint64) bool {
+	for _, info := range r.nodes {
+		for _, rej := range info.Rejected {
+			if rej.serial <= serial {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// markGood records that a node accepted the snapshot with the given version. It becomes the last
+// known good snapshot if it's newer than the current one, and nothing at least as old is being
+// rejected. It must be called with the mutex held.
+func (r *nodeRegistry) markGood(version string) {
+	serial, ok := r.serials[version]
+	if !ok || (r.good != nil && serial <= r.serials[snapshotVersion(r.good)]) || r.rejected(serial) {
+		return
+	}
+	for _, snapshot := range r.history {
+		if snapshotVersion(snapshot) == version {
+			r.good = snapshot
+		}
+	}
+}
+
+// streamResponse records a response that we're about to send on a stream, so that we know what
+// version the node is ACKing or NACKing when it replies.
+func (r *nodeRegistry) streamResponse(stream streamKey, typeURL, nonce, version string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	types, ok := r.types[stream]
+	if !ok {
+		return
+	}
+	ts, ok := types[typeURL]
+	if !ok {
+		ts = &typeState{}
+		types[typeURL] = ts
+	}
+	ts.nonce = nonce
+	ts.version = version
+}
+
+// nodesWithKey returns the number of connected nodes with the given key. It must be called with the
+// mutex held.
+func (r *nodeRegistry) nodesWithKey(key string) int {
+	n := 0
+	for _, info := range r.nodes {
+		if info.Key == key {
+			n++
+		}
+	}
+	return n
+}
+
+// rollbackTo hands the snapshot with the given version back to the nodes with the given key. It
+// must be called with the mutex held.
+func (r *nodeRegistry) rollbackTo(ctx context.Context, key, version string) {
+	var target *ecp_v3_cache.Snapshot
+	for _, snapshot := range r.history {
+		if snapshotVersion(snapshot) == version {
+			target = snapshot
+		}
+	}
+	if target == nil {
+		dlog.Warnf(ctx, "unable to roll xDS node key %q back to snapshot %s: it's too old", key, version)
+		return
+	}
+
+	dlog.Warnf(ctx, "rolling xDS node key %q back to snapshot %s", key, version)
+	if err := r.cache.SetSnapshot(ctx, key, target); err != nil {
+		dlog.Errorf(ctx, "unable to roll xDS node key %q back to snapshot %s: %v", key, version, err)
+	}
+}
+
+// streamClosed forgets about a stream, and about its node if that was the node's last stream.
+func (r *nodeRegistry) streamClosed(ctx context.Context, stream streamKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	si, ok := r.streams[stream]
+	if !ok {
+		return
+	}
+	delete(r.streams, stream)
+	delete(r.types, stream)
+
+	info := r.nodes[si.node]
+	info.Streams--
+	if info.Streams == 0 {
+		delete(r.nodes, si.node)
+		dlog.Infof(ctx, "xDS node %q (cluster %q) disconnected", info.ID, info.Cluster)
+	}
+
+	// The stream counts towards the key it was registered with, which isn't necessarily the
+	// key of the node's first stream.
+	r.keys[si.key]--
+	if r.keys[si.key] == 0 {
+		delete(r.keys, si.key)
+		r.cache.ClearSnapshot(si.key)
+	}
+	r.storeInfo()
+	r.reportRejections()
+}
+
+// storeInfo publishes the state of all the connected nodes to the debug endpoint. It must be
+// called with the mutex held.
+func (r *nodeRegistry) storeInfo() {
+	result := make([]nodeInfo, 0, len(r.nodes))
+	for _, info := range r.nodes {
+		// The debug endpoint marshals the result without holding our mutex, so it needs its own
+		// copy of the maps.
+		cp := *info
+		cp.Acked = make(map[string]string, len(info.Acked))
+		for k, v := range info.Acked {
+			cp.Acked[k] = v
+		}
+		cp.Rejected = make(map[string]rejection, len(info.Rejected))
+		for k, v := range info.Rejected {
+			cp.Rejected[k] = v
+		}
+		result = append(result, cp)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ID != result[j].ID {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].Cluster < result[j].Cluster
+	})
+	r.info.Store(result)
+	xdsNodes.Set(float64(len(result)))
+}
+
+// reportRejections hands the current rejections to the NackReporter, if they've changed. It must
+// be called with the mutex held.
+func (r *nodeRegistry) reportRejections() {
+	var msgs []string
+	for _, info := range r.nodes {
+		for typeURL, rej := range info.Rejected {
+			msgs = append(msgs, fmt.Sprintf("node %q rejected %s version %s: %s", info.ID, typeURL, rej.Version, rej.Error))
+		}
+	}
+	sort.Strings(msgs)
+	msg := strings.Join(msgs, "; ")
+	if msg == r.reported {
+		return
+	}
+	r.reported = msg
+	if r.report == nil {
+		return
+	}
+	if msg == "" {
+		r.report(nil)
+	} else {
+		r.report(fmt.Errorf("envoy rejected configuration: %s", msg))
+	}
+}
@@ -0,0 +1,205 @@
+package ambex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+
+	v3core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	ecp_cache_types "github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	ecp_v3_cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	ecp_v3_resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/debug"
+)
+
+func TestNodeRegistry(t *testing.T) {
+	ctx := debug.NewContext(dlog.NewTestContext(t, false), debug.NewDebug())
+	hasher := HasherV3{ByCluster: true}
+	cache := ecp_v3_cache.NewSnapshotCache(true, hasher, logAdapterV3{logAdapterBase{"V3"}, nil})
+	nodes := newNodeRegistry(ctx, cache, hasher, false, nil)
+
+	snapshot, err := ecp_v3_cache.NewSnapshot("v0", map[ecp_v3_resource.Type][]ecp_cache_types.Resource{
+		ecp_v3_resource.ClusterType: {},
+	})
+	require.NoError(t, err)
+
+	// A node that connects before there are any snapshots gets one as soon as there is.
+	nodes.streamRequest(ctx, streamKey{false, 1}, &v3core.Node{Id: "envoy-a", Cluster: "fleet"}, ecp_v3_resource.ClusterType, "", nil)
+	_, err = cache.GetSnapshot("fleet")
+	assert.Error(t, err)
+	require.NoError(t, nodes.SetSnapshot(ctx, snapshot))
+	got, err := cache.GetSnapshot("fleet")
+	require.NoError(t, err)
+	assert.Equal(t, "v0", got.GetVersion(ecp_v3_resource.ClusterType))
+
+	// A node that connects later gets the latest snapshot straight away. Nodes in the same cluster
+	// share it, and later requests on a stream don't need to carry the node.
+	nodes.streamRequest(ctx, streamKey{true, 1}, &v3core.Node{Id: "envoy-b", Cluster: "fleet"}, ecp_v3_resource.ClusterType, "", nil)
+	nodes.streamRequest(ctx, streamKey{false, 2}, &v3core.Node{Id: "other", Cluster: "elsewhere"}, ecp_v3_resource.ClusterType, "", nil)
+	nodes.streamRequest(ctx, streamKey{false, 2}, nil, ecp_v3_resource.ClusterType, "", nil)
+	_, err = cache.GetSnapshot("elsewhere")
+	require.NoError(t, err)
+
+	info := nodes.info.Load().([]nodeInfo)
+	require.Len(t, info, 3)
+	assert.Equal(t, "envoy-a", info[0].ID)
+	assert.Equal(t, "fleet", info[0].Key)
+	assert.Equal(t, 1, info[0].Streams)
+
+	// The snapshot for a key stays until the last of its streams closes.
+	nodes.streamClosed(ctx, streamKey{false, 1})
+	_, err = cache.GetSnapshot("fleet")
+	assert.NoError(t, err)
+	nodes.streamClosed(ctx, streamKey{true, 1})
+	_, err = cache.GetSnapshot("fleet")
+	assert.Error(t, err)
+	assert.Len(t, nodes.info.Load().([]nodeInfo), 1)
+
+	// Envoys in different clusters can share a node ID. Each is its own node, and closing one
+	// doesn't touch the other's snapshot.
+	nodes.streamRequest(ctx, streamKey{false, 3}, &v3core.Node{Id: "envoy", Cluster: "fleet"}, ecp_v3_resource.ClusterType, "", nil)
+	nodes.streamRequest(ctx, streamKey{false, 4}, &v3core.Node{Id: "envoy", Cluster: "elsewhere"}, ecp_v3_resource.ClusterType, "", nil)
+	info = nodes.info.Load().([]nodeInfo)
+	require.Len(t, info, 3)
+	assert.Equal(t, "elsewhere", info[0].Cluster)
+	assert.Equal(t, "fleet", info[1].Cluster)
+	nodes.streamClosed(ctx, streamKey{false, 4})
+	_, err = cache.GetSnapshot("fleet")
+	assert.NoError(t, err)
+	_, err = cache.GetSnapshot("elsewhere")
+	assert.NoError(t, err)
+	nodes.streamClosed(ctx, streamKey{false, 2})
+	_, err = cache.GetSnapshot("elsewhere")
+	assert.Error(t, err)
+	nodes.streamClosed(ctx, streamKey{false, 3})
+	_, err = cache.GetSnapshot("fleet")
+	assert.Error(t, err)
+	assert.Empty(t, nodes.info.Load().([]nodeInfo))
+}
+
+func TestNodeRegistryNack(t *testing.T) {
+	ctx := debug.NewContext(dlog.NewTestContext(t, false), debug.NewDebug())
+	cache := ecp_v3_cache.NewSnapshotCache(true, HasherV3{}, logAdapterV3{logAdapterBase{"V3"}, nil})
+	var reported []error
+	nodes := newNodeRegistry(ctx, cache, HasherV3{}, true, func(err error) {
+		reported = append(reported, err)
+	})
+
+	setSnapshot := func(version string) {
+		snapshot, err := ecp_v3_cache.NewSnapshot(version, map[ecp_v3_resource.Type][]ecp_cache_types.Resource{
+			ecp_v3_resource.ClusterType:  {},
+			ecp_v3_resource.ListenerType: {},
+		})
+		require.NoError(t, err)
+		require.NoError(t, nodes.SetSnapshot(ctx, snapshot))
+	}
+	current := func() string {
+		snapshot, err := cache.GetSnapshot("envoy")
+		require.NoError(t, err)
+		return snapshot.GetVersion(ecp_v3_resource.ListenerType)
+	}
+
+	stream := streamKey{false, 1}
+	node := &v3core.Node{Id: "envoy"}
+	lds := ecp_v3_resource.ListenerType
+
+	setSnapshot("v0")
+	nodes.streamRequest(ctx, stream, node, lds, "", nil)
+	nodes.streamResponse(stream, lds, "1", "v0")
+	nodes.streamRequest(ctx, stream, nil, lds, "1", nil)
+
+	// A NACK is recorded and reported, and the node goes back to what it last accepted.
+	setSnapshot("v1")
+	nodes.streamResponse(stream, lds, "2", "v1")
+	nodes.streamRequest(ctx, stream, nil, lds, "2", &rpcstatus.Status{Message: "bad listener"})
+	require.Len(t, reported, 1)
+	require.Error(t, reported[0])
+	assert.Contains(t, reported[0].Error(), "bad listener")
+	assert.Equal(t, "v0", current())
+
+	info := nodes.info.Load().([]nodeInfo)
+	require.Len(t, info, 1)
+	assert.Equal(t, "v0", info[0].Acked[lds])
+	assert.Equal(t, "v1", info[0].Rejected[lds].Version)
+
+	// Requests with stale nonces don't count.
+	nodes.streamRequest(ctx, stream, nil, lds, "1", nil)
+	assert.Len(t, reported, 1)
+
+	// Nor does ACKing the snapshot we rolled back to.
+	nodes.streamResponse(stream, lds, "rollback", "v0")
+	nodes.streamRequest(ctx, stream, nil, lds, "rollback", nil)
+	assert.Len(t, reported, 1)
+	info = nodes.info.Load().([]nodeInfo)
+	assert.Equal(t, "v1", info[0].Rejected[lds].Version)
+
+	// A node that connects while the rejection is outstanding gets the last snapshot that was
+	// accepted, not the one that's being rejected.
+	nodes.streamRequest(ctx, streamKey{false, 2}, &v3core.Node{Id: "envoy-b"}, lds, "", nil)
+	snapshot, err := cache.GetSnapshot("envoy-b")
+	require.NoError(t, err)
+	assert.Equal(t, "v0", snapshot.GetVersion(lds))
+	nodes.streamClosed(ctx, streamKey{false, 2})
+
+	// Once a later snapshot is accepted, the rejection goes away.
+	setSnapshot("v2")
+	nodes.streamResponse(stream, lds, "3", "v2")
+	nodes.streamRequest(ctx, stream, nil, lds, "3", nil)
+	require.Len(t, reported, 2)
+	assert.NoError(t, reported[1])
+	assert.Equal(t, "v2", current())
+}
+
+func TestNodeRegistryNackSharedKey(t *testing.T) {
+	ctx := debug.NewContext(dlog.NewTestContext(t, false), debug.NewDebug())
+	hasher := HasherV3{ByCluster: true}
+	cache := ecp_v3_cache.NewSnapshotCache(true, hasher, logAdapterV3{logAdapterBase{"V3"}, nil})
+	var reported []error
+	nodes := newNodeRegistry(ctx, cache, hasher, true, func(err error) {
+		reported = append(reported, err)
+	})
+
+	setSnapshot := func(version string) {
+		snapshot, err := ecp_v3_cache.NewSnapshot(version, map[ecp_v3_resource.Type][]ecp_cache_types.Resource{
+			ecp_v3_resource.ClusterType:  {},
+			ecp_v3_resource.ListenerType: {},
+		})
+		require.NoError(t, err)
+		require.NoError(t, nodes.SetSnapshot(ctx, snapshot))
+	}
+	current := func() string {
+		snapshot, err := cache.GetSnapshot("fleet")
+		require.NoError(t, err)
+		return snapshot.GetVersion(ecp_v3_resource.ListenerType)
+	}
+
+	streamA, streamB := streamKey{false, 1}, streamKey{false, 2}
+	lds := ecp_v3_resource.ListenerType
+
+	setSnapshot("v0")
+	nodes.streamRequest(ctx, streamA, &v3core.Node{Id: "envoy-a", Cluster: "fleet"}, lds, "", nil)
+	nodes.streamRequest(ctx, streamB, &v3core.Node{Id: "envoy-b", Cluster: "fleet"}, lds, "", nil)
+	for _, stream := range []streamKey{streamA, streamB} {
+		nodes.streamResponse(stream, lds, "1", "v0")
+		nodes.streamRequest(ctx, stream, nil, lds, "1", nil)
+	}
+
+	// Both nodes share the snapshot for "fleet", so one of them rejecting v1 doesn't roll the
+	// other back: the rejection is only reported.
+	setSnapshot("v1")
+	nodes.streamResponse(streamA, lds, "2", "v1")
+	nodes.streamRequest(ctx, streamA, nil, lds, "2", &rpcstatus.Status{Message: "bad listener"})
+	require.Len(t, reported, 1)
+	assert.Error(t, reported[0])
+	assert.Equal(t, "v1", current())
+
+	// Once the rejecting node is the only one left with the key, it is rolled back.
+	nodes.streamClosed(ctx, streamB)
+	nodes.streamResponse(streamA, lds, "3", "v1")
+	nodes.streamRequest(ctx, streamA, nil, lds, "3", &rpcstatus.Status{Message: "bad listener"})
+	assert.Equal(t, "v0", current())
+}
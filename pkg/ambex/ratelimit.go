@@ -133,10 +133,13 @@ func updaterWithTicker(ctx context.Context, updates <-chan Update, getUsage Memo
 		staleReconfigs := len(updateTimes)
 
 		info.Store(debugInfo{updateTimes, staleReconfigs, maxStaleReconfigs, pushed, disableRatelimiter})
+		staleReconfigsGauge.Set(float64(staleReconfigs))
+		staleReconfigsMax.Set(float64(maxStaleReconfigs))
 
 		// Decide if we have enough capacity left to perform a reconfig.
 		if maxStaleReconfigs > 0 && staleReconfigs >= maxStaleReconfigs {
 			if !tick {
+				envoyReconfigsThrottled.Inc()
 				dlog.Warnf(ctx, "Memory Usage: throttling reconfig %+v due to constrained memory with %d stale reconfigs (%d max)",
 					latest.Version, staleReconfigs, maxStaleReconfigs)
 			}
@@ -158,6 +161,8 @@ func updaterWithTicker(ctx context.Context, updates <-chan Update, getUsage Memo
 		updateTimes = append(updateTimes, now)
 		dlog.Infof(ctx, "Pushing snapshot %+v", latest.Version)
 		pushed = true
+		envoyReconfigs.Inc()
+		staleReconfigsGauge.Set(float64(len(updateTimes)))
 
 		info.Store(debugInfo{updateTimes, staleReconfigs, maxStaleReconfigs, pushed, disableRatelimiter})
 	}
@@ -0,0 +1,361 @@
+package ambex
+
+import (
+	// standard library
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	// third-party libraries
+	"google.golang.org/protobuf/types/known/structpb"
+
+	// envoy api v3
+	v3bootstrap "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	v3runtime "github.com/envoyproxy/go-control-plane/envoy/service/runtime/v3"
+
+	// first-party libraries
+	"github.com/datawire/dlib/dhttp"
+	"github.com/datawire/dlib/dlog"
+)
+
+// RuntimeLayerName is the name of the RTDS layer that ambex serves to Envoy. The Envoy bootstrap
+// that diagd generates has an rtds_layer with this name, and the ADS configuration that diagd hands
+// to ambex has a static_layer with this name holding the Module's runtime_overrides. ambex serves
+// those values, with any overrides set through the runtime API on top.
+const RuntimeLayerName = "ambex_runtime"
+
+// runtimeOverrides are the Envoy runtime keys that operators have set through ambex's runtime API.
+// They're kept in a file so that they survive ambex restarts, and every change is appended to an
+// audit log.
+type runtimeOverrides struct {
+	path      string
+	auditPath string
+	token     string
+
+	// changed gets a value whenever the overrides change, so that the main loop knows to build a
+	// new snapshot.
+	changed chan struct{}
+
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+// runtimeAuditEntry is one line of the audit log.
+type runtimeAuditEntry struct {
+	Time      time.Time   `json:"time"`
+	Remote    string      `json:"remote"`
+	UserAgent string      `json:"user_agent,omitempty"`
+	Key       string      `json:"key"`
+	Old       interface{} `json:"old"`
+	New       interface{} `json:"new"`
+}
+
+// loadRuntimeOverrides loads the overrides persisted at path, if there are any.
+func loadRuntimeOverrides(ctx context.Context, path, auditPath, token string) (*runtimeOverrides, error) {
+	r := &runtimeOverrides{
+		path:      path,
+		auditPath: auditPath,
+		token:     token,
+		changed:   make(chan struct{}, 1),
+		values:    map[string]interface{}{},
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return r, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, &r.values); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for key, value := range r.values {
+		if err := checkRuntimeOverride(key, value); err != nil {
+			dlog.Errorf(ctx, "%s: ignoring %v", path, err)
+			delete(r.values, key)
+		}
+	}
+	runtimeOverridesGauge.Set(float64(len(r.values)))
+	if len(r.values) > 0 {
+		dlog.Infof(ctx, "Loaded %d runtime overrides from %s", len(r.values), path)
+	}
+	return r, nil
+}
+
+// checkRuntimeOverride makes sure that an override is something Envoy can use as a runtime value.
+// A nil value removes the override.
+func checkRuntimeOverride(key string, value interface{}) error {
+	if key == "" || strings.ContainsAny(key, " \t\r\n/") {
+		return fmt.Errorf("invalid runtime key %q", key)
+	}
+	switch value.(type) {
+	case nil, bool, float64, string:
+		return nil
+	default:
+		return fmt.Errorf("runtime key %q: value must be a string, number or boolean", key)
+	}
+}
+
+// get returns a copy of the current overrides. It's OK to call get on a nil *runtimeOverrides.
+func (r *runtimeOverrides) get() map[string]interface{} {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make(map[string]interface{}, len(r.values))
+	for key, value := range r.values {
+		result[key] = value
+	}
+	return result
+}
+
+// set applies changes to the overrides (a nil value removes the override), persists and audits
+// them, and tells the main loop about them.
+func (r *runtimeOverrides) set(ctx context.Context, req *http.Request, changes map[string]interface{}) error {
+	for key, value := range changes {
+		if err := checkRuntimeOverride(key, value); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	values := make(map[string]interface{}, len(r.values))
+	for key, value := range r.values {
+		values[key] = value
+	}
+
+	keys := make([]string, 0, len(changes))
+	for key := range changes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var entries []runtimeAuditEntry
+	now := time.Now().UTC()
+	for _, key := range keys {
+		old, value := values[key], changes[key]
+		if old == value {
+			continue
+		}
+		if value == nil {
+			delete(values, key)
+		} else {
+			values[key] = value
+		}
+		entries = append(entries, runtimeAuditEntry{
+			Time:      now,
+			Remote:    req.RemoteAddr,
+			UserAgent: req.UserAgent(),
+			Key:       key,
+			Old:       old,
+			New:       value,
+		})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	contents, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(r.path+".tmp", contents, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(r.path+".tmp", r.path); err != nil {
+		return err
+	}
+	r.values = values
+	runtimeOverridesGauge.Set(float64(len(values)))
+
+	// The change has been made at this point, so failing to audit it is logged rather than
+	// returned.
+	audit, err := os.OpenFile(r.auditPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		dlog.Errorf(ctx, "Runtime audit log: %v", err)
+	}
+	for _, entry := range entries {
+		dlog.Infof(ctx, "Runtime override %q changed from %v to %v by %s", entry.Key, entry.Old, entry.New, entry.Remote)
+		if audit != nil {
+			line, _ := json.Marshal(entry)
+			if _, err := audit.Write(append(line, '\n')); err != nil {
+				dlog.Errorf(ctx, "Runtime audit log: %v", err)
+			}
+		}
+	}
+	if audit != nil {
+		audit.Close()
+	}
+
+	select {
+	case r.changed <- struct{}{}:
+	default:
+		// There's already a change waiting to be picked up.
+	}
+	return nil
+}
+
+// ServeHTTP implements the runtime API:
+//
+//	GET    /runtime        the current overrides
+//	PATCH  /runtime        set the overrides in a JSON object; a null value removes one
+//	DELETE /runtime        remove all the overrides
+//	PUT    /runtime/<key>  set one override to the JSON value in the body
+//	DELETE /runtime/<key>  remove one override
+//
+// Every request has to carry the token as "Authorization: Bearer <token>".
+func (r *runtimeOverrides) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(r.token)) != 1 {
+		dlog.Warnf(ctx, "Unauthorized runtime API request from %s", req.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ambex"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	key := ""
+	switch {
+	case req.URL.Path == "/runtime":
+	case strings.HasPrefix(req.URL.Path, "/runtime/"):
+		key = strings.TrimPrefix(req.URL.Path, "/runtime/")
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	var changes map[string]interface{}
+	switch {
+	case req.Method == http.MethodGet && key == "":
+	case req.Method == http.MethodPatch && key == "":
+		if err := readJSON(req, &changes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case req.Method == http.MethodDelete && key == "":
+		changes = map[string]interface{}{}
+		for existing := range r.get() {
+			changes[existing] = nil
+		}
+	case req.Method == http.MethodPut && key != "":
+		var value interface{}
+		if err := readJSON(req, &value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if value == nil {
+			http.Error(w, "use DELETE to remove a runtime override", http.StatusBadRequest)
+			return
+		}
+		changes = map[string]interface{}{key: value}
+	case req.Method == http.MethodDelete && key != "":
+		changes = map[string]interface{}{key: nil}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if changes != nil {
+		if err := r.set(ctx, req, changes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"layer":     RuntimeLayerName,
+		"overrides": r.get(),
+	})
+}
+
+func readJSON(req *http.Request, v interface{}) error {
+	body, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	return nil
+}
+
+// runtimeToken returns the token for the runtime API: $AMBASSADOR_AMBEX_RUNTIME_TOKEN if it's set,
+// or else the one in tokenPath, which is generated if it doesn't exist yet.
+func runtimeToken(tokenPath string) (string, error) {
+	if token := os.Getenv("AMBASSADOR_AMBEX_RUNTIME_TOKEN"); token != "" {
+		return token, nil
+	}
+	contents, err := os.ReadFile(tokenPath)
+	if err == nil && len(strings.TrimSpace(string(contents))) > 0 {
+		return strings.TrimSpace(string(contents)), nil
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	if err := os.MkdirAll(filepath.Dir(tokenPath), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(tokenPath, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// runRuntimeServer serves the runtime API at the given address.
+func runRuntimeServer(ctx context.Context, overrides *runtimeOverrides, address string) error {
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	dlog.Infof(ctx, "Runtime API listening on %s", address)
+
+	sc := &dhttp.ServerConfig{
+		Handler: overrides,
+	}
+	return sc.Serve(ctx, lis)
+}
+
+// runtimeLayer builds the RTDS layer that ambex serves: the values from the bootstrap's static
+// layer named RuntimeLayerName (i.e. the Module's runtime_overrides), with overrides on top.
+func runtimeLayer(bootstrapLayers []*v3bootstrap.RuntimeLayer, overrides map[string]interface{}) (*v3runtime.Runtime, error) {
+	layer := &structpb.Struct{Fields: map[string]*structpb.Value{}}
+	for _, bl := range bootstrapLayers {
+		if bl.Name != RuntimeLayerName {
+			continue
+		}
+		for key, value := range bl.GetStaticLayer().GetFields() {
+			layer.Fields[key] = value
+		}
+	}
+	for key, value := range overrides {
+		v, err := structpb.NewValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("runtime key %q: %w", key, err)
+		}
+		layer.Fields[key] = v
+	}
+	return &v3runtime.Runtime{Name: RuntimeLayerName, Layer: layer}, nil
+}
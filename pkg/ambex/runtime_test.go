@@ -0,0 +1,116 @@
+package ambex
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v3core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	v3runtime "github.com/envoyproxy/go-control-plane/envoy/service/runtime/v3"
+	ecp_v3_cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	ecp_v3_resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+
+	"github.com/datawire/dlib/dlog"
+)
+
+func runtimeRequest(t *testing.T, overrides *runtimeOverrides, token, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req = req.WithContext(dlog.NewTestContext(t, false))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	overrides.ServeHTTP(w, req)
+	return w
+}
+
+func TestRuntimeAPI(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "ambex-runtime.json")
+	auditPath := filepath.Join(dir, "ambex-runtime-audit.log")
+
+	overrides, err := loadRuntimeOverrides(ctx, statePath, auditPath, "secret")
+	require.NoError(t, err)
+
+	// No token, or the wrong one, gets you nowhere.
+	assert.Equal(t, http.StatusUnauthorized, runtimeRequest(t, overrides, "", http.MethodGet, "/runtime", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, runtimeRequest(t, overrides, "wrong", http.MethodPut, "/runtime/foo", "1").Code)
+	assert.Empty(t, overrides.get())
+
+	w := runtimeRequest(t, overrides, "secret", http.MethodPut, "/runtime/overload.premature_reset_total_stream_count", "100")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"layer": "ambex_runtime", "overrides": {"overload.premature_reset_total_stream_count": 100}}`, w.Body.String())
+	assert.Len(t, overrides.changed, 1)
+
+	w = runtimeRequest(t, overrides, "secret", http.MethodPatch, "/runtime", `{"envoy.reloadable_features.foo": false, "overload.premature_reset_total_stream_count": null}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, map[string]interface{}{"envoy.reloadable_features.foo": false}, overrides.get())
+
+	// Only scalars make sense as runtime values.
+	w = runtimeRequest(t, overrides, "secret", http.MethodPut, "/runtime/foo", `{"bar": 1}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, runtimeRequest(t, overrides, "secret", http.MethodPost, "/runtime", "{}").Code)
+
+	// The overrides survive a restart...
+	reloaded, err := loadRuntimeOverrides(ctx, statePath, auditPath, "secret")
+	require.NoError(t, err)
+	assert.Equal(t, overrides.get(), reloaded.get())
+
+	// ...and every change is in the audit log.
+	audit, err := os.Open(auditPath)
+	require.NoError(t, err)
+	defer audit.Close()
+	var lines []string
+	scanner := bufio.NewScanner(audit)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.Len(t, lines, 3)
+	assert.Contains(t, lines[0], `"key":"overload.premature_reset_total_stream_count","old":null,"new":100`)
+	assert.Contains(t, lines[1], `"key":"envoy.reloadable_features.foo","old":null,"new":false`)
+	assert.Contains(t, lines[2], `"key":"overload.premature_reset_total_stream_count","old":100,"new":null`)
+}
+
+func TestUpdateServesRuntimeLayer(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	dir := t.TempDir()
+	bootstrap := `{
+  "@type": "/envoy.config.bootstrap.v3.Bootstrap",
+  "static_resources": {},
+  "layered_runtime": {"layers": [
+    {"name": "static_layer", "static_layer": {"re2.max_program_size.error_level": 200}},
+    {"name": "ambex_runtime", "static_layer": {"a": "module", "b": "module"}}
+  ]}
+}`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "envoy.json"), []byte(bootstrap), 0644))
+
+	stateDir := t.TempDir()
+	overrides, err := loadRuntimeOverrides(ctx, filepath.Join(stateDir, "ambex-runtime.json"), filepath.Join(stateDir, "ambex-runtime-audit.log"), "secret")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, runtimeRequest(t, overrides, "secret", http.MethodPut, "/runtime/b", `"api"`).Code)
+
+	cache := ecp_v3_cache.NewSnapshotCache(true, HasherV3{}, logAdapterV3{logAdapterBase{"V3"}, nil})
+	nodes := newNodeRegistry(ctx, cache, HasherV3{}, false, nil)
+	nodes.streamRequest(ctx, streamKey{false, 1}, &v3core.Node{Id: "test-id"}, ecp_v3_resource.RuntimeType, "", nil)
+	updates := make(chan Update, 1)
+	u := &updater{validate: true, dirs: []string{dir}, nodes: nodes, runtime: overrides, updates: updates}
+
+	require.NoError(t, u.update(ctx))
+	require.NoError(t, (<-updates).Update())
+	snapshot, err := cache.GetSnapshot("test-id")
+	require.NoError(t, err)
+
+	runtimes := snapshot.GetResources(ecp_v3_resource.RuntimeType)
+	require.Len(t, runtimes, 1)
+	layer := runtimes[RuntimeLayerName].(*v3runtime.Runtime).Layer.AsMap()
+	assert.Equal(t, map[string]interface{}{"a": "module", "b": "api"}, layer)
+}
@@ -19,6 +19,7 @@ import (
 	v3listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	v3route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	v3httpman "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	v3tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 
 	// envoy control plane
 	ecp_cache_types "github.com/envoyproxy/go-control-plane/pkg/cache/types"
@@ -190,6 +191,164 @@ func V3ListenerToRdsListener(lnr *v3listener.Listener) (*v3listener.Listener, []
 	return l, routes, nil
 }
 
+// V3ListenerToSdsListener will take a listener definition and extract any TLS certificates and
+// validation contexts supplied inline in its filter chains' transport sockets, replacing them with
+// references to SDS supplied secrets. Like V3ListenerToRdsListener, it does not modify the supplied
+// listener, and it is the identity transform for filter chains that don't terminate TLS or that
+// already use SDS.
+//
+// The point is the same as for RDS: a certificate rotation changes only the secret, not the
+// listener, so envoy can pick up the new certificate without going through a drain cycle.
+//
+// The secret names are derived from the listener name and the filter chain match (not from the
+// certificate itself), so that they stay the same when the certificate changes.
+func V3ListenerToSdsListener(lnr *v3listener.Listener) (*v3listener.Listener, []*v3tls.Secret, error) {
+	l := proto.Clone(lnr).(*v3listener.Listener)
+
+	// Keep track of number of filter chain matches that hash to the same key for collisions
+	matchKeyIndex := make(map[string]int)
+
+	chains := l.FilterChains
+	if l.DefaultFilterChain != nil {
+		chains = append(chains, l.DefaultFilterChain)
+	}
+
+	var secrets []*v3tls.Secret
+	for _, fc := range chains {
+		if fc.TransportSocket == nil {
+			continue
+		}
+		filterChainMatch, _ := json.Marshal(fc.GetFilterChainMatch())
+		matchHash := md5.Sum(filterChainMatch)
+		matchKey := hex.EncodeToString(matchHash[:])
+		prefix := fmt.Sprintf("%s-secret-%s-%d", l.Name, matchKey, matchKeyIndex[matchKey])
+		matchKeyIndex[matchKey]++
+
+		_secrets, err := transportSocketToSds(prefix, fc.TransportSocket)
+		if err != nil {
+			return nil, nil, err
+		}
+		secrets = append(secrets, _secrets...)
+	}
+
+	return l, secrets, nil
+}
+
+// V3ClusterToSdsCluster is the cluster counterpart of V3ListenerToSdsListener: it extracts any
+// inline TLS certificates and validation contexts from the cluster's transport sockets into SDS
+// supplied secrets. It does not modify the supplied cluster.
+func V3ClusterToSdsCluster(cls *v3cluster.Cluster) (*v3cluster.Cluster, []*v3tls.Secret, error) {
+	c := proto.Clone(cls).(*v3cluster.Cluster)
+
+	var secrets []*v3tls.Secret
+	if c.TransportSocket != nil {
+		_secrets, err := transportSocketToSds(c.Name+"-secret", c.TransportSocket)
+		if err != nil {
+			return nil, nil, err
+		}
+		secrets = append(secrets, _secrets...)
+	}
+	for idx, match := range c.TransportSocketMatches {
+		if match.TransportSocket == nil {
+			continue
+		}
+		_secrets, err := transportSocketToSds(fmt.Sprintf("%s-secret-match-%d", c.Name, idx), match.TransportSocket)
+		if err != nil {
+			return nil, nil, err
+		}
+		secrets = append(secrets, _secrets...)
+	}
+
+	return c, secrets, nil
+}
+
+// transportSocketToSds rewrites a TLS transport socket in place so that it refers to SDS secrets
+// instead of carrying its certificates and validation context inline, and returns those secrets,
+// named with the given prefix. Transport sockets that aren't TLS are left alone.
+func transportSocketToSds(prefix string, ts *v3core.TransportSocket) ([]*v3tls.Secret, error) {
+	typedConfig := ts.GetTypedConfig()
+	if typedConfig == nil {
+		return nil, nil
+	}
+
+	var tlsContext interface {
+		proto.Message
+		GetCommonTlsContext() *v3tls.CommonTlsContext
+	}
+	switch {
+	case typedConfig.MessageIs(&v3tls.DownstreamTlsContext{}):
+		tlsContext = &v3tls.DownstreamTlsContext{}
+	case typedConfig.MessageIs(&v3tls.UpstreamTlsContext{}):
+		tlsContext = &v3tls.UpstreamTlsContext{}
+	default:
+		return nil, nil
+	}
+	if err := typedConfig.UnmarshalTo(tlsContext); err != nil {
+		return nil, err
+	}
+
+	common := tlsContext.GetCommonTlsContext()
+	if common == nil {
+		return nil, nil
+	}
+
+	var secrets []*v3tls.Secret
+	var sdsConfigs []*v3tls.SdsSecretConfig
+	for idx, cert := range common.TlsCertificates {
+		secret := &v3tls.Secret{
+			Name: fmt.Sprintf("%s-cert-%d", prefix, idx),
+			Type: &v3tls.Secret_TlsCertificate{TlsCertificate: cert},
+		}
+		secrets = append(secrets, secret)
+		sdsConfigs = append(sdsConfigs, &v3tls.SdsSecretConfig{
+			Name:      secret.Name,
+			SdsConfig: adsConfigSource(),
+		})
+	}
+	if len(sdsConfigs) > 0 {
+		common.TlsCertificates = nil
+		common.TlsCertificateSdsSecretConfigs = append(sdsConfigs, common.TlsCertificateSdsSecretConfigs...)
+	}
+
+	if vc, ok := common.ValidationContextType.(*v3tls.CommonTlsContext_ValidationContext); ok && vc.ValidationContext != nil {
+		secret := &v3tls.Secret{
+			Name: prefix + "-validation",
+			Type: &v3tls.Secret_ValidationContext{ValidationContext: vc.ValidationContext},
+		}
+		secrets = append(secrets, secret)
+		common.ValidationContextType = &v3tls.CommonTlsContext_ValidationContextSdsSecretConfig{
+			ValidationContextSdsSecretConfig: &v3tls.SdsSecretConfig{
+				Name:      secret.Name,
+				SdsConfig: adsConfigSource(),
+			},
+		}
+	}
+
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+
+	// As with the hcm in V3ListenerToRdsListener, the TLS context is stored in a protobuf any, so
+	// we need to remarshal it.
+	any, err := anypb.New(tlsContext)
+	if err != nil {
+		return nil, err
+	}
+	ts.ConfigType = &v3core.TransportSocket_TypedConfig{TypedConfig: any}
+	return secrets, nil
+}
+
+// adsConfigSource returns a ConfigSource that fetches resources via whatever ADS source is defined
+// in the bootstrap configuration.
+func adsConfigSource() *v3core.ConfigSource {
+	return &v3core.ConfigSource{
+		ConfigSourceSpecifier: &v3core.ConfigSource_Ads{
+			Ads: &v3core.AggregatedConfigSource{},
+		},
+		ResourceApiVersion: v3core.ApiVersion_V3,
+	}
+}
+
 // JoinEdsClustersV3 will perform an outer join operation between the eds clusters in the supplied
 // clusterlist and the eds endpoint data in the supplied map. It will return a slice of
 // ClusterLoadAssignments (cast to []ecp_cache_types.Resource) with endpoint data for all the eds clusters in
@@ -2,18 +2,23 @@ package ambex
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 
+	v3Cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	v3Core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	v3Listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	v3Route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	v3Httpman "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	v3Tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 	v3Wellknown "github.com/envoyproxy/go-control-plane/pkg/wellknown"
 )
 
@@ -87,3 +92,119 @@ func TestV3ListenerToRdsListener(t *testing.T) {
 		assert.Equal(t, []string{"*"}, virtualHosts[0].GetDomains())
 	}
 }
+
+func TestV3ListenerToSdsListener(t *testing.T) {
+	cert := &v3Tls.TlsCertificate{
+		CertificateChain: &v3Core.DataSource{Specifier: &v3Core.DataSource_Filename{Filename: "/ambassador/snapshots/default/secrets-decoded/tls-cert/0123.crt"}},
+		PrivateKey:       &v3Core.DataSource{Specifier: &v3Core.DataSource_Filename{Filename: "/ambassador/snapshots/default/secrets-decoded/tls-cert/0123.key"}},
+	}
+	anyTls, err := anypb.New(&v3Tls.DownstreamTlsContext{
+		CommonTlsContext: &v3Tls.CommonTlsContext{
+			TlsCertificates: []*v3Tls.TlsCertificate{cert},
+			ValidationContextType: &v3Tls.CommonTlsContext_ValidationContext{
+				ValidationContext: &v3Tls.CertificateValidationContext{
+					TrustedCa: &v3Core.DataSource{Specifier: &v3Core.DataSource_Filename{Filename: "/ambassador/ca.crt"}},
+				},
+			},
+			AlpnProtocols: []string{"h2", "http/1.1"},
+		},
+	})
+	require.NoError(t, err)
+
+	testListener := &v3Listener.Listener{
+		Name: "emissary-ingress-listener-8443",
+		FilterChains: []*v3Listener.FilterChain{{
+			FilterChainMatch: &v3Listener.FilterChainMatch{
+				ServerNames: []string{"example.com"},
+			},
+			TransportSocket: &v3Core.TransportSocket{
+				Name:       v3Wellknown.TransportSocketTls,
+				ConfigType: &v3Core.TransportSocket_TypedConfig{TypedConfig: anyTls},
+			},
+		}, {
+			// No TLS on this one, it should be left alone.
+		}},
+	}
+
+	lnr, secrets, err := V3ListenerToSdsListener(testListener)
+	require.NoError(t, err)
+
+	// The input must not be modified.
+	assert.True(t, proto.Equal(anyTls, testListener.FilterChains[0].TransportSocket.GetTypedConfig()))
+
+	require.Len(t, secrets, 2)
+	prefix := "emissary-ingress-listener-8443-secret-"
+	assert.True(t, strings.HasPrefix(secrets[0].Name, prefix) && strings.HasSuffix(secrets[0].Name, "-0-cert-0"), secrets[0].Name)
+	assert.True(t, proto.Equal(cert, secrets[0].GetTlsCertificate()))
+	assert.True(t, strings.HasPrefix(secrets[1].Name, prefix) && strings.HasSuffix(secrets[1].Name, "-0-validation"), secrets[1].Name)
+	assert.Equal(t, "/ambassador/ca.crt", secrets[1].GetValidationContext().GetTrustedCa().GetFilename())
+
+	require.Len(t, lnr.FilterChains, 2)
+	assert.Nil(t, lnr.FilterChains[1].TransportSocket)
+	tlsContext := &v3Tls.DownstreamTlsContext{}
+	require.NoError(t, lnr.FilterChains[0].TransportSocket.GetTypedConfig().UnmarshalTo(tlsContext))
+	common := tlsContext.GetCommonTlsContext()
+	assert.Empty(t, common.TlsCertificates)
+	require.Len(t, common.TlsCertificateSdsSecretConfigs, 1)
+	assert.Equal(t, secrets[0].Name, common.TlsCertificateSdsSecretConfigs[0].Name)
+	assert.NotNil(t, common.TlsCertificateSdsSecretConfigs[0].SdsConfig.GetAds())
+	assert.Equal(t, secrets[1].Name, common.GetValidationContextSdsSecretConfig().GetName())
+	assert.Equal(t, []string{"h2", "http/1.1"}, common.AlpnProtocols)
+
+	// Rotating the certificate must change only the secret, not the listener.
+	rotated := proto.Clone(testListener).(*v3Listener.Listener)
+	rotatedTls := &v3Tls.DownstreamTlsContext{}
+	require.NoError(t, anyTls.UnmarshalTo(rotatedTls))
+	rotatedTls.CommonTlsContext.TlsCertificates[0].CertificateChain.Specifier = &v3Core.DataSource_Filename{Filename: "/ambassador/snapshots/default/secrets-decoded/tls-cert/4567.crt"}
+	anyRotated, err := anypb.New(rotatedTls)
+	require.NoError(t, err)
+	rotated.FilterChains[0].TransportSocket.ConfigType = &v3Core.TransportSocket_TypedConfig{TypedConfig: anyRotated}
+
+	rotatedLnr, rotatedSecrets, err := V3ListenerToSdsListener(rotated)
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(lnr, rotatedLnr))
+	require.Len(t, rotatedSecrets, 2)
+	assert.Equal(t, secrets[0].Name, rotatedSecrets[0].Name)
+	assert.False(t, proto.Equal(secrets[0], rotatedSecrets[0]))
+}
+
+func TestV3ClusterToSdsCluster(t *testing.T) {
+	anyTls, err := anypb.New(&v3Tls.UpstreamTlsContext{
+		CommonTlsContext: &v3Tls.CommonTlsContext{
+			TlsCertificates: []*v3Tls.TlsCertificate{{
+				CertificateChain: &v3Core.DataSource{Specifier: &v3Core.DataSource_InlineString{InlineString: "cert"}},
+				PrivateKey:       &v3Core.DataSource{Specifier: &v3Core.DataSource_InlineString{InlineString: "key"}},
+			}},
+		},
+		Sni: "backend.example.com",
+	})
+	require.NoError(t, err)
+
+	testCluster := &v3Cluster.Cluster{
+		Name: "cluster_backend_default",
+		TransportSocket: &v3Core.TransportSocket{
+			Name:       v3Wellknown.TransportSocketTls,
+			ConfigType: &v3Core.TransportSocket_TypedConfig{TypedConfig: anyTls},
+		},
+	}
+
+	cls, secrets, err := V3ClusterToSdsCluster(testCluster)
+	require.NoError(t, err)
+	require.Len(t, secrets, 1)
+	assert.Equal(t, "cluster_backend_default-secret-cert-0", secrets[0].Name)
+	assert.Equal(t, "cert", secrets[0].GetTlsCertificate().GetCertificateChain().GetInlineString())
+
+	tlsContext := &v3Tls.UpstreamTlsContext{}
+	require.NoError(t, cls.TransportSocket.GetTypedConfig().UnmarshalTo(tlsContext))
+	assert.Equal(t, "backend.example.com", tlsContext.Sni)
+	assert.Empty(t, tlsContext.CommonTlsContext.TlsCertificates)
+	require.Len(t, tlsContext.CommonTlsContext.TlsCertificateSdsSecretConfigs, 1)
+	assert.Equal(t, secrets[0].Name, tlsContext.CommonTlsContext.TlsCertificateSdsSecretConfigs[0].Name)
+
+	// A cluster without TLS is left alone.
+	plain := &v3Cluster.Cluster{Name: "cluster_plain_default"}
+	cls, secrets, err = V3ClusterToSdsCluster(plain)
+	require.NoError(t, err)
+	assert.Empty(t, secrets)
+	assert.True(t, proto.Equal(plain, cls))
+}
@@ -0,0 +1,276 @@
+package ambex
+
+import (
+	// standard library
+	"fmt"
+	"sort"
+	"strings"
+
+	// third-party libraries
+	"google.golang.org/protobuf/proto"
+
+	// envoy api v3
+	v3cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	v3core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	v3listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	v3route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	v3httpman "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	v3tcpproxy "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	v3tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+
+	// envoy control plane
+	ecp_cache_types "github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	ecp_v3_cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	ecp_v3_resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+// resourceSources records where each resource in a snapshot came from (usually the file it was
+// loaded from), so that validation errors can point at it. Resources are keyed by type URL and
+// name.
+type resourceSources map[string]string
+
+func (s resourceSources) add(typeURL string, res ecp_cache_types.Resource, source string) {
+	s[typeURL+"/"+ecp_v3_cache.GetResourceName(res)] = source
+}
+
+// describe names a resource for a validation error, e.g. `listener "foo" (from envoy.json)`.
+func (s resourceSources) describe(typeURL, name string) string {
+	kind := typeURL[strings.LastIndex(typeURL, ".")+1:]
+	switch typeURL {
+	case ecp_v3_resource.ListenerType:
+		kind = "listener"
+	case ecp_v3_resource.RouteType:
+		kind = "route configuration"
+	case ecp_v3_resource.ClusterType:
+		kind = "cluster"
+	case ecp_v3_resource.SecretType:
+		kind = "secret"
+	}
+	if source, ok := s[typeURL+"/"+name]; ok {
+		return fmt.Sprintf("%s %q (from %s)", kind, name, source)
+	}
+	return fmt.Sprintf("%s %q", kind, name)
+}
+
+// validationErrors are all the problems found with a snapshot.
+type validationErrors []string
+
+func (e validationErrors) Error() string {
+	return fmt.Sprintf("invalid snapshot: %s", strings.Join(e, "; "))
+}
+
+// snapshotValidator checks the resources that are about to go into a snapshot for mistakes that
+// would make Envoy reject the snapshot, but that neither the generated Validate methods nor
+// Snapshot.Consistent can catch because they involve more than one resource:
+//
+//   - resources of the same type with the same name (the snapshot would silently drop all but one)
+//   - routes, TCP proxies and RDS references to clusters or route configurations that don't exist
+//   - TLS contexts that refer to SDS secrets that don't exist
+//   - listeners that bind the same address
+//   - filter chains in the same listener with the same filter_chain_match
+//   - virtual hosts in the same route configuration with the same domain
+type snapshotValidator struct {
+	sources resourceSources
+	names   map[string]map[string]bool // type URL -> name -> present
+	errors  validationErrors
+}
+
+// validateSnapshot returns a validationErrors describing everything wrong with resources, or nil
+// if it all looks OK.
+func validateSnapshot(resources map[ecp_v3_resource.Type][]ecp_cache_types.Resource, sources resourceSources) error {
+	v := &snapshotValidator{
+		sources: sources,
+		names:   map[string]map[string]bool{},
+	}
+
+	typeURLs := make([]string, 0, len(resources))
+	for typeURL := range resources {
+		typeURLs = append(typeURLs, typeURL)
+	}
+	sort.Strings(typeURLs)
+	for _, typeURL := range typeURLs {
+		v.names[typeURL] = map[string]bool{}
+		for _, res := range resources[typeURL] {
+			name := ecp_v3_cache.GetResourceName(res)
+			if v.names[typeURL][name] {
+				v.errorf(typeURL, name, "is defined more than once")
+			}
+			v.names[typeURL][name] = true
+		}
+	}
+
+	addresses := map[string]string{}
+	for _, res := range resources[ecp_v3_resource.ListenerType] {
+		lnr := res.(*v3listener.Listener)
+		if addr := listenerAddress(lnr); addr != "" {
+			if other, ok := addresses[addr]; ok && other != lnr.Name {
+				v.errorf(ecp_v3_resource.ListenerType, lnr.Name, "binds %s, which %s also binds",
+					addr, v.sources.describe(ecp_v3_resource.ListenerType, other))
+			}
+			addresses[addr] = lnr.Name
+		}
+		v.checkListener(lnr)
+	}
+
+	for _, res := range resources[ecp_v3_resource.RouteType] {
+		rc := res.(*v3route.RouteConfiguration)
+		v.checkRouteConfiguration(ecp_v3_resource.RouteType, rc.Name, rc)
+	}
+
+	for _, res := range resources[ecp_v3_resource.ClusterType] {
+		cls := res.(*v3cluster.Cluster)
+		v.checkTransportSocket(ecp_v3_resource.ClusterType, cls.Name, cls.TransportSocket)
+		for _, match := range cls.TransportSocketMatches {
+			v.checkTransportSocket(ecp_v3_resource.ClusterType, cls.Name, match.TransportSocket)
+		}
+	}
+
+	if len(v.errors) > 0 {
+		return v.errors
+	}
+	return nil
+}
+
+func (v *snapshotValidator) errorf(typeURL, name, format string, args ...interface{}) {
+	v.errors = append(v.errors, v.sources.describe(typeURL, name)+": "+fmt.Sprintf(format, args...))
+}
+
+// refer checks that a resource refers to a resource that exists.
+func (v *snapshotValidator) refer(fromType, fromName, toType, toName string) {
+	if toName == "" || v.names[toType][toName] {
+		return
+	}
+	v.errorf(fromType, fromName, "refers to %s, which doesn't exist", v.sources.describe(toType, toName))
+}
+
+// listenerAddress returns a string that identifies the address a listener binds, or "" if it
+// doesn't bind one we understand.
+func listenerAddress(lnr *v3listener.Listener) string {
+	switch addr := lnr.GetAddress().GetAddress().(type) {
+	case *v3core.Address_SocketAddress:
+		return fmt.Sprintf("%s %s:%d", addr.SocketAddress.Protocol, addr.SocketAddress.Address, addr.SocketAddress.GetPortValue())
+	case *v3core.Address_Pipe:
+		return "unix " + addr.Pipe.Path
+	default:
+		return ""
+	}
+}
+
+func (v *snapshotValidator) checkListener(lnr *v3listener.Listener) {
+	typeURL := ecp_v3_resource.ListenerType
+
+	for i, fc := range lnr.FilterChains {
+		for j := 0; j < i; j++ {
+			// proto.Equal treats a nil message as different from an empty one, but Envoy doesn't.
+			a, b := fc.GetFilterChainMatch(), lnr.FilterChains[j].GetFilterChainMatch()
+			if a == nil {
+				a = &v3listener.FilterChainMatch{}
+			}
+			if b == nil {
+				b = &v3listener.FilterChainMatch{}
+			}
+			if proto.Equal(a, b) {
+				v.errorf(typeURL, lnr.Name, "filter chains %d and %d have the same filter_chain_match", j, i)
+				break
+			}
+		}
+	}
+
+	chains := lnr.FilterChains
+	if lnr.DefaultFilterChain != nil {
+		chains = append(chains[:len(chains):len(chains)], lnr.DefaultFilterChain)
+	}
+	for _, fc := range chains {
+		v.checkTransportSocket(typeURL, lnr.Name, fc.TransportSocket)
+		for _, filter := range fc.Filters {
+			typedConfig := filter.GetTypedConfig()
+			if typedConfig == nil {
+				continue
+			}
+			msg, err := typedConfig.UnmarshalNew()
+			if err != nil {
+				// Not a type that we know about, so not something we can check.
+				continue
+			}
+			switch filterConfig := msg.(type) {
+			case *v3httpman.HttpConnectionManager:
+				if rds := filterConfig.GetRds(); rds != nil && rds.GetConfigSource().GetAds() != nil {
+					v.refer(typeURL, lnr.Name, ecp_v3_resource.RouteType, rds.RouteConfigName)
+				}
+				if rc := filterConfig.GetRouteConfig(); rc != nil {
+					v.checkRouteConfiguration(typeURL, lnr.Name, rc)
+				}
+			case *v3tcpproxy.TcpProxy:
+				v.refer(typeURL, lnr.Name, ecp_v3_resource.ClusterType, filterConfig.GetCluster())
+				for _, wc := range filterConfig.GetWeightedClusters().GetClusters() {
+					v.refer(typeURL, lnr.Name, ecp_v3_resource.ClusterType, wc.Name)
+				}
+			}
+		}
+	}
+}
+
+// checkRouteConfiguration checks a route configuration, which is either a resource of its own or
+// inlined in a listener, in which case typeURL and name are the listener's.
+func (v *snapshotValidator) checkRouteConfiguration(typeURL, name string, rc *v3route.RouteConfiguration) {
+	domains := map[string]string{}
+	for _, vhost := range rc.VirtualHosts {
+		for _, domain := range vhost.Domains {
+			// Envoy doesn't care about the case of domains.
+			domain = strings.ToLower(domain)
+			if other, ok := domains[domain]; ok {
+				v.errorf(typeURL, name, "virtual hosts %q and %q both have domain %q", other, vhost.Name, domain)
+				continue
+			}
+			domains[domain] = vhost.Name
+		}
+
+		for _, route := range vhost.Routes {
+			action := route.GetRoute()
+			if action == nil {
+				continue
+			}
+			v.refer(typeURL, name, ecp_v3_resource.ClusterType, action.GetCluster())
+			for _, wc := range action.GetWeightedClusters().GetClusters() {
+				v.refer(typeURL, name, ecp_v3_resource.ClusterType, wc.Name)
+			}
+			for _, mirror := range action.RequestMirrorPolicies {
+				v.refer(typeURL, name, ecp_v3_resource.ClusterType, mirror.Cluster)
+			}
+		}
+	}
+}
+
+// checkTransportSocket checks that a TLS transport socket only refers to SDS secrets that we
+// serve.
+func (v *snapshotValidator) checkTransportSocket(typeURL, name string, ts *v3core.TransportSocket) {
+	typedConfig := ts.GetTypedConfig()
+	if typedConfig == nil {
+		return
+	}
+	msg, err := typedConfig.UnmarshalNew()
+	if err != nil {
+		return
+	}
+	tlsContext, ok := msg.(interface {
+		GetCommonTlsContext() *v3tls.CommonTlsContext
+	})
+	if !ok {
+		return
+	}
+	common := tlsContext.GetCommonTlsContext()
+
+	sdsConfigs := append([]*v3tls.SdsSecretConfig{}, common.GetTlsCertificateSdsSecretConfigs()...)
+	if vc := common.GetValidationContextSdsSecretConfig(); vc != nil {
+		sdsConfigs = append(sdsConfigs, vc)
+	}
+	if vc := common.GetCombinedValidationContext().GetValidationContextSdsSecretConfig(); vc != nil {
+		sdsConfigs = append(sdsConfigs, vc)
+	}
+	for _, sds := range sdsConfigs {
+		// Secrets that come from somewhere other than us aren't our problem.
+		if sds.GetSdsConfig().GetAds() != nil {
+			v.refer(typeURL, name, ecp_v3_resource.SecretType, sds.Name)
+		}
+	}
+}
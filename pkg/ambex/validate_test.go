@@ -0,0 +1,183 @@
+package ambex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	v3cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	v3core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	v3listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	v3route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	v3httpman "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	v3tcpproxy "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	v3tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	ecp_cache_types "github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	ecp_v3_resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	ecp_wellknown "github.com/envoyproxy/go-control-plane/pkg/wellknown"
+)
+
+func mustAny(t *testing.T, msg proto.Message) *anypb.Any {
+	t.Helper()
+	a, err := anypb.New(msg)
+	require.NoError(t, err)
+	return a
+}
+
+func testValidationListener(t *testing.T, name string, port uint32, chains ...*v3listener.FilterChain) *v3listener.Listener {
+	return &v3listener.Listener{
+		Name: name,
+		Address: &v3core.Address{Address: &v3core.Address_SocketAddress{SocketAddress: &v3core.SocketAddress{
+			Address:       "0.0.0.0",
+			PortSpecifier: &v3core.SocketAddress_PortValue{PortValue: port},
+		}}},
+		FilterChains: chains,
+	}
+}
+
+func rdsFilterChain(t *testing.T, routeConfigName string, match *v3listener.FilterChainMatch) *v3listener.FilterChain {
+	return &v3listener.FilterChain{
+		FilterChainMatch: match,
+		Filters: []*v3listener.Filter{{
+			Name: ecp_wellknown.HTTPConnectionManager,
+			ConfigType: &v3listener.Filter_TypedConfig{TypedConfig: mustAny(t, &v3httpman.HttpConnectionManager{
+				RouteSpecifier: &v3httpman.HttpConnectionManager_Rds{Rds: &v3httpman.Rds{
+					RouteConfigName: routeConfigName,
+					ConfigSource:    adsConfigSource(),
+				}},
+			})},
+		}},
+	}
+}
+
+func testRouteConfig(name string, vhosts map[string][]string, cluster string) *v3route.RouteConfiguration {
+	rc := &v3route.RouteConfiguration{Name: name}
+	for _, vhostName := range []string{"a", "b"} {
+		domains, ok := vhosts[vhostName]
+		if !ok {
+			continue
+		}
+		rc.VirtualHosts = append(rc.VirtualHosts, &v3route.VirtualHost{
+			Name:    vhostName,
+			Domains: domains,
+			Routes: []*v3route.Route{{
+				Match: &v3route.RouteMatch{PathSpecifier: &v3route.RouteMatch_Prefix{Prefix: "/"}},
+				Action: &v3route.Route_Route{Route: &v3route.RouteAction{
+					ClusterSpecifier: &v3route.RouteAction_Cluster{Cluster: cluster},
+				}},
+			}},
+		})
+	}
+	return rc
+}
+
+func TestValidateSnapshot(t *testing.T) {
+	sources := resourceSources{}
+	resources := func(listeners []*v3listener.Listener, routes []*v3route.RouteConfiguration, clusters []*v3cluster.Cluster, secrets []*v3tls.Secret) map[string][]ecp_cache_types.Resource {
+		result := map[string][]ecp_cache_types.Resource{}
+		for _, l := range listeners {
+			result[ecp_v3_resource.ListenerType] = append(result[ecp_v3_resource.ListenerType], l)
+			sources.add(ecp_v3_resource.ListenerType, l, "envoy.json")
+		}
+		for _, r := range routes {
+			result[ecp_v3_resource.RouteType] = append(result[ecp_v3_resource.RouteType], r)
+			sources.add(ecp_v3_resource.RouteType, r, "envoy.json")
+		}
+		for _, c := range clusters {
+			result[ecp_v3_resource.ClusterType] = append(result[ecp_v3_resource.ClusterType], c)
+			sources.add(ecp_v3_resource.ClusterType, c, "clusters.json")
+		}
+		for _, s := range secrets {
+			result[ecp_v3_resource.SecretType] = append(result[ecp_v3_resource.SecretType], s)
+		}
+		return result
+	}
+
+	tlsChain := func(secretName string) *v3listener.FilterChain {
+		fc := rdsFilterChain(t, "rc", &v3listener.FilterChainMatch{ServerNames: []string{"tls.example.com"}})
+		fc.TransportSocket = &v3core.TransportSocket{
+			Name: "envoy.transport_sockets.tls",
+			ConfigType: &v3core.TransportSocket_TypedConfig{TypedConfig: mustAny(t, &v3tls.DownstreamTlsContext{
+				CommonTlsContext: &v3tls.CommonTlsContext{
+					TlsCertificateSdsSecretConfigs: []*v3tls.SdsSecretConfig{{Name: secretName, SdsConfig: adsConfigSource()}},
+				},
+			})},
+		}
+		return fc
+	}
+
+	tcpChain := &v3listener.FilterChain{
+		FilterChainMatch: &v3listener.FilterChainMatch{ServerNames: []string{"tcp.example.com"}},
+		Filters: []*v3listener.Filter{{
+			Name: ecp_wellknown.TCPProxy,
+			ConfigType: &v3listener.Filter_TypedConfig{TypedConfig: mustAny(t, &v3tcpproxy.TcpProxy{
+				StatPrefix:       "tcp",
+				ClusterSpecifier: &v3tcpproxy.TcpProxy_Cluster{Cluster: "missing"},
+			})},
+		}},
+	}
+
+	clusters := []*v3cluster.Cluster{{Name: "backend"}}
+	rc := testRouteConfig("rc", map[string][]string{"a": {"*"}}, "backend")
+
+	testcases := map[string]struct {
+		resources map[string][]ecp_cache_types.Resource
+		errors    []string
+	}{
+		"valid": {
+			resources: resources(
+				[]*v3listener.Listener{testValidationListener(t, "l", 8080, rdsFilterChain(t, "rc", nil), tlsChain("cert"))},
+				[]*v3route.RouteConfiguration{rc},
+				clusters,
+				[]*v3tls.Secret{{Name: "cert"}},
+			),
+		},
+		"missing-references": {
+			resources: resources(
+				[]*v3listener.Listener{testValidationListener(t, "l", 8080, rdsFilterChain(t, "nope", nil), tlsChain("nocert"), tcpChain)},
+				[]*v3route.RouteConfiguration{testRouteConfig("rc", map[string][]string{"a": {"*"}}, "gone")},
+				clusters,
+				nil,
+			),
+			errors: []string{
+				`listener "l" (from envoy.json): refers to route configuration "nope", which doesn't exist`,
+				`listener "l" (from envoy.json): refers to secret "nocert", which doesn't exist`,
+				`listener "l" (from envoy.json): refers to cluster "missing", which doesn't exist`,
+				`route configuration "rc" (from envoy.json): refers to cluster "gone", which doesn't exist`,
+			},
+		},
+		"duplicates": {
+			resources: resources(
+				[]*v3listener.Listener{
+					testValidationListener(t, "l1", 8080, rdsFilterChain(t, "rc", nil), rdsFilterChain(t, "rc", &v3listener.FilterChainMatch{})),
+					testValidationListener(t, "l2", 8080, rdsFilterChain(t, "rc", nil)),
+				},
+				[]*v3route.RouteConfiguration{testRouteConfig("rc", map[string][]string{"a": {"foo.example.com", "*"}, "b": {"FOO.example.com"}}, "backend")},
+				[]*v3cluster.Cluster{{Name: "backend"}, {Name: "backend"}},
+				nil,
+			),
+			errors: []string{
+				`cluster "backend" (from clusters.json): is defined more than once`,
+				`listener "l1" (from envoy.json): filter chains 0 and 1 have the same filter_chain_match`,
+				`listener "l2" (from envoy.json): binds TCP 0.0.0.0:8080, which listener "l1" (from envoy.json) also binds`,
+				`route configuration "rc" (from envoy.json): virtual hosts "a" and "b" both have domain "foo.example.com"`,
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			err := validateSnapshot(tc.resources, sources)
+			if tc.errors == nil {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, validationErrors(tc.errors), err)
+		})
+	}
+}
@@ -85,6 +85,31 @@ type ConsulResolverSpec struct {
 
 	Address    string `json:"address,omitempty"`
 	Datacenter string `json:"datacenter,omitempty"`
+	// FailoverDatacenters are the datacenters to fail over to, in order, when Datacenter has no
+	// healthy instances of a service left.
+	FailoverDatacenters []string `json:"failover_datacenters,omitempty"`
+
+	// TokenSecret is the name of a Secret, in the same namespace as the ConsulResolver, that
+	// holds the Consul ACL token to use in its "token" key.
+	TokenSecret string `json:"token_secret,omitempty"`
+	// TLSSecret is the name of a kubernetes.io/tls Secret, in the same namespace as the
+	// ConsulResolver, with the client certificate and key to present to Consul.
+	TLSSecret string `json:"tls_secret,omitempty"`
+	// CASecret is the name of a Secret, in the same namespace as the ConsulResolver, with the
+	// CA certificate(s) to verify Consul's certificate against in its "tls.crt" key.
+	CASecret string `json:"ca_secret,omitempty"`
+
+	// ConsulNamespace is the Consul Enterprise namespace to look services up in.
+	ConsulNamespace string `json:"consul_namespace,omitempty"`
+	// ConsulPartition is the Consul Enterprise admin partition to look services up in.
+	ConsulPartition string `json:"consul_partition,omitempty"`
+
+	// Tags, if set, limits the ConsulResolver to service instances that have all of these
+	// Consul tags.
+	Tags []string `json:"tags,omitempty"`
+	// Meta, if set, limits the ConsulResolver to service instances whose Consul service
+	// metadata has all of these key/value pairs.
+	Meta map[string]string `json:"meta,omitempty"`
 }
 
 // ConsulResolver is the Schema for the ConsulResolver API
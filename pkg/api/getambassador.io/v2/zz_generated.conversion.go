@@ -1476,6 +1476,38 @@ func autoConvert_v2_ConsulResolverSpec_To_v3alpha1_ConsulResolverSpec(in *Consul
 		in, out := &in.Datacenter, &out.Datacenter
 		*out = *in
 	}
+	if true {
+		in, out := &in.FailoverDatacenters, &out.FailoverDatacenters
+		*out = []string(*in)
+	}
+	if true {
+		in, out := &in.TokenSecret, &out.TokenSecret
+		*out = *in
+	}
+	if true {
+		in, out := &in.TLSSecret, &out.TLSSecret
+		*out = *in
+	}
+	if true {
+		in, out := &in.CASecret, &out.CASecret
+		*out = *in
+	}
+	if true {
+		in, out := &in.ConsulNamespace, &out.ConsulNamespace
+		*out = *in
+	}
+	if true {
+		in, out := &in.ConsulPartition, &out.ConsulPartition
+		*out = *in
+	}
+	if true {
+		in, out := &in.Tags, &out.Tags
+		*out = []string(*in)
+	}
+	if true {
+		in, out := &in.Meta, &out.Meta
+		*out = map[string]string(*in)
+	}
 	return nil
 }
 
@@ -1499,6 +1531,38 @@ func autoConvert_v3alpha1_ConsulResolverSpec_To_v2_ConsulResolverSpec(in *v3alph
 		in, out := &in.Datacenter, &out.Datacenter
 		*out = *in
 	}
+	if true {
+		in, out := &in.FailoverDatacenters, &out.FailoverDatacenters
+		*out = []string(*in)
+	}
+	if true {
+		in, out := &in.TokenSecret, &out.TokenSecret
+		*out = *in
+	}
+	if true {
+		in, out := &in.TLSSecret, &out.TLSSecret
+		*out = *in
+	}
+	if true {
+		in, out := &in.CASecret, &out.CASecret
+		*out = *in
+	}
+	if true {
+		in, out := &in.ConsulNamespace, &out.ConsulNamespace
+		*out = *in
+	}
+	if true {
+		in, out := &in.ConsulPartition, &out.ConsulPartition
+		*out = *in
+	}
+	if true {
+		in, out := &in.Tags, &out.Tags
+		*out = []string(*in)
+	}
+	if true {
+		in, out := &in.Meta, &out.Meta
+		*out = map[string]string(*in)
+	}
 	return nil
 }
 
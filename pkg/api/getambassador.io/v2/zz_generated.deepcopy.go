@@ -477,6 +477,23 @@ func (in *ConsulResolverSpec) DeepCopyInto(out *ConsulResolverSpec) {
 		*out = make(AmbassadorID, len(*in))
 		copy(*out, *in)
 	}
+	if in.FailoverDatacenters != nil {
+		in, out := &in.FailoverDatacenters, &out.FailoverDatacenters
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Tags != nil {
+		in, out := &in.Tags, &out.Tags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Meta != nil {
+		in, out := &in.Meta, &out.Meta
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConsulResolverSpec.
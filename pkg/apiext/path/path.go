@@ -4,4 +4,5 @@ const (
 	WebhooksCrdConvert = "/webhooks/crd-convert"
 	ProbesReady        = "/probes/ready"
 	ProbesLive         = "/probes/live"
+	Metrics            = "/metrics"
 )
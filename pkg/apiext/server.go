@@ -11,6 +11,8 @@ import (
 	"time"
 
 	"github.com/go-logr/zapr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/emissary-ingress/emissary/v3/pkg/apiext/defaults"
@@ -19,6 +21,7 @@ import (
 	crdcontroller "github.com/emissary-ingress/emissary/v3/pkg/apiext/internal/controller/crd"
 	cacertrunnable "github.com/emissary-ingress/emissary/v3/pkg/apiext/internal/runnable/cacert"
 	"github.com/emissary-ingress/emissary/v3/pkg/apiext/path"
+	"github.com/emissary-ingress/emissary/v3/pkg/metrics"
 	corev1 "k8s.io/api/core/v1"
 	apiextv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/labels"
@@ -41,6 +44,18 @@ const (
 	leaderElectionID = "emissary-ca-mgr-leader"
 )
 
+var (
+	conversionRequests = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "emissary_apiext_conversion_requests_total",
+		Help: "Number of CRD conversion webhook requests, by HTTP status code.",
+	}, []string{"code"})
+	conversionSeconds = metrics.Factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "emissary_apiext_conversion_duration_seconds",
+		Help:    "Time taken to handle CRD conversion webhook requests.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{})
+)
+
 // Webhook provides a simple abstraction for apiext webhook server
 type WebhookRunner interface {
 	Run(ctx context.Context, resourceScheme *runtime.Scheme) error
@@ -195,7 +210,10 @@ func (s *WebhookServer) serveHTTPS(ctx context.Context, scheme *runtime.Scheme)
 	errChan := make(chan error)
 
 	mux := http.NewServeMux()
-	mux.Handle(path.WebhooksCrdConvert, conversion.NewWebhookHandler(scheme))
+	mux.Handle(path.WebhooksCrdConvert,
+		promhttp.InstrumentHandlerCounter(conversionRequests,
+			promhttp.InstrumentHandlerDuration(conversionSeconds,
+				conversion.NewWebhookHandler(scheme))))
 
 	server := http.Server{
 		Addr:    fmt.Sprintf(":%d", s.httpsPort),
@@ -226,7 +244,7 @@ func (s *WebhookServer) serveHTTPS(ctx context.Context, scheme *runtime.Scheme)
 	}
 }
 
-// serveHealthz starts http server listening for http healthz (ready,liviness)
+// serveHealthz starts http server listening for http healthz (ready,liviness) and metrics
 func (s *WebhookServer) serveHealthz(ctx context.Context) error {
 	errChan := make(chan error)
 	mux := http.NewServeMux()
@@ -243,6 +261,8 @@ func (s *WebhookServer) serveHealthz(ctx context.Context) error {
 		_, _ = io.WriteString(w, "Living!\n")
 	}))
 
+	mux.Handle(path.Metrics, metrics.Handler())
+
 	server := http.Server{
 		Addr:    fmt.Sprintf(":%d", s.httpPort),
 		Handler: mux,
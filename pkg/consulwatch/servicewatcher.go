@@ -68,6 +68,14 @@ func (w *ServiceWatcher) Watch(handler func(endpoints Endpoints, err error)) {
 				endpointAddress = item.Node.Address
 			}
 
+			// Consul gives each instance one weight for when it's passing its health checks, and
+			// another for when it's only warning.
+			status := item.Checks.AggregatedStatus()
+			weight := item.Service.Weights.Passing
+			if status == consulapi.HealthWarning {
+				weight = item.Service.Weights.Warning
+			}
+
 			endpoints.Endpoints = append(endpoints.Endpoints, Endpoint{
 				Service:  item.Service.Service,
 				SystemID: fmt.Sprintf("consul::%s", item.Node.ID),
@@ -75,6 +83,9 @@ func (w *ServiceWatcher) Watch(handler func(endpoints Endpoints, err error)) {
 				Address:  endpointAddress,
 				Port:     item.Service.Port,
 				Tags:     tags,
+				Meta:     item.Service.Meta,
+				Status:   status,
+				Weight:   weight,
 			})
 		}
 
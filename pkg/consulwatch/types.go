@@ -8,6 +8,10 @@ type Endpoints struct {
 	Id        string     `json:""`
 	Service   string     `json:""`
 	Endpoints []Endpoint `json:""`
+
+	// Subset names the subset of the service's instances that Endpoints holds, if it doesn't
+	// hold all of them (see Select).
+	Subset string `json:",omitempty"`
 }
 
 // GroupByTags returns a map of tag name to array of Endpoint structs.
@@ -28,13 +32,63 @@ func (e *Endpoints) GroupByTags() map[string][]Endpoint {
 	return result
 }
 
+// Select returns the Endpoints that have all the given tags, and all the given service metadata,
+// as the subset with the given name.
+func (e *Endpoints) Select(subset string, tags []string, meta map[string]string) Endpoints {
+	result := Endpoints{Id: e.Id, Service: e.Service, Subset: subset, Endpoints: []Endpoint{}}
+
+	for _, endpoint := range e.Endpoints {
+		if endpoint.matches(tags, meta) {
+			result.Endpoints = append(result.Endpoints, endpoint)
+		}
+	}
+
+	return result
+}
+
 type Endpoint struct {
-	SystemID string   `json:""`
-	ID       string   `json:""`
-	Service  string   `json:""`
-	Address  string   `json:""`
-	Port     int      `json:""`
-	Tags     []string `json:""`
+	SystemID string            `json:""`
+	ID       string            `json:""`
+	Service  string            `json:""`
+	Address  string            `json:""`
+	Port     int               `json:""`
+	Tags     []string          `json:""`
+	Meta     map[string]string `json:",omitempty"`
+
+	// Status is the aggregated status of the instance's Consul health checks: "passing",
+	// "warning", "critical" or "maintenance".
+	Status string `json:",omitempty"`
+	// Weight is the instance's Consul weight for its current Status, or 0 if Consul didn't give
+	// it one.
+	Weight int `json:",omitempty"`
+
+	// Priority is the failover priority of the datacenter the endpoint came from, if the
+	// endpoints came from more than one datacenter: 0 for the primary datacenter, 1 for the
+	// first one to fail over to, and so on.
+	Priority int `json:",omitempty"`
+}
+
+func (e *Endpoint) matches(tags []string, meta map[string]string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, have := range e.Tags {
+			if have == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for key, value := range meta {
+		if have, ok := e.Meta[key]; !ok || have != value {
+			return false
+		}
+	}
+
+	return true
 }
 
 type Certificate struct {
@@ -18,9 +18,15 @@ type Debug struct {
 	timers map[string]*Timer // Holds the debug timers.
 	values map[string]*Value // holds the debug values.
 
+	observer TimerObserver // told about every action timed by any of the timers
+
 	clock ClockFunc // clock function to pass to all the timers
 }
 
+// A TimerObserver is told about every action timed by the timers of a Debug root, along with the
+// name of the timer. This lets the timings be exported elsewhere, e.g. as metrics.
+type TimerObserver func(name string, elapsed time.Duration)
+
 // An atomic.Value with custom json marshalling.
 type Value atomic.Value
 
@@ -74,12 +80,29 @@ func (d *Debug) Timer(name string) (result *Timer) {
 		result, ok = d.timers[name]
 		if !ok {
 			result = NewTimerWithClock(d.clock)
+			result.observe = func(elapsed time.Duration) {
+				var observer TimerObserver
+				d.withMutex(func() {
+					observer = d.observer
+				})
+				if observer != nil {
+					observer(name, elapsed)
+				}
+			}
 			d.timers[name] = result
 		}
 	})
 	return
 }
 
+// The SetTimerObserver() method sets the TimerObserver that is told about every action timed by
+// any of the timers, including timers that already exist.
+func (d *Debug) SetTimerObserver(observer TimerObserver) {
+	d.withMutex(func() {
+		d.observer = observer
+	})
+}
+
 // The Value() method ensures the named atomic.Value exists and returns it.
 func (d *Debug) Value(name string) (result *atomic.Value) {
 	d.withMutex(func() {
@@ -148,6 +148,13 @@
 //	    "reconcileSecrets": "2, 18.704µs/20.786µs/22.868µs"
 //	  },
 //	  "values": {
+//	    # ambex's most recent snapshot, along with how many updates it skipped because they
+//	    # didn't change anything
+//	    "ambexSnapshots": {
+//	      "generation": 42,
+//	      "hash": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+//	      "skipped": 17
+//	    },
 //	    "envoyReconfigs": {
 //	      "times": [
 //	        "2020-11-06T13:13:24.218707995-05:00",
@@ -158,7 +165,29 @@
 //	      "staleMax": 0,
 //	      "synced": true
 //	    },
-//	    "memory": "39.73Gi of Unlimited (0%)"
+//	    "memory": "39.73Gi of Unlimited (0%)",
+//
+//	    # the Envoy nodes connected to ambex
+//	    "xdsNodes": [
+//	      {
+//	        "id": "test-id",
+//	        "cluster": "ambassador-default",
+//	        "key": "test-id",
+//	        "streams": 1,
+//	        "connected": "2020-11-06T13:13:23.912034112-05:00",
+//	        "lastRequest": "2020-11-06T13:13:28.613552091-05:00",
+//	        "acked": {
+//	          "type.googleapis.com/envoy.config.cluster.v3.Cluster": "v4"
+//	        },
+//	        "rejected": {
+//	          "type.googleapis.com/envoy.config.listener.v3.Listener": {
+//	            "version": "v5",
+//	            "error": "error adding listener 'ambassador-listener-8080': ...",
+//	            "time": "2020-11-06T13:13:28.613552091-05:00"
+//	          }
+//	        }
+//	      }
+//	    ]
 //	  }
 //	}
 //
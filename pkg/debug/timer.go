@@ -43,7 +43,8 @@ type Timer struct {
 	min   time.Duration // the max elapsed time for an action
 	max   time.Duration // the min elapsed time for an action
 
-	clock func() time.Time // The clock function used by the timer.
+	clock   func() time.Time    // The clock function used by the timer.
+	observe func(time.Duration) // If set, called with the elapsed time of every action.
 }
 
 // The type of the clock function to use for timing.
@@ -94,6 +95,9 @@ func (t *Timer) record(start time.Time, stop time.Time) {
 		t.count++
 		t.total += delta
 	})
+	if t.observe != nil {
+		t.observe(stop.Sub(start))
+	}
 }
 
 // Convenience function for safely accessing the internals of the struct.
@@ -64,3 +64,30 @@ func TestConcurrentTiming(t *testing.T) {
 func TestAverageZero(t *testing.T) {
 	assert.Equal(t, 0*time.Second, debug.NewTimer().Average())
 }
+
+func TestTimerObserver(t *testing.T) {
+	clock := time.Now()
+	dbg := debug.NewDebugWithClock(func() time.Time {
+		return clock
+	})
+
+	// Timers created before the observer is set are observed too.
+	timer := dbg.Timer("before")
+
+	observed := map[string][]time.Duration{}
+	dbg.SetTimerObserver(func(name string, elapsed time.Duration) {
+		observed[name] = append(observed[name], elapsed)
+	})
+
+	timer.Time(func() {
+		clock = clock.Add(250 * time.Millisecond)
+	})
+	dbg.Timer("after").Time(func() {
+		clock = clock.Add(500 * time.Millisecond)
+	})
+
+	assert.Equal(t, map[string][]time.Duration{
+		"before": {250 * time.Millisecond},
+		"after":  {500 * time.Millisecond},
+	}, observed)
+}
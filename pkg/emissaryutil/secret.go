@@ -0,0 +1,80 @@
+package emissaryutil
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/datawire/dlib/derror"
+	"github.com/datawire/dlib/dlog"
+)
+
+// ValidateTLSSecret checks that whatever TLS private key and certificate a Secret contains can
+// actually be parsed. The secretName is only used to make the errors readable. A Secret that has
+// neither a private key nor a certificate is considered valid; it's up to the caller to decide
+// whether it needs them. The returned MultiError is empty if the Secret is valid.
+func ValidateTLSSecret(ctx context.Context, secretName string, secret *v1.Secret) derror.MultiError {
+	var errs derror.MultiError
+
+	// OK, do we have a TLS private key?
+	privKeyPEMBytes, ok := secret.Data[v1.TLSPrivateKeyKey]
+
+	if ok && len(privKeyPEMBytes) > 0 {
+		// Yes. We need to be able to decode it.
+		caKeyBlock, _ := pem.Decode(privKeyPEMBytes)
+
+		if caKeyBlock != nil {
+			dlog.Debugf(ctx, "%s has private key, block type %s", secretName, caKeyBlock.Type)
+
+			// First try PKCS1.
+			_, err := x509.ParsePKCS1PrivateKey(caKeyBlock.Bytes)
+
+			if err != nil {
+				// Try PKCS8? (No, = instead of := is not a typo here: we're overwriting the
+				// earlier error.)
+				_, err = x509.ParsePKCS8PrivateKey(caKeyBlock.Bytes)
+			}
+
+			if err != nil {
+				// Try EC? (No, = instead of := is not a typo here: we're overwriting the
+				// earlier error.)
+				_, err = x509.ParseECPrivateKey(caKeyBlock.Bytes)
+			}
+
+			// Any issues here?
+			if err != nil {
+				errs = append(errs,
+					fmt.Errorf("%s %s cannot be parsed as PKCS1, PKCS8, or EC: %s", secretName, v1.TLSPrivateKeyKey, err.Error()))
+			}
+		} else {
+			errs = append(errs,
+				fmt.Errorf("%s %s is not a PEM-encoded key", secretName, v1.TLSPrivateKeyKey))
+		}
+	}
+
+	// How about a TLS cert bundle?
+	caCertPEMBytes, ok := secret.Data[v1.TLSCertKey]
+
+	if ok && len(caCertPEMBytes) > 0 {
+		caCertBlock, _ := pem.Decode(caCertPEMBytes)
+
+		if caCertBlock != nil {
+			dlog.Debugf(ctx, "%s has public key, block type %s", secretName, caCertBlock.Type)
+
+			_, err := x509.ParseCertificate(caCertBlock.Bytes)
+
+			if err != nil {
+				errs = append(errs,
+					fmt.Errorf("%s %s cannot be parsed as x.509: %s", secretName, v1.TLSCertKey, err.Error()))
+			}
+		} else {
+			errs = append(errs,
+				fmt.Errorf("%s %s is not a PEM-encoded certificate", secretName, v1.TLSCertKey))
+		}
+	}
+
+	return errs
+}
@@ -1,11 +1,16 @@
 package gateway
 
 import (
+	"context"
 	"fmt"
 
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/emissary-ingress/emissary/v3/pkg/emissaryutil"
 	"github.com/emissary-ingress/emissary/v3/pkg/kates"
 	v3core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	v3endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	v3tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 )
 
 // Compile_Endpoints transforms a kubernetes endpoints resource into a v3endpoint.ClusterLoadAssignment
@@ -64,3 +69,46 @@ func makeLbEndpoint(protocol, ip string, port int) *v3endpoint.LbEndpoint {
 		},
 	}
 }
+
+// SecretName returns the name that envoy knows a kubernetes Secret by.
+func SecretName(namespace, name string) string {
+	return resourceKeyFromParts("Secret", namespace, name)
+}
+
+// Compile_Secret transforms a kubernetes TLS secret into a v3tls.Secret that listeners can refer to
+// via SDS.
+func Compile_Secret(ctx context.Context, secret *kates.Secret) *CompiledSecret {
+	src := SourceFromResource(secret)
+
+	var compiled *CompiledSecret
+	cert, key := secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey]
+	if len(cert) == 0 || len(key) == 0 {
+		compiled = &CompiledSecret{
+			CompiledItem: NewCompiledItemError(src, fmt.Sprintf("secret must contain both %s and %s", v1.TLSCertKey, v1.TLSPrivateKeyKey)),
+		}
+	} else if errs := emissaryutil.ValidateTLSSecret(ctx, src.Location(), secret); len(errs) > 0 {
+		compiled = &CompiledSecret{
+			CompiledItem: NewCompiledItemError(src, errs.Error()),
+		}
+	} else {
+		compiled = &CompiledSecret{
+			CompiledItem: NewCompiledItem(src),
+			Secret: &v3tls.Secret{
+				Name: SecretName(secret.Namespace, secret.Name),
+				Type: &v3tls.Secret_TlsCertificate{
+					TlsCertificate: &v3tls.TlsCertificate{
+						CertificateChain: &v3core.DataSource{
+							Specifier: &v3core.DataSource_InlineBytes{InlineBytes: cert},
+						},
+						PrivateKey: &v3core.DataSource{
+							Specifier: &v3core.DataSource_InlineBytes{InlineBytes: key},
+						},
+					},
+				},
+			},
+		}
+	}
+	compiled.Namespace = secret.Namespace
+
+	return compiled
+}
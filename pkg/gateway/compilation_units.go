@@ -1,11 +1,15 @@
 package gateway
 
 import (
+	"time"
+
 	v3cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	v3endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	v3listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	v3route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
-	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
+	v3tcpproxy "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	v3tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	gw "sigs.k8s.io/gateway-api/apis/v1"
 )
 
 // The types in this file primarily decorate envoy configuration with pointers back to Sources
@@ -35,6 +39,7 @@ type CompiledConfig struct {
 	Routes          []*CompiledRoute
 	Clusters        []*CompiledCluster
 	LoadAssignments []*CompiledLoadAssignment
+	Secrets         []*CompiledSecret
 }
 
 // CompiledListener is an envoy Listener plus a Predicate that the dispatcher uses to determine
@@ -48,6 +53,27 @@ type CompiledListener struct {
 	// RouteConfiguration from all the available CompiledRoutes.
 	Predicate func(route *CompiledRoute) bool
 	Domains   []string
+
+	// RouteDomains, if set, narrows the Domains that a particular route is served on, e.g. to
+	// honor the intersection of a Gateway listener's hostname with an HTTPRoute's hostnames. If
+	// RouteDomains is nil, every route that satisfies the Predicate is served on all Domains.
+	RouteDomains func(route *CompiledRoute) []string
+
+	// RouteConfigDomains, if set, narrows the domains further for each of the RouteConfigurations
+	// that the Listener's filter chains use, by name, e.g. so that each filter chain of an HTTPS
+	// listener only serves the routes of its own Gateway listener. Routes with no domains for a
+	// RouteConfiguration are left out of it.
+	RouteConfigDomains map[string]func(route *CompiledRoute) []string
+
+	// FilterChainSecrets maps the name of a filter chain in the Listener to the names of the
+	// CompiledSecrets that it refers to via SDS. The dispatcher drops any filter chain whose
+	// secrets aren't available, and serves the secrets that are used alongside the listener.
+	FilterChainSecrets map[string][]string
+
+	// RouteFilterChains is set for listeners that proxy connections rather than requests. Instead
+	// of assembling a RouteConfiguration, the dispatcher appends the filter chains it returns for
+	// each route that satisfies the Predicate to the Listener.
+	RouteFilterChains func(route *CompiledRoute) []*v3listener.FilterChain
 }
 
 // CompiledRoute is
@@ -58,8 +84,25 @@ type CompiledRoute struct {
 	// source such as labels kind, namespace, name, etc.
 	HTTPRoute *gw.HTTPRoute
 
+	// Name and CreationTimestamp identify the resource that produced the route. They break ties
+	// when the dispatcher orders the routes of different resources by precedence.
+	Name              string
+	CreationTimestamp time.Time
+
+	// Kind, ParentRefs, and Hostnames describe how the route asks to be attached to listeners.
+	Kind       string
+	ParentRefs []gw.ParentReference
+	Hostnames  []gw.Hostname
+
 	Routes      []*v3route.Route
 	ClusterRefs []*ClusterRef
+
+	// FilterErrors holds an error for each filter in the route that couldn't be compiled.
+	FilterErrors []CompiledItem
+
+	// TCPProxy is set instead of Routes for routes that forward whole connections, i.e. TCPRoutes
+	// and TLSRoutes.
+	TCPProxy *v3tcpproxy.TcpProxy
 }
 
 // ClusterRef represents a reference to an envoy v2.Cluster.
@@ -70,6 +113,8 @@ type ClusterRef struct {
 	// These are temporary fields to deal with how endpoints are currently plumbed from the watcher
 	// through to ambex.
 	EndpointPath string
+	Service      string // The kubernetes Service backing the cluster, if different from Name.
+	HTTP2        bool   // Whether the cluster must speak HTTP/2 to its endpoints, e.g. for gRPC.
 }
 
 // CompiledCluster decorates an envoy v2.Cluster.
@@ -83,3 +128,9 @@ type CompiledLoadAssignment struct {
 	CompiledItem
 	LoadAssignment *v3endpoint.ClusterLoadAssignment
 }
+
+// CompiledSecret decorates an envoy v3tls.Secret.
+type CompiledSecret struct {
+	CompiledItem
+	Secret *v3tls.Secret
+}
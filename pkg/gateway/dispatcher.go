@@ -4,8 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/durationpb"
 
 	// Envoy API v3
@@ -15,6 +19,8 @@ import (
 	v3endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	v3listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	v3route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	v3tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	v3upstreamhttp "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
 
 	// Envoy control plane API's
 	ecp_cache_types "github.com/envoyproxy/go-control-plane/pkg/cache/types"
@@ -30,33 +36,34 @@ import (
 // resources and invokes those transforms to produce compiled envoy configurations. It also knows
 // how to assemble the compiled envoy configuration into a complete snapshot.
 //
-// Currently the dispatch process is relatively simple, each resource is processed as an independent
-// unit. This is sufficient for the gateway API since the currently implemented resources are
-// conveniently defined in such a way as to make them independent.
+// Each resource is transformed as a unit. A transform that needs to look at other resources, e.g. a
+// Gateway that needs the Secrets named by its certificateRefs, is registered with
+// RegisterWithQuery and is passed a Query API along with the resource. Any resources queried by the
+// transform are automatically tracked as dependencies of that resource, and whenever a resource is
+// upserted or deleted the dispatcher transforms everything that depends on it again. Kinds that are
+// only ever looked up, such as Services, are registered with RegisterDependency.
 //
 // Consistency is guaranteed assuming transform functions don't use out of band communication to
-// include information from other resources. This guarantee is achieved because each transform is
-// only passed a single resource and can therefore only use information from that one
-// resource. Changes to any other resource cannot impact the result of that transform.
+// include information from other resources. Everything a transform can learn about other resources
+// comes through its Query, so changes to any resource the transform didn't query cannot impact the
+// result of that transform.
 //
-// Not all the Emissary resources are defined as conveniently, so the Dispatcher design is expected
-// to be extended in two ways to handle resources with more complex interdependencies:
-//
-//  1. Grouping -- This feature would cover resources that need to be processed as a group,
-//     e.g. Mappings that get grouped together based on prefix. Instead of dispatching at the
-//     granularity of a single resource, the dispatcher will track groups of resources that need to
-//     be processed together via a logical "hash" function provided at registration. Whenever any
-//     item in a given bucket changes, the dispatcher will transform the entire bucket.
-//
-//  2. Dependencies -- This feature would cover resources that need to lookup the contents of other
-//     resources in order to properly implement their transform. This would be done by passing the
-//     transform function a Query API. Any resources queried by the transform would be
-//     automatically tracked as a dependency of that resource. The dependencies would then be used
-//     to perform invalidation whenever a resource is Upsert()ed.
+// The Dispatcher does not group resources: every transform still compiles exactly one resource.
+// Resources that can only be compiled together, e.g. Mappings that get grouped together based on
+// prefix, are not handled by the Dispatcher.
 type Dispatcher struct {
-	// Map from kind to transform function.
-	transforms map[string]func(kates.Object) (*CompiledConfig, error)
+	// Map from kind to transform function. Kinds registered with RegisterDependency have a nil
+	// transform.
+	transforms map[string]func(kates.Object, *Query) (*CompiledConfig, error)
 	configs    map[string]*CompiledConfig
+	// Map from resource key to the most recently upserted resource, used for computing status and
+	// for answering queries.
+	resources map[string]kates.Object
+	// Map from a resource key (or List query key) to the keys of the resources whose transforms
+	// queried it.
+	dependents map[string]map[string]bool
+	// Map from resource key to the keys its transform queried the last time it ran.
+	dependencies map[string]map[string]bool
 
 	version         string
 	changeCount     int
@@ -83,8 +90,11 @@ func resourceKeyFromParts(kind, namespace, name string) string {
 // NewDispatcher creates a new and empty *Dispatcher struct.
 func NewDispatcher() *Dispatcher {
 	return &Dispatcher{
-		transforms: map[string]func(kates.Object) (*CompiledConfig, error){},
-		configs:    map[string]*CompiledConfig{},
+		transforms:   map[string]func(kates.Object, *Query) (*CompiledConfig, error){},
+		configs:      map[string]*CompiledConfig{},
+		resources:    map[string]kates.Object{},
+		dependents:   map[string]map[string]bool{},
+		dependencies: map[string]map[string]bool{},
 	}
 }
 
@@ -92,6 +102,28 @@ func NewDispatcher() *Dispatcher {
 // argument must be a function that takes a single resource of the supplied "kind" and returns a
 // single CompiledConfig object, i.e.: `func(Kind) *CompiledConfig`
 func (d *Dispatcher) Register(kind string, transform func(kates.Object) (*CompiledConfig, error)) error {
+	return d.RegisterWithQuery(kind, func(resource kates.Object, _ *Query) (*CompiledConfig, error) {
+		return transform(resource)
+	})
+}
+
+// RegisterWithQuery registers a transform function that may look up other resources via the
+// supplied Query, i.e.: `func(Kind, *Query) *CompiledConfig`. The resource will be transformed
+// again whenever anything it looked up changes.
+func (d *Dispatcher) RegisterWithQuery(kind string, transform func(kates.Object, *Query) (*CompiledConfig, error)) error {
+	if transform == nil {
+		return errors.Errorf("nil transform: %q", kind)
+	}
+	return d.register(kind, transform)
+}
+
+// RegisterDependency registers a kind of resource that produces no envoy configuration of its own
+// but that transforms may look up via their Query, e.g. Services or Secrets.
+func (d *Dispatcher) RegisterDependency(kind string) error {
+	return d.register(kind, nil)
+}
+
+func (d *Dispatcher) register(kind string, transform func(kates.Object, *Query) (*CompiledConfig, error)) error {
 	_, ok := d.transforms[kind]
 	if ok {
 		return errors.Errorf("duplicate transform: %q", kind)
@@ -108,8 +140,25 @@ func (d *Dispatcher) IsRegistered(kind string) bool {
 	return ok
 }
 
-// Upsert processes the given kubernetes resource whether it is new or just updated.
-func (d *Dispatcher) Upsert(resource kates.Object) error {
+// IsRelevant returns true if a change to the resource with the given kind, namespace, and name
+// could change the configuration the dispatcher produces. That is the case if the kind has a
+// transform, or if any transform has queried the resource.
+func (d *Dispatcher) IsRelevant(kind, namespace, name string) bool {
+	if d.transforms[kind] != nil {
+		return true
+	}
+	for _, dep := range invalidatedKeys(resourceKeyFromParts(kind, namespace, name)) {
+		if len(d.dependents[dep]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Upsert processes the given kubernetes resource whether it is new or just updated, along with
+// every resource that depends on it. Upserting a resource with the same resourceVersion as the one
+// the dispatcher already has is a no-op, so it is cheap to upsert resources that haven't changed.
+func (d *Dispatcher) Upsert(ctx context.Context, resource kates.Object) error {
 	gvk := resource.GetObjectKind().GroupVersionKind()
 	xform, ok := d.transforms[gvk.Kind]
 	if !ok {
@@ -117,41 +166,118 @@ func (d *Dispatcher) Upsert(resource kates.Object) error {
 	}
 
 	key := resourceKey(resource)
-
-	config, err := xform(resource)
-	if err != nil {
-		return errors.Wrapf(err, "internal error processing %s", key)
+	if old, ok := d.resources[key]; ok && resource.GetResourceVersion() != "" &&
+		old.GetResourceVersion() == resource.GetResourceVersion() {
+		return nil
 	}
 
-	d.configs[key] = config
+	if xform != nil {
+		if err := d.transform(ctx, key, resource, xform); err != nil {
+			return err
+		}
+	}
+	d.resources[key] = resource
 	// Clear out the snapshot so we regenerate one.
 	d.snapshot = nil
-	return nil
+	return d.transformDependents(ctx, key)
 }
 
 // Delete processes the deletion of the given kubernetes resource.
-func (d *Dispatcher) Delete(resource kates.Object) {
-	key := resourceKey(resource)
+func (d *Dispatcher) Delete(ctx context.Context, resource kates.Object) {
+	gvk := resource.GetObjectKind().GroupVersionKind()
+	d.DeleteKey(ctx, gvk.Kind, resource.GetNamespace(), resource.GetName())
+}
+
+// DeleteKey processes the deletion of the kubernetes resource with the given kind, namespace, and
+// name, along with every resource that depends on it.
+func (d *Dispatcher) DeleteKey(ctx context.Context, kind, namespace, name string) {
+	key := resourceKeyFromParts(kind, namespace, name)
+	if _, ok := d.resources[key]; !ok {
+		return
+	}
 	delete(d.configs, key)
+	delete(d.resources, key)
+	d.setDependencies(key, nil)
 
 	// Clear out the snapshot so we regenerate one.
 	d.snapshot = nil
+	// There's no way to report errors from here, but any dependent that fails to transform keeps
+	// its previous configuration, just as a failed Upsert would.
+	_ = d.transformDependents(ctx, key)
 }
 
-func (d *Dispatcher) DeleteKey(kind, namespace, name string) {
-	key := resourceKeyFromParts(kind, namespace, name)
-	delete(d.configs, key)
-	d.snapshot = nil
+// transform runs the transform for a resource, and records the resulting configuration along with
+// whatever the transform queried.
+func (d *Dispatcher) transform(ctx context.Context, key string, resource kates.Object, xform func(kates.Object, *Query) (*CompiledConfig, error)) error {
+	query := newQuery(ctx, d)
+	config, err := xform(resource, query)
+	if err != nil {
+		return errors.Wrapf(err, "internal error processing %s", key)
+	}
+	d.configs[key] = config
+	d.setDependencies(key, query.deps)
+	return nil
+}
+
+// setDependencies replaces the dependencies recorded for a resource.
+func (d *Dispatcher) setDependencies(key string, deps map[string]bool) {
+	for dep := range d.dependencies[key] {
+		delete(d.dependents[dep], key)
+		if len(d.dependents[dep]) == 0 {
+			delete(d.dependents, dep)
+		}
+	}
+	delete(d.dependencies, key)
+	if len(deps) == 0 {
+		return
+	}
+	d.dependencies[key] = deps
+	for dep := range deps {
+		if d.dependents[dep] == nil {
+			d.dependents[dep] = map[string]bool{}
+		}
+		d.dependents[dep][key] = true
+	}
+}
+
+// transformDependents runs the transform for every resource that queried the resource with the
+// given key. Transforms only query resources, never the configuration produced from them, so this
+// doesn't need to recurse.
+func (d *Dispatcher) transformDependents(ctx context.Context, key string) error {
+	dependents := map[string]bool{}
+	for _, dep := range invalidatedKeys(key) {
+		for dependent := range d.dependents[dep] {
+			dependents[dependent] = true
+		}
+	}
+	keys := make([]string, 0, len(dependents))
+	for dependent := range dependents {
+		keys = append(keys, dependent)
+	}
+	sort.Strings(keys)
+
+	var errs []string
+	for _, dependent := range keys {
+		resource := d.resources[dependent]
+		xform := d.transforms[resource.GetObjectKind().GroupVersionKind().Kind]
+		if err := d.transform(ctx, dependent, resource, xform); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
 }
 
 // UpsertYaml parses the supplied yaml and invokes Upsert on the result.
-func (d *Dispatcher) UpsertYaml(manifests string) error {
+func (d *Dispatcher) UpsertYaml(ctx context.Context, manifests string) error {
 	objs, err := kates.ParseManifests(manifests)
 	if err != nil {
 		return err
 	}
 	for _, obj := range objs {
-		err := d.Upsert(obj)
+		err := d.Upsert(ctx, obj)
 		if err != nil {
 			return err
 		}
@@ -180,6 +306,9 @@ func (d *Dispatcher) GetErrors() []*CompiledItem {
 					result = append(result, &cr.CompiledItem)
 				}
 			}
+			for i := range r.FilterErrors {
+				result = append(result, &r.FilterErrors[i])
+			}
 		}
 		for _, c := range config.Clusters {
 			if c.Error != "" {
@@ -191,6 +320,11 @@ func (d *Dispatcher) GetErrors() []*CompiledItem {
 				result = append(result, &la.CompiledItem)
 			}
 		}
+		for _, s := range config.Secrets {
+			if s.Error != "" {
+				result = append(result, &s.CompiledItem)
+			}
+		}
 	}
 	return result
 }
@@ -248,15 +382,26 @@ func (d *Dispatcher) IsWatched(namespace, name string) bool {
 	return ok
 }
 
-func (d *Dispatcher) buildClusterMap() (map[string]string, map[string]bool) {
-	refs := map[string]string{}
+func (d *Dispatcher) buildClusterMap() (map[string]*ClusterRef, map[string]bool) {
+	refs := map[string]*ClusterRef{}
 	watches := map[string]bool{}
 	for _, config := range d.configs {
 		for _, route := range config.Routes {
 			for _, ref := range route.ClusterRefs {
-				refs[ref.Name] = ref.EndpointPath
-				if route.Namespace != "" {
-					key := fmt.Sprintf("%s:%s", route.Namespace, ref.Name)
+				if ref.Error != "" {
+					continue
+				}
+				refs[ref.Name] = ref
+				namespace := ref.Namespace
+				if namespace == "" {
+					namespace = route.Namespace
+				}
+				service := ref.Service
+				if service == "" {
+					service = ref.Name
+				}
+				if namespace != "" {
+					key := fmt.Sprintf("%s:%s", namespace, service)
 					watches[key] = true
 				}
 			}
@@ -275,63 +420,461 @@ func (d *Dispatcher) buildEndpointMap() map[string]*v3endpoint.ClusterLoadAssign
 	return endpoints
 }
 
-func (d *Dispatcher) buildRouteConfigurations() ([]ecp_cache_types.Resource, []ecp_cache_types.Resource) {
+func (d *Dispatcher) buildSecretMap() map[string]*v3tls.Secret {
+	secrets := map[string]*v3tls.Secret{}
+	for _, config := range d.configs {
+		for _, s := range config.Secrets {
+			if s.Error != "" {
+				continue
+			}
+			secrets[s.Secret.Name] = s.Secret
+		}
+	}
+	return secrets
+}
+
+func (d *Dispatcher) buildRouteConfigurations() ([]ecp_cache_types.Resource, []ecp_cache_types.Resource, []ecp_cache_types.Resource) {
 	listeners := []ecp_cache_types.Resource{}
 	routes := []ecp_cache_types.Resource{}
-	for _, config := range d.configs {
+	secrets := []ecp_cache_types.Resource{}
+	secretMap := d.buildSecretMap()
+
+	// Envoy can only have one listener per address, so CompiledListeners that bind the same
+	// address, e.g. those for two Gateways with listeners on the same port, are merged.
+	var merged []*mergedListener
+	byAddress := map[string]*mergedListener{}
+	for _, config := range d.sortedConfigs() {
 		for _, lst := range config.Listeners {
-			listeners = append(listeners, lst.Listener)
-			r := d.buildRouteConfiguration(lst)
-			if r != nil {
-				routes = append(routes, r)
+			if lst.Listener == nil {
+				// The transform couldn't produce a listener, it will have reported why.
+				continue
+			}
+			listener := resolveListenerSecrets(lst, secretMap)
+			if listener != nil && lst.RouteFilterChains != nil {
+				listener = d.buildRouteFilterChains(lst, listener)
+			}
+			if listener == nil {
+				continue
+			}
+			key := listenerAddress(listener)
+			if m, ok := byAddress[key]; ok {
+				m.merge(lst, listener)
+				continue
+			}
+			m := newMergedListener(lst, listener)
+			merged = append(merged, m)
+			if key != "" {
+				byAddress[key] = m
+			}
+		}
+	}
+
+	usedSecrets := map[string]bool{}
+	for _, m := range merged {
+		listeners = append(listeners, m.listener)
+		for _, chain := range m.listener.FilterChains {
+			for _, name := range m.owners[chain].FilterChainSecrets[chain.Name] {
+				if !usedSecrets[name] {
+					usedSecrets[name] = true
+					secrets = append(secrets, secretMap[name])
+				}
 			}
 		}
+		for _, name := range m.rdsNames {
+			routes = append(routes, d.buildRouteConfiguration(name, m.rdsSources[name]))
+		}
 	}
-	return listeners, routes
+	return listeners, routes, secrets
 }
 
-func (d *Dispatcher) buildRouteConfiguration(lst *CompiledListener) *v3route.RouteConfiguration {
-	rdsName, isRds := getRdsName(lst.Listener)
-	if !isRds {
-		return nil
+// mergedListener is an envoy Listener assembled from all the CompiledListeners that bind the same
+// address.
+type mergedListener struct {
+	listener *v3listener.Listener
+
+	// owners maps each of the listener's filter chains to the CompiledListener it came from.
+	owners map[*v3listener.FilterChain]*CompiledListener
+
+	// rdsNames lists the RouteConfigurations that the listener's filter chains use, and
+	// rdsSources has the CompiledListeners whose routes go into each of them.
+	rdsNames   []string
+	rdsSources map[string][]routeSource
+}
+
+// routeSource is a CompiledListener whose routes go into a RouteConfiguration, along with the
+// name that the CompiledListener itself gave that RouteConfiguration.
+type routeSource struct {
+	lst     *CompiledListener
+	rdsName string
+}
+
+func newMergedListener(lst *CompiledListener, listener *v3listener.Listener) *mergedListener {
+	m := &mergedListener{
+		listener:   proto.Clone(listener).(*v3listener.Listener),
+		owners:     map[*v3listener.FilterChain]*CompiledListener{},
+		rdsSources: map[string][]routeSource{},
+	}
+	for _, chain := range m.listener.FilterChains {
+		m.own(lst, chain)
 	}
+	return m
+}
 
-	var routes []*v3route.Route
-	for _, config := range d.configs {
-		for _, route := range config.Routes {
-			if lst.Predicate(route) {
-				routes = append(routes, route.Routes...)
+// merge adds the filter chains and listener filters of another CompiledListener's listener. Only
+// one filter chain can serve a given match: if both chains route requests, the other
+// CompiledListener's routes go into the RouteConfiguration of the chain that is already there,
+// otherwise the chain that is already there wins.
+func (m *mergedListener) merge(lst *CompiledListener, listener *v3listener.Listener) {
+	for _, chain := range listener.FilterChains {
+		var existing *v3listener.FilterChain
+		for _, c := range m.listener.FilterChains {
+			if proto.Equal(c.FilterChainMatch, chain.FilterChainMatch) {
+				existing = c
+				break
+			}
+		}
+		if existing == nil {
+			chain = proto.Clone(chain).(*v3listener.FilterChain)
+			m.listener.FilterChains = append(m.listener.FilterChains, chain)
+			m.own(lst, chain)
+			continue
+		}
+		name, isRds := getChainRdsName(existing)
+		if own, ok := getChainRdsName(chain); isRds && ok {
+			m.addRdsSource(name, routeSource{lst: lst, rdsName: own})
+		}
+	}
+	for _, filter := range listener.ListenerFilters {
+		present := false
+		for _, f := range m.listener.ListenerFilters {
+			if f.Name == filter.Name {
+				present = true
+				break
 			}
 		}
+		if !present {
+			m.listener.ListenerFilters = append(m.listener.ListenerFilters, proto.Clone(filter).(*v3listener.ListenerFilter))
+		}
 	}
+}
 
-	return &v3route.RouteConfiguration{
-		Name: rdsName,
-		VirtualHosts: []*v3route.VirtualHost{
-			{
-				Name:    rdsName,
-				Domains: lst.Domains,
-				Routes:  routes,
-			},
-		},
+func (m *mergedListener) own(lst *CompiledListener, chain *v3listener.FilterChain) {
+	m.owners[chain] = lst
+	if name, ok := getChainRdsName(chain); ok {
+		m.addRdsSource(name, routeSource{lst: lst, rdsName: name})
+	}
+}
+
+func (m *mergedListener) addRdsSource(name string, source routeSource) {
+	sources, ok := m.rdsSources[name]
+	if !ok {
+		m.rdsNames = append(m.rdsNames, name)
+	}
+	for _, s := range sources {
+		if s == source {
+			return
+		}
 	}
+	m.rdsSources[name] = append(sources, source)
 }
 
-// getRdsName returns the RDS route configuration name configured for the listener and a flag
-// indicating whether the listener uses Rds.
-func getRdsName(l *v3listener.Listener) (string, bool) {
-	for _, fc := range l.FilterChains {
-		for _, f := range fc.Filters {
-			if f.Name != ecp_wellknown.HTTPConnectionManager {
+// listenerAddress returns a string that identifies the socket address a listener binds, or "" if
+// it doesn't have one.
+func listenerAddress(l *v3listener.Listener) string {
+	addr := l.GetAddress().GetSocketAddress()
+	if addr == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s %s:%d", addr.Protocol, addr.Address, addr.GetPortValue())
+}
+
+// buildRouteFilterChains returns a copy of the listener with the filter chains for all the
+// CompiledRoutes that satisfy the listener's Predicate appended, or nil if the listener ends up with
+// no filter chains at all. If more than one route asks for the same filter chain match, the route
+// that sorts first wins.
+func (d *Dispatcher) buildRouteFilterChains(lst *CompiledListener, listener *v3listener.Listener) *v3listener.Listener {
+	listener = proto.Clone(listener).(*v3listener.Listener)
+	for _, config := range d.sortedConfigs() {
+		for _, route := range config.Routes {
+			if lst.Predicate == nil || !lst.Predicate(route) {
 				continue
 			}
+			for _, chain := range lst.RouteFilterChains(route) {
+				duplicate := false
+				for _, existing := range listener.FilterChains {
+					if proto.Equal(existing.FilterChainMatch, chain.FilterChainMatch) {
+						duplicate = true
+						break
+					}
+				}
+				if !duplicate {
+					listener.FilterChains = append(listener.FilterChains, chain)
+				}
+			}
+		}
+	}
+	if len(listener.FilterChains) == 0 {
+		return nil
+	}
+	return listener
+}
+
+// resolveListenerSecrets returns the listener with any filter chains that refer to unavailable
+// secrets removed, or nil if there are no filter chains left.
+func resolveListenerSecrets(lst *CompiledListener, secretMap map[string]*v3tls.Secret) *v3listener.Listener {
+	if lst.FilterChainSecrets == nil {
+		return lst.Listener
+	}
+	listener := proto.Clone(lst.Listener).(*v3listener.Listener)
+	var chains []*v3listener.FilterChain
+	for _, chain := range listener.FilterChains {
+		resolved := true
+		for _, name := range lst.FilterChainSecrets[chain.Name] {
+			if _, ok := secretMap[name]; !ok {
+				resolved = false
+				break
+			}
+		}
+		if resolved {
+			chains = append(chains, chain)
+		}
+	}
+	if len(chains) == 0 {
+		return nil
+	}
+	listener.FilterChains = chains
+	return listener
+}
 
-			hcm := ecp_v3_resource.GetHTTPConnectionManager(f)
-			if hcm != nil {
-				rds := hcm.GetRds()
-				if rds != nil {
-					return rds.RouteConfigName, true
+// buildRouteConfiguration assembles the named RouteConfiguration from all the CompiledRoutes that
+// satisfy the Predicate of any of the sources' CompiledListeners. Routes are grouped into one VirtualHost per
+// distinct domain. Since Envoy only ever picks a single VirtualHost for a given request, a route
+// that is served on a wildcard domain is also included in every more specific VirtualHost that the
+// wildcard covers. Within each VirtualHost, routes are ordered by precedence, see
+// routeEntry.precedes.
+func (d *Dispatcher) buildRouteConfiguration(rdsName string, sources []routeSource) *v3route.RouteConfiguration {
+	var domains []string
+	seen := map[string]bool{}
+	addDomain := func(domain string) {
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	for _, source := range sources {
+		for _, domain := range source.lst.Domains {
+			addDomain(domain)
+		}
+	}
+
+	var matched []*CompiledRoute
+	routeDomains := map[*CompiledRoute][]string{}
+	for _, config := range d.sortedConfigs() {
+		for _, route := range config.Routes {
+			for _, source := range sources {
+				lst := source.lst
+				if lst.Predicate == nil || !lst.Predicate(route) {
+					continue
+				}
+				rd := lst.Domains
+				if lst.RouteDomains != nil {
+					rd = lst.RouteDomains(route)
+				}
+				if narrow, ok := lst.RouteConfigDomains[source.rdsName]; ok {
+					if rd = narrow(route); len(rd) == 0 {
+						continue
+					}
+				}
+				for _, domain := range rd {
+					addDomain(domain)
+				}
+				if _, ok := routeDomains[route]; !ok {
+					matched = append(matched, route)
 				}
+				routeDomains[route] = append(routeDomains[route], rd...)
+			}
+		}
+	}
+
+	var vhosts []*v3route.VirtualHost
+	for _, domain := range domains {
+		var entries []routeEntry
+		for _, route := range matched {
+			pattern, ok := coveringPattern(routeDomains[route], domain)
+			if !ok {
+				continue
+			}
+			for _, r := range route.Routes {
+				entries = append(entries, routeEntry{owner: route, route: r, hostname: pattern})
+			}
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].precedes(entries[j]) })
+		routes := make([]*v3route.Route, 0, len(entries))
+		for _, e := range entries {
+			routes = append(routes, e.route)
+		}
+		vhosts = append(vhosts, &v3route.VirtualHost{
+			Name:    fmt.Sprintf("%s-%s", rdsName, domain),
+			Domains: []string{domain},
+			Routes:  routes,
+		})
+	}
+
+	return &v3route.RouteConfiguration{
+		Name:         rdsName,
+		VirtualHosts: vhosts,
+	}
+}
+
+// sortedConfigs returns the compiled configs ordered by resource key so that assembly is
+// deterministic.
+func (d *Dispatcher) sortedConfigs() []*CompiledConfig {
+	keys := make([]string, 0, len(d.configs))
+	for key := range d.configs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]*CompiledConfig, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, d.configs[key])
+	}
+	return result
+}
+
+// routeEntry is a single envoy route in a VirtualHost, along with the CompiledRoute it came from
+// and the most specific of that CompiledRoute's domains that covers the VirtualHost.
+type routeEntry struct {
+	owner    *CompiledRoute
+	route    *v3route.Route
+	hostname string
+}
+
+// precedes implements the Gateway API route precedence: an Exact path match, then the longest
+// prefix match (see pathRank for regular expressions), then a method match, then the most header matches, then the most query parameter
+// matches. Ties between different resources go to the one with the more specific hostname, then
+// to the oldest, then to the first by namespace/name. Routes that are still tied keep the order
+// of the rules they came from.
+func (a routeEntry) precedes(b routeEntry) bool {
+	am, bm := a.route.GetMatch(), b.route.GetMatch()
+	if ar, br := pathRank(am), pathRank(bm); ar != br {
+		return ar < br
+	}
+	if al, bl := pathLength(am), pathLength(bm); al != bl {
+		return al > bl
+	}
+	if ah, bh := hasMethodMatch(am), hasMethodMatch(bm); ah != bh {
+		return ah
+	}
+	if ah, bh := len(am.GetHeaders()), len(bm.GetHeaders()); ah != bh {
+		return ah > bh
+	}
+	if aq, bq := len(am.GetQueryParameters()), len(bm.GetQueryParameters()); aq != bq {
+		return aq > bq
+	}
+	if a.owner == b.owner {
+		return false
+	}
+	if ah, bh := hostnameRank(a.hostname), hostnameRank(b.hostname); ah != bh {
+		return ah > bh
+	}
+	if at, bt := a.owner.CreationTimestamp, b.owner.CreationTimestamp; !at.Equal(bt) {
+		return at.Before(bt)
+	}
+	if a.owner.Namespace != b.owner.Namespace {
+		return a.owner.Namespace < b.owner.Namespace
+	}
+	return a.owner.Name < b.owner.Name
+}
+
+// pathRank orders the kinds of path match: exact paths first, then regular expressions, then
+// prefixes. The Gateway API leaves the place of regular expressions up to the implementation; they
+// go before prefixes so that a catch-all prefix can't hide them.
+func pathRank(m *v3route.RouteMatch) int {
+	switch m.GetPathSpecifier().(type) {
+	case *v3route.RouteMatch_Path:
+		return 0
+	case *v3route.RouteMatch_Prefix, *v3route.RouteMatch_PathSeparatedPrefix:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// pathLength returns the number of characters in an exact or prefix path match.
+func pathLength(m *v3route.RouteMatch) int {
+	switch p := m.GetPathSpecifier().(type) {
+	case *v3route.RouteMatch_Path:
+		return len(p.Path)
+	case *v3route.RouteMatch_Prefix:
+		return len(p.Prefix)
+	case *v3route.RouteMatch_PathSeparatedPrefix:
+		return len(p.PathSeparatedPrefix)
+	default:
+		return 0
+	}
+}
+
+// hasMethodMatch returns true if the match includes the header match that Compile_HTTPRouteMatch
+// uses for the request method. Since methods are compared first, also counting that header match
+// as one of the header matches doesn't change the order.
+func hasMethodMatch(m *v3route.RouteMatch) bool {
+	for _, h := range m.GetHeaders() {
+		if h.Name == ":method" {
+			return true
+		}
+	}
+	return false
+}
+
+// hostnameRank measures how specific a hostname is: any exact hostname beats any wildcard, and
+// otherwise longer is more specific.
+func hostnameRank(hostname string) int {
+	if strings.HasPrefix(hostname, "*") {
+		return len(hostname)
+	}
+	return len(hostname) + 1<<16
+}
+
+// coveringPattern returns the most specific of the supplied patterns that is or matches the
+// domain, and false if there is none.
+func coveringPattern(patterns []string, domain string) (string, bool) {
+	var result string
+	found := false
+	for _, pattern := range patterns {
+		if hostnameMatches(pattern, domain) && (!found || hostnameRank(pattern) > hostnameRank(result)) {
+			result = pattern
+			found = true
+		}
+	}
+	return result, found
+}
+
+// hostnameMatches returns true if the hostname (which may itself be a wildcard) is covered by the
+// pattern. Patterns are either "*", a wildcard of the form "*.example.com", or an exact hostname.
+func hostnameMatches(pattern, hostname string) bool {
+	switch {
+	case pattern == "*" || pattern == hostname:
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(hostname, pattern[1:])
+	default:
+		return false
+	}
+}
+
+// getChainRdsName returns the RDS route configuration name configured for the filter chain and a
+// flag indicating whether the filter chain uses Rds.
+func getChainRdsName(fc *v3listener.FilterChain) (string, bool) {
+	for _, f := range fc.Filters {
+		if f.Name != ecp_wellknown.HTTPConnectionManager {
+			continue
+		}
+
+		hcm := ecp_v3_resource.GetHTTPConnectionManager(f)
+		if hcm != nil {
+			rds := hcm.GetRds()
+			if rds != nil {
+				return rds.RouteConfigName, true
 			}
 		}
 	}
@@ -347,9 +890,14 @@ func (d *Dispatcher) buildSnapshot(ctx context.Context) {
 
 	clusters := []ecp_cache_types.Resource{}
 	endpoints := []ecp_cache_types.Resource{}
-	for name, path := range clusterMap {
-		clusters = append(clusters, makeCluster(name, path))
-		key := path
+	for name, ref := range clusterMap {
+		cluster, err := makeCluster(name, ref.EndpointPath, ref.HTTP2)
+		if err != nil {
+			dlog.Errorf(ctx, "Dispatcher error making cluster %s: %v", name, err)
+			continue
+		}
+		clusters = append(clusters, cluster)
+		key := ref.EndpointPath
 		if key == "" {
 			key = name
 		}
@@ -364,13 +912,14 @@ func (d *Dispatcher) buildSnapshot(ctx context.Context) {
 		}
 	}
 
-	listeners, routes := d.buildRouteConfigurations()
+	listeners, routes, secrets := d.buildRouteConfigurations()
 
 	snapshotResources := map[ecp_v3_resource.Type][]ecp_cache_types.Resource{
 		ecp_v3_resource.EndpointType: endpoints,
 		ecp_v3_resource.ClusterType:  clusters,
 		ecp_v3_resource.RouteType:    routes,
 		ecp_v3_resource.ListenerType: listeners,
+		ecp_v3_resource.SecretType:   secrets,
 	}
 
 	snapshot, err := ecp_v3_cache.NewSnapshot(d.version, snapshotResources)
@@ -387,8 +936,8 @@ func (d *Dispatcher) buildSnapshot(ctx context.Context) {
 	}
 }
 
-func makeCluster(name, path string) *v3cluster.Cluster {
-	return &v3cluster.Cluster{
+func makeCluster(name, path string, http2 bool) (*v3cluster.Cluster, error) {
+	cluster := &v3cluster.Cluster{
 		Name:                 name,
 		ConnectTimeout:       &durationpb.Duration{Seconds: 10},
 		ClusterDiscoveryType: &v3cluster.Cluster_Type{Type: v3cluster.Cluster_EDS},
@@ -397,4 +946,22 @@ func makeCluster(name, path string) *v3cluster.Cluster {
 			ServiceName: path,
 		},
 	}
+	if http2 {
+		opts, err := anypb.New(&v3upstreamhttp.HttpProtocolOptions{
+			UpstreamProtocolOptions: &v3upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_{
+				ExplicitHttpConfig: &v3upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig{
+					ProtocolConfig: &v3upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_Http2ProtocolOptions{
+						Http2ProtocolOptions: &v3core.Http2ProtocolOptions{},
+					},
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		cluster.TypedExtensionProtocolOptions = map[string]*anypb.Any{
+			"envoy.extensions.upstreams.http.v3.HttpProtocolOptions": opts,
+		}
+	}
+	return cluster, nil
 }
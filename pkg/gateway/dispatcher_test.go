@@ -41,7 +41,7 @@ func TestDispatcherRegister(t *testing.T) {
 	err := disp.Register("Foo", wrapFooCompiler(compile_Foo))
 	require.NoError(t, err)
 	foo := makeFoo("default", "foo", "bar")
-	assert.NoError(t, disp.Upsert(foo))
+	assert.NoError(t, disp.Upsert(ctx, foo))
 	l := disp.GetListener(ctx, "bar")
 	require.NotNil(t, l)
 	assert.Equal(t, "bar", l.Name)
@@ -67,33 +67,36 @@ func TestIsRegistered(t *testing.T) {
 
 func TestDispatcherFaultIsolation1(t *testing.T) {
 	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
 	disp := gateway.NewDispatcher()
 	err := disp.Register("Foo", wrapFooCompiler(compile_Foo))
 	require.NoError(t, err)
 	foo := makeFoo("default", "foo", "bang")
 	foo.Spec.PanicArg = errors.New("bang bang!")
-	err = disp.Upsert(foo)
+	err = disp.Upsert(ctx, foo)
 	assertErrorContains(t, err, "error processing")
 }
 
 func TestDispatcherFaultIsolation2(t *testing.T) {
 	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
 	disp := gateway.NewDispatcher()
 	err := disp.Register("Foo", wrapFooCompiler(compile_Foo))
 	require.NoError(t, err)
 	foo := makeFoo("default", "foo", "bang")
 	foo.Spec.PanicArg = errors.New("bang bang!")
-	err = disp.Upsert(foo)
+	err = disp.Upsert(ctx, foo)
 	assertErrorContains(t, err, "error processing")
 }
 
 func TestDispatcherTransformError(t *testing.T) {
 	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
 	disp := gateway.NewDispatcher()
 	err := disp.Register("Foo", wrapFooCompiler(compile_FooWithErrors))
 	require.NoError(t, err)
 	foo := makeFoo("default", "foo", "bar")
-	err = disp.Upsert(foo)
+	err = disp.Upsert(ctx, foo)
 	require.NoError(t, err)
 
 	errors := disp.GetErrors()
@@ -144,9 +147,10 @@ func compile_FooWithErrors(f *Foo) (*gateway.CompiledConfig, error) {
 
 func TestDispatcherNoTransform(t *testing.T) {
 	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
 	disp := gateway.NewDispatcher()
 	foo := makeFoo("default", "foo", "bar")
-	err := disp.Upsert(foo)
+	err := disp.Upsert(ctx, foo)
 	assertErrorContains(t, err, "no transform for kind")
 }
 
@@ -157,11 +161,11 @@ func TestDispatcherDelete(t *testing.T) {
 	err := disp.Register("Foo", wrapFooCompiler(compile_Foo))
 	require.NoError(t, err)
 	foo := makeFoo("default", "foo", "bar")
-	assert.NoError(t, disp.Upsert(foo))
+	assert.NoError(t, disp.Upsert(ctx, foo))
 	l := disp.GetListener(ctx, "bar")
 	require.NotNil(t, l)
 	assert.Equal(t, "bar", l.Name)
-	disp.Delete(foo)
+	disp.Delete(ctx, foo)
 	l = disp.GetListener(ctx, "bar")
 	require.Nil(t, l)
 }
@@ -173,15 +177,104 @@ func TestDispatcherDeleteKey(t *testing.T) {
 	err := disp.Register("Foo", wrapFooCompiler(compile_Foo))
 	require.NoError(t, err)
 	foo := makeFoo("default", "foo", "bar")
-	assert.NoError(t, disp.Upsert(foo))
+	assert.NoError(t, disp.Upsert(ctx, foo))
 	l := disp.GetListener(ctx, "bar")
 	require.NotNil(t, l)
 	assert.Equal(t, "bar", l.Name)
-	disp.DeleteKey("Foo", "default", "foo")
+	disp.DeleteKey(ctx, "Foo", "default", "foo")
 	l = disp.GetListener(ctx, "bar")
 	require.Nil(t, l)
 }
 
+func TestDispatcherQueryDependencies(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	disp := gateway.NewDispatcher()
+	require.NoError(t, disp.RegisterDependency("Bar"))
+	calls := 0
+	err := disp.RegisterWithQuery("Foo", func(untyped kates.Object, q *gateway.Query) (*gateway.CompiledConfig, error) {
+		calls++
+		f := untyped.(*Foo)
+		name := f.Spec.Value + "-missing"
+		if q.Get("Bar", f.Namespace, f.Spec.Value) != nil {
+			name = f.Spec.Value + "-found"
+		}
+		return compile_Foo(makeFoo(f.Namespace, f.Name, name))
+	})
+	require.NoError(t, err)
+	assert.True(t, disp.IsRegistered("Bar"))
+	assert.False(t, disp.IsRelevant("Bar", "default", "bar"))
+
+	require.NoError(t, disp.Upsert(ctx, makeFoo("default", "foo", "bar")))
+	assert.NotNil(t, disp.GetListener(ctx, "bar-missing"))
+	assert.Equal(t, 1, calls)
+	assert.True(t, disp.IsRelevant("Bar", "default", "bar"))
+	assert.False(t, disp.IsRelevant("Bar", "default", "other"))
+
+	// Upserting the dependency transforms the dependent again.
+	bar := makeFoo("default", "bar", "")
+	bar.Kind = "Bar"
+	require.NoError(t, disp.Upsert(ctx, bar))
+	assert.NotNil(t, disp.GetListener(ctx, "bar-found"))
+	assert.Nil(t, disp.GetListener(ctx, "bar-missing"))
+	assert.Equal(t, 2, calls)
+
+	// Resources that nothing depends on don't cause any transforms.
+	other := makeFoo("default", "other", "")
+	other.Kind = "Bar"
+	require.NoError(t, disp.Upsert(ctx, other))
+	assert.Equal(t, 2, calls)
+
+	// Neither does upserting a resource that hasn't changed.
+	bar = makeFoo("default", "bar", "")
+	bar.Kind = "Bar"
+	bar.ResourceVersion = "1"
+	require.NoError(t, disp.Upsert(ctx, bar))
+	assert.Equal(t, 3, calls)
+	unchanged := *bar
+	require.NoError(t, disp.Upsert(ctx, &unchanged))
+	assert.Equal(t, 3, calls)
+
+	disp.Delete(ctx, bar)
+	assert.NotNil(t, disp.GetListener(ctx, "bar-missing"))
+	assert.Equal(t, 4, calls)
+
+	// Once the dependent is gone, so are its dependencies.
+	disp.DeleteKey(ctx, "Foo", "default", "foo")
+	require.NoError(t, disp.Upsert(ctx, bar))
+	assert.Equal(t, 4, calls)
+}
+
+func TestDispatcherQueryList(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	disp := gateway.NewDispatcher()
+	require.NoError(t, disp.RegisterDependency("Bar"))
+	err := disp.RegisterWithQuery("Foo", func(untyped kates.Object, q *gateway.Query) (*gateway.CompiledConfig, error) {
+		f := untyped.(*Foo)
+		name := fmt.Sprintf("%s-%d", f.Spec.Value, len(q.List("Bar", f.Spec.Value)))
+		return compile_Foo(makeFoo(f.Namespace, f.Name, name))
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, disp.Upsert(ctx, makeFoo("default", "foo", "default")))
+	require.NoError(t, disp.Upsert(ctx, makeFoo("default", "all", "")))
+	assert.NotNil(t, disp.GetListener(ctx, "default-0"))
+	assert.NotNil(t, disp.GetListener(ctx, "-0"))
+
+	for _, ns := range []string{"default", "default", "other"} {
+		bar := makeFoo(ns, fmt.Sprintf("bar-%d", len(ns)), "")
+		bar.Kind = "Bar"
+		require.NoError(t, disp.Upsert(ctx, bar))
+	}
+	assert.NotNil(t, disp.GetListener(ctx, "default-1"))
+	assert.NotNil(t, disp.GetListener(ctx, "-2"))
+
+	disp.DeleteKey(ctx, "Bar", "other", "bar-5")
+	assert.NotNil(t, disp.GetListener(ctx, "default-1"))
+	assert.NotNil(t, disp.GetListener(ctx, "-1"))
+}
+
 func compile_Foo(f *Foo) (*gateway.CompiledConfig, error) {
 	if f.Spec.Value == "bang" {
 		return nil, f.Spec.PanicArg
@@ -198,13 +291,14 @@ func compile_Foo(f *Foo) (*gateway.CompiledConfig, error) {
 
 func TestDispatcherUpsertYamlErr(t *testing.T) {
 	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
 	disp := gateway.NewDispatcher()
-	err := disp.UpsertYaml("{")
+	err := disp.UpsertYaml(ctx, "{")
 	assertErrorContains(t, err, "error converting")
-	err = disp.UpsertYaml(`
+	err = disp.UpsertYaml(ctx, `
 ---
 kind: Gatewayyyy
-apiVersion: networking.x-k8s.io/v1alpha1
+apiVersion: gateway.networking.k8s.io/v1
 metadata:
   name: my-gateway
 spec:
@@ -222,7 +316,7 @@ func TestDispatcherAssemblyWithRouteConfg(t *testing.T) {
 	err := disp.Register("Foo", wrapFooCompiler(compile_FooWithRouteConfigName))
 	require.NoError(t, err)
 	foo := makeFoo("default", "foo", "bar")
-	assert.NoError(t, disp.Upsert(foo))
+	assert.NoError(t, disp.Upsert(ctx, foo))
 	l := disp.GetListener(ctx, "bar")
 	require.NotNil(t, l)
 	assert.Equal(t, "bar", l.Name)
@@ -292,7 +386,7 @@ func TestDispatcherAssemblyWithEmptyRouteConfigName(t *testing.T) {
 	require.NoError(t, err)
 
 	foo := makeFoo("default", "foo", "bar")
-	err = disp.Upsert(foo)
+	err = disp.Upsert(ctx, foo)
 	assert.NoError(t, err)
 
 	// due to inconsistent SanptShot the listener returned should be nil
@@ -355,7 +449,7 @@ func TestDispatcherAssemblyWithoutRds(t *testing.T) {
 	err := disp.Register("Foo", wrapFooCompiler(compile_FooWithoutRds))
 	require.NoError(t, err)
 	foo := makeFoo("default", "foo", "bar")
-	assert.NoError(t, disp.Upsert(foo))
+	assert.NoError(t, disp.Upsert(ctx, foo))
 	l := disp.GetListener(ctx, "bar")
 	require.NotNil(t, l)
 	assert.Equal(t, "bar", l.Name)
@@ -408,7 +502,7 @@ func TestDispatcherAssemblyEndpointDefaulting(t *testing.T) {
 	err := disp.Register("Foo", wrapFooCompiler(compile_FooWithClusterRefs))
 	require.NoError(t, err)
 	foo := makeFoo("default", "foo", "bar")
-	err = disp.Upsert(foo)
+	err = disp.Upsert(ctx, foo)
 	require.NoError(t, err)
 
 	_, snapshot := disp.GetSnapshot(ctx)
@@ -451,7 +545,7 @@ func TestDispatcherAssemblyEndpointWatches(t *testing.T) {
 	err := disp.Register("Foo", wrapFooCompiler(compile_FooEndpointWatches))
 	require.NoError(t, err)
 	foo := makeFoo("default", "foo", "bar")
-	err = disp.Upsert(foo)
+	err = disp.Upsert(ctx, foo)
 	require.NoError(t, err)
 	disp.GetSnapshot(ctx)
 	assert.True(t, disp.IsWatched("foo-ns", "foo"))
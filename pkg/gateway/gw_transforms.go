@@ -3,18 +3,26 @@ package gateway
 import (
 	// standard library
 	"fmt"
+	"regexp"
+	"sort"
+	"strings"
 
 	// third-party libraries
 	"github.com/pkg/errors"
 	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
-	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
+	gw "sigs.k8s.io/gateway-api/apis/v1"
+	gwv1a2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
+	gwv1b1 "sigs.k8s.io/gateway-api/apis/v1beta1"
 
 	// envoy api v3
 	v3core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	v3listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	v3route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	v3tlsinspector "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/listener/tls_inspector/v3"
 	v3httpman "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	v3tcpproxy "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	v3tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 	v3matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
 
 	// envoy control plane
@@ -24,12 +32,36 @@ import (
 	"github.com/emissary-ingress/emissary/v3/pkg/kates"
 )
 
-func Compile_Gateway(gateway *gw.Gateway) (*CompiledConfig, error) {
+// ControllerName is the GatewayClass controllerName that Emissary implements. Gateways whose
+// class names a different controller are left alone.
+const ControllerName = gw.GatewayController("getambassador.io/gateway-controller")
+
+// Compile_GatewayClass doesn't produce any envoy configuration, GatewayClasses exist so that the
+// watcher can decide which Gateways belong to us (see ControllerName).
+func Compile_GatewayClass(gwc *gw.GatewayClass) (*CompiledConfig, error) {
+	return &CompiledConfig{
+		CompiledItem: NewCompiledItem(SourceFromResource(gwc)),
+	}, nil
+}
+
+func Compile_Gateway(gateway *gw.Gateway, q *Query) (*CompiledConfig, error) {
 	src := SourceFromResource(gateway)
+
+	// Gateway listeners that share a port are served by a single envoy listener.
+	byPort := map[gw.PortNumber][]gw.Listener{}
+	var ports []gw.PortNumber
+	for _, l := range gateway.Spec.Listeners {
+		if _, ok := byPort[l.Port]; !ok {
+			ports = append(ports, l.Port)
+		}
+		byPort[l.Port] = append(byPort[l.Port], l)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+
 	var listeners []*CompiledListener
-	for idx, l := range gateway.Spec.Listeners {
-		name := fmt.Sprintf("%s-%d", getName(gateway), idx)
-		listener, err := Compile_Listener(src, l, name)
+	for _, port := range ports {
+		name := fmt.Sprintf("%s-%d", getName(gateway), port)
+		listener, err := Compile_Listener(src, gateway, byPort[port], name, q)
 		if err != nil {
 			return nil, err
 		}
@@ -38,66 +70,520 @@ func Compile_Gateway(gateway *gw.Gateway) (*CompiledConfig, error) {
 	return &CompiledConfig{
 		CompiledItem: NewCompiledItem(src),
 		Listeners:    listeners,
+		Secrets:      compileCertificateRefs(gateway, q),
+	}, nil
+}
+
+// compileCertificateRefs compiles the Secrets named by the certificateRefs of all the Gateway's
+// listeners. Secrets that don't exist are skipped; the dispatcher drops the filter chains that need
+// them and the status reports why.
+func compileCertificateRefs(gateway *gw.Gateway, q *Query) []*CompiledSecret {
+	var result []*CompiledSecret
+	seen := map[string]bool{}
+	for _, lst := range gateway.Spec.Listeners {
+		if lst.TLS == nil {
+			continue
+		}
+		for _, ref := range lst.TLS.CertificateRefs {
+			if _, msg := validateCertificateRef(gateway, ref, q); msg != "" {
+				continue
+			}
+			namespace := gateway.Namespace
+			if ref.Namespace != nil {
+				namespace = string(*ref.Namespace)
+			}
+			name := SecretName(namespace, string(ref.Name))
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if secret, ok := q.Get("Secret", namespace, string(ref.Name)).(*kates.Secret); ok {
+				result = append(result, Compile_Secret(q.Context(), secret))
+			}
+		}
+	}
+	return result
+}
+
+// Compile_Listener produces a single envoy listener for all the Gateway listeners that share a
+// port. HTTPS listeners get one filter chain and RouteConfiguration each, selected by SNI and
+// terminating TLS with the certificate from the listener's certificateRefs. The certificates themselves are compiled by
+// Compile_Gateway and supplied by the dispatcher via SDS.
+func Compile_Listener(parent Source, gateway *gw.Gateway, lsts []gw.Listener, name string, q *Query) (*CompiledListener, error) {
+	src := Sourcef("port %d in %s", lsts[0].Port, parent)
+	for _, lst := range lsts {
+		if _, msg := validateListener(lst); msg != "" {
+			return &CompiledListener{
+				CompiledItem: NewCompiledItemError(Sourcef("listener %s in %s", lst.Name, parent), msg),
+			}, nil
+		}
+	}
+	if _, msg := validatePort(lsts); msg != "" {
+		return &CompiledListener{
+			CompiledItem: NewCompiledItemError(src, msg),
+		}, nil
+	}
+
+	listener := &v3listener.Listener{
+		Name: name,
+		Address: &v3core.Address{Address: &v3core.Address_SocketAddress{SocketAddress: &v3core.SocketAddress{
+			Address:       "0.0.0.0",
+			PortSpecifier: &v3core.SocketAddress_PortValue{PortValue: uint32(lsts[0].Port)},
+		}}},
+	}
+
+	if lsts[0].Protocol == gw.HTTPSProtocolType || lsts[0].Protocol == gw.TLSProtocolType {
+		inspectorAny, err := anypb.New(&v3tlsinspector.TlsInspector{})
+		if err != nil {
+			return nil, err
+		}
+		listener.ListenerFilters = []*v3listener.ListenerFilter{
+			{
+				Name:       ecp_wellknown.TlsInspector,
+				ConfigType: &v3listener.ListenerFilter_TypedConfig{TypedConfig: inspectorAny},
+			},
+		}
+	}
+
+	routeDomains := func(route *CompiledRoute) []string {
+		var result []string
+		for _, lst := range lsts {
+			if !listenerAccepts(gateway, lst, route) {
+				continue
+			}
+			result = append(result, intersectHostnames(lst.Hostname, route.Hostnames)...)
+		}
+		return result
+	}
+	predicate := func(route *CompiledRoute) bool {
+		return len(routeDomains(route)) > 0
+	}
+
+	if lsts[0].Protocol == gw.TCPProtocolType || lsts[0].Protocol == gw.TLSProtocolType {
+		// These listeners proxy whole connections, so their filter chains come from the routes.
+		return &CompiledListener{
+			CompiledItem: NewCompiledItem(src),
+			Listener:     listener,
+			Predicate:    predicate,
+			RouteFilterChains: func(route *CompiledRoute) []*v3listener.FilterChain {
+				return routeFilterChains(gateway, lsts, route)
+			},
+		}, nil
+	}
+
+	if lsts[0].Protocol != gw.HTTPSProtocolType {
+		filters, err := hcmFilters(name, name)
+		if err != nil {
+			return nil, err
+		}
+		listener.FilterChains = []*v3listener.FilterChain{{Filters: filters}}
+		return &CompiledListener{
+			CompiledItem: NewCompiledItem(src),
+			Listener:     listener,
+			Predicate:    predicate,
+			RouteDomains: routeDomains,
+		}, nil
+	}
+
+	// Each HTTPS listener gets its own filter chain and RouteConfiguration, so that a route that
+	// attaches to one of them can't be reached through the SNI of another.
+	chainSecrets := map[string][]string{}
+	chainDomains := map[string]func(route *CompiledRoute) []string{}
+	for _, lst := range lsts {
+		lst := lst
+		chainName := fmt.Sprintf("%s-%s", name, lst.Name)
+		filters, err := hcmFilters(name, chainName)
+		if err != nil {
+			return nil, err
+		}
+		chain, secrets, err := compileTLSFilterChain(gateway, lst, chainName, filters, q)
+		if err != nil {
+			return nil, err
+		}
+		if chain == nil {
+			// The certificateRefs are invalid, the status will report why.
+			continue
+		}
+		listener.FilterChains = append(listener.FilterChains, chain)
+		chainSecrets[chain.Name] = secrets
+		chainDomains[chainName] = func(route *CompiledRoute) []string {
+			if !listenerAccepts(gateway, lst, route) {
+				return nil
+			}
+			return intersectHostnames(lst.Hostname, route.Hostnames)
+		}
+	}
+
+	return &CompiledListener{
+		CompiledItem:       NewCompiledItem(src),
+		Listener:           listener,
+		Predicate:          predicate,
+		RouteDomains:       routeDomains,
+		RouteConfigDomains: chainDomains,
+		FilterChainSecrets: chainSecrets,
 	}, nil
 }
 
-func Compile_Listener(parent Source, lst gw.Listener, name string) (*CompiledListener, error) {
-	hcm := &v3httpman.HttpConnectionManager{
-		StatPrefix: name,
+// hcmFilters returns the filters for a filter chain that routes requests using the named
+// RouteConfiguration.
+func hcmFilters(statPrefix, rdsName string) ([]*v3listener.Filter, error) {
+	hcmAny, err := anypb.New(&v3httpman.HttpConnectionManager{
+		StatPrefix: statPrefix,
 		HttpFilters: []*v3httpman.HttpFilter{
 			{Name: ecp_wellknown.CORS},
 			{Name: ecp_wellknown.Router},
 		},
 		RouteSpecifier: &v3httpman.HttpConnectionManager_Rds{
 			Rds: &v3httpman.Rds{
-				ConfigSource: &v3core.ConfigSource{
-					ConfigSourceSpecifier: &v3core.ConfigSource_Ads{
-						Ads: &v3core.AggregatedConfigSource{},
-					},
-				},
-				RouteConfigName: name,
+				ConfigSource:    adsConfigSource(),
+				RouteConfigName: rdsName,
 			},
 		},
-	}
-	hcmAny, err := anypb.New(hcm)
+	})
 	if err != nil {
 		return nil, err
 	}
+	return []*v3listener.Filter{
+		{
+			Name:       ecp_wellknown.HTTPConnectionManager,
+			ConfigType: &v3listener.Filter_TypedConfig{TypedConfig: hcmAny},
+		},
+	}, nil
+}
 
-	return &CompiledListener{
-		CompiledItem: NewCompiledItem(Sourcef("listener %s", lst.Hostname)),
-		Listener: &v3listener.Listener{
-			Name: name,
-			Address: &v3core.Address{Address: &v3core.Address_SocketAddress{SocketAddress: &v3core.SocketAddress{
-				Address:       "0.0.0.0",
-				PortSpecifier: &v3core.SocketAddress_PortValue{PortValue: uint32(lst.Port)},
-			}}},
-			FilterChains: []*v3listener.FilterChain{
-				{
-					Filters: []*v3listener.Filter{
-						{
-							Name:       ecp_wellknown.HTTPConnectionManager,
-							ConfigType: &v3listener.Filter_TypedConfig{TypedConfig: hcmAny},
-						},
-					},
-				},
-			},
+// routeFilterChains produces the filter chains that proxy connections for a TCPRoute or TLSRoute
+// attached to TCP or TLS Gateway listeners. TLSRoutes get a filter chain per listener selected by
+// SNI, TCPRoutes get a filter chain that matches everything.
+func routeFilterChains(gateway *gw.Gateway, lsts []gw.Listener, route *CompiledRoute) []*v3listener.FilterChain {
+	if route.TCPProxy == nil {
+		// The route has no usable backends, it will have reported why.
+		return nil
+	}
+	tcpAny, err := anypb.New(route.TCPProxy)
+	if err != nil {
+		return nil
+	}
+	filters := []*v3listener.Filter{
+		{
+			Name:       ecp_wellknown.TCPProxy,
+			ConfigType: &v3listener.Filter_TypedConfig{TypedConfig: tcpAny},
 		},
-		Predicate: func(route *CompiledRoute) bool {
-			return true
+	}
+
+	var result []*v3listener.FilterChain
+	for _, lst := range lsts {
+		if !listenerAccepts(gateway, lst, route) {
+			continue
+		}
+		chain := &v3listener.FilterChain{Filters: filters}
+		if lst.Protocol == gw.TLSProtocolType {
+			domains := intersectHostnames(lst.Hostname, route.Hostnames)
+			if len(domains) == 0 {
+				continue
+			}
+			if !(len(domains) == 1 && domains[0] == "*") {
+				chain.FilterChainMatch = &v3listener.FilterChainMatch{ServerNames: domains}
+			}
+		}
+		result = append(result, chain)
+	}
+	return result
+}
+
+// compileTLSFilterChain produces the named filter chain that terminates TLS for a single HTTPS
+// Gateway listener, along with the names of the secrets that the chain needs. If any of the
+// listener's certificateRefs are invalid, no filter chain is produced.
+func compileTLSFilterChain(gateway *gw.Gateway, lst gw.Listener, name string, filters []*v3listener.Filter, q *Query) (*v3listener.FilterChain, []string, error) {
+	var secrets []string
+	var sdsConfigs []*v3tls.SdsSecretConfig
+	for _, ref := range lst.TLS.CertificateRefs {
+		if _, msg := validateCertificateRef(gateway, ref, q); msg != "" {
+			return nil, nil, nil
+		}
+		namespace := gateway.Namespace
+		if ref.Namespace != nil {
+			namespace = string(*ref.Namespace)
+		}
+		secret := SecretName(namespace, string(ref.Name))
+		secrets = append(secrets, secret)
+		sdsConfigs = append(sdsConfigs, &v3tls.SdsSecretConfig{
+			Name:      secret,
+			SdsConfig: adsConfigSource(),
+		})
+	}
+
+	tlsAny, err := anypb.New(&v3tls.DownstreamTlsContext{
+		CommonTlsContext: &v3tls.CommonTlsContext{
+			TlsCertificateSdsSecretConfigs: sdsConfigs,
+			AlpnProtocols:                  []string{"h2", "http/1.1"},
 		},
-		Domains: []string{"*"},
-	}, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chain := &v3listener.FilterChain{
+		Name:    name,
+		Filters: filters,
+		TransportSocket: &v3core.TransportSocket{
+			Name:       ecp_wellknown.TransportSocketTLS,
+			ConfigType: &v3core.TransportSocket_TypedConfig{TypedConfig: tlsAny},
+		},
+	}
+	if lst.Hostname != nil && *lst.Hostname != "" {
+		chain.FilterChainMatch = &v3listener.FilterChainMatch{
+			ServerNames: []string{string(*lst.Hostname)},
+		}
+	}
+	return chain, secrets, nil
+}
+
+// adsConfigSource returns a ConfigSource that fetches resources over ADS.
+func adsConfigSource() *v3core.ConfigSource {
+	return &v3core.ConfigSource{
+		ConfigSourceSpecifier: &v3core.ConfigSource_Ads{
+			Ads: &v3core.AggregatedConfigSource{},
+		},
+	}
+}
+
+// validateListener checks for Gateway listener configuration that we cannot implement, and returns
+// the reason and message explaining why. An empty message means the listener is valid.
+func validateListener(lst gw.Listener) (gw.ListenerConditionReason, string) {
+	switch lst.Protocol {
+	case gw.HTTPProtocolType:
+		if lst.TLS != nil {
+			return gw.ListenerReasonInvalid, "tls is not allowed on HTTP listeners"
+		}
+	case gw.HTTPSProtocolType:
+		if lst.TLS == nil {
+			return gw.ListenerReasonInvalid, "HTTPS listeners must specify tls"
+		}
+		if lst.TLS.Mode != nil && *lst.TLS.Mode != gw.TLSModeTerminate {
+			return gw.ListenerReasonInvalid, fmt.Sprintf("unsupported tls mode for HTTPS: %q", *lst.TLS.Mode)
+		}
+		if len(lst.TLS.CertificateRefs) == 0 {
+			return gw.ListenerReasonInvalid, "HTTPS listeners must specify at least one certificateRef"
+		}
+	case gw.TLSProtocolType:
+		if lst.TLS == nil || lst.TLS.Mode == nil || *lst.TLS.Mode != gw.TLSModePassthrough {
+			return gw.ListenerReasonInvalid, "TLS listeners only support tls mode Passthrough"
+		}
+	case gw.TCPProtocolType:
+		if lst.TLS != nil {
+			return gw.ListenerReasonInvalid, "tls is not allowed on TCP listeners"
+		}
+	default:
+		return gw.ListenerReasonUnsupportedProtocol, fmt.Sprintf("unsupported protocol: %q", lst.Protocol)
+	}
+	if lst.AllowedRoutes != nil && lst.AllowedRoutes.Namespaces != nil &&
+		lst.AllowedRoutes.Namespaces.From != nil && *lst.AllowedRoutes.Namespaces.From == gw.NamespacesFromSelector {
+		return gw.ListenerReasonInvalid, "allowedRoutes namespace selectors are not supported"
+	}
+	return "", ""
+}
+
+// validatePort checks that the Gateway listeners sharing a port can be served by a single envoy
+// listener, and returns the reason and message explaining why not. An empty message means there is
+// no conflict.
+func validatePort(lsts []gw.Listener) (gw.ListenerConditionReason, string) {
+	hostnames := map[gw.Hostname]bool{}
+	for _, lst := range lsts {
+		if lst.Protocol != lsts[0].Protocol {
+			return gw.ListenerReasonProtocolConflict, fmt.Sprintf("port %d has listeners with conflicting protocols", lst.Port)
+		}
+		var hostname gw.Hostname
+		if lst.Hostname != nil {
+			hostname = *lst.Hostname
+		}
+		if hostnames[hostname] {
+			return gw.ListenerReasonHostnameConflict, fmt.Sprintf("port %d has more than one listener for hostname %q", lst.Port, hostname)
+		}
+		hostnames[hostname] = true
+	}
+	return "", ""
+}
+
+// validateCertificateRef checks that a listener's certificateRef is something we can use, and
+// returns the reason and message explaining why not. An empty message means the reference is
+// valid. This doesn't check that the Secret exists.
+func validateCertificateRef(gateway *gw.Gateway, ref gw.SecretObjectReference, q *Query) (gw.ListenerConditionReason, string) {
+	if (ref.Group != nil && *ref.Group != "") || (ref.Kind != nil && *ref.Kind != "Secret") {
+		return gw.ListenerReasonInvalidCertificateRef, fmt.Sprintf("unsupported certificateRef kind: %s", secretKind(ref))
+	}
+	if ref.Namespace != nil && !referenceGranted(q, "Gateway", gateway.Namespace, "", "Secret", string(*ref.Namespace), string(ref.Name)) {
+		return gw.ListenerReasonRefNotPermitted, fmt.Sprintf("certificateRef to Secret %s.%s is not permitted by any ReferenceGrant", ref.Name, *ref.Namespace)
+	}
+	return "", ""
+}
+
+// referenceGranted returns true if a Gateway API resource of the given kind in fromNamespace may
+// refer to the resource of the given group and kind named toName in toNamespace. References within
+// a namespace are always allowed, references to another namespace must be allowed by a
+// ReferenceGrant in that namespace.
+func referenceGranted(q *Query, fromKind, fromNamespace, toGroup, toKind, toNamespace, toName string) bool {
+	if fromNamespace == toNamespace {
+		return true
+	}
+	for _, obj := range q.List("ReferenceGrant", toNamespace) {
+		grant, ok := obj.(*gwv1b1.ReferenceGrant)
+		if !ok {
+			continue
+		}
+		fromOK := false
+		for _, from := range grant.Spec.From {
+			if string(from.Group) == gw.GroupName && string(from.Kind) == fromKind && string(from.Namespace) == fromNamespace {
+				fromOK = true
+				break
+			}
+		}
+		if !fromOK {
+			continue
+		}
+		for _, to := range grant.Spec.To {
+			if string(to.Group) == toGroup && string(to.Kind) == toKind && (to.Name == nil || *to.Name == "" || string(*to.Name) == toName) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func secretKind(ref gw.SecretObjectReference) string {
+	kind := "Secret"
+	if ref.Kind != nil {
+		kind = string(*ref.Kind)
+	}
+	if ref.Group != nil && *ref.Group != "" {
+		return fmt.Sprintf("%s.%s", kind, *ref.Group)
+	}
+	return kind
+}
+
+// listenerAccepts returns true if the route asks to be attached to the given Gateway listener and
+// the listener allows it.
+func listenerAccepts(gateway *gw.Gateway, lst gw.Listener, route *CompiledRoute) bool {
+	for _, ref := range route.ParentRefs {
+		if parentRefMatches(ref, route.Namespace, gateway, lst) {
+			return listenerAllows(gateway, lst, route)
+		}
+	}
+	return false
+}
+
+// listenerAllows returns true if the listener's allowedRoutes permit the route to attach.
+func listenerAllows(gateway *gw.Gateway, lst gw.Listener, route *CompiledRoute) bool {
+	from := gw.NamespacesFromSame
+	if lst.AllowedRoutes != nil && lst.AllowedRoutes.Namespaces != nil && lst.AllowedRoutes.Namespaces.From != nil {
+		from = *lst.AllowedRoutes.Namespaces.From
+	}
+	switch from {
+	case gw.NamespacesFromAll:
+	case gw.NamespacesFromSame:
+		if route.Namespace != gateway.Namespace {
+			return false
+		}
+	default:
+		return false
+	}
+
+	for _, kind := range supportedKinds(lst) {
+		if string(kind.Kind) == route.Kind {
+			return true
+		}
+	}
+	return false
+}
+
+// supportedKinds returns the kinds of route that may attach to the listener.
+func supportedKinds(lst gw.Listener) []gw.RouteGroupKind {
+	var protocolKinds []gw.Kind
+	switch lst.Protocol {
+	case gw.HTTPProtocolType, gw.HTTPSProtocolType:
+		protocolKinds = []gw.Kind{"HTTPRoute", "GRPCRoute"}
+	case gw.TLSProtocolType:
+		protocolKinds = []gw.Kind{"TLSRoute"}
+	case gw.TCPProtocolType:
+		protocolKinds = []gw.Kind{"TCPRoute"}
+	}
+
+	group := gw.Group(gw.GroupName)
+	var result []gw.RouteGroupKind
+	if lst.AllowedRoutes == nil || len(lst.AllowedRoutes.Kinds) == 0 {
+		for _, kind := range protocolKinds {
+			result = append(result, gw.RouteGroupKind{Group: &group, Kind: kind})
+		}
+		return result
+	}
+	for _, kind := range lst.AllowedRoutes.Kinds {
+		if kind.Group != nil && *kind.Group != gw.GroupName {
+			continue
+		}
+		for _, supported := range protocolKinds {
+			if kind.Kind == supported {
+				result = append(result, gw.RouteGroupKind{Group: &group, Kind: kind.Kind})
+			}
+		}
+	}
+	return result
+}
+
+// parentRefMatches returns true if the parentRef of a route in the given namespace refers to the
+// supplied Gateway listener.
+func parentRefMatches(ref gw.ParentReference, routeNamespace string, gateway *gw.Gateway, lst gw.Listener) bool {
+	if ref.Group != nil && *ref.Group != gw.GroupName {
+		return false
+	}
+	if ref.Kind != nil && *ref.Kind != "Gateway" {
+		return false
+	}
+	namespace := routeNamespace
+	if ref.Namespace != nil {
+		namespace = string(*ref.Namespace)
+	}
+	if namespace != gateway.Namespace || string(ref.Name) != gateway.Name {
+		return false
+	}
+	if ref.SectionName != nil && *ref.SectionName != lst.Name {
+		return false
+	}
+	if ref.Port != nil && *ref.Port != lst.Port {
+		return false
+	}
+	return true
+}
 
+// intersectHostnames computes the domains that a route with the supplied hostnames is served on
+// when attached to a listener with the supplied hostname.
+func intersectHostnames(listenerHostname *gw.Hostname, routeHostnames []gw.Hostname) []string {
+	lh := "*"
+	if listenerHostname != nil && *listenerHostname != "" {
+		lh = string(*listenerHostname)
+	}
+	if len(routeHostnames) == 0 {
+		return []string{lh}
+	}
+	var result []string
+	for _, h := range routeHostnames {
+		rh := string(h)
+		switch {
+		case hostnameMatches(lh, rh):
+			result = append(result, rh)
+		case hostnameMatches(rh, lh):
+			result = append(result, lh)
+		}
+	}
+	return result
 }
 
-func Compile_HTTPRoute(httpRoute *gw.HTTPRoute) (*CompiledConfig, error) {
+func Compile_HTTPRoute(httpRoute *gw.HTTPRoute, q *Query) (*CompiledConfig, error) {
 	src := SourceFromResource(httpRoute)
 	clusterRefs := []*ClusterRef{}
 	var routes []*v3route.Route
+	var filterErrors []CompiledItem
 	for idx, rule := range httpRoute.Spec.Rules {
 		s := Sourcef("rule %d in %s", idx, src)
-		_routes, err := Compile_HTTPRouteRule(s, rule, httpRoute.Namespace, &clusterRefs)
+		_routes, err := Compile_HTTPRouteRule(s, q, rule, httpRoute.Namespace, &clusterRefs, &filterErrors)
 		if err != nil {
 			return nil, err
 		}
@@ -107,61 +593,650 @@ func Compile_HTTPRoute(httpRoute *gw.HTTPRoute) (*CompiledConfig, error) {
 		CompiledItem: NewCompiledItem(src),
 		Routes: []*CompiledRoute{
 			{
-				CompiledItem: CompiledItem{Source: src, Namespace: httpRoute.Namespace},
-				HTTPRoute:    httpRoute,
-				Routes:       routes,
-				ClusterRefs:  clusterRefs,
+				CompiledItem:      CompiledItem{Source: src, Namespace: httpRoute.Namespace},
+				HTTPRoute:         httpRoute,
+				Name:              httpRoute.Name,
+				CreationTimestamp: httpRoute.CreationTimestamp.Time,
+				Kind:              "HTTPRoute",
+				ParentRefs:        httpRoute.Spec.ParentRefs,
+				Hostnames:         httpRoute.Spec.Hostnames,
+				Routes:            routes,
+				ClusterRefs:       clusterRefs,
+				FilterErrors:      filterErrors,
 			},
 		},
 	}, nil
 }
 
-func Compile_HTTPRouteRule(src Source, rule gw.HTTPRouteRule, namespace string, clusterRefs *[]*ClusterRef) ([]*v3route.Route, error) {
-	var clusters []*v3route.WeightedCluster_ClusterWeight
-	for idx, fwd := range rule.ForwardTo {
-		s := Sourcef("forwardTo %d in %s", idx, src)
-		clusters = append(clusters, Compile_HTTPRouteForwardTo(s, fwd, namespace, clusterRefs))
+// Compile_HTTPRouteRule produces a route for each of the rule's matches. Any of the rule's filters
+// that we cannot implement are recorded in filterErrors, and requests that would have been
+// processed by them receive a 500, since skipping a filter could do more harm than failing.
+func Compile_HTTPRouteRule(src Source, q *Query, rule gw.HTTPRouteRule, namespace string, clusterRefs *[]*ClusterRef, filterErrors *[]CompiledItem) ([]*v3route.Route, error) {
+	valid := true
+	for idx, filter := range rule.Filters {
+		if _, msg := validateHTTPRouteFilter(filter, rule.Matches); msg != "" {
+			*filterErrors = append(*filterErrors, NewCompiledItemError(Sourcef("filter %d in %s", idx, src), msg))
+			valid = false
+		}
 	}
 
-	wc := &v3route.WeightedCluster{Clusters: clusters}
+	var clusters []*v3route.WeightedCluster_ClusterWeight
+	for idx, backend := range rule.BackendRefs {
+		s := Sourcef("backendRef %d in %s", idx, src)
+		if len(backend.Filters) > 0 {
+			*filterErrors = append(*filterErrors, NewCompiledItemError(s, "backendRef filters are not supported"))
+			valid = false
+		}
+		cw := Compile_HTTPBackendRef(s, q, backend, namespace, clusterRefs)
+		if cw != nil {
+			clusters = append(clusters, cw)
+		}
+	}
+	if !valid {
+		clusters = nil
+	}
 
 	matches, err := Compile_HTTPRouteMatches(rule.Matches)
 	if err != nil {
 		return nil, err
 	}
+
 	var result []*v3route.Route
-	for _, match := range matches {
-		result = append(result, &v3route.Route{
-			Match: match,
-			Action: &v3route.Route_Route{Route: &v3route.RouteAction{
-				ClusterSpecifier: &v3route.RouteAction_WeightedClusters{WeightedClusters: wc},
-			}},
+	for idx, match := range matches {
+		route := weightedRoute(match, clusters)
+		if valid {
+			prefix := matchPrefix(gw.HTTPRouteMatch{})
+			if len(rule.Matches) > 0 {
+				prefix = matchPrefix(rule.Matches[idx])
+			}
+			for fidx, filter := range rule.Filters {
+				s := Sourcef("filter %d in %s", fidx, src)
+				Compile_HTTPRouteFilter(s, q, filter, namespace, prefix, route, clusterRefs)
+			}
+		}
+		result = append(result, route)
+	}
+
+	return result, nil
+}
+
+// validateHTTPRouteFilter checks for HTTPRoute filters that we cannot implement, and returns the
+// reason and message explaining why. The matches are those of the rule that the filter belongs
+// to. An empty message means the filter is valid.
+func validateHTTPRouteFilter(filter gw.HTTPRouteFilter, matches []gw.HTTPRouteMatch) (gw.RouteConditionReason, string) {
+	var path *gw.HTTPPathModifier
+	switch filter.Type {
+	case gw.HTTPRouteFilterRequestHeaderModifier:
+		if filter.RequestHeaderModifier == nil {
+			return gw.RouteReasonUnsupportedValue, "RequestHeaderModifier filters must specify requestHeaderModifier"
+		}
+	case gw.HTTPRouteFilterResponseHeaderModifier:
+		if filter.ResponseHeaderModifier == nil {
+			return gw.RouteReasonUnsupportedValue, "ResponseHeaderModifier filters must specify responseHeaderModifier"
+		}
+	case gw.HTTPRouteFilterRequestRedirect:
+		if filter.RequestRedirect == nil {
+			return gw.RouteReasonUnsupportedValue, "RequestRedirect filters must specify requestRedirect"
+		}
+		if code := filter.RequestRedirect.StatusCode; code != nil {
+			if _, ok := redirectResponseCodes[*code]; !ok {
+				return gw.RouteReasonUnsupportedValue, fmt.Sprintf("unsupported redirect status code: %d", *code)
+			}
+		}
+		path = filter.RequestRedirect.Path
+	case gw.HTTPRouteFilterURLRewrite:
+		if filter.URLRewrite == nil {
+			return gw.RouteReasonUnsupportedValue, "URLRewrite filters must specify urlRewrite"
+		}
+		path = filter.URLRewrite.Path
+	case gw.HTTPRouteFilterRequestMirror:
+		if filter.RequestMirror == nil {
+			return gw.RouteReasonUnsupportedValue, "RequestMirror filters must specify requestMirror"
+		}
+		if reason, msg := validateBackendRef(filter.RequestMirror.BackendRef); msg != "" {
+			return reason, msg
+		}
+	default:
+		return gw.RouteReasonUnsupportedValue, fmt.Sprintf("unsupported filter type: %q", filter.Type)
+	}
+
+	if path != nil {
+		switch path.Type {
+		case gw.FullPathHTTPPathModifier:
+			if path.ReplaceFullPath == nil {
+				return gw.RouteReasonUnsupportedValue, "ReplaceFullPath path modifiers must specify replaceFullPath"
+			}
+		case gw.PrefixMatchHTTPPathModifier:
+			if path.ReplacePrefixMatch == nil {
+				return gw.RouteReasonUnsupportedValue, "ReplacePrefixMatch path modifiers must specify replacePrefixMatch"
+			}
+			for _, match := range matches {
+				if matchPrefix(match) == nil {
+					return gw.RouteReasonUnsupportedValue, "ReplacePrefixMatch may only be used with PathPrefix matches"
+				}
+			}
+		default:
+			return gw.RouteReasonUnsupportedValue, fmt.Sprintf("unsupported path modifier type: %q", path.Type)
+		}
+	}
+	return "", ""
+}
+
+// validateHTTPRouteFilters checks all the filters of an HTTPRoute, and returns the reason and
+// message for the first one we cannot implement. An empty message means all the filters are valid.
+func validateHTTPRouteFilters(httpRoute *gw.HTTPRoute) (gw.RouteConditionReason, string) {
+	for _, rule := range httpRoute.Spec.Rules {
+		for _, filter := range rule.Filters {
+			if reason, msg := validateHTTPRouteFilter(filter, rule.Matches); msg != "" {
+				return reason, msg
+			}
+		}
+		for _, backend := range rule.BackendRefs {
+			if len(backend.Filters) > 0 {
+				return gw.RouteReasonUnsupportedValue, "backendRef filters are not supported"
+			}
+		}
+	}
+	return "", ""
+}
+
+var redirectResponseCodes = map[int]v3route.RedirectAction_RedirectResponseCode{
+	301: v3route.RedirectAction_MOVED_PERMANENTLY,
+	302: v3route.RedirectAction_FOUND,
+	303: v3route.RedirectAction_SEE_OTHER,
+	307: v3route.RedirectAction_TEMPORARY_REDIRECT,
+	308: v3route.RedirectAction_PERMANENT_REDIRECT,
+}
+
+// matchPrefix returns the path prefix that the match selects, or nil if it is not a PathPrefix
+// match.
+func matchPrefix(match gw.HTTPRouteMatch) *string {
+	prefix := "/"
+	if match.Path != nil {
+		if match.Path.Type != nil && *match.Path.Type != gw.PathMatchPathPrefix {
+			return nil
+		}
+		if match.Path.Value != nil {
+			prefix = *match.Path.Value
+		}
+	}
+	return &prefix
+}
+
+// Compile_HTTPRouteFilter applies a (valid) filter to a route. The prefix is the path prefix that
+// the route matches, or nil if the route doesn't match a path prefix.
+func Compile_HTTPRouteFilter(src Source, q *Query, filter gw.HTTPRouteFilter, namespace string, prefix *string, route *v3route.Route, clusterRefs *[]*ClusterRef) {
+	switch filter.Type {
+	case gw.HTTPRouteFilterRequestHeaderModifier:
+		mod := filter.RequestHeaderModifier
+		route.RequestHeadersToAdd = append(route.RequestHeadersToAdd, compileHeaderModifier(mod)...)
+		route.RequestHeadersToRemove = append(route.RequestHeadersToRemove, mod.Remove...)
+	case gw.HTTPRouteFilterResponseHeaderModifier:
+		mod := filter.ResponseHeaderModifier
+		route.ResponseHeadersToAdd = append(route.ResponseHeadersToAdd, compileHeaderModifier(mod)...)
+		route.ResponseHeadersToRemove = append(route.ResponseHeadersToRemove, mod.Remove...)
+	case gw.HTTPRouteFilterRequestRedirect:
+		// A redirect replaces whatever the route would otherwise have done.
+		redirect := filter.RequestRedirect
+		action := &v3route.RedirectAction{ResponseCode: v3route.RedirectAction_FOUND}
+		if redirect.Scheme != nil {
+			action.SchemeRewriteSpecifier = &v3route.RedirectAction_SchemeRedirect{SchemeRedirect: *redirect.Scheme}
+		}
+		if redirect.Hostname != nil {
+			action.HostRedirect = string(*redirect.Hostname)
+		}
+		if redirect.Port != nil {
+			action.PortRedirect = uint32(*redirect.Port)
+		}
+		if redirect.StatusCode != nil {
+			action.ResponseCode = redirectResponseCodes[*redirect.StatusCode]
+		}
+		if path := redirect.Path; path != nil {
+			switch path.Type {
+			case gw.FullPathHTTPPathModifier:
+				action.PathRewriteSpecifier = &v3route.RedirectAction_PathRedirect{PathRedirect: *path.ReplaceFullPath}
+			case gw.PrefixMatchHTTPPathModifier:
+				action.PathRewriteSpecifier = &v3route.RedirectAction_RegexRewrite{RegexRewrite: prefixRewrite(*prefix, *path.ReplacePrefixMatch)}
+			}
+		}
+		route.Action = &v3route.Route_Redirect{Redirect: action}
+	case gw.HTTPRouteFilterURLRewrite:
+		action := route.GetRoute()
+		if action == nil {
+			// The route doesn't forward requests anywhere, so there is nothing to rewrite.
+			return
+		}
+		rewrite := filter.URLRewrite
+		if rewrite.Hostname != nil {
+			action.HostRewriteSpecifier = &v3route.RouteAction_HostRewriteLiteral{HostRewriteLiteral: string(*rewrite.Hostname)}
+		}
+		if path := rewrite.Path; path != nil {
+			switch path.Type {
+			case gw.FullPathHTTPPathModifier:
+				action.RegexRewrite = &v3matcher.RegexMatchAndSubstitute{
+					Pattern:      regexMatcher("^/.*$"),
+					Substitution: *path.ReplaceFullPath,
+				}
+			case gw.PrefixMatchHTTPPathModifier:
+				action.RegexRewrite = prefixRewrite(*prefix, *path.ReplacePrefixMatch)
+			}
+		}
+	case gw.HTTPRouteFilterRequestMirror:
+		action := route.GetRoute()
+		if action == nil {
+			return
+		}
+		backend := gw.BackendRef{BackendObjectReference: filter.RequestMirror.BackendRef}
+		name, _, ok := compileBackendRef(src, q, "HTTPRoute", backend, namespace, false, clusterRefs)
+		if !ok {
+			return
+		}
+		action.RequestMirrorPolicies = append(action.RequestMirrorPolicies, &v3route.RouteAction_RequestMirrorPolicy{
+			Cluster: name,
+		})
+	}
+}
+
+// compileHeaderModifier turns the set and add parts of a header modifier into envoy header
+// options. Headers that are set replace any existing value, headers that are added are appended.
+func compileHeaderModifier(mod *gw.HTTPHeaderFilter) []*v3core.HeaderValueOption {
+	var result []*v3core.HeaderValueOption
+	for _, h := range mod.Set {
+		result = append(result, &v3core.HeaderValueOption{
+			Header:       &v3core.HeaderValue{Key: string(h.Name), Value: h.Value},
+			AppendAction: v3core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+		})
+	}
+	for _, h := range mod.Add {
+		result = append(result, &v3core.HeaderValueOption{
+			Header:       &v3core.HeaderValue{Key: string(h.Name), Value: h.Value},
+			AppendAction: v3core.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD,
 		})
 	}
+	return result
+}
+
+// prefixRewrite replaces the matched path prefix with the replacement. Like the match itself, this
+// works on whole path elements, so replacing /foo with /bar turns /foo/baz into /bar/baz, and
+// replacing /foo with / turns /foo/baz into /baz.
+func prefixRewrite(prefix, replacement string) *v3matcher.RegexMatchAndSubstitute {
+	prefix = strings.TrimSuffix(prefix, "/")
+	replacement = strings.TrimSuffix(replacement, "/")
+	switch {
+	case replacement == "":
+		return &v3matcher.RegexMatchAndSubstitute{
+			Pattern:      regexMatcher(fmt.Sprintf("^%s/*", regexp.QuoteMeta(prefix))),
+			Substitution: "/",
+		}
+	case prefix == "":
+		return &v3matcher.RegexMatchAndSubstitute{
+			Pattern:      regexMatcher("^/"),
+			Substitution: replacement + "/",
+		}
+	default:
+		return &v3matcher.RegexMatchAndSubstitute{
+			Pattern:      regexMatcher(fmt.Sprintf("^%s", regexp.QuoteMeta(prefix))),
+			Substitution: replacement,
+		}
+	}
+}
+
+// invalidBackendCluster is the name used in weighted clusters for backends that we cannot route to.
+// No cluster by that name ever exists, and routes that use it are configured to answer with a 500
+// when it is picked. It can't clash with a real cluster since those are all named after a port.
+const invalidBackendCluster = "invalid_backend"
+
+// weightedRoute produces a route that spreads requests across the clusters according to their
+// weights. Requests that would have been sent to an invalid backend must receive a 500, so they
+// keep their share of the requests via invalidBackendCluster.
+func weightedRoute(match *v3route.RouteMatch, clusters []*v3route.WeightedCluster_ClusterWeight) *v3route.Route {
+	route := &v3route.Route{Match: match}
+	valid, invalid := splitWeight(clusters)
+	if valid == 0 {
+		route.Action = &v3route.Route_DirectResponse{DirectResponse: &v3route.DirectResponseAction{Status: 500}}
+		return route
+	}
+	action := &v3route.RouteAction{
+		ClusterSpecifier: &v3route.RouteAction_WeightedClusters{
+			WeightedClusters: &v3route.WeightedCluster{Clusters: clusters},
+		},
+	}
+	if invalid > 0 {
+		action.ClusterNotFoundResponseCode = v3route.RouteAction_INTERNAL_SERVER_ERROR
+	}
+	route.Action = &v3route.Route_Route{Route: action}
+	return route
+}
+
+// splitWeight returns the total weight of the valid clusters and of the invalid backends.
+func splitWeight(clusters []*v3route.WeightedCluster_ClusterWeight) (uint32, uint32) {
+	var valid, invalid uint32
+	for _, c := range clusters {
+		if c.Name == invalidBackendCluster {
+			invalid += c.Weight.GetValue()
+		} else {
+			valid += c.Weight.GetValue()
+		}
+	}
+	return valid, invalid
+}
+
+// Compile_HTTPBackendRef records a ClusterRef for the backend and returns the corresponding
+// weighted cluster, see compileWeightedBackend.
+func Compile_HTTPBackendRef(src Source, q *Query, backend gw.HTTPBackendRef, namespace string, clusterRefs *[]*ClusterRef) *v3route.WeightedCluster_ClusterWeight {
+	return compileWeightedBackend(src, q, "HTTPRoute", backend.BackendRef, namespace, false, clusterRefs)
+}
 
-	return result, err
+// compileWeightedBackend records a ClusterRef for a backend of an HTTPRoute or GRPCRoute and
+// returns the corresponding weighted cluster. If the backend is not something we can route to, its
+// share of the requests goes to invalidBackendCluster instead. Backends with no weight get no
+// weighted cluster at all.
+func compileWeightedBackend(src Source, q *Query, kind string, backend gw.BackendRef, namespace string, http2 bool, clusterRefs *[]*ClusterRef) *v3route.WeightedCluster_ClusterWeight {
+	name, weight, ok := compileBackendRef(src, q, kind, backend, namespace, http2, clusterRefs)
+	if !ok {
+		name = invalidBackendCluster
+	}
+	if weight == 0 {
+		return nil
+	}
+	return &v3route.WeightedCluster_ClusterWeight{
+		Name:   name,
+		Weight: &wrapperspb.UInt32Value{Value: weight},
+	}
 }
 
-func Compile_HTTPRouteForwardTo(src Source, forward gw.HTTPRouteForwardTo, namespace string, clusterRefs *[]*ClusterRef) *v3route.WeightedCluster_ClusterWeight {
-	suffix := ""
-	clusterName := *forward.ServiceName
-	if forward.Port != nil {
-		suffix = fmt.Sprintf("/%d", *forward.Port)
-		clusterName = fmt.Sprintf("%s_%d", *forward.ServiceName, *forward.Port)
+// compileBackendRef records a ClusterRef for a backend of any kind of route and returns the cluster
+// name and weight. The kind and namespace are those of the route. If the backend is not something
+// we can route to, it records an error instead and returns false, along with the weight.
+func compileBackendRef(src Source, q *Query, kind string, backend gw.BackendRef, namespace string, http2 bool, clusterRefs *[]*ClusterRef) (string, uint32, bool) {
+	weight := int32(1)
+	if backend.Weight != nil {
+		weight = *backend.Weight
+	}
+
+	ref := backend.BackendObjectReference
+	_, msg := validateBackendRef(ref)
+	if msg == "" {
+		_, msg = permitBackendRef(q, kind, namespace, ref)
+	}
+	if msg != "" {
+		*clusterRefs = append(*clusterRefs, &ClusterRef{
+			CompiledItem: NewCompiledItemError(src, msg),
+		})
+		return "", uint32(weight), false
+	}
+
+	if ref.Namespace != nil {
+		namespace = string(*ref.Namespace)
+	}
+	clusterName := fmt.Sprintf("%s_%s_%d", namespace, ref.Name, *ref.Port)
+	if http2 {
+		// The same Service port may also be used by routes that speak HTTP/1.
+		clusterName += "_h2"
 	}
 
 	*clusterRefs = append(*clusterRefs, &ClusterRef{
-		CompiledItem: NewCompiledItem(src),
+		CompiledItem: CompiledItem{Source: src, Namespace: namespace},
 		Name:         clusterName,
-		EndpointPath: fmt.Sprintf("k8s/%s/%s%s", namespace, *forward.ServiceName, suffix),
+		EndpointPath: fmt.Sprintf("k8s/%s/%s/%d", namespace, ref.Name, *ref.Port),
+		Service:      string(ref.Name),
+		HTTP2:        http2,
 	})
-	return &v3route.WeightedCluster_ClusterWeight{
-		Name:   clusterName,
-		Weight: &wrapperspb.UInt32Value{Value: uint32(forward.Weight)},
+	return clusterName, uint32(weight), true
+}
+
+// validateBackendRef checks for backendRefs that we cannot route to, and returns the reason and
+// message explaining why. An empty message means the backendRef is valid.
+func validateBackendRef(ref gw.BackendObjectReference) (gw.RouteConditionReason, string) {
+	if (ref.Group != nil && *ref.Group != "") || (ref.Kind != nil && *ref.Kind != "Service") {
+		return gw.RouteReasonInvalidKind, fmt.Sprintf("unsupported backendRef kind: %s", backendKind(ref))
+	}
+	if ref.Port == nil {
+		return gw.RouteReasonUnsupportedValue, "backendRef to a Service must specify a port"
+	}
+	return "", ""
+}
+
+// permitBackendRef checks that a route of the given kind in the given namespace is allowed to refer
+// to the (valid) backend, and returns the reason and message explaining why not. An empty message
+// means the reference is permitted.
+func permitBackendRef(q *Query, kind, namespace string, ref gw.BackendObjectReference) (gw.RouteConditionReason, string) {
+	if ref.Namespace == nil || referenceGranted(q, kind, namespace, "", "Service", string(*ref.Namespace), string(ref.Name)) {
+		return "", ""
+	}
+	return gw.RouteReasonRefNotPermitted, fmt.Sprintf("backendRef to Service %s.%s is not permitted by any ReferenceGrant", ref.Name, *ref.Namespace)
+}
+
+func backendKind(ref gw.BackendObjectReference) string {
+	kind := "Service"
+	if ref.Kind != nil {
+		kind = string(*ref.Kind)
+	}
+	if ref.Group != nil && *ref.Group != "" {
+		return fmt.Sprintf("%s.%s", kind, *ref.Group)
+	}
+	return kind
+}
+
+// Compile_TCPRoute produces a CompiledRoute that forwards every connection accepted by the TCP
+// Gateway listeners it attaches to.
+func Compile_TCPRoute(tcpRoute *gwv1a2.TCPRoute, q *Query) (*CompiledConfig, error) {
+	src := SourceFromResource(tcpRoute)
+	var backends [][]gw.BackendRef
+	for _, rule := range tcpRoute.Spec.Rules {
+		backends = append(backends, rule.BackendRefs)
 	}
+	return &CompiledConfig{
+		CompiledItem: NewCompiledItem(src),
+		Routes: []*CompiledRoute{
+			compileConnectionRoute(src, q, tcpRoute, "TCPRoute", tcpRoute.Spec.ParentRefs, nil, backends),
+		},
+	}, nil
+}
+
+// Compile_TLSRoute produces a CompiledRoute that forwards TLS connections, selected by SNI, without
+// terminating them.
+func Compile_TLSRoute(tlsRoute *gwv1a2.TLSRoute, q *Query) (*CompiledConfig, error) {
+	src := SourceFromResource(tlsRoute)
+	var backends [][]gw.BackendRef
+	for _, rule := range tlsRoute.Spec.Rules {
+		backends = append(backends, rule.BackendRefs)
+	}
+	return &CompiledConfig{
+		CompiledItem: NewCompiledItem(src),
+		Routes: []*CompiledRoute{
+			compileConnectionRoute(src, q, tlsRoute, "TLSRoute", tlsRoute.Spec.ParentRefs, tlsRoute.Spec.Hostnames, backends),
+		},
+	}, nil
+}
+
+// compileConnectionRoute produces the CompiledRoute for a TCPRoute or TLSRoute. Connections are
+// spread across the backends of all the rules according to their weights.
+func compileConnectionRoute(src Source, q *Query, route kates.Object, kind string, parentRefs []gw.ParentReference, hostnames []gw.Hostname, rules [][]gw.BackendRef) *CompiledRoute {
+	clusterRefs := []*ClusterRef{}
+	var clusters []*v3tcpproxy.TcpProxy_WeightedCluster_ClusterWeight
+	for ruleIdx, backends := range rules {
+		for idx, backend := range backends {
+			s := Sourcef("backendRef %d in rule %d in %s", idx, ruleIdx, src)
+			name, weight, ok := compileBackendRef(s, q, kind, backend, route.GetNamespace(), false, &clusterRefs)
+			if ok && weight > 0 {
+				clusters = append(clusters, &v3tcpproxy.TcpProxy_WeightedCluster_ClusterWeight{
+					Name:   name,
+					Weight: weight,
+				})
+			}
+		}
+	}
+
+	var tcpProxy *v3tcpproxy.TcpProxy
+	switch len(clusters) {
+	case 0:
+		// Connections that would have been sent to an invalid backend are refused.
+	case 1:
+		tcpProxy = &v3tcpproxy.TcpProxy{
+			StatPrefix:       getName(route),
+			ClusterSpecifier: &v3tcpproxy.TcpProxy_Cluster{Cluster: clusters[0].Name},
+		}
+	default:
+		tcpProxy = &v3tcpproxy.TcpProxy{
+			StatPrefix: getName(route),
+			ClusterSpecifier: &v3tcpproxy.TcpProxy_WeightedClusters{
+				WeightedClusters: &v3tcpproxy.TcpProxy_WeightedCluster{Clusters: clusters},
+			},
+		}
+	}
+
+	return &CompiledRoute{
+		CompiledItem:      CompiledItem{Source: src, Namespace: route.GetNamespace()},
+		Name:              route.GetName(),
+		CreationTimestamp: route.GetCreationTimestamp().Time,
+		Kind:              kind,
+		ParentRefs:        parentRefs,
+		Hostnames:         hostnames,
+		ClusterRefs:       clusterRefs,
+		TCPProxy:          tcpProxy,
+	}
+}
+
+// Compile_GRPCRoute produces a CompiledRoute whose routes match gRPC requests by service and
+// method, and which forwards them to its backends over HTTP/2.
+func Compile_GRPCRoute(grpcRoute *gwv1a2.GRPCRoute, q *Query) (*CompiledConfig, error) {
+	src := SourceFromResource(grpcRoute)
+	clusterRefs := []*ClusterRef{}
+	var routes []*v3route.Route
+	var filterErrors []CompiledItem
+	for idx, rule := range grpcRoute.Spec.Rules {
+		s := Sourcef("rule %d in %s", idx, src)
+		for fidx := range rule.Filters {
+			filterErrors = append(filterErrors, NewCompiledItemError(Sourcef("filter %d in %s", fidx, s), "GRPCRoute filters are not supported"))
+		}
+		_routes, err := Compile_GRPCRouteRule(s, q, rule, grpcRoute.Namespace, &clusterRefs)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, _routes...)
+	}
+
+	return &CompiledConfig{
+		CompiledItem: NewCompiledItem(src),
+		Routes: []*CompiledRoute{
+			{
+				CompiledItem:      CompiledItem{Source: src, Namespace: grpcRoute.Namespace},
+				Name:              grpcRoute.Name,
+				CreationTimestamp: grpcRoute.CreationTimestamp.Time,
+				Kind:              "GRPCRoute",
+				ParentRefs:        grpcRoute.Spec.ParentRefs,
+				Hostnames:         grpcRoute.Spec.Hostnames,
+				Routes:            routes,
+				ClusterRefs:       clusterRefs,
+				FilterErrors:      filterErrors,
+			},
+		},
+	}, nil
+}
+
+func Compile_GRPCRouteRule(src Source, q *Query, rule gwv1a2.GRPCRouteRule, namespace string, clusterRefs *[]*ClusterRef) ([]*v3route.Route, error) {
+	var clusters []*v3route.WeightedCluster_ClusterWeight
+	for idx, backend := range rule.BackendRefs {
+		s := Sourcef("backendRef %d in %s", idx, src)
+		if cw := compileWeightedBackend(s, q, "GRPCRoute", backend.BackendRef, namespace, true, clusterRefs); cw != nil {
+			clusters = append(clusters, cw)
+		}
+	}
+	if len(rule.Filters) > 0 {
+		// As with HTTPRoutes, requests must not skip filters that we can't implement.
+		clusters = nil
+	}
+
+	matches, err := Compile_GRPCRouteMatches(rule.Matches)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*v3route.Route
+	for _, match := range matches {
+		result = append(result, weightedRoute(match, clusters))
+	}
+	return result, nil
+}
+
+func Compile_GRPCRouteMatches(matches []gwv1a2.GRPCRouteMatch) ([]*v3route.RouteMatch, error) {
+	var result []*v3route.RouteMatch
+	for _, match := range matches {
+		item, err := Compile_GRPCRouteMatch(match)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	if len(matches) == 0 {
+		result = append(result, &v3route.RouteMatch{
+			PathSpecifier: &v3route.RouteMatch_Prefix{Prefix: "/"},
+			Grpc:          &v3route.RouteMatch_GrpcRouteMatchOptions{},
+		})
+	}
+	return result, nil
+}
+
+// Compile_GRPCRouteMatch turns a gRPC service/method match into a match on the request path, which
+// gRPC always sets to "/<service>/<method>".
+func Compile_GRPCRouteMatch(match gwv1a2.GRPCRouteMatch) (*v3route.RouteMatch, error) {
+	result := &v3route.RouteMatch{
+		PathSpecifier: &v3route.RouteMatch_Prefix{Prefix: "/"},
+		Grpc:          &v3route.RouteMatch_GrpcRouteMatchOptions{},
+	}
+
+	if method := match.Method; method != nil {
+		matchType := gwv1a2.GRPCMethodMatchExact
+		if method.Type != nil {
+			matchType = *method.Type
+		}
+		switch matchType {
+		case gwv1a2.GRPCMethodMatchExact:
+			switch {
+			case method.Service != nil && method.Method != nil:
+				result.PathSpecifier = &v3route.RouteMatch_Path{Path: fmt.Sprintf("/%s/%s", *method.Service, *method.Method)}
+			case method.Service != nil:
+				result.PathSpecifier = &v3route.RouteMatch_Prefix{Prefix: fmt.Sprintf("/%s/", *method.Service)}
+			case method.Method != nil:
+				result.PathSpecifier = &v3route.RouteMatch_SafeRegex{SafeRegex: regexMatcher(fmt.Sprintf("/[^/]+/%s", regexp.QuoteMeta(*method.Method)))}
+			}
+		case gwv1a2.GRPCMethodMatchRegularExpression:
+			service, name := "[^/]+", "[^/]+"
+			if method.Service != nil {
+				service = *method.Service
+			}
+			if method.Method != nil {
+				name = *method.Method
+			}
+			result.PathSpecifier = &v3route.RouteMatch_SafeRegex{SafeRegex: regexMatcher(fmt.Sprintf("/%s/%s", service, name))}
+		default:
+			return nil, errors.Errorf("unknown method match type: %q", matchType)
+		}
+	}
+
+	var headerMatches []gw.HTTPHeaderMatch
+	for _, h := range match.Headers {
+		headerMatches = append(headerMatches, gw.HTTPHeaderMatch{
+			Type:  h.Type,
+			Name:  gw.HTTPHeaderName(h.Name),
+			Value: h.Value,
+		})
+	}
+	headers, err := Compile_HTTPHeaderMatches(headerMatches)
+	if err != nil {
+		return nil, err
+	}
+	result.Headers = headers
+
+	return result, nil
 }
 
 func Compile_HTTPRouteMatches(matches []gw.HTTPRouteMatch) ([]*v3route.RouteMatch, error) {
+	if len(matches) == 0 {
+		// A rule without matches matches all requests.
+		return []*v3route.RouteMatch{{PathSpecifier: &v3route.RouteMatch_Prefix{Prefix: "/"}}}, nil
+	}
 	var result []*v3route.RouteMatch
 	for _, match := range matches {
 		item, err := Compile_HTTPRouteMatch(match)
@@ -174,50 +1249,77 @@ func Compile_HTTPRouteMatches(matches []gw.HTTPRouteMatch) ([]*v3route.RouteMatc
 }
 
 func Compile_HTTPRouteMatch(match gw.HTTPRouteMatch) (*v3route.RouteMatch, error) {
-	headers, err := Compile_HTTPHeaderMatch(match.Headers)
+	headers, err := Compile_HTTPHeaderMatches(match.Headers)
+	if err != nil {
+		return nil, err
+	}
+	if match.Method != nil {
+		headers = append(headers, &v3route.HeaderMatcher{
+			Name:                 ":method",
+			HeaderMatchSpecifier: &v3route.HeaderMatcher_StringMatch{StringMatch: exactMatcher(string(*match.Method))},
+		})
+	}
+	queryParams, err := Compile_HTTPQueryParamMatches(match.QueryParams)
 	if err != nil {
 		return nil, err
 	}
 	result := &v3route.RouteMatch{
-		Headers: headers,
+		Headers:         headers,
+		QueryParameters: queryParams,
 	}
 
-	switch match.Path.Type {
+	pathType := gw.PathMatchPathPrefix
+	pathValue := "/"
+	if match.Path != nil {
+		if match.Path.Type != nil {
+			pathType = *match.Path.Type
+		}
+		if match.Path.Value != nil {
+			pathValue = *match.Path.Value
+		}
+	}
+
+	switch pathType {
 	case gw.PathMatchExact:
-		result.PathSpecifier = &v3route.RouteMatch_Path{Path: match.Path.Value}
-	case gw.PathMatchPrefix:
-		result.PathSpecifier = &v3route.RouteMatch_Prefix{Prefix: match.Path.Value}
+		result.PathSpecifier = &v3route.RouteMatch_Path{Path: pathValue}
+	case gw.PathMatchPathPrefix:
+		// Gateway API prefixes match whole path elements, i.e. /foo matches /foo and /foo/bar but
+		// not /foobar.
+		prefix := strings.TrimSuffix(pathValue, "/")
+		if prefix == "" {
+			result.PathSpecifier = &v3route.RouteMatch_Prefix{Prefix: "/"}
+		} else {
+			result.PathSpecifier = &v3route.RouteMatch_PathSeparatedPrefix{PathSeparatedPrefix: prefix}
+		}
 	case gw.PathMatchRegularExpression:
-		result.PathSpecifier = &v3route.RouteMatch_SafeRegex{SafeRegex: regexMatcher(match.Path.Value)}
-	case "":
-		// no path match, but PathSpecifier is required
-		result.PathSpecifier = &v3route.RouteMatch_Prefix{}
+		result.PathSpecifier = &v3route.RouteMatch_SafeRegex{SafeRegex: regexMatcher(pathValue)}
 	default:
-		return nil, errors.Errorf("unknown path match type: %q", match.Path.Type)
+		return nil, errors.Errorf("unknown path match type: %q", pathType)
 	}
 
 	return result, nil
 }
 
-func Compile_HTTPHeaderMatch(headerMatch *gw.HTTPHeaderMatch) ([]*v3route.HeaderMatcher, error) {
-	if headerMatch == nil {
-		return nil, nil
-	}
-
+func Compile_HTTPHeaderMatches(headerMatches []gw.HTTPHeaderMatch) ([]*v3route.HeaderMatcher, error) {
 	var result []*v3route.HeaderMatcher
-	for hdr, pattern := range headerMatch.Values {
+	for _, headerMatch := range headerMatches {
+		matchType := gw.HeaderMatchExact
+		if headerMatch.Type != nil {
+			matchType = *headerMatch.Type
+		}
+
 		hm := &v3route.HeaderMatcher{
-			Name:        hdr,
+			Name:        string(headerMatch.Name),
 			InvertMatch: false,
 		}
 
-		switch headerMatch.Type {
+		switch matchType {
 		case gw.HeaderMatchExact:
-			hm.HeaderMatchSpecifier = &v3route.HeaderMatcher_ExactMatch{ExactMatch: pattern}
+			hm.HeaderMatchSpecifier = &v3route.HeaderMatcher_StringMatch{StringMatch: exactMatcher(headerMatch.Value)}
 		case gw.HeaderMatchRegularExpression:
-			hm.HeaderMatchSpecifier = &v3route.HeaderMatcher_SafeRegexMatch{SafeRegexMatch: regexMatcher(pattern)}
+			hm.HeaderMatchSpecifier = &v3route.HeaderMatcher_StringMatch{StringMatch: regexStringMatcher(headerMatch.Value)}
 		default:
-			return nil, errors.Errorf("unknown header match type: %s", headerMatch.Type)
+			return nil, errors.Errorf("unknown header match type: %s", matchType)
 		}
 
 		result = append(result, hm)
@@ -225,6 +1327,40 @@ func Compile_HTTPHeaderMatch(headerMatch *gw.HTTPHeaderMatch) ([]*v3route.Header
 	return result, nil
 }
 
+func Compile_HTTPQueryParamMatches(queryMatches []gw.HTTPQueryParamMatch) ([]*v3route.QueryParameterMatcher, error) {
+	var result []*v3route.QueryParameterMatcher
+	for _, queryMatch := range queryMatches {
+		matchType := gw.QueryParamMatchExact
+		if queryMatch.Type != nil {
+			matchType = *queryMatch.Type
+		}
+
+		qm := &v3route.QueryParameterMatcher{
+			Name: string(queryMatch.Name),
+		}
+
+		switch matchType {
+		case gw.QueryParamMatchExact:
+			qm.QueryParameterMatchSpecifier = &v3route.QueryParameterMatcher_StringMatch{StringMatch: exactMatcher(queryMatch.Value)}
+		case gw.QueryParamMatchRegularExpression:
+			qm.QueryParameterMatchSpecifier = &v3route.QueryParameterMatcher_StringMatch{StringMatch: regexStringMatcher(queryMatch.Value)}
+		default:
+			return nil, errors.Errorf("unknown query param match type: %s", matchType)
+		}
+
+		result = append(result, qm)
+	}
+	return result, nil
+}
+
+func exactMatcher(value string) *v3matcher.StringMatcher {
+	return &v3matcher.StringMatcher{MatchPattern: &v3matcher.StringMatcher_Exact{Exact: value}}
+}
+
+func regexStringMatcher(pattern string) *v3matcher.StringMatcher {
+	return &v3matcher.StringMatcher{MatchPattern: &v3matcher.StringMatcher_SafeRegex{SafeRegex: regexMatcher(pattern)}}
+}
+
 func regexMatcher(pattern string) *v3matcher.RegexMatcher {
 	return &v3matcher.RegexMatcher{
 		EngineType: &v3matcher.RegexMatcher_GoogleRe2{GoogleRe2: &v3matcher.RegexMatcher_GoogleRE2{}},
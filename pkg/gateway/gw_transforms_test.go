@@ -11,7 +11,13 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
+	gw "sigs.k8s.io/gateway-api/apis/v1"
+	gwv1a2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
+
+	v3cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	v3core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	v3route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	ecp_v3_resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 
 	"github.com/datawire/dlib/dgroup"
 	"github.com/datawire/dlib/dlog"
@@ -56,63 +62,71 @@ func TestGatewayMatches(t *testing.T) {
 
 		// One rule for each type of path match (exact, prefix, regex) and each type of header match
 		// (exact and regex).
-		if err := d.UpsertYaml(`
+		if err := d.UpsertYaml(ctx, `
 ---
 kind: Gateway
-apiVersion: networking.x-k8s.io/v1alpha1
+apiVersion: gateway.networking.k8s.io/v1
 metadata:
   name: my-gateway
   namespace: default
 spec:
+  gatewayClassName: emissary
   listeners:
-  - protocol: HTTP
+  - name: http
+    protocol: HTTP
     port: 8080
 ---
 kind: HTTPRoute
-apiVersion: networking.x-k8s.io/v1alpha1
+apiVersion: gateway.networking.k8s.io/v1
 metadata:
   name: my-route
   namespace: default
 
 spec:
+  parentRefs:
+  - name: my-gateway
   rules:
   - matches:
     - path:
         type: Exact
         value: /exact
-    forwardTo:
-    - serviceName: foo-backend-1
+    backendRefs:
+    - name: foo-backend-1
       port: 9000
       weight: 100
   - matches:
     - path:
-        type: Prefix
+        type: PathPrefix
         value: /prefix
-    forwardTo:
-    - serviceName: foo-backend-1
+    backendRefs:
+    - name: foo-backend-1
+      port: 9000
       weight: 100
   - matches:
     - path:
         type: RegularExpression
         value: "/regular_expression(_[aA]+)?"
-    forwardTo:
-    - serviceName: foo-backend-1
+    backendRefs:
+    - name: foo-backend-1
+      port: 9000
       weight: 100
   - matches:
     - headers:
-        type: Exact
-        values:
-          exact: foo
-    forwardTo:
-    - serviceName: foo-backend-1
+      - type: Exact
+        name: exact
+        value: foo
+    backendRefs:
+    - name: foo-backend-1
+      port: 9000
       weight: 100
   - matches:
     - headers:
-        type: RegularExpression
-        values:
-          regular_expression: "foo(_[aA]+)?"
-    forwardTo:
-    - serviceName: foo-backend-1
+      - type: RegularExpression
+        name: regular_expression
+        value: "foo(_[aA]+)?"
+    backendRefs:
+    - name: foo-backend-1
+      port: 9000
       weight: 100
 `); err != nil {
 			return err
@@ -123,10 +137,10 @@ spec:
 			return err
 		}
 
-		if err := d.Upsert(makeEndpoint("default", "foo-backend-1", loopbackIp, 9000)); err != nil {
+		if err := d.Upsert(ctx, makeEndpoint("default", "foo-backend-1", loopbackIp, 9000)); err != nil {
 			return err
 		}
-		if err := d.Upsert(makeEndpoint("default", "foo-backend-2", loopbackIp, 9001)); err != nil {
+		if err := d.Upsert(ctx, makeEndpoint("default", "foo-backend-2", loopbackIp, 9001)); err != nil {
 			return err
 		}
 
@@ -172,15 +186,16 @@ spec:
 
 func TestBadMatchTypes(t *testing.T) {
 	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
 	d, err := makeDispatcher()
 	require.NoError(t, err)
 
 	// One rule for each type of path match (exact, prefix, regex) and each type of header match
 	// (exact and regex).
-	err = d.UpsertYaml(`
+	err = d.UpsertYaml(ctx, `
 ---
 kind: HTTPRoute
-apiVersion: networking.x-k8s.io/v1alpha1
+apiVersion: gateway.networking.k8s.io/v1
 metadata:
   name: my-route
   namespace: default
@@ -190,17 +205,17 @@ spec:
     - path:
         type: Blah
         value: /exact
-    forwardTo:
-    - serviceName: foo-backend-1
+    backendRefs:
+    - name: foo-backend-1
       port: 9000
       weight: 100
 `)
 	assertErrorContains(t, err, `processing HTTPRoute:default:my-route: unknown path match type: "Blah"`)
 
-	err = d.UpsertYaml(`
+	err = d.UpsertYaml(ctx, `
 ---
 kind: HTTPRoute
-apiVersion: networking.x-k8s.io/v1alpha1
+apiVersion: gateway.networking.k8s.io/v1
 metadata:
   name: my-route
   namespace: default
@@ -208,27 +223,1012 @@ spec:
   rules:
   - matches:
     - headers:
-        type: Bleh
-        values:
-          exact: foo
-    forwardTo:
-    - serviceName: foo-backend-1
+      - type: Bleh
+        name: exact
+        value: foo
+    backendRefs:
+    - name: foo-backend-1
+      port: 9000
       weight: 100
 `)
 	assertErrorContains(t, err, `processing HTTPRoute:default:my-route: unknown header match type: Bleh`)
 }
 
+func TestGatewayAttachment(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	// Two listeners share a port, routes attach to them by sectionName and hostname, and a route
+	// from another namespace is not allowed to attach at all.
+	err = d.UpsertYaml(ctx, `
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: foo
+    protocol: HTTP
+    port: 8080
+    hostname: "*.foo.com"
+  - name: bar
+    protocol: HTTP
+    port: 8080
+    hostname: bar.com
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: foo-route
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+    sectionName: foo
+  hostnames:
+  - www.foo.com
+  - bar.com
+  rules:
+  - backendRefs:
+    - name: foo-backend
+      port: 9000
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: any-route
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  rules:
+  - backendRefs:
+    - name: any-backend
+      port: 9000
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: other-route
+  namespace: other
+spec:
+  parentRefs:
+  - name: my-gateway
+    namespace: default
+  rules:
+  - backendRefs:
+    - name: other-backend
+      port: 9000
+`)
+	require.NoError(t, err)
+
+	require.NotNil(t, d.GetListener(ctx, "default-my-gateway-8080"))
+	rc := d.GetRouteConfiguration(ctx, "default-my-gateway-8080")
+	require.NotNil(t, rc)
+
+	clusters := map[string][]string{}
+	for _, vh := range rc.VirtualHosts {
+		require.Len(t, vh.Domains, 1)
+		for _, r := range vh.Routes {
+			for _, c := range r.GetRoute().GetWeightedClusters().GetClusters() {
+				clusters[vh.Domains[0]] = append(clusters[vh.Domains[0]], c.Name)
+			}
+		}
+	}
+	assert.Equal(t, map[string][]string{
+		"*.foo.com":   {"default_any-backend_9000"},
+		"bar.com":     {"default_any-backend_9000"},
+		"www.foo.com": {"default_foo-backend_9000", "default_any-backend_9000"},
+	}, clusters)
+}
+
+func TestGatewaySharedPort(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	// Two Gateways have listeners on the same port, so they have to share an envoy listener.
+	err = d.UpsertYaml(ctx, `
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: gateway-a
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: http
+    protocol: HTTP
+    port: 8080
+    hostname: a.com
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: gateway-b
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: http
+    protocol: HTTP
+    port: 8080
+    hostname: b.com
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: a-route
+  namespace: default
+spec:
+  parentRefs:
+  - name: gateway-a
+  rules:
+  - backendRefs:
+    - name: a-backend
+      port: 9000
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: b-route
+  namespace: default
+spec:
+  parentRefs:
+  - name: gateway-b
+  rules:
+  - backendRefs:
+    - name: b-backend
+      port: 9000
+`)
+	require.NoError(t, err)
+
+	_, snapshot := d.GetSnapshot(ctx)
+	require.NotNil(t, snapshot)
+	listeners := snapshot.GetResources(ecp_v3_resource.ListenerType)
+	require.Len(t, listeners, 1)
+	lst := d.GetListener(ctx, "default-gateway-a-8080")
+	require.NotNil(t, lst)
+	assert.Len(t, lst.FilterChains, 1)
+
+	rc := d.GetRouteConfiguration(ctx, "default-gateway-a-8080")
+	require.NotNil(t, rc)
+	clusters := map[string][]string{}
+	for _, vh := range rc.VirtualHosts {
+		for _, r := range vh.Routes {
+			for _, c := range r.GetRoute().GetWeightedClusters().GetClusters() {
+				clusters[vh.Domains[0]] = append(clusters[vh.Domains[0]], c.Name)
+			}
+		}
+	}
+	assert.Equal(t, map[string][]string{
+		"a.com": {"default_a-backend_9000"},
+		"b.com": {"default_b-backend_9000"},
+	}, clusters)
+}
+
+func TestHTTPRoutePrecedence(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	// The rules are deliberately spread across routes in the wrong order, and the routes that tie
+	// on their matches are told apart by age and then by name.
+	err = d.UpsertYaml(ctx, `
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: http
+    protocol: HTTP
+    port: 8080
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: a-route
+  namespace: default
+  creationTimestamp: "2024-01-02T00:00:00Z"
+spec:
+  parentRefs:
+  - name: my-gateway
+  rules:
+  - backendRefs:
+    - name: catch-all
+      port: 80
+  - matches:
+    - path:
+        type: PathPrefix
+        value: /foo
+    backendRefs:
+    - name: newer-foo
+      port: 80
+  - matches:
+    - path:
+        type: PathPrefix
+        value: /foo
+      queryParams:
+      - name: q
+        value: x
+    backendRefs:
+    - name: foo-query
+      port: 80
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: z-route
+  namespace: default
+  creationTimestamp: "2024-01-01T00:00:00Z"
+spec:
+  parentRefs:
+  - name: my-gateway
+  rules:
+  - matches:
+    - path:
+        type: PathPrefix
+        value: /foo
+    backendRefs:
+    - name: older-foo
+      port: 80
+  - matches:
+    - path:
+        type: PathPrefix
+        value: /foo
+      headers:
+      - name: x-foo
+        value: bar
+    backendRefs:
+    - name: foo-header
+      port: 80
+  - matches:
+    - path:
+        type: PathPrefix
+        value: /foo
+      method: GET
+    backendRefs:
+    - name: foo-method
+      port: 80
+  - matches:
+    - path:
+        type: PathPrefix
+        value: /foo/bar
+    backendRefs:
+    - name: foo-bar
+      port: 80
+  - matches:
+    - path:
+        type: Exact
+        value: /foo
+    backendRefs:
+    - name: foo-exact
+      port: 80
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: m-route
+  namespace: default
+  creationTimestamp: "2024-01-01T00:00:00Z"
+spec:
+  parentRefs:
+  - name: my-gateway
+  rules:
+  - matches:
+    - path:
+        type: PathPrefix
+        value: /foo
+    backendRefs:
+    - name: older-foo-by-name
+      port: 80
+`)
+	require.NoError(t, err)
+
+	rc := d.GetRouteConfiguration(ctx, "default-my-gateway-8080")
+	require.NotNil(t, rc)
+	require.Len(t, rc.VirtualHosts, 1)
+	var clusters []string
+	for _, r := range rc.VirtualHosts[0].Routes {
+		for _, c := range r.GetRoute().GetWeightedClusters().GetClusters() {
+			clusters = append(clusters, c.Name)
+		}
+	}
+	assert.Equal(t, []string{
+		"default_foo-exact_80",
+		"default_foo-bar_80",
+		"default_foo-method_80",
+		"default_foo-header_80",
+		"default_foo-query_80",
+		"default_older-foo-by-name_80",
+		"default_older-foo_80",
+		"default_newer-foo_80",
+		"default_catch-all_80",
+	}, clusters)
+}
+
+func TestHTTPRouteInvalidBackends(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	// An invalid backend keeps its share of the requests, and that share gets a 500.
+	err = d.UpsertYaml(ctx, `
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: http
+    protocol: HTTP
+    port: 8080
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-route
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  rules:
+  - matches:
+    - path:
+        type: PathPrefix
+        value: /some
+    backendRefs:
+    - name: foo-backend
+      port: 9000
+      weight: 3
+    - name: bucket
+      kind: Bucket
+      group: example.com
+      weight: 1
+  - matches:
+    - path:
+        type: PathPrefix
+        value: /none
+    backendRefs:
+    - name: bucket
+      kind: Bucket
+      group: example.com
+`)
+	require.NoError(t, err)
+	require.Len(t, d.GetErrors(), 2)
+
+	rc := d.GetRouteConfiguration(ctx, "default-my-gateway-8080")
+	require.NotNil(t, rc)
+	require.Len(t, rc.VirtualHosts, 1)
+	routes := map[string]*v3route.Route{}
+	for _, route := range rc.VirtualHosts[0].Routes {
+		routes[route.Match.GetPathSeparatedPrefix()] = route
+	}
+
+	some := routes["/some"].GetRoute()
+	require.NotNil(t, some)
+	assert.Equal(t, v3route.RouteAction_INTERNAL_SERVER_ERROR, some.ClusterNotFoundResponseCode)
+	weights := map[string]uint32{}
+	for _, c := range some.GetWeightedClusters().GetClusters() {
+		weights[c.Name] = c.Weight.GetValue()
+	}
+	assert.Equal(t, map[string]uint32{"default_foo-backend_9000": 3, "invalid_backend": 1}, weights)
+
+	assert.Equal(t, uint32(500), routes["/none"].GetDirectResponse().GetStatus())
+
+	_, snapshot := d.GetSnapshot(ctx)
+	require.NotNil(t, snapshot)
+	assert.NotContains(t, snapshot.GetResources(ecp_v3_resource.ClusterType), "invalid_backend")
+}
+
+func TestGatewayTLS(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	// Two HTTPS listeners share a port and are told apart by SNI. Only one of them has a
+	// certificate that exists, so only that one gets a filter chain.
+	err = d.UpsertYaml(ctx, `
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: foo
+    protocol: HTTPS
+    port: 8443
+    hostname: "*.foo.com"
+    tls:
+      certificateRefs:
+      - name: foo-cert
+  - name: bar
+    protocol: HTTPS
+    port: 8443
+    hostname: bar.com
+    tls:
+      certificateRefs:
+      - name: bar-cert
+`)
+	require.NoError(t, err)
+	assert.Nil(t, d.GetListener(ctx, "default-my-gateway-8443"))
+
+	require.NoError(t, d.Upsert(ctx, makeTLSSecret(t, "default", "foo-cert", "*.foo.com")))
+	lst := d.GetListener(ctx, "default-my-gateway-8443")
+	require.NotNil(t, lst)
+	require.Len(t, lst.ListenerFilters, 1)
+	require.Len(t, lst.FilterChains, 1)
+	chain := lst.FilterChains[0]
+	assert.Equal(t, []string{"*.foo.com"}, chain.FilterChainMatch.ServerNames)
+	assert.NotNil(t, chain.TransportSocket)
+
+	_, snapshot := d.GetSnapshot(ctx)
+	require.NotNil(t, snapshot)
+	secrets := snapshot.GetResources(ecp_v3_resource.SecretType)
+	assert.Contains(t, secrets, gateway.SecretName("default", "foo-cert"))
+	assert.Len(t, secrets, 1)
+
+	// An invalid secret is reported and doesn't get used.
+	bad := makeTLSSecret(t, "default", "bar-cert", "bar.com")
+	bad.Data["tls.crt"] = []byte("garbage")
+	require.NoError(t, d.Upsert(ctx, bad))
+	lst = d.GetListener(ctx, "default-my-gateway-8443")
+	require.NotNil(t, lst)
+	assert.Len(t, lst.FilterChains, 1)
+	errs := d.GetErrors()
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error, "is not a PEM-encoded certificate")
+
+	require.NoError(t, d.Upsert(ctx, makeTLSSecret(t, "default", "bar-cert", "bar.com")))
+	lst = d.GetListener(ctx, "default-my-gateway-8443")
+	require.NotNil(t, lst)
+	assert.Len(t, lst.FilterChains, 2)
+}
+
+func TestGatewayTLSRouteIsolation(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	// The foo route only attaches to the foo listener, so it must not be reachable with the SNI
+	// of the bar listener, even though it asks for bar.com.
+	err = d.UpsertYaml(ctx, `
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: foo
+    protocol: HTTPS
+    port: 8443
+    hostname: "*.foo.com"
+    tls:
+      certificateRefs:
+      - name: foo-cert
+  - name: bar
+    protocol: HTTPS
+    port: 8443
+    hostname: bar.com
+    tls:
+      certificateRefs:
+      - name: bar-cert
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: foo-route
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+    sectionName: foo
+  hostnames:
+  - www.foo.com
+  - bar.com
+  rules:
+  - backendRefs:
+    - name: foo-backend
+      port: 9000
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: any-route
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  rules:
+  - backendRefs:
+    - name: any-backend
+      port: 9000
+`)
+	require.NoError(t, err)
+	require.NoError(t, d.Upsert(ctx, makeTLSSecret(t, "default", "foo-cert", "*.foo.com")))
+	require.NoError(t, d.Upsert(ctx, makeTLSSecret(t, "default", "bar-cert", "bar.com")))
+
+	lst := d.GetListener(ctx, "default-my-gateway-8443")
+	require.NotNil(t, lst)
+	require.Len(t, lst.FilterChains, 2)
+
+	clusters := func(name string) map[string][]string {
+		rc := d.GetRouteConfiguration(ctx, name)
+		require.NotNil(t, rc, name)
+		result := map[string][]string{}
+		for _, vh := range rc.VirtualHosts {
+			for _, r := range vh.Routes {
+				for _, c := range r.GetRoute().GetWeightedClusters().GetClusters() {
+					result[vh.Domains[0]] = append(result[vh.Domains[0]], c.Name)
+				}
+			}
+		}
+		return result
+	}
+	assert.Equal(t, map[string][]string{
+		"*.foo.com":   {"default_any-backend_9000"},
+		"www.foo.com": {"default_foo-backend_9000", "default_any-backend_9000"},
+	}, clusters("default-my-gateway-8443-foo"))
+	assert.Equal(t, map[string][]string{
+		"bar.com": {"default_any-backend_9000"},
+	}, clusters("default-my-gateway-8443-bar"))
+}
+
+func TestGatewayReferenceGrants(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	// Both the certificateRef and the backendRef point into the "shared" namespace, so neither is
+	// allowed until there is a ReferenceGrant there.
+	err = d.UpsertYaml(ctx, `
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: https
+    protocol: HTTPS
+    port: 8443
+    tls:
+      certificateRefs:
+      - name: shared-cert
+        namespace: shared
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-route
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  rules:
+  - backendRefs:
+    - name: db
+      namespace: shared
+      port: 5432
+`)
+	require.NoError(t, err)
+	require.NoError(t, d.Upsert(ctx, makeTLSSecret(t, "shared", "shared-cert", "*.foo.com")))
+
+	assert.Nil(t, d.GetListener(ctx, "default-my-gateway-8443"))
+	errs := d.GetErrors()
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error, "backendRef to Service db.shared is not permitted")
+	_, snapshot := d.GetSnapshot(ctx)
+	require.NotNil(t, snapshot)
+	assert.NotContains(t, snapshot.GetResources(ecp_v3_resource.ClusterType), "shared_db_5432")
+
+	// A grant for the wrong kind of resource doesn't help.
+	err = d.UpsertYaml(ctx, `
+---
+kind: ReferenceGrant
+apiVersion: gateway.networking.k8s.io/v1beta1
+metadata:
+  name: allow-default
+  namespace: shared
+spec:
+  from:
+  - group: gateway.networking.k8s.io
+    kind: GRPCRoute
+    namespace: default
+  to:
+  - group: ""
+    kind: Service
+`)
+	require.NoError(t, err)
+	assert.Len(t, d.GetErrors(), 1)
+
+	err = d.UpsertYaml(ctx, `
+---
+kind: ReferenceGrant
+apiVersion: gateway.networking.k8s.io/v1beta1
+metadata:
+  name: allow-default
+  namespace: shared
+spec:
+  from:
+  - group: gateway.networking.k8s.io
+    kind: HTTPRoute
+    namespace: default
+  - group: gateway.networking.k8s.io
+    kind: Gateway
+    namespace: default
+  to:
+  - group: ""
+    kind: Service
+  - group: ""
+    kind: Secret
+    name: shared-cert
+`)
+	require.NoError(t, err)
+	assert.Empty(t, d.GetErrors())
+	lst := d.GetListener(ctx, "default-my-gateway-8443")
+	require.NotNil(t, lst)
+	assert.Len(t, lst.FilterChains, 1)
+	_, snapshot = d.GetSnapshot(ctx)
+	require.NotNil(t, snapshot)
+	assert.Contains(t, snapshot.GetResources(ecp_v3_resource.ClusterType), "shared_db_5432")
+	assert.Contains(t, snapshot.GetResources(ecp_v3_resource.SecretType), gateway.SecretName("shared", "shared-cert"))
+
+	// Taking the grant away takes the access away again.
+	d.DeleteKey(ctx, "ReferenceGrant", "shared", "allow-default")
+	assert.Nil(t, d.GetListener(ctx, "default-my-gateway-8443"))
+	assert.Len(t, d.GetErrors(), 1)
+}
+
+func TestHTTPRouteFilters(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	err = d.UpsertYaml(ctx, `
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: http
+    protocol: HTTP
+    port: 8080
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-route
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  rules:
+  - matches:
+    - path:
+        type: Exact
+        value: /headers
+    filters:
+    - type: RequestHeaderModifier
+      requestHeaderModifier:
+        set:
+        - name: x-set
+          value: one
+        add:
+        - name: x-add
+          value: two
+        remove:
+        - x-remove
+    backendRefs:
+    - name: foo-backend
+      port: 9000
+  - matches:
+    - path:
+        type: PathPrefix
+        value: /old
+    filters:
+    - type: RequestRedirect
+      requestRedirect:
+        scheme: https
+        statusCode: 301
+        path:
+          type: ReplacePrefixMatch
+          replacePrefixMatch: /new
+  - matches:
+    - path:
+        type: PathPrefix
+        value: /api
+    filters:
+    - type: URLRewrite
+      urlRewrite:
+        hostname: api.internal
+        path:
+          type: ReplacePrefixMatch
+          replacePrefixMatch: /
+    - type: RequestMirror
+      requestMirror:
+        backendRef:
+          name: shadow
+          port: 9001
+    backendRefs:
+    - name: foo-backend
+      port: 9000
+  - matches:
+    - path:
+        type: PathPrefix
+        value: /ext
+    filters:
+    - type: ExtensionRef
+      extensionRef:
+        group: example.com
+        kind: Thing
+        name: thing
+    backendRefs:
+    - name: foo-backend
+      port: 9000
+`)
+	require.NoError(t, err)
+
+	errs := d.GetErrors()
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error, `unsupported filter type: "ExtensionRef"`)
+
+	rc := d.GetRouteConfiguration(ctx, "default-my-gateway-8080")
+	require.NotNil(t, rc)
+	require.Len(t, rc.VirtualHosts, 1)
+	routes := map[string]*v3route.Route{}
+	for _, route := range rc.VirtualHosts[0].Routes {
+		path := route.Match.GetPath()
+		if path == "" {
+			path = route.Match.GetPathSeparatedPrefix()
+		}
+		routes[path] = route
+	}
+
+	headers := routes["/headers"]
+	require.NotNil(t, headers)
+	require.Len(t, headers.RequestHeadersToAdd, 2)
+	assert.Equal(t, "x-set", headers.RequestHeadersToAdd[0].Header.Key)
+	assert.Equal(t, v3core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD, headers.RequestHeadersToAdd[0].AppendAction)
+	assert.Equal(t, "x-add", headers.RequestHeadersToAdd[1].Header.Key)
+	assert.Equal(t, v3core.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD, headers.RequestHeadersToAdd[1].AppendAction)
+	assert.Equal(t, []string{"x-remove"}, headers.RequestHeadersToRemove)
+
+	redirect := routes["/old"].GetRedirect()
+	require.NotNil(t, redirect)
+	assert.Equal(t, "https", redirect.GetSchemeRedirect())
+	assert.Equal(t, v3route.RedirectAction_MOVED_PERMANENTLY, redirect.ResponseCode)
+	assert.Equal(t, "^/old", redirect.GetRegexRewrite().Pattern.Regex)
+	assert.Equal(t, "/new", redirect.GetRegexRewrite().Substitution)
+
+	api := routes["/api"].GetRoute()
+	require.NotNil(t, api)
+	assert.Equal(t, "api.internal", api.GetHostRewriteLiteral())
+	assert.Equal(t, "^/api/*", api.RegexRewrite.Pattern.Regex)
+	assert.Equal(t, "/", api.RegexRewrite.Substitution)
+	require.Len(t, api.RequestMirrorPolicies, 1)
+	assert.Equal(t, "default_shadow_9001", api.RequestMirrorPolicies[0].Cluster)
+
+	// Requests must not skip a filter that we can't implement.
+	assert.Equal(t, uint32(500), routes["/ext"].GetDirectResponse().GetStatus())
+}
+
+func TestGatewayTCPAndTLSRoutes(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	err = d.UpsertYaml(ctx, `
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: tcp
+    protocol: TCP
+    port: 9000
+  - name: tls
+    protocol: TLS
+    port: 9443
+    hostname: "*.foo.com"
+    tls:
+      mode: Passthrough
+---
+kind: TCPRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: tcp-route
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  rules:
+  - backendRefs:
+    - name: db
+      port: 5432
+---
+kind: TLSRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: tls-route
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  hostnames:
+  - www.foo.com
+  - www.bar.com
+  rules:
+  - backendRefs:
+    - name: web-a
+      port: 8443
+      weight: 3
+    - name: web-b
+      port: 8443
+      weight: 1
+`)
+	require.NoError(t, err)
+	assert.Empty(t, d.GetErrors())
+
+	// The TCPRoute only attaches to the TCP listener, and takes all of its connections.
+	tcp := d.GetListener(ctx, "default-my-gateway-9000")
+	require.NotNil(t, tcp)
+	require.Len(t, tcp.FilterChains, 1)
+	assert.Nil(t, tcp.FilterChains[0].FilterChainMatch)
+	assert.Equal(t, "envoy.filters.network.tcp_proxy", tcp.FilterChains[0].Filters[0].Name)
+
+	// The TLSRoute is selected by SNI, and only for the hostnames the listener allows.
+	tls := d.GetListener(ctx, "default-my-gateway-9443")
+	require.NotNil(t, tls)
+	require.Len(t, tls.ListenerFilters, 1)
+	require.Len(t, tls.FilterChains, 1)
+	assert.Equal(t, []string{"www.foo.com"}, tls.FilterChains[0].FilterChainMatch.ServerNames)
+	assert.Nil(t, tls.FilterChains[0].TransportSocket)
+
+	_, snapshot := d.GetSnapshot(ctx)
+	require.NotNil(t, snapshot)
+	clusters := snapshot.GetResources(ecp_v3_resource.ClusterType)
+	assert.Contains(t, clusters, "default_db_5432")
+	assert.Contains(t, clusters, "default_web-a_8443")
+	assert.Contains(t, clusters, "default_web-b_8443")
+}
+
+func TestGatewayGRPCRoute(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	err = d.UpsertYaml(ctx, `
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: http
+    protocol: HTTP
+    port: 8080
+---
+kind: GRPCRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: grpc-route
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  rules:
+  - matches:
+    - method:
+        service: helloworld.Greeter
+        method: SayHello
+    backendRefs:
+    - name: greeter
+      port: 50051
+  - matches:
+    - method:
+        service: helloworld.Greeter
+    backendRefs:
+    - name: greeter
+      port: 50051
+`)
+	require.NoError(t, err)
+	assert.Empty(t, d.GetErrors())
+
+	rc := d.GetRouteConfiguration(ctx, "default-my-gateway-8080")
+	require.NotNil(t, rc)
+	require.Len(t, rc.VirtualHosts, 1)
+	routes := rc.VirtualHosts[0].Routes
+	require.Len(t, routes, 2)
+	assert.Equal(t, "/helloworld.Greeter/SayHello", routes[0].Match.GetPath())
+	assert.Equal(t, "/helloworld.Greeter/", routes[1].Match.GetPrefix())
+	assert.NotNil(t, routes[0].Match.Grpc)
+
+	_, snapshot := d.GetSnapshot(ctx)
+	require.NotNil(t, snapshot)
+	clusters := snapshot.GetResources(ecp_v3_resource.ClusterType)
+	require.Contains(t, clusters, "default_greeter_50051_h2")
+	cluster, ok := clusters["default_greeter_50051_h2"].(*v3cluster.Cluster)
+	require.True(t, ok)
+	assert.Contains(t, cluster.TypedExtensionProtocolOptions, "envoy.extensions.upstreams.http.v3.HttpProtocolOptions")
+}
+
 func makeDispatcher() (*gateway.Dispatcher, error) {
 	d := gateway.NewDispatcher()
 
-	if err := d.Register("Gateway", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
-		return gateway.Compile_Gateway(untyped.(*gw.Gateway))
+	if err := d.Register("GatewayClass", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_GatewayClass(untyped.(*gw.GatewayClass))
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := d.RegisterWithQuery("Gateway", func(untyped kates.Object, q *gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_Gateway(untyped.(*gw.Gateway), q)
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := d.RegisterWithQuery("HTTPRoute", func(untyped kates.Object, q *gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_HTTPRoute(untyped.(*gw.HTTPRoute), q)
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := d.RegisterWithQuery("GRPCRoute", func(untyped kates.Object, q *gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_GRPCRoute(untyped.(*gwv1a2.GRPCRoute), q)
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := d.RegisterWithQuery("TCPRoute", func(untyped kates.Object, q *gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_TCPRoute(untyped.(*gwv1a2.TCPRoute), q)
 	}); err != nil {
 		return nil, err
 	}
 
-	if err := d.Register("HTTPRoute", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
-		return gateway.Compile_HTTPRoute(untyped.(*gw.HTTPRoute))
+	if err := d.RegisterWithQuery("TLSRoute", func(untyped kates.Object, q *gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_TLSRoute(untyped.(*gwv1a2.TLSRoute), q)
 	}); err != nil {
 		return nil, err
 	}
@@ -239,6 +1239,12 @@ func makeDispatcher() (*gateway.Dispatcher, error) {
 		return nil, err
 	}
 
+	for _, kind := range []string{"Secret", "ReferenceGrant"} {
+		if err := d.RegisterDependency(kind); err != nil {
+			return nil, err
+		}
+	}
+
 	return d, nil
 }
 
@@ -1,7 +1,18 @@
 package gateway_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
 	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+	"github.com/stretchr/testify/require"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -31,3 +42,32 @@ type FooSpec struct {
 func (f *Foo) DeepCopyObject() runtime.Object {
 	return nil
 }
+
+// makeTLSSecret creates a kubernetes TLS secret holding a freshly generated self-signed certificate
+// for the given hostname.
+func makeTLSSecret(t *testing.T, namespace, name, hostname string) *kates.Secret {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return &kates.Secret{
+		TypeMeta:   kates.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: kates.ObjectMeta{Namespace: namespace, Name: name},
+		Type:       kates.SecretTypeTLS,
+		Data: map[string][]byte{
+			"tls.crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+			"tls.key": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		},
+	}
+}
@@ -0,0 +1,76 @@
+package gateway
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+)
+
+// Query gives a transform read access to the other resources that the dispatcher knows about.
+// Everything a transform looks up via its Query, including lookups that find nothing, is recorded
+// as a dependency of the resource being transformed. Whenever one of those dependencies is upserted
+// or deleted, the dispatcher runs the transform again.
+type Query struct {
+	ctx  context.Context
+	d    *Dispatcher
+	deps map[string]bool
+}
+
+func newQuery(ctx context.Context, d *Dispatcher) *Query {
+	return &Query{ctx: ctx, d: d, deps: map[string]bool{}}
+}
+
+// Context returns the context of whatever caused the transform to run, e.g. an Upsert.
+func (q *Query) Context() context.Context {
+	return q.ctx
+}
+
+// Get returns the resource of the given kind, namespace, and name, or nil if the dispatcher
+// doesn't know about one. Cluster scoped resources have an empty namespace.
+func (q *Query) Get(kind, namespace, name string) kates.Object {
+	key := resourceKeyFromParts(kind, namespace, name)
+	q.deps[key] = true
+	return q.d.resources[key]
+}
+
+// List returns all the resources of the given kind in the namespace, sorted by name. An empty
+// namespace lists the resources in every namespace, sorted by namespace and then name.
+func (q *Query) List(kind, namespace string) []kates.Object {
+	q.deps[listKey(kind, namespace)] = true
+
+	prefix := resourceKeyFromParts(kind, namespace, "")
+	if namespace == "" {
+		prefix = kind + ":"
+	}
+	var keys []string
+	for key := range q.d.resources {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := make([]kates.Object, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, q.d.resources[key])
+	}
+	return result
+}
+
+// listKey is the dependency key recorded for a List query. It uses "*" where a resource key would
+// have a name (or namespace), which can never collide with a real resource.
+func listKey(kind, namespace string) string {
+	if namespace == "" {
+		namespace = "*"
+	}
+	return resourceKeyFromParts(kind, namespace, "*")
+}
+
+// invalidatedKeys returns the dependency keys that a change to the resource with the given key
+// invalidates: the resource itself, and the List queries that would include it.
+func invalidatedKeys(key string) []string {
+	parts := strings.SplitN(key, ":", 3)
+	return []string{key, listKey(parts[0], parts[1]), listKey(parts[0], "")}
+}
@@ -0,0 +1,560 @@
+package gateway
+
+import (
+	// standard library
+	"context"
+	"fmt"
+	"sort"
+
+	// third-party libraries
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gw "sigs.k8s.io/gateway-api/apis/v1"
+	gwv1a2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
+
+	// envoy api v3
+	v3tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+
+	// first-party libraries
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+)
+
+// GetStatuses computes the Gateway API status for every GatewayClass, Gateway, and route that the
+// dispatcher knows about. Only resources whose status differs from what the resource already
+// has are returned, and each returned resource is a copy with the new status filled in, suitable
+// for passing to (*kates.Client).UpdateStatus.
+func (d *Dispatcher) GetStatuses(ctx context.Context) []kates.Object {
+	_, snapshot := d.GetSnapshot(ctx)
+	programmed := snapshot != nil
+
+	var gateways []*gw.Gateway
+	var routes []kates.Object
+	var classes []*gw.GatewayClass
+	for _, key := range d.sortedResourceKeys() {
+		switch obj := d.resources[key].(type) {
+		case *gw.GatewayClass:
+			classes = append(classes, obj)
+		case *gw.Gateway:
+			gateways = append(gateways, obj)
+		case *gw.HTTPRoute, *gwv1a2.GRPCRoute, *gwv1a2.TCPRoute, *gwv1a2.TLSRoute:
+			routes = append(routes, obj)
+		}
+	}
+
+	var result []kates.Object
+	for _, gwc := range classes {
+		if gwc.Spec.ControllerName != ControllerName {
+			continue
+		}
+		status := gwc.Status.DeepCopy()
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               string(gw.GatewayClassConditionStatusAccepted),
+			Status:             metav1.ConditionTrue,
+			Reason:             string(gw.GatewayClassReasonAccepted),
+			ObservedGeneration: gwc.Generation,
+		})
+		if !equality.Semantic.DeepEqual(status, &gwc.Status) {
+			updated := gwc.DeepCopy()
+			updated.Status = *status
+			result = append(result, updated)
+		}
+	}
+
+	for _, gateway := range gateways {
+		status := d.gatewayStatus(ctx, gateway, programmed)
+		if !equality.Semantic.DeepEqual(status, &gateway.Status) {
+			updated := gateway.DeepCopy()
+			updated.Status = *status
+			result = append(result, updated)
+		}
+	}
+
+	for _, obj := range routes {
+		switch route := obj.(type) {
+		case *gw.HTTPRoute:
+			status := d.httpRouteStatus(ctx, route, gateways)
+			if !equality.Semantic.DeepEqual(status, &route.Status) {
+				updated := route.DeepCopy()
+				updated.Status = *status
+				result = append(result, updated)
+			}
+		case *gwv1a2.GRPCRoute:
+			status := d.grpcRouteStatus(ctx, route, gateways)
+			if !equality.Semantic.DeepEqual(status, &route.Status) {
+				updated := route.DeepCopy()
+				updated.Status = *status
+				result = append(result, updated)
+			}
+		case *gwv1a2.TCPRoute:
+			status := d.tcpRouteStatus(ctx, route, gateways)
+			if !equality.Semantic.DeepEqual(status, &route.Status) {
+				updated := route.DeepCopy()
+				updated.Status = *status
+				result = append(result, updated)
+			}
+		case *gwv1a2.TLSRoute:
+			status := d.tlsRouteStatus(ctx, route, gateways)
+			if !equality.Semantic.DeepEqual(status, &route.Status) {
+				updated := route.DeepCopy()
+				updated.Status = *status
+				result = append(result, updated)
+			}
+		}
+	}
+
+	return result
+}
+
+// sortedResourceKeys returns the keys of all the known resources in order so that status
+// computation is deterministic.
+func (d *Dispatcher) sortedResourceKeys() []string {
+	keys := make([]string, 0, len(d.resources))
+	for key := range d.resources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// compiledRoutes returns the CompiledRoutes of every kind.
+func (d *Dispatcher) compiledRoutes() []*CompiledRoute {
+	var result []*CompiledRoute
+	for _, config := range d.sortedConfigs() {
+		result = append(result, config.Routes...)
+	}
+	return result
+}
+
+func (d *Dispatcher) gatewayStatus(ctx context.Context, gateway *gw.Gateway, programmed bool) *gw.GatewayStatus {
+	status := gateway.Status.DeepCopy()
+	generation := gateway.Generation
+
+	// A listener that shares a port with an invalid listener can't be programmed, since all the
+	// Gateway listeners on a port are served by a single envoy listener.
+	badPorts := map[gw.PortNumber]bool{}
+	byPort := map[gw.PortNumber][]gw.Listener{}
+	for _, lst := range gateway.Spec.Listeners {
+		if _, msg := validateListener(lst); msg != "" {
+			badPorts[lst.Port] = true
+		}
+		byPort[lst.Port] = append(byPort[lst.Port], lst)
+	}
+	type conflict struct {
+		reason gw.ListenerConditionReason
+		msg    string
+	}
+	conflicts := map[gw.PortNumber]conflict{}
+	for port, lsts := range byPort {
+		if reason, msg := validatePort(lsts); msg != "" {
+			conflicts[port] = conflict{reason, msg}
+			badPorts[port] = true
+		}
+	}
+	secretMap := d.buildSecretMap()
+
+	routes := d.compiledRoutes()
+	listeners := make([]gw.ListenerStatus, 0, len(gateway.Spec.Listeners))
+	allValid := true
+	for _, lst := range gateway.Spec.Listeners {
+		var conditions []metav1.Condition
+		for _, old := range status.Listeners {
+			if old.Name == lst.Name {
+				conditions = old.Conditions
+				break
+			}
+		}
+
+		if c, ok := conflicts[lst.Port]; ok {
+			allValid = false
+			meta.SetStatusCondition(&conditions, metav1.Condition{
+				Type:               string(gw.ListenerConditionConflicted),
+				Status:             metav1.ConditionTrue,
+				Reason:             string(c.reason),
+				Message:            c.msg,
+				ObservedGeneration: generation,
+			})
+		} else {
+			meta.SetStatusCondition(&conditions, metav1.Condition{
+				Type:               string(gw.ListenerConditionConflicted),
+				Status:             metav1.ConditionFalse,
+				Reason:             string(gw.ListenerReasonNoConflicts),
+				ObservedGeneration: generation,
+			})
+		}
+
+		reason, msg := validateListener(lst)
+		if msg != "" {
+			allValid = false
+			meta.SetStatusCondition(&conditions, metav1.Condition{
+				Type:               string(gw.ListenerConditionAccepted),
+				Status:             metav1.ConditionFalse,
+				Reason:             string(reason),
+				Message:            msg,
+				ObservedGeneration: generation,
+			})
+		} else {
+			meta.SetStatusCondition(&conditions, metav1.Condition{
+				Type:               string(gw.ListenerConditionAccepted),
+				Status:             metav1.ConditionTrue,
+				Reason:             string(gw.ListenerReasonAccepted),
+				ObservedGeneration: generation,
+			})
+		}
+
+		kinds := supportedKinds(lst)
+		refsReason, refsMsg := resolveListenerRefs(gateway, lst, secretMap, newQuery(ctx, d))
+		if lst.AllowedRoutes != nil && len(lst.AllowedRoutes.Kinds) > len(kinds) {
+			meta.SetStatusCondition(&conditions, metav1.Condition{
+				Type:               string(gw.ListenerConditionResolvedRefs),
+				Status:             metav1.ConditionFalse,
+				Reason:             string(gw.ListenerReasonInvalidRouteKinds),
+				Message:            fmt.Sprintf("some route kinds are not supported on %s listeners", lst.Protocol),
+				ObservedGeneration: generation,
+			})
+		} else if refsMsg != "" {
+			meta.SetStatusCondition(&conditions, metav1.Condition{
+				Type:               string(gw.ListenerConditionResolvedRefs),
+				Status:             metav1.ConditionFalse,
+				Reason:             string(refsReason),
+				Message:            refsMsg,
+				ObservedGeneration: generation,
+			})
+		} else {
+			meta.SetStatusCondition(&conditions, metav1.Condition{
+				Type:               string(gw.ListenerConditionResolvedRefs),
+				Status:             metav1.ConditionTrue,
+				Reason:             string(gw.ListenerReasonResolvedRefs),
+				ObservedGeneration: generation,
+			})
+		}
+
+		switch {
+		case badPorts[lst.Port]:
+			meta.SetStatusCondition(&conditions, metav1.Condition{
+				Type:               string(gw.ListenerConditionProgrammed),
+				Status:             metav1.ConditionFalse,
+				Reason:             string(gw.ListenerReasonInvalid),
+				Message:            fmt.Sprintf("port %d has invalid listeners", lst.Port),
+				ObservedGeneration: generation,
+			})
+		case refsMsg != "":
+			meta.SetStatusCondition(&conditions, metav1.Condition{
+				Type:               string(gw.ListenerConditionProgrammed),
+				Status:             metav1.ConditionFalse,
+				Reason:             string(gw.ListenerReasonInvalid),
+				Message:            refsMsg,
+				ObservedGeneration: generation,
+			})
+		case !programmed:
+			meta.SetStatusCondition(&conditions, metav1.Condition{
+				Type:               string(gw.ListenerConditionProgrammed),
+				Status:             metav1.ConditionFalse,
+				Reason:             string(gw.ListenerReasonPending),
+				ObservedGeneration: generation,
+			})
+		default:
+			meta.SetStatusCondition(&conditions, metav1.Condition{
+				Type:               string(gw.ListenerConditionProgrammed),
+				Status:             metav1.ConditionTrue,
+				Reason:             string(gw.ListenerReasonProgrammed),
+				ObservedGeneration: generation,
+			})
+		}
+
+		var attached int32
+		if msg == "" && !badPorts[lst.Port] {
+			for _, route := range routes {
+				if listenerAccepts(gateway, lst, route) && len(intersectHostnames(lst.Hostname, route.Hostnames)) > 0 {
+					attached++
+				}
+			}
+		}
+
+		listeners = append(listeners, gw.ListenerStatus{
+			Name:           lst.Name,
+			SupportedKinds: kinds,
+			AttachedRoutes: attached,
+			Conditions:     conditions,
+		})
+	}
+	status.Listeners = listeners
+
+	if allValid {
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               string(gw.GatewayConditionAccepted),
+			Status:             metav1.ConditionTrue,
+			Reason:             string(gw.GatewayReasonAccepted),
+			ObservedGeneration: generation,
+		})
+	} else {
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               string(gw.GatewayConditionAccepted),
+			Status:             metav1.ConditionFalse,
+			Reason:             string(gw.GatewayReasonListenersNotValid),
+			Message:            "one or more listeners are invalid",
+			ObservedGeneration: generation,
+		})
+	}
+	if programmed {
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               string(gw.GatewayConditionProgrammed),
+			Status:             metav1.ConditionTrue,
+			Reason:             string(gw.GatewayReasonProgrammed),
+			ObservedGeneration: generation,
+		})
+	} else {
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               string(gw.GatewayConditionProgrammed),
+			Status:             metav1.ConditionFalse,
+			Reason:             string(gw.GatewayReasonPending),
+			ObservedGeneration: generation,
+		})
+	}
+
+	return status
+}
+
+// resolveListenerRefs checks that all of a listener's certificateRefs refer to valid Secrets that
+// the dispatcher knows about. It returns the reason for the ResolvedRefs condition along with a
+// message that is empty if all the references were resolved.
+func resolveListenerRefs(gateway *gw.Gateway, lst gw.Listener, secretMap map[string]*v3tls.Secret, q *Query) (gw.ListenerConditionReason, string) {
+	if lst.TLS == nil {
+		return gw.ListenerReasonResolvedRefs, ""
+	}
+	for _, ref := range lst.TLS.CertificateRefs {
+		if reason, msg := validateCertificateRef(gateway, ref, q); msg != "" {
+			return reason, msg
+		}
+		namespace := gateway.Namespace
+		if ref.Namespace != nil {
+			namespace = string(*ref.Namespace)
+		}
+		if _, ok := secretMap[SecretName(namespace, string(ref.Name))]; !ok {
+			return gw.ListenerReasonInvalidCertificateRef, fmt.Sprintf("Secret %s.%s does not exist or is not a valid TLS secret", ref.Name, namespace)
+		}
+	}
+	return gw.ListenerReasonResolvedRefs, ""
+}
+
+// routeStatus computes the status that is common to every kind of route, given the route's kind,
+// namespace, generation, parentRefs, hostnames, and the backendRefs of all of its rules. If
+// unsupported is not empty, it explains why part of the route (e.g. a filter) cannot be
+// implemented, and the route is not accepted. ReferenceGrants are looked up via the Query.
+func routeStatus(
+	q *Query,
+	old *gw.RouteStatus,
+	kind, namespace string,
+	generation int64,
+	parentRefs []gw.ParentReference,
+	hostnames []gw.Hostname,
+	backends []gw.BackendObjectReference,
+	unsupported string,
+	gateways []*gw.Gateway,
+) *gw.RouteStatus {
+	status := old.DeepCopy()
+
+	compiled := &CompiledRoute{
+		CompiledItem: CompiledItem{Namespace: namespace},
+		Kind:         kind,
+		ParentRefs:   parentRefs,
+		Hostnames:    hostnames,
+	}
+
+	resolvedReason, resolvedMsg := gw.RouteReasonResolvedRefs, ""
+	for _, backend := range backends {
+		reason, msg := validateBackendRef(backend)
+		if msg == "" {
+			reason, msg = permitBackendRef(q, kind, namespace, backend)
+		}
+		if msg != "" {
+			resolvedReason, resolvedMsg = reason, msg
+			break
+		}
+	}
+
+	// Parent statuses that belong to other controllers are left untouched.
+	var parents []gw.RouteParentStatus
+	for _, ps := range status.Parents {
+		if ps.ControllerName != ControllerName {
+			parents = append(parents, ps)
+		}
+	}
+
+	for _, ref := range parentRefs {
+		gateway := findParentGateway(ref, namespace, gateways)
+		if gateway == nil {
+			// Not one of ours.
+			continue
+		}
+
+		var conditions []metav1.Condition
+		for _, old := range status.Parents {
+			if old.ControllerName == ControllerName && equality.Semantic.DeepEqual(old.ParentRef, ref) {
+				conditions = old.Conditions
+				break
+			}
+		}
+
+		reason, msg := routeAcceptance(gateway, ref, compiled)
+		if msg == "" && unsupported != "" {
+			reason, msg = gw.RouteReasonUnsupportedValue, unsupported
+		}
+		if msg == "" {
+			meta.SetStatusCondition(&conditions, metav1.Condition{
+				Type:               string(gw.RouteConditionAccepted),
+				Status:             metav1.ConditionTrue,
+				Reason:             string(reason),
+				ObservedGeneration: generation,
+			})
+		} else {
+			meta.SetStatusCondition(&conditions, metav1.Condition{
+				Type:               string(gw.RouteConditionAccepted),
+				Status:             metav1.ConditionFalse,
+				Reason:             string(reason),
+				Message:            msg,
+				ObservedGeneration: generation,
+			})
+		}
+
+		if resolvedMsg == "" {
+			meta.SetStatusCondition(&conditions, metav1.Condition{
+				Type:               string(gw.RouteConditionResolvedRefs),
+				Status:             metav1.ConditionTrue,
+				Reason:             string(resolvedReason),
+				ObservedGeneration: generation,
+			})
+		} else {
+			meta.SetStatusCondition(&conditions, metav1.Condition{
+				Type:               string(gw.RouteConditionResolvedRefs),
+				Status:             metav1.ConditionFalse,
+				Reason:             string(resolvedReason),
+				Message:            resolvedMsg,
+				ObservedGeneration: generation,
+			})
+		}
+
+		parents = append(parents, gw.RouteParentStatus{
+			ParentRef:      ref,
+			ControllerName: ControllerName,
+			Conditions:     conditions,
+		})
+	}
+	status.Parents = parents
+
+	return status
+}
+
+func (d *Dispatcher) httpRouteStatus(ctx context.Context, route *gw.HTTPRoute, gateways []*gw.Gateway) *gw.HTTPRouteStatus {
+	var backends []gw.BackendObjectReference
+	for _, rule := range route.Spec.Rules {
+		for _, backend := range rule.BackendRefs {
+			backends = append(backends, backend.BackendObjectReference)
+		}
+		for _, filter := range rule.Filters {
+			if filter.RequestMirror != nil {
+				backends = append(backends, filter.RequestMirror.BackendRef)
+			}
+		}
+	}
+	_, unsupported := validateHTTPRouteFilters(route)
+	status := routeStatus(newQuery(ctx, d), &route.Status.RouteStatus, "HTTPRoute", route.Namespace, route.Generation,
+		route.Spec.ParentRefs, route.Spec.Hostnames, backends, unsupported, gateways)
+	return &gw.HTTPRouteStatus{RouteStatus: *status}
+}
+
+func (d *Dispatcher) grpcRouteStatus(ctx context.Context, route *gwv1a2.GRPCRoute, gateways []*gw.Gateway) *gwv1a2.GRPCRouteStatus {
+	var backends []gw.BackendObjectReference
+	unsupported := ""
+	for _, rule := range route.Spec.Rules {
+		if len(rule.Filters) > 0 {
+			unsupported = "GRPCRoute filters are not supported"
+		}
+		for _, backend := range rule.BackendRefs {
+			backends = append(backends, backend.BackendObjectReference)
+		}
+	}
+	status := routeStatus(newQuery(ctx, d), &route.Status.RouteStatus, "GRPCRoute", route.Namespace, route.Generation,
+		route.Spec.ParentRefs, route.Spec.Hostnames, backends, unsupported, gateways)
+	return &gwv1a2.GRPCRouteStatus{RouteStatus: *status}
+}
+
+func (d *Dispatcher) tcpRouteStatus(ctx context.Context, route *gwv1a2.TCPRoute, gateways []*gw.Gateway) *gwv1a2.TCPRouteStatus {
+	var backends []gw.BackendObjectReference
+	for _, rule := range route.Spec.Rules {
+		for _, backend := range rule.BackendRefs {
+			backends = append(backends, backend.BackendObjectReference)
+		}
+	}
+	status := routeStatus(newQuery(ctx, d), &route.Status.RouteStatus, "TCPRoute", route.Namespace, route.Generation,
+		route.Spec.ParentRefs, nil, backends, "", gateways)
+	return &gwv1a2.TCPRouteStatus{RouteStatus: *status}
+}
+
+func (d *Dispatcher) tlsRouteStatus(ctx context.Context, route *gwv1a2.TLSRoute, gateways []*gw.Gateway) *gwv1a2.TLSRouteStatus {
+	var backends []gw.BackendObjectReference
+	for _, rule := range route.Spec.Rules {
+		for _, backend := range rule.BackendRefs {
+			backends = append(backends, backend.BackendObjectReference)
+		}
+	}
+	status := routeStatus(newQuery(ctx, d), &route.Status.RouteStatus, "TLSRoute", route.Namespace, route.Generation,
+		route.Spec.ParentRefs, route.Spec.Hostnames, backends, "", gateways)
+	return &gwv1a2.TLSRouteStatus{RouteStatus: *status}
+}
+
+// findParentGateway returns the Gateway that the parentRef points to, or nil if the parentRef
+// doesn't refer to a Gateway that we know about.
+func findParentGateway(ref gw.ParentReference, routeNamespace string, gateways []*gw.Gateway) *gw.Gateway {
+	if ref.Group != nil && *ref.Group != gw.GroupName {
+		return nil
+	}
+	if ref.Kind != nil && *ref.Kind != "Gateway" {
+		return nil
+	}
+	namespace := routeNamespace
+	if ref.Namespace != nil {
+		namespace = string(*ref.Namespace)
+	}
+	for _, gateway := range gateways {
+		if gateway.Namespace == namespace && gateway.Name == string(ref.Name) {
+			return gateway
+		}
+	}
+	return nil
+}
+
+// routeAcceptance determines whether the route is accepted by any of the listeners of the gateway
+// selected by the parentRef. It returns the reason for the Accepted condition along with a message
+// that is empty if the route was accepted.
+func routeAcceptance(gateway *gw.Gateway, ref gw.ParentReference, route *CompiledRoute) (gw.RouteConditionReason, string) {
+	var candidates []gw.Listener
+	for _, lst := range gateway.Spec.Listeners {
+		if _, msg := validateListener(lst); msg != "" {
+			continue
+		}
+		if parentRefMatches(ref, route.Namespace, gateway, lst) {
+			candidates = append(candidates, lst)
+		}
+	}
+	if len(candidates) == 0 {
+		return gw.RouteReasonNoMatchingParent, "no valid listener matches the parentRef"
+	}
+
+	var allowed []gw.Listener
+	for _, lst := range candidates {
+		if listenerAllows(gateway, lst, route) {
+			allowed = append(allowed, lst)
+		}
+	}
+	if len(allowed) == 0 {
+		return gw.RouteReasonNotAllowedByListeners, "the route is not allowed by any matching listener"
+	}
+
+	for _, lst := range allowed {
+		if len(intersectHostnames(lst.Hostname, route.Hostnames)) > 0 {
+			return gw.RouteReasonAccepted, ""
+		}
+	}
+	return gw.RouteReasonNoMatchingListenerHostname, "no matching listener hostname"
+}
@@ -0,0 +1,172 @@
+package gateway_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gw "sigs.k8s.io/gateway-api/apis/v1"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+)
+
+func TestGatewayStatus(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	require.NoError(t, d.UpsertYaml(ctx, `
+---
+kind: GatewayClass
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: emissary
+spec:
+  controllerName: getambassador.io/gateway-controller
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+  generation: 3
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: http
+    protocol: HTTP
+    port: 8080
+    hostname: "*.foo.com"
+  - name: udp
+    protocol: UDP
+    port: 9090
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: good-route
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  hostnames:
+  - www.foo.com
+  rules:
+  - backendRefs:
+    - name: foo-backend
+      port: 9000
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: bad-hostname
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  - name: someone-elses-gateway
+  hostnames:
+  - bar.com
+  rules:
+  - backendRefs:
+    - name: foo-backend
+      kind: Widget
+      port: 9000
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: bad-filter
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  hostnames:
+  - api.foo.com
+  rules:
+  - filters:
+    - type: ExtensionRef
+      extensionRef:
+        group: example.com
+        kind: Thing
+        name: thing
+    backendRefs:
+    - name: foo-backend
+      port: 9000
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: cross-namespace
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  hostnames:
+  - www.foo.com
+  rules:
+  - backendRefs:
+    - name: foo-backend
+      namespace: other
+      port: 9000
+`))
+
+	statuses := d.GetStatuses(ctx)
+	objs := map[string]kates.Object{}
+	for _, obj := range statuses {
+		objs[obj.GetObjectKind().GroupVersionKind().Kind+"/"+obj.GetName()] = obj
+	}
+	require.Len(t, objs, 6)
+
+	gwc := objs["GatewayClass/emissary"].(*gw.GatewayClass)
+	assert.True(t, meta.IsStatusConditionTrue(gwc.Status.Conditions, string(gw.GatewayClassConditionStatusAccepted)))
+
+	gtw := objs["Gateway/my-gateway"].(*gw.Gateway)
+	accepted := meta.FindStatusCondition(gtw.Status.Conditions, string(gw.GatewayConditionAccepted))
+	require.NotNil(t, accepted)
+	assert.Equal(t, metav1.ConditionFalse, accepted.Status)
+	assert.Equal(t, int64(3), accepted.ObservedGeneration)
+	require.Len(t, gtw.Status.Listeners, 2)
+	assert.Equal(t, int32(3), gtw.Status.Listeners[0].AttachedRoutes)
+	assert.True(t, meta.IsStatusConditionTrue(gtw.Status.Listeners[0].Conditions, string(gw.ListenerConditionProgrammed)))
+	udpAccepted := meta.FindStatusCondition(gtw.Status.Listeners[1].Conditions, string(gw.ListenerConditionAccepted))
+	require.NotNil(t, udpAccepted)
+	assert.Equal(t, string(gw.ListenerReasonUnsupportedProtocol), udpAccepted.Reason)
+
+	good := objs["HTTPRoute/good-route"].(*gw.HTTPRoute)
+	require.Len(t, good.Status.Parents, 1)
+	assert.True(t, meta.IsStatusConditionTrue(good.Status.Parents[0].Conditions, string(gw.RouteConditionAccepted)))
+	assert.True(t, meta.IsStatusConditionTrue(good.Status.Parents[0].Conditions, string(gw.RouteConditionResolvedRefs)))
+
+	bad := objs["HTTPRoute/bad-hostname"].(*gw.HTTPRoute)
+	require.Len(t, bad.Status.Parents, 1)
+	badAccepted := meta.FindStatusCondition(bad.Status.Parents[0].Conditions, string(gw.RouteConditionAccepted))
+	require.NotNil(t, badAccepted)
+	assert.Equal(t, string(gw.RouteReasonNoMatchingListenerHostname), badAccepted.Reason)
+	badRefs := meta.FindStatusCondition(bad.Status.Parents[0].Conditions, string(gw.RouteConditionResolvedRefs))
+	require.NotNil(t, badRefs)
+	assert.Equal(t, string(gw.RouteReasonInvalidKind), badRefs.Reason)
+
+	badFilter := objs["HTTPRoute/bad-filter"].(*gw.HTTPRoute)
+	require.Len(t, badFilter.Status.Parents, 1)
+	filterAccepted := meta.FindStatusCondition(badFilter.Status.Parents[0].Conditions, string(gw.RouteConditionAccepted))
+	require.NotNil(t, filterAccepted)
+	assert.Equal(t, metav1.ConditionFalse, filterAccepted.Status)
+	assert.Equal(t, string(gw.RouteReasonUnsupportedValue), filterAccepted.Reason)
+
+	cross := objs["HTTPRoute/cross-namespace"].(*gw.HTTPRoute)
+	require.Len(t, cross.Status.Parents, 1)
+	crossRefs := meta.FindStatusCondition(cross.Status.Parents[0].Conditions, string(gw.RouteConditionResolvedRefs))
+	require.NotNil(t, crossRefs)
+	assert.Equal(t, metav1.ConditionFalse, crossRefs.Status)
+	assert.Equal(t, string(gw.RouteReasonRefNotPermitted), crossRefs.Reason)
+
+	// Once the computed status has been written back, there is nothing left to update.
+	for _, obj := range statuses {
+		require.NoError(t, d.Upsert(ctx, obj))
+	}
+	assert.Empty(t, d.GetStatuses(ctx))
+}
@@ -3,6 +3,7 @@ package kates
 import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	xv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -56,9 +57,11 @@ type Event = corev1.Event
 type ConfigMap = corev1.ConfigMap
 
 type Secret = corev1.Secret
+type SecretType = corev1.SecretType
 
 const SecretTypeServiceAccountToken = corev1.SecretTypeServiceAccountToken
 const SecretTypeTLS = corev1.SecretTypeTLS
+const SecretTypeOpaque = corev1.SecretTypeOpaque
 
 type Service = corev1.Service
 type ServiceSpec = corev1.ServiceSpec
@@ -68,6 +71,20 @@ type EndpointSubset = corev1.EndpointSubset
 type EndpointAddress = corev1.EndpointAddress
 type EndpointPort = corev1.EndpointPort
 
+type EndpointSlice = discoveryv1.EndpointSlice
+type EndpointSliceEndpoint = discoveryv1.Endpoint
+type EndpointSlicePort = discoveryv1.EndpointPort
+type EndpointConditions = discoveryv1.EndpointConditions
+type EndpointHints = discoveryv1.EndpointHints
+type ForZone = discoveryv1.ForZone
+type AddressType = discoveryv1.AddressType
+
+var AddressTypeIPv4 = discoveryv1.AddressTypeIPv4
+var AddressTypeIPv6 = discoveryv1.AddressTypeIPv6
+var AddressTypeFQDN = discoveryv1.AddressTypeFQDN
+
+const LabelServiceName = discoveryv1.LabelServiceName
+
 type Protocol = corev1.Protocol
 
 var ProtocolTCP = corev1.ProtocolTCP
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/pflag"
 
 	// k8s libraries
@@ -39,6 +40,7 @@ import (
 
 	"github.com/datawire/dlib/dlog"
 	kates_internal "github.com/emissary-ingress/emissary/v3/pkg/kates_internal"
+	"github.com/emissary-ingress/emissary/v3/pkg/metrics"
 )
 
 // The Client struct provides an interface to interact with the kubernetes api-server. You can think
@@ -377,6 +379,11 @@ func (c *Client) Watch(ctx context.Context, queries ...Query) (*Accumulator, err
 
 // ==
 
+var watchErrors = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+	Name: "emissary_kates_watch_errors_total",
+	Help: "Number of errors watching Kubernetes resources, by kind.",
+}, []string{"kind"})
+
 func (c *Client) watchRaw(ctx context.Context, query Query, target chan rawUpdate, cli dynamic.ResourceInterface) {
 	var informer cache.SharedInformer
 
@@ -389,33 +396,36 @@ func (c *Client) watchRaw(ctx context.Context, query Query, target chan rawUpdat
 		}
 	})
 	informer = cache.NewSharedInformer(lw, &Unstructured{}, 5*time.Minute)
-	// TODO: uncomment this when we get to kubernetes 1.19. Right now errors will get logged by
-	// klog. With this error handler in place we will log them to our own logger and provide a
-	// more useful error message:
-	/*
-		informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
-			// This is from client-go/tools/cache/reflector.go:563
-			isExpiredError := func(err error) bool {
-				// In Kubernetes 1.17 and earlier, the api server returns both apierrors.StatusReasonExpired and
-				// apierrors.StatusReasonGone for HTTP 410 (Gone) status code responses. In 1.18 the kube server is more consistent
-				// and always returns apierrors.StatusReasonExpired. For backward compatibility we can only remove the apierrors.IsGone
-				// check when we fully drop support for Kubernetes 1.17 servers from reflectors.
-				return apierrors.IsResourceExpired(err) || apierrors.IsGone(err)
-			}
+	// Log watch errors to our own logger with a more useful error message than klog would, and
+	// count them so that they can be alerted on.
+	err := informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		// This is from client-go/tools/cache/reflector.go:563
+		isExpiredError := func(err error) bool {
+			// In Kubernetes 1.17 and earlier, the api server returns both apierrors.StatusReasonExpired and
+			// apierrors.StatusReasonGone for HTTP 410 (Gone) status code responses. In 1.18 the kube server is more consistent
+			// and always returns apierrors.StatusReasonExpired. For backward compatibility we can only remove the apierrors.IsGone
+			// check when we fully drop support for Kubernetes 1.17 servers from reflectors.
+			return apierrors.IsResourceExpired(err) || apierrors.IsGone(err)
+		}
 
-			switch {
-			case isExpiredError(err):
-				log.Printf("Watch of %s closed with: %v", query.Kind, err)
-			case err == io.EOF:
-				// watch closed normally
-			case err == io.ErrUnexpectedEOF:
-				log.Printf("Watch for %s closed with unexpected EOF: %v", query.Kind, err)
-			default:
-				log.Printf("Failed to watch %s: %v", query.Kind, err)
-			}
-		})
-	*/
-	_, err := informer.AddEventHandler(
+		switch {
+		case isExpiredError(err):
+			// The informer just relists, so this isn't really an error.
+			dlog.Debugf(ctx, "Watch of %s closed with: %v", query.Kind, err)
+		case err == io.EOF:
+			// watch closed normally
+		case err == io.ErrUnexpectedEOF:
+			watchErrors.WithLabelValues(query.Kind).Inc()
+			dlog.Warnf(ctx, "Watch for %s closed with unexpected EOF: %v", query.Kind, err)
+		default:
+			watchErrors.WithLabelValues(query.Kind).Inc()
+			dlog.Errorf(ctx, "Failed to watch %s: %v", query.Kind, err)
+		}
+	})
+	if err != nil {
+		dlog.Errorf(ctx, "error setting watch error handler, %s", err)
+	}
+	_, err = informer.AddEventHandler(
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
 				// This is for testing. It allows us to deliberately increase the probability of
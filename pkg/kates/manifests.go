@@ -12,7 +12,9 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/kubernetes/scheme"
-	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
+	gw "sigs.k8s.io/gateway-api/apis/v1"
+	gwv1a2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
+	gwv1b1 "sigs.k8s.io/gateway-api/apis/v1beta1"
 	"sigs.k8s.io/yaml"
 
 	amb "github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io/v3alpha1"
@@ -33,6 +35,12 @@ func init() {
 	if err := gw.AddToScheme(sch); err != nil {
 		panic(err) // panic is ok in init() I guess
 	}
+	if err := gwv1a2.AddToScheme(sch); err != nil {
+		panic(err) // panic is ok in init() I guess
+	}
+	if err := gwv1b1.AddToScheme(sch); err != nil {
+		panic(err) // panic is ok in init() I guess
+	}
 }
 
 func NewObject(kind, version string) (Object, error) {
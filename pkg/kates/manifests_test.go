@@ -5,7 +5,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
+	gw "sigs.k8s.io/gateway-api/apis/v1"
 
 	amb "github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io/v3alpha1"
 )
@@ -95,59 +95,60 @@ func TestGatewayResources(t *testing.T) {
 const gatewayResources = `
 ---
 kind: GatewayClass
-apiVersion: networking.x-k8s.io/v1alpha1
+apiVersion: gateway.networking.k8s.io/v1
 metadata:
   name: acme-lb
 spec:
-  controller: acme.io/gateway-controller
+  controllerName: acme.io/gateway-controller
   parametersRef:
     name: acme-lb
     group: acme.io
     kind: Parameters
 ---
 kind: Gateway
-apiVersion: networking.x-k8s.io/v1alpha1
+apiVersion: gateway.networking.k8s.io/v1
 metadata:
   name: my-gateway
 spec:
   gatewayClassName: acme-lb
-  listeners:  # Use GatewayClass defaults for listener definition.
-  - protocol: HTTP
+  listeners:
+  - name: http
+    protocol: HTTP
     port: 80
-    routes:
-      kind: HTTPRoute
-      selector:
-        matchLabels:
-          app: foo
+    allowedRoutes:
+      kinds:
+      - kind: HTTPRoute
       namespaces:
         from: "Same"
 ---
 kind: HTTPRoute
-apiVersion: networking.x-k8s.io/v1alpha1
+apiVersion: gateway.networking.k8s.io/v1
 metadata:
   name: http-app-1
   labels:
     app: foo
 spec:
+  parentRefs:
+  - name: my-gateway
   hostnames:
   - "foo.com"
   rules:
   - matches:
     - path:
-        type: Prefix
+        type: PathPrefix
         value: /bar
-    forwardTo:
-    - serviceName: my-service1
+    backendRefs:
+    - name: my-service1
       port: 8080
   - matches:
     - headers:
-        type: Exact
-        values:
-          magic: foo
+      - type: Exact
+        name: magic
+        value: foo
       path:
-        type: Prefix
+        type: PathPrefix
         value: /some/thing
-    forwardTo:
-    - serviceName: my-service2
+    backendRefs:
+    - name: my-service2
       port: 8080
 `
@@ -14,8 +14,26 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+
 	"github.com/datawire/dlib/dlog"
 	"github.com/emissary-ingress/emissary/v3/pkg/debug"
+	"github.com/emissary-ingress/emissary/v3/pkg/metrics"
+)
+
+var (
+	usageBytes = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Name: "emissary_memory_usage_bytes",
+		Help: "Memory used by the cgroup Emissary runs in.",
+	})
+	limitBytes = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Name: "emissary_memory_limit_bytes",
+		Help: "Memory limit of the cgroup Emissary runs in, or 0 if there is no limit.",
+	})
+	usagePercent = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Name: "emissary_memory_usage_percent",
+		Help: "Memory used by the cgroup Emissary runs in, as a percentage of its limit.",
+	})
 )
 
 // The Watch method will check memory usage every 10 seconds and log it if it jumps more than 10Gi
@@ -85,7 +103,7 @@ func (m *MemoryUsage) maybeDo(now time.Time, f func()) {
 // The GetMemoryUsage function returns MemoryUsage info for the entire cgroup.
 func GetMemoryUsage(ctx context.Context) *MemoryUsage {
 	usage, limit := readUsage(ctx)
-	return &MemoryUsage{
+	result := &MemoryUsage{
 		usage:      usage,
 		limit:      limit,
 		perProcess: readPerProcess(ctx),
@@ -93,6 +111,8 @@ func GetMemoryUsage(ctx context.Context) *MemoryUsage {
 		readUsage:      readUsage,
 		readPerProcess: readPerProcess,
 	}
+	result.updateMetrics()
+	return result
 }
 
 // The MemoryUsage struct to holds memory usage and memory limit information about a cgroup.
@@ -161,6 +181,19 @@ func (m *MemoryUsage) Refresh(ctx context.Context) {
 		// Overwrite any old process info with new/updated process info.
 		m.perProcess[pid] = usage
 	}
+
+	m.updateMetrics()
+}
+
+// Export the usage as metrics. This must be called with the mutex held.
+func (m *MemoryUsage) updateMetrics() {
+	usageBytes.Set(float64(m.usage))
+	if m.limit == unlimited {
+		limitBytes.Set(0)
+	} else {
+		limitBytes.Set(float64(m.limit))
+	}
+	usagePercent.Set(float64(m.percentUsed()))
 }
 
 // If there is no cgroups memory limit then the value in
@@ -0,0 +1,76 @@
+// Package metrics exports Prometheus metrics for the Go side of Emissary: the watcher, ambex, the
+// ambex ratelimiter, Consul and Kubernetes watches, memory usage, and apiext.
+//
+// Packages define their own metrics with the Factory, e.g.
+//
+//	var snapshotsSkipped = metrics.Factory.NewCounter(prometheus.CounterOpts{
+//		Name: "emissary_ambex_snapshots_skipped_total",
+//		Help: "Number of ambex updates skipped because nothing changed.",
+//	})
+//
+// and they get served by Handler (or WriteText) along with the Go runtime and process metrics.
+// Every debug.Timer that's attached to a Debug passed to ObserveTimers is exported as well.
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/emissary-ingress/emissary/v3/pkg/debug"
+)
+
+// Registry holds all of our metrics. We don't use the prometheus.DefaultRegisterer, so that only
+// the metrics we define ourselves are exported, and not whatever our dependencies register there.
+var Registry = prometheus.NewRegistry()
+
+// Factory creates metrics that are registered with the Registry.
+var Factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler returns an http.Handler that serves all the metrics in the Registry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// WriteText writes all the metrics in the Registry to w in the Prometheus text format. This is
+// for when the metrics have to be served along with metrics from somewhere else.
+func WriteText(w io.Writer) error {
+	families, err := Registry.Gather()
+	if err != nil {
+		return err
+	}
+	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, family := range families {
+		if err := enc.Encode(family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var timerSeconds = Factory.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "emissary_timer_duration_seconds",
+	Help:    "Time taken by the actions timed by the debug timers, by timer name.",
+	Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+}, []string{"timer"})
+
+// ObserveTimers exports the timings of all the timers in dbg as the
+// emissary_timer_duration_seconds histogram.
+func ObserveTimers(dbg *debug.Debug) {
+	dbg.SetTimerObserver(func(name string, elapsed time.Duration) {
+		timerSeconds.WithLabelValues(name).Observe(elapsed.Seconds())
+	})
+}
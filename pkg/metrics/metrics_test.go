@@ -0,0 +1,31 @@
+package metrics_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emissary-ingress/emissary/v3/pkg/debug"
+	"github.com/emissary-ingress/emissary/v3/pkg/metrics"
+)
+
+func TestObserveTimers(t *testing.T) {
+	clock := time.Now()
+	dbg := debug.NewDebugWithClock(func() time.Time {
+		return clock
+	})
+	metrics.ObserveTimers(dbg)
+
+	dbg.Timer("testTimer").Time(func() {
+		clock = clock.Add(250 * time.Millisecond)
+	})
+
+	var buf bytes.Buffer
+	require.NoError(t, metrics.WriteText(&buf))
+	assert.Contains(t, buf.String(), `emissary_timer_duration_seconds_count{timer="testTimer"} 1`)
+	assert.Contains(t, buf.String(), `emissary_timer_duration_seconds_sum{timer="testTimer"} 0.25`)
+	assert.Contains(t, buf.String(), "go_goroutines ")
+}
@@ -6,7 +6,9 @@ import (
 	amb "github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io/v3alpha1"
 	"github.com/emissary-ingress/emissary/v3/pkg/consulwatch"
 	"github.com/emissary-ingress/emissary/v3/pkg/kates"
-	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
+	gw "sigs.k8s.io/gateway-api/apis/v1"
+	gwv1a2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
+	gwv1b1 "sigs.k8s.io/gateway-api/apis/v1beta1"
 )
 
 const ApiVersion = "v1"
@@ -56,10 +58,11 @@ type ConsulSnapshot struct {
 
 type KubernetesSnapshot struct {
 	// k8s resources
-	IngressClasses []*IngressClass    `json:"ingressclasses"`
-	Ingresses      []*Ingress         `json:"ingresses"`
-	Services       []*kates.Service   `json:"service"`
-	Endpoints      []*kates.Endpoints `json:"Endpoints"`
+	IngressClasses []*IngressClass        `json:"ingressclasses"`
+	Ingresses      []*Ingress             `json:"ingresses"`
+	Services       []*kates.Service       `json:"service"`
+	Endpoints      []*kates.Endpoints     `json:"Endpoints"`
+	EndpointSlices []*kates.EndpointSlice `json:"-"` // only used for endpoint routing, so not posted to diagd
 
 	// ambassador resources
 	Listeners   []*amb.Listener   `json:"Listener"`
@@ -85,6 +88,11 @@ type KubernetesSnapshot struct {
 	GatewayClasses []*gw.GatewayClass
 	Gateways       []*gw.Gateway
 	HTTPRoutes     []*gw.HTTPRoute
+	GRPCRoutes     []*gwv1a2.GRPCRoute
+	TCPRoutes      []*gwv1a2.TCPRoute
+	TLSRoutes      []*gwv1a2.TLSRoute
+
+	ReferenceGrants []*gwv1b1.ReferenceGrant
 
 	// It is safe to ignore AmbassadorInstallation, ambassador doesn't need to look at those, just
 	// the operator.
@@ -0,0 +1,402 @@
+// Package snapshotdir manages the numbered snapshot files that ambex and diagd keep for debugging,
+// e.g. ambex-1.json, ambex-2.json, ... where ambex-1.json is the newest.
+//
+// Older snapshots can be compressed (ambex-2.json.gz, ambex-2.json.zst), and can be stored as a
+// JSON Patch (RFC 6902) against the next newer snapshot (ambex-2.json.patch, which turns the
+// contents of ambex-1.json into the contents of ambex-2.json). Because the patches go from newer
+// to older, the newest snapshot is always stored in full, and the oldest snapshots can be deleted
+// without breaking anything. diagd writes its snapshot-#.yaml files in the same format, except
+// that its newest snapshot is snapshot.yaml rather than snapshot-1.yaml.
+package snapshotdir
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/klauspost/compress/zstd"
+	createpatch "gomodules.xyz/jsonpatch/v2"
+
+	"github.com/datawire/dlib/dlog"
+)
+
+// Compression is how snapshot files are compressed.
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+const patchSuffix = ".patch"
+
+// suffix returns the filename suffix for files compressed with c.
+func (c Compression) suffix() string {
+	switch c {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// Options controls how many snapshots are kept, and how.
+type Options struct {
+	// Count is the number of snapshots to keep. If it's 0, no snapshots are written at all.
+	Count int
+	// Compression is how to compress every snapshot except the newest.
+	Compression Compression
+	// MaxBytes, if nonzero, is the most disk space the snapshots may use. The oldest snapshots
+	// are deleted to stay under it, but the newest snapshot is always kept.
+	MaxBytes int64
+	// Deltas says to store every snapshot except the newest as a patch against the next newer
+	// one.
+	Deltas bool
+}
+
+// OptionsFromEnv reads the Options from the environment variables ${prefix}_COUNT,
+// ${prefix}_COMPRESSION, ${prefix}_MAX_BYTES and ${prefix}_DELTAS. Invalid values are logged and
+// ignored.
+func OptionsFromEnv(ctx context.Context, prefix string, defaultCount int) Options {
+	opts := Options{
+		Count:       defaultCount,
+		Compression: CompressionNone,
+	}
+
+	if str := os.Getenv(prefix + "_COUNT"); str != "" {
+		count, err := strconv.Atoi(str)
+		if err != nil || count < 0 {
+			dlog.Errorf(ctx, "Invalid %s_COUNT: %s, using %d", prefix, str, defaultCount)
+		} else {
+			opts.Count = count
+		}
+	}
+
+	if str := os.Getenv(prefix + "_COMPRESSION"); str != "" {
+		switch c := Compression(strings.ToLower(str)); c {
+		case CompressionNone, CompressionGzip, CompressionZstd:
+			opts.Compression = c
+		default:
+			dlog.Errorf(ctx, "Invalid %s_COMPRESSION: %s, using %s", prefix, str, opts.Compression)
+		}
+	}
+
+	if str := os.Getenv(prefix + "_MAX_BYTES"); str != "" {
+		maxBytes, err := strconv.ParseInt(str, 10, 64)
+		if err != nil || maxBytes < 0 {
+			dlog.Errorf(ctx, "Invalid %s_MAX_BYTES: %s, not limiting snapshot size", prefix, str)
+		} else {
+			opts.MaxBytes = maxBytes
+		}
+	}
+
+	if str := os.Getenv(prefix + "_DELTAS"); str != "" {
+		deltas, err := strconv.ParseBool(str)
+		if err != nil {
+			dlog.Errorf(ctx, "Invalid %s_DELTAS: %s, storing full snapshots", prefix, str)
+		} else {
+			opts.Deltas = deltas
+		}
+	}
+
+	return opts
+}
+
+// A snapshotFile is the name of a snapshot file, broken down into its parts. For
+// "ambex-2.json.patch.gz", that's "ambex", 2, ".json", true, ".gz".
+type snapshotFile struct {
+	name       string
+	generation int
+	ext        string
+	patch      bool
+	compressed string
+}
+
+// generation 0 is the unnumbered file that diagd uses for its newest snapshot.
+var snapshotFileRE = regexp.MustCompile(`^(.+?)(?:-(\d+))?(\.[^.]+)(\.patch)?(\.gz|\.zst)?$`)
+
+func parseFilename(filename string) (snapshotFile, bool) {
+	match := snapshotFileRE.FindStringSubmatch(filename)
+	if match == nil {
+		return snapshotFile{}, false
+	}
+	f := snapshotFile{
+		name:       match[1],
+		ext:        match[3],
+		patch:      match[4] != "",
+		compressed: match[5],
+	}
+	if match[2] != "" {
+		f.generation, _ = strconv.Atoi(match[2])
+	}
+	return f, true
+}
+
+func (f snapshotFile) String() string {
+	var b strings.Builder
+	b.WriteString(f.name)
+	if f.generation > 0 {
+		fmt.Fprintf(&b, "-%d", f.generation)
+	}
+	b.WriteString(f.ext)
+	if f.patch {
+		b.WriteString(patchSuffix)
+	}
+	b.WriteString(f.compressed)
+	return b.String()
+}
+
+// listGenerations finds all the snapshot files in dir for name and ext, by generation. If there's
+// more than one file for a generation (because the options changed), full snapshots win over
+// patches, and the rest end up in extra.
+func listGenerations(dir, name, ext string) (files map[int]snapshotFile, extra []snapshotFile, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	files = map[int]snapshotFile{}
+	for _, entry := range entries {
+		f, ok := parseFilename(entry.Name())
+		if !ok || f.name != name || f.ext != ext || entry.IsDir() {
+			continue
+		}
+		if existing, ok := files[f.generation]; ok {
+			if existing.patch && !f.patch {
+				existing, f = f, existing
+			}
+			files[f.generation] = existing
+			extra = append(extra, f)
+			continue
+		}
+		files[f.generation] = f
+	}
+	return files, extra, nil
+}
+
+// Write stores contents as the newest snapshot, dir/name-1ext, renumbering the older snapshots and
+// deleting the ones that are too old or don't fit in opts.MaxBytes.
+func Write(ctx context.Context, dir, name, ext string, contents []byte, opts Options) error {
+	if opts.Count <= 0 {
+		return nil
+	}
+
+	files, extra, err := listGenerations(dir, name, ext)
+	if err != nil {
+		return err
+	}
+	for _, f := range extra {
+		_ = os.Remove(filepath.Join(dir, f.String()))
+	}
+
+	generations := make([]int, 0, len(files))
+	for gen := range files {
+		if gen > 0 {
+			generations = append(generations, gen)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(generations)))
+
+	// The current newest snapshot is going to become the second newest, so if we're storing
+	// deltas, it needs to turn into a patch against the new one.
+	var previousPatch []byte
+	if prev, ok := files[1]; ok && opts.Deltas && opts.Count > 1 && !prev.patch {
+		previous, err := readFile(filepath.Join(dir, prev.String()), prev)
+		if err == nil {
+			previousPatch, err = createPatch(contents, previous)
+		}
+		if err != nil {
+			dlog.Warnf(ctx, "unable to store %s as a delta: %v", prev, err)
+			previousPatch = nil
+		}
+	}
+
+	for _, gen := range generations {
+		from := files[gen]
+		to := from
+		to.generation = gen + 1
+		fromPath := filepath.Join(dir, from.String())
+
+		switch {
+		case to.generation > opts.Count:
+			err = os.Remove(fromPath)
+		case gen == 1 && previousPatch != nil:
+			to.patch = true
+			to.compressed = opts.Compression.suffix()
+			if err = writeFile(filepath.Join(dir, to.String()), previousPatch, opts.Compression); err == nil {
+				err = os.Remove(fromPath)
+			}
+		case gen == 1 && from.compressed != opts.Compression.suffix():
+			to.compressed = opts.Compression.suffix()
+			var data []byte
+			if data, err = readFile(fromPath, from); err == nil {
+				if err = writeFile(filepath.Join(dir, to.String()), data, opts.Compression); err == nil {
+					err = os.Remove(fromPath)
+				}
+			}
+		default:
+			err = os.Rename(fromPath, filepath.Join(dir, to.String()))
+		}
+		if err != nil && !os.IsNotExist(err) {
+			dlog.Infof(ctx, "could not rotate snapshot %s: %v", fromPath, err)
+		}
+	}
+
+	newest := snapshotFile{name: name, generation: 1, ext: ext}
+	if err := writeFile(filepath.Join(dir, newest.String()), contents, CompressionNone); err != nil {
+		return err
+	}
+
+	if opts.MaxBytes > 0 {
+		enforceMaxBytes(ctx, dir, name, ext, opts.MaxBytes)
+	}
+	return nil
+}
+
+// enforceMaxBytes deletes the oldest snapshots until the rest fit in maxBytes, always keeping the
+// newest one.
+func enforceMaxBytes(ctx context.Context, dir, name, ext string, maxBytes int64) {
+	files, _, err := listGenerations(dir, name, ext)
+	if err != nil {
+		return
+	}
+	generations := make([]int, 0, len(files))
+	for gen := range files {
+		generations = append(generations, gen)
+	}
+	sort.Ints(generations)
+
+	var total int64
+	for i, gen := range generations {
+		path := filepath.Join(dir, files[gen].String())
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		total += info.Size()
+		if total > maxBytes && i > 0 {
+			dlog.Debugf(ctx, "snapshot %s doesn't fit in %d bytes, removing it", path, maxBytes)
+			if err := os.Remove(path); err != nil {
+				dlog.Infof(ctx, "could not remove snapshot %s: %v", path, err)
+			}
+		}
+	}
+}
+
+// writeFile writes data to path, going through a temporary file so that nobody reading the
+// snapshots sees half of one.
+func writeFile(path string, data []byte, compression Compression) error {
+	switch compression {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	case CompressionZstd:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return err
+		}
+		data = enc.EncodeAll(data, nil)
+		enc.Close()
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ReadFile returns the contents of a snapshot, decompressing it and applying patches as needed.
+func ReadFile(path string) ([]byte, error) {
+	f, ok := parseFilename(filepath.Base(path))
+	if !ok {
+		return os.ReadFile(path)
+	}
+	return readFile(path, f)
+}
+
+func readFile(path string, f snapshotFile) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch f.compressed {
+	case ".gz":
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	case ".zst":
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		data, err = dec.DecodeAll(data, nil)
+		dec.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if !f.patch {
+		return data, nil
+	}
+
+	if f.generation == 0 {
+		return nil, fmt.Errorf("%s: the newest snapshot can't be a patch", path)
+	}
+	dir := filepath.Dir(path)
+	files, _, err := listGenerations(dir, f.name, f.ext)
+	if err != nil {
+		return nil, err
+	}
+	newer, ok := files[f.generation-1]
+	if !ok {
+		return nil, fmt.Errorf("%s: is a patch against %s-%d%s, which is missing", path, f.name, f.generation-1, f.ext)
+	}
+	base, err := readFile(filepath.Join(dir, newer.String()), newer)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := jsonpatch.DecodePatch(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	result, err := patch.Apply(base)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return result, nil
+}
+
+// createPatch returns a JSON Patch that turns from into to.
+func createPatch(from, to []byte) ([]byte, error) {
+	ops, err := createpatch.CreatePatch(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ops)
+}
@@ -0,0 +1,130 @@
+package snapshotdir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/dlib/dlog"
+)
+
+func snapshotContents(i int) []byte {
+	// Big enough that the patches and compression actually save something.
+	clusters := make([]string, 50)
+	for j := range clusters {
+		clusters[j] = fmt.Sprintf(`{"name": "cluster_%d", "connect_timeout": "%ds"}`, j, j+i)
+	}
+	return []byte(fmt.Sprintf(`{"version": "v%d", "clusters": [%s]}`, i, strings.Join(clusters, ", ")))
+}
+
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestWrite(t *testing.T) {
+	testcases := map[string]struct {
+		opts  Options
+		files []string
+	}{
+		"plain": {
+			opts:  Options{Count: 3},
+			files: []string{"ambex-1.json", "ambex-2.json", "ambex-3.json"},
+		},
+		"gzip": {
+			opts:  Options{Count: 3, Compression: CompressionGzip},
+			files: []string{"ambex-1.json", "ambex-2.json.gz", "ambex-3.json.gz"},
+		},
+		"zstd-deltas": {
+			opts:  Options{Count: 3, Compression: CompressionZstd, Deltas: true},
+			files: []string{"ambex-1.json", "ambex-2.json.patch.zst", "ambex-3.json.patch.zst"},
+		},
+		"deltas": {
+			opts:  Options{Count: 4, Deltas: true},
+			files: []string{"ambex-1.json", "ambex-2.json.patch", "ambex-3.json.patch", "ambex-4.json.patch"},
+		},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			ctx := dlog.NewTestContext(t, false)
+			dir := t.TempDir()
+			for i := 1; i <= 5; i++ {
+				require.NoError(t, Write(ctx, dir, "ambex", ".json", snapshotContents(i), tc.opts))
+			}
+			assert.Equal(t, tc.files, listFiles(t, dir))
+
+			for _, file := range tc.files {
+				f, ok := parseFilename(file)
+				require.True(t, ok)
+				contents, err := ReadFile(filepath.Join(dir, file))
+				require.NoError(t, err)
+				assert.JSONEq(t, string(snapshotContents(6-f.generation)), string(contents), file)
+			}
+		})
+	}
+}
+
+func TestWriteOptionsChange(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	dir := t.TempDir()
+	for i := 1; i <= 2; i++ {
+		require.NoError(t, Write(ctx, dir, "ambex", ".json", snapshotContents(i), Options{Count: 5}))
+	}
+	for i := 3; i <= 4; i++ {
+		require.NoError(t, Write(ctx, dir, "ambex", ".json", snapshotContents(i), Options{Count: 5, Compression: CompressionGzip, Deltas: true}))
+	}
+	require.NoError(t, Write(ctx, dir, "ambex", ".json", snapshotContents(5), Options{Count: 5}))
+
+	assert.Equal(t, []string{"ambex-1.json", "ambex-2.json", "ambex-3.json.patch.gz", "ambex-4.json.patch.gz", "ambex-5.json"}, listFiles(t, dir))
+	for i := 1; i <= 5; i++ {
+		contents, err := ReadFile(filepath.Join(dir, listFiles(t, dir)[i-1]))
+		require.NoError(t, err)
+		assert.JSONEq(t, string(snapshotContents(6-i)), string(contents))
+	}
+}
+
+func TestWriteMaxBytes(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	dir := t.TempDir()
+	size := int64(len(snapshotContents(1)))
+
+	opts := Options{Count: 10, MaxBytes: 3*size + size/2}
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, Write(ctx, dir, "ambex", ".json", snapshotContents(i), opts))
+	}
+	assert.Equal(t, []string{"ambex-1.json", "ambex-2.json", "ambex-3.json"}, listFiles(t, dir))
+
+	// The newest snapshot is kept no matter what.
+	opts.MaxBytes = 1
+	require.NoError(t, Write(ctx, dir, "ambex", ".json", snapshotContents(6), opts))
+	assert.Equal(t, []string{"ambex-1.json"}, listFiles(t, dir))
+}
+
+func TestReadFileDiagd(t *testing.T) {
+	// diagd's newest snapshot is unnumbered, and the next one is a patch against it.
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "snapshot.yaml"), []byte(`{"a": 1, "b": [1, 2]}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "snapshot-1.yaml.patch"), []byte(`[{"op": "replace", "path": "/a", "value": 2}]`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "snapshot-2.yaml.patch"), []byte(`[{"op": "remove", "path": "/b/1"}]`), 0644))
+
+	contents, err := ReadFile(filepath.Join(dir, "snapshot-2.yaml.patch"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"a": 2, "b": [1]}`, string(contents))
+
+	_, err = ReadFile(filepath.Join(dir, "snapshot-4.yaml.patch"))
+	assert.Error(t, err)
+}
@@ -78,6 +78,7 @@ from ambassador.utils import (
     parse_bool,
     parse_json,
 )
+from ambassador_diag.snapshotdir import SnapshotDir, SnapshotOptions
 from ambassador_diag.templates import TEMPLATE_PATH
 
 __version__ = Version
@@ -1675,41 +1676,35 @@ class AmbassadorEventWatcher(threading.Thread):
             )
             return
 
-        snapcount = int(os.environ.get("AMBASSADOR_SNAPSHOT_COUNT", "4"))
-        snaplist: List[Tuple[str, str]] = []
+        snapfmts = ["aconf{}.json", "econf{}.json", "ir{}.json", "snapshot{}.yaml"]
+        snapdir = SnapshotDir(self.logger, app.snapshot_path, SnapshotOptions.from_env(self.logger))
 
-        if snapcount > 0:
+        if snapdir.opts.count > 0:
             self.logger.debug("rotating snapshots for snapshot %s" % snapshot)
 
-            # If snapcount is 4, this range statement becomes range(-4, -1)
-            # which gives [ -4, -3, -2 ], which the list comprehension turns
-            # into [ ( "-3", "-4" ), ( "-2", "-3" ), ( "-1", "-2" ) ]...
-            # which is the list of suffixes to rename to rotate the snapshots.
+        # Make sure we don't leave this method on error! The reconfiguration
+        # timer is still running, but also, the snapshots are a debugging aid:
+        # if we can't rotate them, meh, whatever. SnapshotDir takes care of that,
+        # and of compressing the older snapshots and storing them as deltas if
+        # $AMBASSADOR_SNAPSHOT_COMPRESSION or $AMBASSADOR_SNAPSHOT_DELTAS say to.
+        for fmt in snapfmts:
+            snapdir.rotate(fmt)
 
-            snaplist += [(str(x + 1), str(x)) for x in range(-1 * snapcount, -1)]
-
-            # After dealing with that, we need to rotate the current file into -1.
-            snaplist.append(("", "-1"))
-
-        # Whether or not we do any rotation, we need to cycle in the '-tmp' file.
-        snaplist.append(("-tmp", ""))
-
-        for from_suffix, to_suffix in snaplist:
-            for fmt in ["aconf{}.json", "econf{}.json", "ir{}.json", "snapshot{}.yaml"]:
-                from_path = os.path.join(app.snapshot_path, fmt.format(from_suffix))
-                to_path = os.path.join(app.snapshot_path, fmt.format(to_suffix))
+            # Whether or not we do any rotation, we need to cycle in the '-tmp' file.
+            from_path = os.path.join(app.snapshot_path, fmt.format("-tmp"))
+            to_path = os.path.join(app.snapshot_path, fmt.format(""))
 
-                # Make sure we don't leave this method on error! The reconfiguration
-                # timer is still running, but also, the snapshots are a debugging aid:
-                # if we can't rotate them, meh, whatever.
+            try:
+                self.logger.debug("rotate: %s -> %s" % (from_path, to_path))
+                os.rename(from_path, to_path)
+            except IOError as e:
+                self.logger.debug("skip %s -> %s: %s" % (from_path, to_path, e))
+            except Exception as e:
+                self.logger.debug("could not rename %s -> %s: %s" % (from_path, to_path, e))
 
-                try:
-                    self.logger.debug("rotate: %s -> %s" % (from_path, to_path))
-                    os.rename(from_path, to_path)
-                except IOError as e:
-                    self.logger.debug("skip %s -> %s: %s" % (from_path, to_path, e))
-                except Exception as e:
-                    self.logger.debug("could not rename %s -> %s: %s" % (from_path, to_path, e))
+        # If $AMBASSADOR_SNAPSHOT_MAX_BYTES is set, drop the oldest snapshots until
+        # the rest fit.
+        snapdir.enforce_max_bytes(snapfmts)
 
         app.latest_snapshot = snapshot
         self.logger.debug("saving Envoy configuration for snapshot %s" % snapshot)
@@ -0,0 +1,254 @@
+# Rotation of the snapshots that diagd keeps in its snapshot directory (snapshot.yaml,
+# snapshot-1.yaml, ..., and likewise for aconf, econf and ir). The newest one is always the
+# unnumbered, uncompressed file. Older ones can be compressed (snapshot-2.yaml.gz,
+# snapshot-2.yaml.zst) and stored as a JSON Patch against the next newer one
+# (snapshot-2.yaml.patch turns snapshot-1.yaml into snapshot-2.yaml). This is the same format
+# that ambex uses for its ambex-#.json snapshots; see the Go snapshotdir package, which can read
+# these back in (e.g. for `busyambassador snapdiff`).
+
+import gzip
+import json
+import logging
+import os
+from typing import Callable, List, Optional
+
+import jsonpatch
+
+from ambassador.utils import parse_bool
+
+Compressor = Callable[[bytes], bytes]
+
+# diagd builds a new SnapshotDir for every snapshot, so remember whether we've already said that
+# zstd isn't there rather than saying it on every reconfigure.
+_warned_no_zstd = False
+
+
+def _zstd_compressor() -> Optional[Compressor]:
+    # zstandard is one of our dependencies, but fall back to the standard library's zstd (Python
+    # 3.14 and later) in case it's missing.
+    try:
+        import zstandard  # type: ignore
+
+        return zstandard.ZstdCompressor().compress
+    except ImportError:
+        pass
+
+    try:
+        from compression import zstd  # type: ignore
+
+        return zstd.compress
+    except ImportError:
+        return None
+
+
+class SnapshotOptions:
+    """
+    How many snapshots to keep, and how. See SnapshotOptions.from_env for the knobs.
+    """
+
+    def __init__(
+        self, count: int, compression: str = "none", max_bytes: int = 0, deltas: bool = False
+    ) -> None:
+        self.count = count
+        self.compression = compression
+        self.max_bytes = max_bytes
+        self.deltas = deltas
+
+    @classmethod
+    def from_env(
+        cls, logger: logging.Logger, prefix: str = "AMBASSADOR_SNAPSHOT", default_count: int = 4
+    ) -> "SnapshotOptions":
+        opts = cls(default_count)
+
+        count = os.environ.get(f"{prefix}_COUNT", "")
+        if count:
+            try:
+                opts.count = max(int(count), 0)
+            except ValueError:
+                logger.error(f"Invalid {prefix}_COUNT: {count}, using {default_count}")
+
+        compression = os.environ.get(f"{prefix}_COMPRESSION", "").lower()
+        if compression:
+            if compression in ("none", "gzip", "zstd"):
+                opts.compression = compression
+            else:
+                logger.error(f"Invalid {prefix}_COMPRESSION: {compression}, using none")
+
+        max_bytes = os.environ.get(f"{prefix}_MAX_BYTES", "")
+        if max_bytes:
+            try:
+                opts.max_bytes = max(int(max_bytes), 0)
+            except ValueError:
+                logger.error(f"Invalid {prefix}_MAX_BYTES: {max_bytes}, not limiting snapshot size")
+
+        opts.deltas = parse_bool(os.environ.get(f"{prefix}_DELTAS", "false"))
+
+        return opts
+
+
+class SnapshotDir:
+    """
+    SnapshotDir rotates the snapshots in a directory according to a SnapshotOptions.
+    """
+
+    SUFFIXES = [
+        patch + compressed for patch in ("", ".patch") for compressed in ("", ".gz", ".zst")
+    ]
+
+    def __init__(self, logger: logging.Logger, path: str, opts: SnapshotOptions) -> None:
+        self.logger = logger
+        self.path = path
+        self.opts = opts
+
+        self.compress: Optional[Compressor] = None
+        self.compressed_suffix = ""
+
+        if opts.compression == "zstd":
+            self.compress = _zstd_compressor()
+            self.compressed_suffix = ".zst"
+
+            if not self.compress:
+                global _warned_no_zstd
+
+                if not _warned_no_zstd:
+                    self.logger.warning("zstd is not available, compressing snapshots with gzip")
+                    _warned_no_zstd = True
+
+                opts.compression = "gzip"
+
+        if opts.compression == "gzip":
+            self.compress = gzip.compress
+            self.compressed_suffix = ".gz"
+
+    def _name(self, fmt: str, generation: int, suffix: str = "") -> str:
+        return os.path.join(self.path, fmt.format(f"-{generation}" if generation else "") + suffix)
+
+    def _find(self, fmt: str, generation: int) -> List[str]:
+        # Full snapshots come first, so if the options changed and there's more than one file
+        # for a generation, we'll prefer the full one.
+        return [
+            suffix
+            for suffix in self.SUFFIXES
+            if os.path.exists(self._name(fmt, generation, suffix))
+        ]
+
+    def _write(self, path: str, data: bytes) -> None:
+        if self.compress:
+            data = self.compress(data)
+
+        with open(path + ".tmp", "wb") as output:
+            output.write(data)
+
+        os.rename(path + ".tmp", path)
+
+    def rotate(self, fmt: str) -> None:
+        """
+        Rotate the snapshots for fmt (e.g. "snapshot{}.yaml") one step: snapshot-1.yaml becomes
+        snapshot-2.yaml and so on, and snapshot.yaml becomes snapshot-1.yaml. snapshot-tmp.yaml,
+        if it's there, is the snapshot that's about to replace snapshot.yaml, and is left alone.
+        """
+
+        count = self.opts.count
+
+        if count <= 0:
+            return
+
+        for generation in range(count, 0, -1):
+            suffixes = self._find(fmt, generation)
+
+            for extra in suffixes[1:]:
+                self._remove(self._name(fmt, generation, extra))
+
+            if not suffixes:
+                continue
+
+            from_path = self._name(fmt, generation, suffixes[0])
+
+            if generation == count:
+                self._remove(from_path)
+            else:
+                self._rename(from_path, self._name(fmt, generation + 1, suffixes[0]))
+
+        current = self._name(fmt, 0)
+
+        if not os.path.exists(current):
+            return
+
+        try:
+            with open(current, "rb") as input:
+                data = input.read()
+
+            suffix = ""
+
+            if self.opts.deltas and (count > 1):
+                patch = self._patch(fmt, data)
+
+                if patch is not None:
+                    data = patch
+                    suffix = ".patch"
+
+            if suffix or self.compress:
+                self._write(self._name(fmt, 1, suffix + self.compressed_suffix), data)
+                self._remove(current)
+            else:
+                self._rename(current, self._name(fmt, 1))
+        except Exception as e:
+            self.logger.debug("could not rotate %s: %s" % (current, e))
+
+    def _patch(self, fmt: str, data: bytes) -> Optional[bytes]:
+        # The current snapshot is about to be replaced by the -tmp one, so it becomes a patch
+        # against that.
+        newer = os.path.join(self.path, fmt.format("-tmp"))
+
+        try:
+            with open(newer, "rb") as input:
+                newer_obj = json.load(input)
+
+            patch = jsonpatch.make_patch(newer_obj, json.loads(data))
+
+            return patch.to_string().encode("utf-8")
+        except Exception as e:
+            self.logger.debug("could not store %s as a delta: %s" % (self._name(fmt, 0), e))
+            return None
+
+    def enforce_max_bytes(self, fmts: List[str]) -> None:
+        """
+        Delete the oldest generations of snapshots until all the snapshots for fmts fit in
+        max_bytes. The newest generation is always kept.
+        """
+
+        if self.opts.max_bytes <= 0:
+            return
+
+        total = 0
+
+        for generation in range(0, self.opts.count + 1):
+            paths = [
+                self._name(fmt, generation, suffix)
+                for fmt in fmts
+                for suffix in self._find(fmt, generation)
+            ]
+
+            for path in paths:
+                total += os.path.getsize(path)
+
+            if (generation > 0) and (total > self.opts.max_bytes):
+                for path in paths:
+                    self.logger.debug(
+                        "snapshot %s doesn't fit in %d bytes, removing it"
+                        % (path, self.opts.max_bytes)
+                    )
+                    self._remove(path)
+
+    def _rename(self, from_path: str, to_path: str) -> None:
+        try:
+            self.logger.debug("rotate: %s -> %s" % (from_path, to_path))
+            os.rename(from_path, to_path)
+        except Exception as e:
+            self.logger.debug("could not rename %s -> %s: %s" % (from_path, to_path, e))
+
+    def _remove(self, path: str) -> None:
+        try:
+            os.remove(path)
+        except Exception as e:
+            self.logger.debug("could not remove %s: %s" % (path, e))
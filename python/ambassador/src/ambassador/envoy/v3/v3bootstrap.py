@@ -1,11 +1,14 @@
+import ipaddress
 import os
-from typing import TYPE_CHECKING, Optional, Tuple
+import re
+from typing import TYPE_CHECKING, Any, Dict, Optional, Tuple
 from typing import cast as typecast
 from urllib.parse import urlparse
 
 from ...ir.ircluster import IRCluster
 from ...ir.irlogservice import IRLogService
 from ...ir.irtracing import IRTracing
+from ...utils import SystemInfo, parse_bool
 from .v3cluster import V3Cluster
 
 if TYPE_CHECKING:
@@ -15,16 +18,26 @@ if TYPE_CHECKING:
 class V3Bootstrap(dict):
     def __init__(self, config: "V3Config") -> None:
         api_version = "V3"
+
+        # With AMBASSADOR_XDS_DELTA, Envoy uses incremental xDS, so that ambex only has to send
+        # the resources that changed rather than every resource of a type. ambex reads the same
+        # variable.
+        api_type = "GRPC"
+        if parse_bool(os.environ.get("AMBASSADOR_XDS_DELTA", "false")):
+            api_type = "DELTA_GRPC"
+
         super().__init__(
             **{
                 "node": {
                     "cluster": config.ir.ambassador_nodename,
-                    "id": "test-id",  # MUST BE test-id, see below
+                    # The pod name, so that ambex can tell Envoys apart. diagd overrides this with
+                    # --service-node when it validates.
+                    "id": SystemInfo.MyHostName,
                 },
                 "static_resources": {},  # Filled in later
                 "dynamic_resources": {
                     "ads_config": {
-                        "api_type": "GRPC",
+                        "api_type": api_type,
                         "transport_api_version": api_version,
                         "grpc_services": [{"envoy_grpc": {"cluster_name": "xds_cluster"}}],
                     },
@@ -32,40 +45,11 @@ class V3Bootstrap(dict):
                     "lds_config": {"ads": {}, "resource_api_version": api_version},
                 },
                 "admin": dict(config.admin),
-                "layered_runtime": dict(config.layered_runtime),
+                "layered_runtime": config.layered_runtime.bootstrap_layers(),
             }
         )
 
-        clusters = [
-            {
-                "name": "xds_cluster",
-                "connect_timeout": "1s",
-                "dns_lookup_family": "V4_ONLY",
-                "http2_protocol_options": {},
-                "lb_policy": "ROUND_ROBIN",
-                "load_assignment": {
-                    "cluster_name": "cluster_127_0_0_1_8003",
-                    "endpoints": [
-                        {
-                            "lb_endpoints": [
-                                {
-                                    "endpoint": {
-                                        "address": {
-                                            "socket_address": {
-                                                # this should be kept in-sync with entrypoint.sh `ambex --ads-listen-address=...`
-                                                "address": "127.0.0.1",
-                                                "port_value": 8003,
-                                                "protocol": "TCP",
-                                            }
-                                        }
-                                    }
-                                }
-                            ]
-                        }
-                    ],
-                },
-            }
-        ]
+        clusters = [xds_cluster(config)]
 
         if config.tracing:
             self["tracing"] = dict(config.tracing)
@@ -127,3 +111,96 @@ class V3Bootstrap(dict):
 def split_host_port(value: str) -> Tuple[Optional[str], int]:
     parsed = urlparse("//" + value)
     return parsed.hostname, int(parsed.port or 80)
+
+
+def xds_cluster(config: "V3Config") -> Dict[str, Any]:
+    """
+    The cluster that Envoy reaches ambex's ADS server through. This has to agree with how the
+    entrypoint starts ambex: AMBASSADOR_AMBEX_ADS_ADDRESS is where ambex listens (host:port, or
+    unix:/path for a unix socket), and the AMBASSADOR_AMBEX_ADS_TLS_* variables say whether it
+    wants TLS or mTLS.
+    """
+
+    address = os.environ.get("AMBASSADOR_AMBEX_ADS_ADDRESS", "") or "127.0.0.1:8003"
+
+    cluster: Dict[str, Any] = {
+        "name": "xds_cluster",
+        "connect_timeout": "1s",
+        "dns_lookup_family": "V4_ONLY",
+        "http2_protocol_options": {},
+        "lb_policy": "ROUND_ROBIN",
+    }
+
+    # The hostname to send as SNI, if ambex is reached by name.
+    server_name: Optional[str] = None
+
+    if address.startswith("unix:"):
+        socket_address: Dict[str, Any] = {"pipe": {"path": address[len("unix:") :]}}
+    else:
+        host, port = split_host_port(address)
+
+        socket_address = {
+            "socket_address": {
+                "address": host or "127.0.0.1",
+                "port_value": port,
+                "protocol": "TCP",
+            }
+        }
+
+        try:
+            ipaddress.ip_address(host or "127.0.0.1")
+        except ValueError:
+            cluster["type"] = "STRICT_DNS"
+            server_name = host
+
+    cluster["load_assignment"] = {
+        "cluster_name": "cluster_" + re.sub(r"[^0-9A-Za-z]+", "_", address).strip("_"),
+        "endpoints": [{"lb_endpoints": [{"endpoint": {"address": socket_address}}]}],
+    }
+
+    cert = os.environ.get("AMBASSADOR_AMBEX_ADS_TLS_CERT", "")
+
+    if cert:
+        # Envoy checks ambex's certificate against AMBASSADOR_AMBEX_ADS_TLS_CA, which can be left
+        # out if ambex's certificate is self-signed.
+        common_tls_context: Dict[str, Any] = {
+            "alpn_protocols": ["h2"],
+            "validation_context": {
+                "trusted_ca": {
+                    "filename": os.environ.get("AMBASSADOR_AMBEX_ADS_TLS_CA", "") or cert
+                }
+            },
+        }
+
+        if os.environ.get("AMBASSADOR_AMBEX_ADS_TLS_CLIENT_CA", ""):
+            # ambex wants a client certificate too.
+            envoy_cert = os.environ.get("AMBASSADOR_AMBEX_ADS_TLS_ENVOY_CERT", "")
+            envoy_key = os.environ.get("AMBASSADOR_AMBEX_ADS_TLS_ENVOY_KEY", "")
+
+            if envoy_cert and envoy_key:
+                common_tls_context["tls_certificates"] = [
+                    {
+                        "certificate_chain": {"filename": envoy_cert},
+                        "private_key": {"filename": envoy_key},
+                    }
+                ]
+            else:
+                config.ir.logger.error(
+                    "AMBASSADOR_AMBEX_ADS_TLS_CLIENT_CA is set, but AMBASSADOR_AMBEX_ADS_TLS_ENVOY_CERT "
+                    + "and AMBASSADOR_AMBEX_ADS_TLS_ENVOY_KEY aren't, so Envoy can't connect to ambex"
+                )
+
+        tls_context: Dict[str, Any] = {
+            "@type": "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext",
+            "common_tls_context": common_tls_context,
+        }
+
+        if server_name:
+            tls_context["sni"] = server_name
+
+        cluster["transport_socket"] = {
+            "name": "envoy.transport_sockets.tls",
+            "typed_config": tls_context,
+        }
+
+    return cluster
@@ -12,11 +12,15 @@
 # See the License for the specific language governing permissions and
 # limitations under the License
 
-from typing import TYPE_CHECKING
+from typing import TYPE_CHECKING, Any, Dict
 
 if TYPE_CHECKING:
     from . import V3Config  # pragma: no cover
 
+# The name of the RTDS layer that ambex serves. This must match RuntimeLayerName in
+# pkg/ambex/runtime.go.
+AMBEX_RUNTIME_LAYER = "ambex_runtime"
+
 
 class V3Runtime(dict):
     def __init__(self, config: "V3Config") -> None:
@@ -85,7 +89,55 @@ class V3Runtime(dict):
                         f"value: {use_rapid_reset_goaway} is invalid for Module field envoy.restart_features.send_goaway_for_premature_rst_streams. This field must be true/false"
                     )
 
-        self.update({"layers": [{"name": "static_layer", "static_layer": static_runtime_layer}]})
+        # runtime_overrides aren't baked into the bootstrap: ambex serves them to Envoy over RTDS,
+        # along with anything set through ambex's runtime API, so changing them doesn't need an
+        # Envoy restart.
+        runtime_overrides: Dict[str, Any] = {}
+        user_overrides = config.ir.ambassador_module.get("runtime_overrides", None)
+        if user_overrides:
+            if isinstance(user_overrides, dict):
+                for key, value in user_overrides.items():
+                    if isinstance(key, str) and key and isinstance(value, (bool, int, float, str)):
+                        runtime_overrides[key] = value
+                    else:
+                        config.ir.logger.error(
+                            f"value: {value} is invalid for Module field runtime_overrides.{key}. must be a string, number or boolean"
+                        )
+            else:
+                config.ir.logger.error(
+                    f"value: {user_overrides} is invalid for Module field runtime_overrides. must be a dictionary"
+                )
+
+        # This is the layered_runtime that ambex sees: it picks the runtime_overrides out of the
+        # layer named AMBEX_RUNTIME_LAYER. The bootstrap that Envoy sees gets an RTDS layer in its
+        # place; see bootstrap_layers.
+        self.update(
+            {
+                "layers": [
+                    {"name": "static_layer", "static_layer": static_runtime_layer},
+                    {"name": AMBEX_RUNTIME_LAYER, "static_layer": runtime_overrides},
+                ]
+            }
+        )
+
+    def bootstrap_layers(self) -> Dict[str, Any]:
+        """
+        The layered_runtime for the Envoy bootstrap, where the runtime_overrides layer is fetched
+        from ambex over RTDS.
+        """
+
+        return {
+            "layers": [
+                self["layers"][0],
+                {
+                    "name": AMBEX_RUNTIME_LAYER,
+                    "rtds_layer": {
+                        "name": AMBEX_RUNTIME_LAYER,
+                        "rtds_config": {"ads": {}, "resource_api_version": "V3"},
+                    },
+                },
+            ]
+        }
 
     @classmethod
     def generate(cls, config: "V3Config") -> None:
@@ -414,12 +414,21 @@ class ResourceFetcher:
             "endpoints": normalized_endpoints,
         }
 
+        rkey = f"consul-{name}-{spec['datacenter']}"
+
+        # A ConsulResolver that filters instances by tags or metadata hands us its own subset of
+        # the service, which needs its own key.
+        subset = consul_object.get("Subset")
+
+        if subset:
+            rkey += f"-{subset}"
+
         self.manager.emit(
             NormalizedResource.from_data(
                 "Service",
                 name,
                 spec=spec,
-                rkey=f"consul-{name}-{spec['datacenter']}",
+                rkey=rkey,
             )
         )
 
@@ -62,6 +62,7 @@ class IRAmbassador(IRResource):
         "regex_type",
         "resolver",
         "runtime_flags",
+        "runtime_overrides",
         "error_response_overrides",
         "header_case_overrides",
         "server_name",
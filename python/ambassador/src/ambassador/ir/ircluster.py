@@ -104,6 +104,15 @@ class IRCluster(IRResource):
         # Toss in the original service before we mess with it, too.
         name_fields.append(service)
 
+        # If the resolver is a ConsulResolver that picks out a subset of the service's
+        # instances, different subsets need different clusters.
+        resolver_ir = ir.get_resolver(
+            resolver or ir.ambassador_module.get("resolver", "kubernetes-service")
+        )
+
+        if resolver_ir and resolver_ir.consul_subset:
+            name_fields.append(resolver_ir.consul_subset)
+
         # If we have a ctx_name, does it match a real context?
         if ctx_name:
             if ctx_name is True:
@@ -69,6 +69,19 @@ class IRServiceResolver(IRResource):
 
         return True
 
+    @property
+    def consul_subset(self) -> Optional[str]:
+        # A ConsulResolver that filters its service instances by tags or metadata selects its
+        # own subset of them, which is named after the resolver. This has to match what the
+        # Go side does when it watches Consul.
+        if self.kind != "ConsulResolver":
+            return None
+
+        if not self.get("tags") and not self.get("meta"):
+            return None
+
+        return self.name
+
     def valid_mapping(self, ir: "IR", mapping: "IRBaseMapping") -> bool:
         fn = {
             "KubernetesServiceResolver": self._k8s_svc_valid_mapping,
@@ -190,7 +203,12 @@ class IRServiceResolver(IRResource):
         # We ignore the port in the lookup (we should've already posted a warning about the port
         # being present, actually).
 
-        return self.get_endpoints(ir, f"consul-{svc_name}-{self.datacenter}", None)
+        key = f"consul-{svc_name}-{self.datacenter}"
+
+        if self.consul_subset:
+            key += f"-{self.consul_subset}"
+
+        return self.get_endpoints(ir, key, None)
 
     def get_endpoints(self, ir: "IR", key: str, port: Optional[int]) -> Optional[SvcEndpointSet]:
         # OK. Do we have a Service by this key?
@@ -310,11 +328,16 @@ class IRServiceResolver(IRResource):
         # For Consul, we look things up with the service name and the datacenter at present.
         # We ignore the port in the lookup (we should've already posted a warning about the port
         # being present, actually).
+        endpoint_path = "consul/%s/%s" % (self.datacenter, svc_name)
+
+        if self.consul_subset:
+            endpoint_path += "/%s" % self.consul_subset
+
         return {
             "service": svc_name,
             "datacenter": self.datacenter,
             "kind": self.kind,
-            "endpoint_path": "consul/%s/%s" % (self.datacenter, svc_name),
+            "endpoint_path": endpoint_path,
         }
 
 
@@ -239,7 +239,7 @@ custom_tags:
         traceId = trace["traceId"]
         assert len(traceId) == 32
         for t in self.results[102].json[0]:
-            if t.get("tags", {}).get("node_id") == "test-id":
+            if t.get("tags", {}).get("node_id"):
                 assert "ltag" in t["tags"]
                 assert t["tags"]["ltag"] == "lvalue"
                 assert "etag" in t["tags"]
@@ -0,0 +1,70 @@
+import pytest
+
+from tests.utils import default_listener_manifests, econf_compile
+
+
+def xds_cluster(econf):
+    clusters = econf["bootstrap"]["static_resources"]["clusters"]
+    return next(cluster for cluster in clusters if cluster["name"] == "xds_cluster")
+
+
+def xds_address(cluster):
+    return cluster["load_assignment"]["endpoints"][0]["lb_endpoints"][0]["endpoint"]["address"]
+
+
+@pytest.mark.compilertest
+def test_xds_cluster_default(monkeypatch):
+    monkeypatch.delenv("AMBASSADOR_AMBEX_ADS_ADDRESS", raising=False)
+    monkeypatch.delenv("AMBASSADOR_AMBEX_ADS_TLS_CERT", raising=False)
+
+    cluster = xds_cluster(econf_compile(default_listener_manifests()))
+
+    assert xds_address(cluster) == {
+        "socket_address": {"address": "127.0.0.1", "port_value": 8003, "protocol": "TCP"}
+    }
+    assert "transport_socket" not in cluster
+
+
+@pytest.mark.compilertest
+def test_xds_cluster_tls(monkeypatch):
+    monkeypatch.setenv("AMBASSADOR_AMBEX_ADS_ADDRESS", "ambex.default:8443")
+    monkeypatch.setenv("AMBASSADOR_AMBEX_ADS_TLS_CERT", "/ads/tls.crt")
+    monkeypatch.setenv("AMBASSADOR_AMBEX_ADS_TLS_CA", "/ads/ca.crt")
+    monkeypatch.delenv("AMBASSADOR_AMBEX_ADS_TLS_CLIENT_CA", raising=False)
+
+    cluster = xds_cluster(econf_compile(default_listener_manifests()))
+
+    assert cluster["type"] == "STRICT_DNS"
+    assert xds_address(cluster)["socket_address"]["address"] == "ambex.default"
+    assert xds_address(cluster)["socket_address"]["port_value"] == 8443
+
+    tls_context = cluster["transport_socket"]["typed_config"]
+    assert tls_context["sni"] == "ambex.default"
+    assert tls_context["common_tls_context"]["validation_context"] == {
+        "trusted_ca": {"filename": "/ads/ca.crt"}
+    }
+    assert "tls_certificates" not in tls_context["common_tls_context"]
+
+
+@pytest.mark.compilertest
+def test_xds_cluster_mtls(monkeypatch):
+    monkeypatch.setenv("AMBASSADOR_AMBEX_ADS_ADDRESS", "unix:/run/ambex/ads.sock")
+    monkeypatch.setenv("AMBASSADOR_AMBEX_ADS_TLS_CERT", "/ads/tls.crt")
+    monkeypatch.delenv("AMBASSADOR_AMBEX_ADS_TLS_CA", raising=False)
+    monkeypatch.setenv("AMBASSADOR_AMBEX_ADS_TLS_CLIENT_CA", "/ads/client-ca.crt")
+    monkeypatch.setenv("AMBASSADOR_AMBEX_ADS_TLS_ENVOY_CERT", "/envoy/tls.crt")
+    monkeypatch.setenv("AMBASSADOR_AMBEX_ADS_TLS_ENVOY_KEY", "/envoy/tls.key")
+
+    cluster = xds_cluster(econf_compile(default_listener_manifests()))
+
+    assert xds_address(cluster) == {"pipe": {"path": "/run/ambex/ads.sock"}}
+
+    # Without a CA, ambex's certificate is taken to be self-signed.
+    common_tls_context = cluster["transport_socket"]["typed_config"]["common_tls_context"]
+    assert common_tls_context["validation_context"] == {"trusted_ca": {"filename": "/ads/tls.crt"}}
+    assert common_tls_context["tls_certificates"] == [
+        {
+            "certificate_chain": {"filename": "/envoy/tls.crt"},
+            "private_key": {"filename": "/envoy/tls.key"},
+        }
+    ]
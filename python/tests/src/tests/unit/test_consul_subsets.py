@@ -0,0 +1,90 @@
+import pytest
+
+from tests.utils import default_listener_manifests, econf_compile
+
+CONSUL_SUBSET_MANIFESTS = """
+---
+apiVersion: getambassador.io/v3alpha1
+kind: ConsulResolver
+metadata:
+  name: consul-dc1
+  namespace: default
+spec:
+  address: consul-server:8500
+  datacenter: dc1
+---
+apiVersion: getambassador.io/v3alpha1
+kind: ConsulResolver
+metadata:
+  name: consul-canary
+  namespace: default
+spec:
+  address: consul-server:8500
+  datacenter: dc1
+  tags:
+  - canary
+---
+apiVersion: getambassador.io/v3alpha1
+kind: ConsulResolver
+metadata:
+  name: consul-v2
+  namespace: default
+spec:
+  address: consul-server:8500
+  datacenter: dc1
+  meta:
+    version: v2
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: myservice-all
+  namespace: default
+spec:
+  hostname: "*"
+  prefix: /all/
+  service: myservice
+  resolver: consul-dc1
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: myservice-stable
+  namespace: default
+spec:
+  hostname: "*"
+  prefix: /myservice/
+  service: myservice
+  resolver: consul-v2
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: myservice-canary
+  namespace: default
+spec:
+  hostname: "*"
+  prefix: /myservice/
+  service: myservice
+  resolver: consul-canary
+  weight: 10
+"""
+
+
+@pytest.mark.compilertest
+def test_consul_subsets():
+    econf = econf_compile(default_listener_manifests() + CONSUL_SUBSET_MANIFESTS)
+
+    eds_service_names = sorted(
+        cluster["eds_cluster_config"]["service_name"]
+        for cluster in econf["static_resources"]["clusters"]
+        if cluster.get("eds_cluster_config")
+    )
+
+    # An unfiltered ConsulResolver keeps the usual endpoint path; each filtering ConsulResolver
+    # gets its own cluster, with the resolver's name on the end of the path.
+    assert eds_service_names == [
+        "consul/dc1/myservice",
+        "consul/dc1/myservice/consul-canary",
+        "consul/dc1/myservice/consul-v2",
+    ]
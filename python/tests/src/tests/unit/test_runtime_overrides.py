@@ -0,0 +1,43 @@
+import pytest
+
+from tests.utils import econf_compile, module_and_mapping_manifests
+
+
+def _runtime_layers(module_confs):
+    econf = econf_compile(module_and_mapping_manifests(module_confs, []))
+    return econf["layered_runtime"]["layers"], econf["bootstrap"]["layered_runtime"]["layers"]
+
+
+@pytest.mark.compilertest
+def test_runtime_overrides_default():
+    ads_layers, bootstrap_layers = _runtime_layers(None)
+
+    assert ads_layers[1] == {"name": "ambex_runtime", "static_layer": {}}
+    assert bootstrap_layers[0] == ads_layers[0]
+    assert bootstrap_layers[1] == {
+        "name": "ambex_runtime",
+        "rtds_layer": {
+            "name": "ambex_runtime",
+            "rtds_config": {"ads": {}, "resource_api_version": "V3"},
+        },
+    }
+
+
+@pytest.mark.compilertest
+def test_runtime_overrides():
+    ads_layers, bootstrap_layers = _runtime_layers(
+        [
+            "runtime_overrides:",
+            '  "overload.premature_reset_total_stream_count": 500',
+            '  "envoy.reloadable_features.foo": false',
+            '  "bad": [1, 2]',
+        ]
+    )
+
+    assert ads_layers[1]["static_layer"] == {
+        "overload.premature_reset_total_stream_count": 500,
+        "envoy.reloadable_features.foo": False,
+    }
+    # The overrides only go to Envoy over RTDS.
+    assert "overload.premature_reset_total_stream_count" not in bootstrap_layers[0]["static_layer"]
+    assert "rtds_layer" in bootstrap_layers[1]
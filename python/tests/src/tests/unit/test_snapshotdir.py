@@ -0,0 +1,138 @@
+import gzip
+import json
+import logging
+import os
+from pathlib import Path
+from typing import Any, List
+
+import jsonpatch
+import pytest
+
+import ambassador_diag.snapshotdir as snapshotdir
+from ambassador_diag.snapshotdir import SnapshotDir, SnapshotOptions
+
+logger = logging.getLogger("ambassador")
+
+FMT = "econf{}.json"
+
+
+def reconfigure(path: Path, opts: SnapshotOptions, obj: Any) -> SnapshotDir:
+    # Do what diagd does for each new snapshot: write it to the -tmp file, rotate, then move the
+    # -tmp file into place.
+    (path / FMT.format("-tmp")).write_text(json.dumps(obj))
+
+    snapdir = SnapshotDir(logger, str(path), opts)
+    snapdir.rotate(FMT)
+    os.rename(path / FMT.format("-tmp"), path / FMT.format(""))
+    snapdir.enforce_max_bytes([FMT])
+
+    return snapdir
+
+
+def files(path: Path) -> List[str]:
+    return sorted(os.listdir(path))
+
+
+def test_rotate(tmp_path: Path):
+    opts = SnapshotOptions(2)
+
+    for i in range(4):
+        reconfigure(tmp_path, opts, {"generation": i})
+
+    assert files(tmp_path) == ["econf-1.json", "econf-2.json", "econf.json"]
+    assert json.loads((tmp_path / "econf.json").read_text()) == {"generation": 3}
+    assert json.loads((tmp_path / "econf-1.json").read_text()) == {"generation": 2}
+    assert json.loads((tmp_path / "econf-2.json").read_text()) == {"generation": 1}
+
+
+def test_rotate_disabled(tmp_path: Path):
+    opts = SnapshotOptions(0)
+
+    for i in range(3):
+        reconfigure(tmp_path, opts, {"generation": i})
+
+    assert files(tmp_path) == ["econf.json"]
+
+
+def test_gzip(tmp_path: Path):
+    opts = SnapshotOptions(2, compression="gzip")
+
+    for i in range(3):
+        reconfigure(tmp_path, opts, {"generation": i})
+
+    # The newest snapshot is never compressed.
+    assert files(tmp_path) == ["econf-1.json.gz", "econf-2.json.gz", "econf.json"]
+    assert json.loads(gzip.decompress((tmp_path / "econf-1.json.gz").read_bytes())) == {
+        "generation": 1
+    }
+
+
+def test_deltas(tmp_path: Path):
+    opts = SnapshotOptions(2, deltas=True)
+    objs = [{"generation": i, "static": "x" * 100} for i in range(3)]
+
+    for obj in objs:
+        reconfigure(tmp_path, opts, obj)
+
+    assert files(tmp_path) == ["econf-1.json.patch", "econf-2.json.patch", "econf.json"]
+
+    # Each patch turns the next newer snapshot into the older one.
+    newest = json.loads((tmp_path / "econf.json").read_text())
+    assert newest == objs[2]
+
+    patch1 = jsonpatch.JsonPatch.from_string((tmp_path / "econf-1.json.patch").read_text())
+    older = patch1.apply(newest)
+    assert older == objs[1]
+
+    patch2 = jsonpatch.JsonPatch.from_string((tmp_path / "econf-2.json.patch").read_text())
+    assert patch2.apply(older) == objs[0]
+
+
+def test_max_bytes(tmp_path: Path):
+    obj = {"static": "x" * 1000}
+    size = len(json.dumps(obj))
+    opts = SnapshotOptions(4, max_bytes=2 * size + 10)
+
+    for _ in range(4):
+        reconfigure(tmp_path, opts, obj)
+
+    # Only the newest two fit.
+    assert files(tmp_path) == ["econf-1.json", "econf.json"]
+
+    # The newest one is always kept, even if it's too big by itself.
+    opts = SnapshotOptions(4, max_bytes=1)
+    reconfigure(tmp_path, opts, obj)
+    assert files(tmp_path) == ["econf.json"]
+
+
+def test_zstd_fallback(tmp_path: Path, monkeypatch: pytest.MonkeyPatch, caplog):
+    monkeypatch.setattr(snapshotdir, "_zstd_compressor", lambda: None)
+    monkeypatch.setattr(snapshotdir, "_warned_no_zstd", False)
+
+    with caplog.at_level(logging.WARNING, logger="ambassador"):
+        for i in range(3):
+            reconfigure(tmp_path, SnapshotOptions(2, compression="zstd"), {"generation": i})
+
+    # Without zstd we fall back to gzip, and only say so once.
+    assert files(tmp_path) == ["econf-1.json.gz", "econf-2.json.gz", "econf.json"]
+    warnings = [r for r in caplog.records if "zstd is not available" in r.getMessage()]
+    assert len(warnings) == 1
+
+
+def test_options_from_env(monkeypatch: pytest.MonkeyPatch):
+    monkeypatch.setenv("AMBASSADOR_SNAPSHOT_COUNT", "7")
+    monkeypatch.setenv("AMBASSADOR_SNAPSHOT_COMPRESSION", "GZIP")
+    monkeypatch.setenv("AMBASSADOR_SNAPSHOT_MAX_BYTES", "1024")
+    monkeypatch.setenv("AMBASSADOR_SNAPSHOT_DELTAS", "true")
+
+    opts = SnapshotOptions.from_env(logger)
+    assert (opts.count, opts.compression, opts.max_bytes, opts.deltas) == (7, "gzip", 1024, True)
+
+    # Bad values are ignored.
+    monkeypatch.setenv("AMBASSADOR_SNAPSHOT_COUNT", "lots")
+    monkeypatch.setenv("AMBASSADOR_SNAPSHOT_COMPRESSION", "lzma")
+    monkeypatch.setenv("AMBASSADOR_SNAPSHOT_MAX_BYTES", "big")
+    monkeypatch.delenv("AMBASSADOR_SNAPSHOT_DELTAS")
+
+    opts = SnapshotOptions.from_env(logger)
+    assert (opts.count, opts.compression, opts.max_bytes, opts.deltas) == (4, "none", 0, False)